@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/apsdehal/go-logger"
+	"github.com/nwihardjo/SpaghettiSearch/database"
+	"github.com/nwihardjo/SpaghettiSearch/indexer"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// writes the index and the page cache to a single archive, refer to database/backup.go
+// the tables of a running server are locked by it, use -server to let the server write the archive instead
+func main() {
+	dbOpts := database.DefaultDBOptions()
+	dbOpts.RegisterFlags(flag.CommandLine)
+	out := flag.String("out", "backup-"+time.Now().Format("20060102-150405")+".tar.gz", "-out=<archive_file>")
+	docsDir := flag.String("docsDir", indexer.DocsDir, "-docsDir=<page_cache_directory>")
+	server := flag.String("server", "", "-server=<url_of_running_server_started_with_allowBackup>")
+	flag.Parse()
+	// pages are renamed in the page cache by migrations, with -autoMigrate
+	dbOpts.DocsDir = *docsDir
+
+	log, _ := logger.New("backup", 1)
+
+	// archive is written to a temporary file first, a failed backup never leaves a truncated archive behind
+	f, err := os.Create(*out + ".tmp")
+	if err != nil {
+		log.Errorf("Failed to create %s: %v", *out, err)
+		os.Exit(1)
+	}
+	defer os.Remove(*out + ".tmp")
+
+	timer := time.Now()
+	if *server != "" {
+		err = fetchBackup(*server, f)
+	} else {
+		err = localBackup(log, dbOpts, *docsDir, f)
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(*out+".tmp", *out)
+	}
+	if err != nil {
+		log.Errorf("Backup failed: %v", err)
+		os.Exit(1)
+	}
+	fmt.Println("Backup written to", *out, "in", time.Since(timer))
+}
+
+func localBackup(log *logger.Logger, dbOpts database.DBOptions, docsDir string, w io.Writer) error {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	tables, err := database.OpenTables(ctx, log, dbOpts)
+	if err != nil {
+		return err
+	}
+	defer tables.Close(ctx, cancel)
+
+	manifest, err := database.Backup(ctx, w, tables.All(), docsDir)
+	if err != nil {
+		return err
+	}
+	for name, keys := range manifest.Tables {
+		fmt.Println("\t", name, ":", keys, "keys")
+	}
+	fmt.Println("\t", manifest.Docs, "cached pages")
+	return nil
+}
+
+func fetchBackup(server string, w io.Writer) error {
+	resp, err := http.Get(server + "/backup")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server responded %s", resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
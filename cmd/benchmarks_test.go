@@ -18,8 +18,11 @@ import (
 	"time"
 )
 
-var ctx context.Context
-var frw [5]database.DB
+// ctx is declared by debug_retrieval.go
+var frw []database.DB
+
+// docID of the document of BenchmarkGet200Children200Words
+const benchDocID uint32 = 1
 
 func BenchmarkMD5(b *testing.B) {
 	for i := 0; i < b.N; i++ {
@@ -48,10 +51,10 @@ func BenchmarkGetWord(b *testing.B) {
 func BenchmarkGet200Children200Words(b *testing.B) {
 	p := make([]byte, 16)
 	_, _ = rand.Read(p)
-	var c []string
+	var c []uint32
 	w := make(map[string]uint32)
 	for i := 0; i < 200; i++ {
-		c = append(c, hex.EncodeToString(p))
+		c = append(c, rand.Uint32())
 		w[hex.EncodeToString(p)] = 100000
 	}
 
@@ -60,25 +63,21 @@ func BenchmarkGet200Children200Words(b *testing.B) {
 		panic(e)
 	}
 	t := database.DocInfo{
-		*currURL,
-		nil,
-		time.Now(),
-		0,
-		c,
-		nil,
-		w,
+		Url:           *currURL,
+		Mod_date:      time.Now(),
+		Children:      c,
+		Words_mapping: w,
+		Discovered:    time.Now(),
+		Checked:       time.Now(),
 	}
 
-	key := []byte("https://www.test.com")
-	hashedK := md5.Sum(key)
-	hashedKStr := hex.EncodeToString(hashedK[:])
-	if err := frw[1].Set(ctx, hashedKStr, t); err != nil {
+	if err := frw[1].Set(ctx, benchDocID, t); err != nil {
 		panic(err)
 	}
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		_, err := frw[1].Get(ctx, hashedKStr)
+		_, err := frw[1].Get(ctx, benchDocID)
 		if err != nil {
 			panic(err)
 		}
@@ -135,10 +134,10 @@ func Benchmark_gofunc(b *testing.B) {
 	fmt.Println(temp)
 }
 
-func randFloats(min, max int, n int) []float32 {
-	res := make([]float32, n)
+func randFloats(min, max int, n int) []float64 {
+	res := make([]float64, n)
 	for i := range res {
-		res[i] = float32(min + rand.Int()*(max-min))
+		res[i] = float64(min + rand.Int()*(max-min))
 	}
 	return res
 }
@@ -149,13 +148,15 @@ func TestMain(m *testing.M) {
 	slice2 = randFloats(1, 1000, 5000)
 	slice3 = randFloats(1, 1000, 5000)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithCancel(context.Background())
 	log, _ := logger.New("test", 0, ioutil.Discard)
 
-	inv, forw, _ := database.DB_init(ctx, log)
-	for i, v := range forw {
-		frw[i] = v
+	inv, forw, err := database.DB_init(ctx, log, database.DefaultDBOptions())
+	if err != nil {
+		panic(err)
 	}
+	frw = forw
 
 	for _, bdb_i := range inv {
 		defer bdb_i.Close(ctx, cancel)
@@ -172,10 +173,7 @@ func TestMain(m *testing.M) {
 		panic(e)
 	}
 
-	key := []byte("https://www.test.com")
-	hashedK = md5.Sum(key)
-	hashedKStr = hex.EncodeToString(hashedK[:])
-	e = frw[1].Delete(ctx, hashedKStr)
+	e = frw[1].Delete(ctx, benchDocID)
 	if e != nil {
 		panic(e)
 	}
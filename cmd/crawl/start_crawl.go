@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -10,24 +9,53 @@ import (
 	"github.com/eapache/channels"
 	"github.com/nwihardjo/SpaghettiSearch/crawler"
 	"github.com/nwihardjo/SpaghettiSearch/database"
+	"github.com/nwihardjo/SpaghettiSearch/indexer"
+	"github.com/nwihardjo/SpaghettiSearch/parser"
 	"github.com/nwihardjo/SpaghettiSearch/ranking"
 	"golang.org/x/sync/semaphore"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-type URLHash [16]byte
-
 func main() {
 	numOfPages := flag.Int("numPages", 500, "-numPages=<number_of_pages_crawled>")
 	startURL := flag.String("startURL", "https://www.cse.ust.hk", "-startURL=<crawler_entry_point>")
 	domainOnly := flag.Bool("domainOnly", true, "-domainOnly=<crawl_only_domain_given_domain_or_not>")
+	dbOpts := database.DefaultDBOptions()
+	dbOpts.RegisterFlags(flag.CommandLine)
+	collect := flag.Bool("collectPlaceholders", false, "-collectPlaceholders=<remove_placeholders_of_children_not_fetched_after_crawling_or_not>")
+	gcOpts := database.PlaceholderOptions{MaxAge: 30 * 24 * time.Hour}
+	gcOpts.RegisterFlags(flag.CommandLine)
+	userAgent := flag.String("userAgent", "SpaghettiSearch", "-userAgent=<user_agent_sent,_and_matched_against_robots.txt_rules>")
+	maxThreadNum := flag.Int("maxConcurrency", 500, "-maxConcurrency=<pages_fetched_at_once_over_every_host>")
+	frontierOpts := crawler.DefaultFrontierOptions()
+	frontierOpts.RegisterFlags(flag.CommandLine)
+	resume := flag.Bool("resume", false, "-resume=<continue_the_crawl_checkpointed_in_dbDir,_from_its_startURL_depth_and_page_count_or_not>")
+	checkpointInterval := flag.Duration("checkpointInterval", time.Minute, "-checkpointInterval=<interval_between_two_checkpoints_of_the_frontier>")
+	trackingParams := flag.String("trackingParams", strings.Join(parser.TrackingParams, ","), "-trackingParams=<query_parameters_removed_from_every_url,_comma_separated,_trailing_*_matches_a_prefix>")
+	publish := flag.String("publish", "", "-publish=<symlink_the_server_opens,_to_point_to_a_copy_of_the_index_once_crawled>")
 	flag.Parse()
 
+	// links are canonicalised before being crawled, the start URL as well. Refer to parser/canonical.go
+	parser.TrackingParams = nil
+	for _, p := range strings.Split(*trackingParams, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			parser.TrackingParams = append(parser.TrackingParams, p)
+		}
+	}
+	if canonical, err := parser.CanonicalURL(*startURL); err != nil {
+		panic(err)
+	} else {
+		*startURL = canonical
+	}
+
 	fmt.Println("Crawler started...")
 
 	start := time.Now()
@@ -43,6 +71,30 @@ func main() {
 		Timeout:   td,
 	}
 
+	ctx, cancel := context.WithCancel(context.TODO())
+	log, _ := logger.New("test", 1)
+	tables, err := database.OpenTables(ctx, log, dbOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	// frontier is checkpointed next to the index, refer to database/crawl_frontier.go
+	checkpoints, err := database.OpenCrawlFrontier(ctx, log, dbOpts)
+	if err != nil {
+		panic(err)
+	}
+	var resumed *database.CrawlCheckpoint
+	if *resume {
+		if resumed, err = checkpoints.Load(ctx); err == database.ErrNotFound {
+			fmt.Println("No crawl checkpointed in", dbOpts.Dir, "- starting from", *startURL)
+		} else if err != nil {
+			panic(err)
+		} else if *startURL, err = parser.CanonicalURL(resumed.StartURL); err != nil {
+			// checkpoints of older builds hold the start URL as given
+			panic(err)
+		}
+	}
+
 	var domain string
 	if temp, err := url.Parse(*startURL); err != nil {
 		panic(err)
@@ -50,84 +102,142 @@ func main() {
 		domain = temp.Hostname()
 	}
 
-	maxThreadNum := 500
-	sem := semaphore.NewWeighted(int64(maxThreadNum))
-	visited := make(map[URLHash]bool)
-	queue := channels.NewInfiniteChannel()
+	// robots.txt is fetched once per host, and kept for the whole crawl
+	robots := crawler.NewRobots(client, *userAgent)
+
+	// URLs outside the domain, or disallowed by robots.txt, are dropped by the frontier
+	var disallowed int64
+	frontier := crawler.NewFrontier(frontierOpts, robots, func(u *url.URL) bool {
+		if !strings.HasSuffix(u.Hostname(), domain) && *domainOnly {
+			return false
+		}
+		if !robots.Allowed(u) {
+			atomic.AddInt64(&disallowed, 1)
+			return false
+		}
+		return true
+	})
+
+	sem := semaphore.NewWeighted(int64(*maxThreadNum))
 	errorsChannel := channels.NewInfiniteChannel()
-	var mutex sync.Mutex
 	var lock2 sync.RWMutex
 
-	ctx, cancel := context.WithCancel(context.TODO())
-	log, _ := logger.New("test", 1)
-	inv, forw, _ := database.DB_init(ctx, log)
-	for _, bdb_i := range inv {
-		defer bdb_i.Close(ctx, cancel)
-	}
-	for _, bdb := range forw {
-		defer bdb.Close(ctx, cancel)
-	}
+	// Ctrl-C stops handing out pages, the crawl is checkpointed once the pages in flight are done
+	crawlCtx, stopCrawl := context.WithCancel(ctx)
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupted
+		// a second Ctrl-C kills the crawler
+		signal.Stop(interrupted)
+		fmt.Println("\nInterrupted, waiting for the pages in flight...")
+		stopCrawl()
+	}()
 
 	// parse ODP directory for context-sensitive PageRank
 	// parsing will only be done once, and not in parallel as it can create issue with the too many pipes or sockets to be opened
 	timeODP := time.Now()
-	if temp, _ := forw[5].Iterate(ctx); len(temp.KV) == 0 {
-		crawler.ParseODP(ctx, inv, forw)
+	hasTopic := false
+	tables.TopicMetadata.Raw().ScanRange(ctx, "", "", func(_ interface{}, _ interface{}) error {
+		hasTopic = true
+		return database.ErrStopScan
+	}, database.ScanOptions{Limit: 1})
+	if !hasTopic {
+		// pagerank falls back to no topic if ODP cannot be stored, it is parsed again by the next crawl
+		if err = crawler.ParseODP(ctx, tables); err != nil {
+			log.Errorf("Failed to store ODP topics: %v", err)
+		}
 	}
 	ODPCrawlTime := time.Since(timeODP)
 
-	queue.In() <- []string{"", *startURL}
-
-	depth := 0
-	nextDepthSize := 1
+	depth, visited, replaced, nextDepthSize := 0, 0, 0, 0
+	if resumed != nil {
+		depth, visited, replaced, disallowed = resumed.Depth, resumed.Visited, resumed.Replaced, resumed.Disallowed
+		if nextDepthSize, err = frontier.Restore(resumed); err != nil {
+			panic(err)
+		}
+		fmt.Println("Resuming the crawl of", *startURL, "checkpointed at", resumed.Saved, "-", visited, "pages visited")
+	} else {
+		frontier.Push("", *startURL)
+	}
+	if nextDepthSize == 0 {
+		/* Current depth of the crawl resumed is done */
+		if nextDepthSize = frontier.NextLevel(); resumed != nil && nextDepthSize > 0 {
+			depth += 1
+		}
+	}
 	fmt.Println("Depth:", depth, "- Queued:", nextDepthSize)
 
-	for len(visited) < *numOfPages {
-		for queue.Len() > 0 && len(visited) < *numOfPages && nextDepthSize > 0 {
-			if edge, ok := (<-queue.Out()).([]string); ok {
-
-				nextDepthSize -= 1
-
-				parentURL := edge[0]
-				currentURL := edge[1]
+	/* Pages failing are replaced by another page */
+	drainErrors := func() {
+		for errorsChannel.Len() > 0 {
+			if _, ok := (<-errorsChannel.Out()).(string); ok {
+				replaced += 1
+			} else {
+				os.Exit(1)
+			}
+		}
+	}
 
-				/* Check if currentURL is already visited */
-				if visited[md5.Sum([]byte(currentURL))] {
-					/*
-						If currentURL is already visited (handle cycle),
-						do not visit this URL
-					*/
-					continue
-				}
+	/* Pages in flight are crawled again on resume, hence not counted as visited */
+	lastCheckpoint := time.Now()
+	checkpoint := func() {
+		drainErrors()
+		cp := &database.CrawlCheckpoint{
+			StartURL:   *startURL,
+			Depth:      depth,
+			Replaced:   replaced,
+			Disallowed: atomic.LoadInt64(&disallowed),
+		}
+		cp.Visited = visited - frontier.Checkpoint(cp)
+		if err := checkpoints.Save(ctx, cp); err != nil {
+			log.Errorf("Failed to checkpoint the crawl: %v", err)
+		}
+		lastCheckpoint = time.Now()
+	}
 
-				/* If currentURL is not in the specified domain, skip it */
-				u, e := url.Parse(currentURL)
-				if e != nil {
-					panic(e)
-				}
-				if !strings.HasSuffix(u.Hostname(), domain) && *domainOnly {
-					continue
-				}
+	/* Replace the checkpoint of the previous crawl */
+	checkpoint()
 
-				/* Put currentURL to visited buffer */
-				visited[md5.Sum([]byte(currentURL))] = true
+	for visited < *numOfPages+replaced && nextDepthSize > 0 && crawlCtx.Err() == nil {
+		levelDone := false
+		for visited < *numOfPages+replaced {
+			if time.Since(lastCheckpoint) >= *checkpointInterval {
+				checkpoint()
+			}
 
-				/* Add below goroutine (child) to the list of children to be waited */
-				if e = sem.Acquire(ctx, 1); e != nil {
-					panic(e)
-				}
+			/* Wait for a host of the current depth to be ready */
+			edge, ok := frontier.Next(crawlCtx)
+			if !ok {
+				levelDone = crawlCtx.Err() == nil
+				break
+			}
 
-				/* Crawl the URL using goroutine */
-				go crawler.Crawl(sem, parentURL, currentURL, errorsChannel,
-					client, &lock2, queue, &mutex, inv, forw)
+			/* URLs fetched again after a 429 or 503 are counted once */
+			if edge.Attempts == 0 {
+				visited += 1
+			}
 
-			} else {
-				os.Exit(1)
+			/* Add below goroutine (child) to the list of children to be waited */
+			if e := sem.Acquire(ctx, 1); e != nil {
+				panic(e)
 			}
+
+			/* Crawl the URL using goroutine, pages failing are skipped and replaced by another page */
+			/* Released once the URL is done and its failure reported, so that waiting for all children covers both */
+			go func(edge *crawler.Edge) {
+				defer sem.Release(1)
+				err := crawler.Crawl(edge.Parent, edge.URL,
+					client, robots, &lock2, frontier, tables)
+				if retried := frontier.Done(edge, err); err != nil && !retried {
+					log.Errorf("Skipping %s: %v", edge.URL, err)
+					errorsChannel.In() <- edge.URL
+				}
+			}(edge)
 		}
 
 		/* Wait for all children to finish */
-		if e := sem.Acquire(ctx, int64(maxThreadNum)); e != nil {
+		if e := sem.Acquire(ctx, int64(*maxThreadNum)); e != nil {
 			panic(e)
 		}
 
@@ -139,43 +249,73 @@ func main() {
 			stored in the database and that the parents
 			URL are already mapped to some doc id
 		*/
-		for errorsChannel.Len() > 0 {
-			if _, ok := (<-errorsChannel.Out()).(string); ok {
-				*numOfPages += 1
-			} else {
-				os.Exit(1)
-			}
-		}
+		drainErrors()
 
 		/* If finished with current depth level, proceed to the next level */
-		if nextDepthSize == 0 {
-
-			// Maybe also sync DB per level???
+		if levelDone {
 			depth += 1
-			nextDepthSize += queue.Len()
+			nextDepthSize = frontier.NextLevel()
 			fmt.Println("Depth:", depth, "- Queued:", nextDepthSize)
 		}
 
-		if queue.Len() <= 0 {
-			break
-		}
+		/* Checkpoint once the pages in flight are done, the crawl can be resumed with a larger -numPages */
+		checkpoint()
 
-		sem.Release(int64(maxThreadNum))
+		sem.Release(int64(*maxThreadNum))
 	}
 
-	/* Close the queue channel */
-	queue.Close()
+	if e := checkpoints.Close(ctx); e != nil {
+		log.Errorf("Failed to close the checkpoint of the crawl: %v", e)
+	}
+	if crawlCtx.Err() != nil {
+		tables.Close(ctx, cancel)
+		fmt.Println("\nCrawl checkpointed at depth", depth, "after", visited, "pages, run with -resume to continue")
+		os.Exit(1)
+	}
+	stopCrawl()
 
-	fmt.Println("\nTotal visited length:", len(visited))
+	fmt.Println("\nTotal visited length:", visited)
+	fmt.Println("\nTotal disallowed by robots.txt:", atomic.LoadInt64(&disallowed))
 	fmt.Println("\nTotal crawling ODP: ", ODPCrawlTime)
 	fmt.Println("\nTotal crawling and indexing time: " + time.Now().Sub(start).String())
 
+	// placeholders are removed before ranking, so that they take no part in the pagerank
+	if *collect {
+		report, err := database.CollectPlaceholders(ctx, tables, gcOpts)
+		if err != nil {
+			log.Errorf("Failed to remove placeholders: %v", err)
+		} else {
+			fmt.Println("\nRemoved", len(report.Removed), "of", report.Placeholders, "placeholders")
+		}
+	}
+
 	// perform database update
 	timer := time.Now()
-	ranking.UpdateTopicSensitivePagerank(ctx, 0.75, 1e-20, forw)
-	ranking.UpdateTermWeights(ctx, &inv[0], forw, "title")
-	ranking.UpdateTermWeights(ctx, &inv[1], forw, "body")
+	if err = ranking.UpdateTopicSensitivePagerank(ctx, 0.75, 1e-20, tables); err == nil {
+		if err = ranking.UpdateTermWeights(ctx, tables.TitlePostings, tables, "title"); err == nil {
+			err = ranking.UpdateTermWeights(ctx, tables.BodyPostings, tables, "body")
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to update pagerank and idf: %v", err)
+		tables.Close(ctx, cancel)
+		os.Exit(1)
+	}
 
 	fmt.Println("Updating pagerank and idf takes", time.Since(timer))
+
+	// tables are copied once closed, refer to database/publish.go
+	if err = tables.Close(ctx, cancel); err != nil {
+		log.Errorf("Failed to close the index: %v", err)
+		os.Exit(1)
+	}
+	if *publish != "" {
+		dir, err := database.Publish(dbOpts.Dir, indexer.DocsDir, *publish)
+		if err != nil {
+			log.Errorf("Failed to publish the index: %v", err)
+			os.Exit(1)
+		}
+		fmt.Println("\nPublished the index to", dir, "through", *publish)
+	}
 	fmt.Println("\nTotal elapsed time: ", time.Now().Sub(start).String())
 }
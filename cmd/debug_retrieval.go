@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"github.com/apsdehal/go-logger"
 	"github.com/gorilla/mux"
 	db "github.com/nwihardjo/SpaghettiSearch/database"
@@ -14,8 +15,7 @@ import (
 )
 
 // global declaration used in db
-var forw []db.DB
-var inv []db.DB
+var tables *db.Tables
 var ctx context.Context
 
 func setHeader(w http.ResponseWriter) {
@@ -40,7 +40,12 @@ func GetWebpages(w http.ResponseWriter, r *http.Request) {
 	log.Print("Querying terms:", query)
 	timer := time.Now()
 
-	result := retrieval.Retrieve(query, ctx, forw, inv)
+	result, err := retrieval.Retrieve(query, ctx, tables)
+	if err != nil {
+		log.Print("Query failed: ", err)
+		http.Error(w, "Failed to process the query", http.StatusInternalServerError)
+		return
+	}
 	log.Print("result is ", len(result))
 
 	json.NewEncoder(w).Encode(result)
@@ -48,21 +53,20 @@ func GetWebpages(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	dbOpts := db.DefaultDBOptions()
+	dbOpts.ReadOnly = true
+	dbOpts.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
 	// initialise db connection
 	ctx, cancel := context.WithCancel(context.TODO())
 	log_, _ := logger.New("test", 1)
 	var err error
-	inv, forw, err = db.DB_init(ctx, log_)
+	tables, err = db.OpenTables(ctx, log_, dbOpts)
 	if err != nil {
 		panic(err)
 	}
-
-	for _, bdb_i := range inv {
-		defer bdb_i.Close(ctx, cancel)
-	}
-	for _, bdb := range forw {
-		defer bdb.Close(ctx, cancel)
-	}
+	defer tables.Close(ctx, cancel)
 
 	// start server
 	router := mux.NewRouter()
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/apsdehal/go-logger"
+	"github.com/nwihardjo/SpaghettiSearch/database"
+	"io"
+	"os"
+	"time"
+)
+
+// writes the index as JSON lines with URLs and words resolved, refer to database/export.go
+// the dump goes to stdout unless -out is given, progress is printed to stderr
+func main() {
+	dbOpts := database.DefaultDBOptions()
+	// exporting never writes to the index
+	dbOpts.ReadOnly = true
+	dbOpts.RegisterFlags(flag.CommandLine)
+	out := flag.String("out", "", "-out=<jsonl_file>")
+	flag.Parse()
+
+	log, _ := logger.New("export", 1)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	tables, err := database.OpenTables(ctx, log, dbOpts)
+	if err != nil {
+		log.Errorf("Failed to open the index: %v", err)
+		os.Exit(1)
+	}
+	defer tables.Close(ctx, cancel)
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Errorf("Failed to create %s: %v", *out, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	timer := time.Now()
+	summary, err := database.Export(ctx, w, tables)
+	if err != nil {
+		log.Errorf("Export failed: %v", err)
+		tables.Close(ctx, cancel)
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "Exported", summary.Docs, "documents,", summary.Terms, "terms,", summary.Topics, "topics and",
+		summary.Keywords, "topic keywords in", time.Since(timer))
+}
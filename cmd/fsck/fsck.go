@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/apsdehal/go-logger"
+	"github.com/nwihardjo/SpaghettiSearch/database"
+	"github.com/nwihardjo/SpaghettiSearch/indexer"
+	"os"
+	"time"
+)
+
+// cross-checks the tables and the page cache, refer to database/fsck.go
+// exits with status 1 if any violation is left in the index
+func main() {
+	dbOpts := database.DefaultDBOptions()
+	dbOpts.RegisterFlags(flag.CommandLine)
+	docsDir := flag.String("docsDir", indexer.DocsDir, "-docsDir=<page_cache_directory>")
+	repair := flag.Bool("repair", false, "-repair=<repair_the_violations_which_can_be_repaired_or_only_report_them>")
+	verbose := flag.Bool("verbose", false, "-verbose=<print_every_violation_or_only_the_summary>")
+	flag.Parse()
+	// pages are renamed in the page cache by migrations, with -autoMigrate
+	dbOpts.DocsDir = *docsDir
+
+	log, _ := logger.New("fsck", 1)
+	if *repair && dbOpts.ReadOnly {
+		log.Error("Tables opened as read-only cannot be repaired")
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	tables, err := database.OpenTables(ctx, log, dbOpts)
+	if err != nil {
+		log.Errorf("Failed to open the index: %v", err)
+		os.Exit(1)
+	}
+
+	timer := time.Now()
+	report, err := database.Fsck(ctx, tables, *docsDir, *repair)
+	if e := tables.Close(ctx, cancel); err == nil {
+		err = e
+	}
+	if err != nil {
+		log.Errorf("Check failed: %v", err)
+		os.Exit(1)
+	}
+
+	if *verbose {
+		for _, v := range report.Violations {
+			status := ""
+			if v.Repaired {
+				status = " (repaired)"
+			} else if !v.Repairable {
+				status = " (not repairable)"
+			}
+			fmt.Printf("%s\t%s\t%s%s\n", v.Check, v.Key, v.Detail, status)
+		}
+	}
+
+	fmt.Println("Checked", report.Docs, "documents and", report.Words, "words in", time.Since(timer))
+	for _, check := range []string{database.CheckPostings, database.CheckWords, database.CheckChildren,
+		database.CheckRank, database.CheckMagnitude, database.CheckDocs, database.CheckRegistry} {
+		found, repaired := report.Count(check)
+		fmt.Printf("\t%-10s: %d violations, %d repaired\n", check, found, repaired)
+	}
+
+	if report.Remaining() > 0 {
+		fmt.Println(report.Remaining(), "violations left, run with -repair to repair them, missing ranks and pages need another crawl")
+		os.Exit(1)
+	}
+}
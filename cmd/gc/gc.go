@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/apsdehal/go-logger"
+	"github.com/nwihardjo/SpaghettiSearch/database"
+	"os"
+	"time"
+)
+
+// removes the placeholders of children never fetched, refer to database/gc.go
+// pageRanks of the documents left are updated by the next crawl
+func main() {
+	dbOpts := database.DefaultDBOptions()
+	dbOpts.RegisterFlags(flag.CommandLine)
+	gcOpts := database.PlaceholderOptions{MaxAge: 30 * 24 * time.Hour}
+	gcOpts.RegisterFlags(flag.CommandLine)
+	dryRun := flag.Bool("dryRun", false, "-dryRun=<only_print_the_placeholders_to_be_removed_or_not>")
+	verbose := flag.Bool("verbose", false, "-verbose=<print_every_placeholder_removed_or_only_the_summary>")
+	flag.Parse()
+	gcOpts.DryRun = *dryRun
+
+	log, _ := logger.New("gc", 1)
+	if !*dryRun && dbOpts.ReadOnly {
+		log.Error("Tables opened as read-only cannot be collected, run with -dryRun")
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	tables, err := database.OpenTables(ctx, log, dbOpts)
+	if err != nil {
+		log.Errorf("Failed to open the index: %v", err)
+		os.Exit(1)
+	}
+
+	timer := time.Now()
+	report, err := database.CollectPlaceholders(ctx, tables, gcOpts)
+	if e := tables.Close(ctx, cancel); err == nil {
+		err = e
+	}
+	if err != nil {
+		log.Errorf("Collection failed: %v", err)
+		os.Exit(1)
+	}
+
+	if *verbose {
+		for _, p := range report.Removed {
+			fmt.Printf("%d\t%s\n", p.DocID, p.Url)
+		}
+	}
+
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	fmt.Println("Checked", report.Docs, "documents, of which", report.Placeholders, "placeholders, in", time.Since(timer))
+	fmt.Printf("%s %d placeholders, %d postings, %d pageRanks and %d magnitudes, pruned %d documents\n", verb,
+		len(report.Removed), report.Postings, report.Ranks, report.Magnitudes, report.Pruned)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/apsdehal/go-logger"
+	"github.com/nwihardjo/SpaghettiSearch/database"
+	"io"
+	"os"
+	"time"
+)
+
+// rebuilds an index from a dump written by cmd/export into an empty -dbDir
+// the dump is read from stdin unless -in is given
+func main() {
+	dbOpts := database.DefaultDBOptions()
+	dbOpts.RegisterFlags(flag.CommandLine)
+	in := flag.String("in", "", "-in=<jsonl_file>")
+	flag.Parse()
+
+	log, _ := logger.New("import", 1)
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			log.Errorf("Failed to open %s: %v", *in, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	tables, err := database.OpenTables(ctx, log, dbOpts)
+	if err != nil {
+		log.Errorf("Failed to open the index: %v", err)
+		os.Exit(1)
+	}
+
+	timer := time.Now()
+	summary, err := database.Import(ctx, r, tables)
+	if e := tables.Close(ctx, cancel); err == nil {
+		err = e
+	}
+	if err != nil {
+		log.Errorf("Import failed: %v", err)
+		os.Exit(1)
+	}
+	fmt.Println("Imported", summary.Docs, "documents,", summary.Terms, "terms,", summary.Topics, "topics and",
+		summary.Keywords, "topic keywords into", dbOpts.Dir, "in", time.Since(timer))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/apsdehal/go-logger"
+	"github.com/nwihardjo/SpaghettiSearch/database"
+	"github.com/nwihardjo/SpaghettiSearch/parser"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+var hashPattern = regexp.MustCompile("^[0-9a-f]{32}$")
+
+// prints statistics of the index, or a view of it, refer to database/inspect.go
+// without -top, -doc or -term the statistics of every table are printed
+func main() {
+	dbOpts := database.DefaultDBOptions()
+	// inspecting never writes to the index
+	dbOpts.ReadOnly = true
+	dbOpts.RegisterFlags(flag.CommandLine)
+	top := flag.Int("top", 0, "-top=<number_of_terms_with_the_highest_document_frequency_to_print>")
+	section := flag.String("section", "body", "-section=<posting_lists_ranked_by_top,_title_or_body>")
+	doc := flag.String("doc", "", "-doc=<url_or_docID_of_the_document_to_print>")
+	term := flag.String("term", "", "-term=<word_or_wordHash_whose_posting_lists_to_print>")
+	asJSON := flag.Bool("json", false, "-json=<print_json_instead_of_text>")
+	flag.Parse()
+
+	log, _ := logger.New("inspect", 1)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	tables, err := database.OpenTables(ctx, log, dbOpts)
+	if err != nil {
+		log.Errorf("Failed to open the index: %v", err)
+		os.Exit(1)
+	}
+	defer tables.Close(ctx, cancel)
+
+	var view interface{}
+	switch {
+	case *doc != "":
+		var docID uint32
+		if docID, err = toDocID(ctx, tables.DocIDs, *doc); err == nil {
+			view, err = database.InspectDoc(ctx, tables, docID)
+		}
+	case *term != "":
+		var wordHash string
+		if wordHash, err = termHash(*term); err == nil {
+			view, err = database.InspectTerm(ctx, tables, wordHash)
+		}
+	case *top > 0:
+		postings := tables.BodyPostings
+		if *section == "title" {
+			postings = tables.TitlePostings
+		}
+		view, err = database.TopTerms(ctx, postings, tables.Words, *top)
+	default:
+		view, err = database.Stats(ctx, tables)
+	}
+	if err == database.ErrNotFound {
+		err = fmt.Errorf("not found in the index")
+	}
+	if err != nil {
+		log.Errorf("Failed to inspect the index: %v", err)
+		tables.Close(ctx, cancel)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err = enc.Encode(view); err != nil {
+			log.Errorf("Failed to write JSON: %v", err)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	switch v := view.(type) {
+	case *database.IndexStats:
+		printStats(w, v)
+	case []database.TermFrequency:
+		fmt.Fprintln(w, "RANK\tDOCS\tWORD\tWORDHASH")
+		for i, t := range v {
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", i+1, t.Docs, t.Word, t.WordHash)
+		}
+	case *database.DocView:
+		printDoc(w, v)
+	case *database.TermView:
+		fmt.Fprintf(w, "Word:\t%s (%s)\n", v.Word, v.WordHash)
+		printPostings(w, "Title", v.Title)
+		printPostings(w, "Body", v.Body)
+	}
+}
+
+// documents are looked up in the registry by URL, docIDs are taken as they are
+func toDocID(ctx context.Context, registry *database.DocRegistry, s string) (uint32, error) {
+	if docID, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(docID), nil
+	}
+	return registry.ID(ctx, s)
+}
+
+// words are hashed the same way as the indexer does, wordHashes are taken as they are
+func toHash(s string) string {
+	if hashPattern.MatchString(s) {
+		return s
+	}
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// words are cleaned and stemmed the same way as the indexer does
+func termHash(s string) (string, error) {
+	if hashPattern.MatchString(s) {
+		return s, nil
+	}
+	words := parser.Laundry(s)
+	if len(words) != 1 {
+		return "", fmt.Errorf("%q is a stop word or more than one word", s)
+	}
+	return toHash(words[0]), nil
+}
+
+func printStats(w *tabwriter.Writer, s *database.IndexStats) {
+	fmt.Fprintf(w, "Schema version:\t%d\n", s.SchemaVersion)
+	fmt.Fprintf(w, "Vocabulary:\t%d words\n", s.Vocabulary)
+	fmt.Fprintf(w, "Documents:\t%d\n\n", s.Documents)
+	fmt.Fprintln(w, "TABLE\tKEYS\tFRAGMENTS\tLSM\tVLOG")
+	for _, t := range s.Tables {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", t.Name, t.Keys, t.Fragments, humanSize(t.LSMSize), humanSize(t.VlogSize))
+	}
+}
+
+func printDoc(w *tabwriter.Writer, d *database.DocView) {
+	fmt.Fprintf(w, "DocID:\t%d\n", d.DocID)
+	fmt.Fprintf(w, "URL:\t%s\n", d.Url)
+	fmt.Fprintf(w, "Title:\t%s\n", strings.Join(d.Title, " "))
+	fmt.Fprintf(w, "Modified:\t%s\n", d.ModDate)
+	fmt.Fprintf(w, "Size:\t%d\n", d.Size)
+	fmt.Fprintf(w, "Rank:\t%v\n", d.Rank)
+	fmt.Fprintf(w, "Magnitude:\t%v\n", d.Magnitude)
+
+	fmt.Fprintf(w, "\nChildren (%d):\n", len(d.Children))
+	for _, c := range d.Children {
+		fmt.Fprintf(w, "\t%d\t%s\n", c.DocID, c.Url)
+	}
+	fmt.Fprintf(w, "\nParents (%d):\n", len(d.Parents))
+	for _, p := range d.Parents {
+		fmt.Fprintf(w, "\t%d\t%s\t%s\n", p.DocID, p.Url, strings.Join(p.Anchor, " "))
+	}
+	fmt.Fprintf(w, "\nWords (%d):\n", len(d.Words))
+	for _, c := range d.Words {
+		fmt.Fprintf(w, "\t%s\t%d\n", c.Word, c.Freq)
+	}
+}
+
+func printPostings(w *tabwriter.Writer, section string, postings []database.Posting) {
+	fmt.Fprintf(w, "\n%s (%d documents):\n", section, len(postings))
+	for _, p := range postings {
+		fmt.Fprintf(w, "\t%.4f\t%s\t%v\n", p.Weight, p.Url, p.Positions)
+	}
+}
+
+func humanSize(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
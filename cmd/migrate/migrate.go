@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/apsdehal/go-logger"
+	"github.com/nwihardjo/SpaghettiSearch/database"
+	"github.com/nwihardjo/SpaghettiSearch/indexer"
+	"os"
+)
+
+// upgrades the index in -dbDir in place to the schema version of this build
+func main() {
+	dbOpts := database.DefaultDBOptions()
+	dbOpts.RegisterFlags(flag.CommandLine)
+	dryRun := flag.Bool("dryRun", false, "-dryRun=<only_print_the_schema_version_or_not>")
+	docsDir := flag.String("docsDir", indexer.DocsDir, "-docsDir=<page_cache_directory,_whose_pages_are_renamed_with_the_urls_of_the_documents>")
+	flag.Parse()
+	dbOpts.DocsDir = *docsDir
+
+	log, _ := logger.New("migrate", 1)
+
+	version, err := database.SchemaVersionOf(dbOpts)
+	if err != nil {
+		log.Errorf("Failed to read the schema version of %s: %v", dbOpts.Dir, err)
+		os.Exit(1)
+	}
+
+	switch {
+	case version == 0:
+		fmt.Println("No index found in", dbOpts.Dir)
+		return
+	case version == database.SchemaVersion:
+		fmt.Println("Index in", dbOpts.Dir, "is up to date, schema version", version)
+		return
+	case version > database.SchemaVersion:
+		fmt.Println("Index in", dbOpts.Dir, "has schema version", version, "which is newer than", database.SchemaVersion, "of this build")
+		os.Exit(1)
+	}
+
+	fmt.Println("Index in", dbOpts.Dir, "has schema version", version, ", to be migrated to", database.SchemaVersion)
+	if *dryRun {
+		return
+	}
+
+	if _, err = database.Migrate(context.Background(), log, dbOpts); err != nil {
+		log.Errorf("Migration failed: %v", err)
+		os.Exit(1)
+	}
+	fmt.Println("Migrated", dbOpts.Dir, "to schema version", database.SchemaVersion)
+}
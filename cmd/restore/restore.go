@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/apsdehal/go-logger"
+	"github.com/nwihardjo/SpaghettiSearch/database"
+	"github.com/nwihardjo/SpaghettiSearch/indexer"
+	"os"
+	"time"
+)
+
+// rebuilds the index and the page cache of an archive written by cmd/backup into an empty -dbDir
+// pages already in -docsDir are only overwritten with -force
+func main() {
+	dbOpts := database.DefaultDBOptions()
+	dbOpts.RegisterFlags(flag.CommandLine)
+	in := flag.String("in", "", "-in=<archive_file>")
+	docsDir := flag.String("docsDir", indexer.DocsDir, "-docsDir=<page_cache_directory>")
+	force := flag.Bool("force", false, "-force=<overwrite_pages_already_in_docsDir_or_not>")
+	flag.Parse()
+
+	log, _ := logger.New("restore", 1)
+
+	if *in == "" {
+		fmt.Println("Usage: restore -in=<archive_file> [-dbDir=<directory>] [-docsDir=<directory>] [-force]")
+		os.Exit(2)
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		log.Errorf("Failed to open %s: %v", *in, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	timer := time.Now()
+	manifest, err := database.Restore(context.Background(), log, f, dbOpts, *docsDir, *force)
+	if err != nil {
+		log.Errorf("Restore failed: %v", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Restored backup of", manifest.Created.Format(time.RFC1123), "into", dbOpts.Dir, "in", time.Since(timer))
+	if manifest.SchemaVersion < database.SchemaVersion {
+		fmt.Println("Index has schema version", manifest.SchemaVersion, ", run migrate before using it")
+	}
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"github.com/apsdehal/go-logger"
 	"github.com/gorilla/mux"
 	db "github.com/nwihardjo/SpaghettiSearch/database"
+	"github.com/nwihardjo/SpaghettiSearch/indexer"
 	"github.com/nwihardjo/SpaghettiSearch/retrieval"
 	"log"
 	"net/http"
@@ -14,10 +16,8 @@ import (
 	"time"
 )
 
-// global declaration used in db
-var forw []db.DB
-var inv []db.DB
-var ctx context.Context
+// global declaration used in db, tables are acquired for every request as a newly published index may be swapped in
+var served *db.Served
 
 type request struct {
 	Query string `json:"query"`
@@ -38,13 +38,21 @@ func GetWebpages(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		var query request
 		if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
-			panic(err)
+			http.Error(w, "Malformed query", http.StatusBadRequest)
+			return
 		}
 
 		log.Print("Querying terms:", query)
 
 		timer := time.Now()
-		result := retrieval.Retrieve(query.Query, ctx, forw, inv)
+		tables, release := served.Acquire()
+		defer release()
+		result, err := retrieval.Retrieve(query.Query, r.Context(), tables)
+		if err != nil {
+			log.Print("Query failed: ", err)
+			http.Error(w, "Failed to process the query", http.StatusInternalServerError)
+			return
+		}
 		json.NewEncoder(w).Encode(result)
 
 		log.Print("Query processed in ", time.Since(timer))
@@ -58,13 +66,20 @@ func GetWordList(w http.ResponseWriter, r *http.Request) {
 
 	setHeader(w)
 
-	tempT, err := inv[0].IterateInv(ctx, pre, forw[0])
+	ctx := r.Context()
+	tables, release := served.Acquire()
+	defer release()
+	tempT, err := tables.TitlePostings.Raw().IterateInv(ctx, pre, tables.Words.Raw())
 	if err != nil {
-		panic(err)
+		log.Print("Word list failed: ", err)
+		http.Error(w, "Failed to get the word list", http.StatusInternalServerError)
+		return
 	}
-	tempB, err := inv[1].IterateInv(ctx, pre, forw[0])
+	tempB, err := tables.BodyPostings.Raw().IterateInv(ctx, pre, tables.Words.Raw())
 	if err != nil {
-		panic(err)
+		log.Print("Word list failed: ", err)
+		http.Error(w, "Failed to get the word list", http.StatusInternalServerError)
+		return
 	}
 	merged_ := make(map[string]bool)
 	for _, i := range tempT {
@@ -84,8 +99,60 @@ func GetWordList(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(merged)
 }
 
+// streams a consistent backup of the index while serving queries, refer to cmd/backup
+// tables are consistent across units of work only, ranks updated meanwhile by a batch may be half-included
+func GetBackup(w http.ResponseWriter, r *http.Request) {
+	log.Print("Writing backup...")
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename=backup-"+time.Now().Format("20060102-150405")+".tar.gz")
+
+	timer := time.Now()
+	tables, release := served.Acquire()
+	defer release()
+	// status has been sent once the archive is being written, the client detects failure by the truncated archive
+	docsDir := tables.DocsDir
+	if docsDir == "" {
+		docsDir = indexer.DocsDir
+	}
+	if _, err := db.Backup(r.Context(), w, tables.All(), docsDir); err != nil {
+		log.Print("Backup failed: ", err)
+		return
+	}
+	log.Print("Backup written in ", time.Since(timer))
+}
+
+// hit rates of the caches of the forward tables since the index being served has been opened
+func GetCacheStats(w http.ResponseWriter, r *http.Request) {
+	setHeader(w)
+	tables, release := served.Acquire()
+	defer release()
+	stats := make(map[string]interface{})
+	for _, s := range tables.CacheStats() {
+		stats[s.Name] = map[string]interface{}{
+			"hits":      s.Hits,
+			"misses":    s.Misses,
+			"evictions": s.Evictions,
+			"entries":   s.Entries,
+			"capacity":  s.Capacity,
+			"hitRate":   s.HitRate(),
+		}
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
 func main() {
 	// bind to port for heroku deployment
+	dbOpts := db.DefaultDBOptions()
+	// the server never writes to the index, so that it can run while the crawler publishes new ones
+	dbOpts.ReadOnly = true
+	// documents of popular results are resolved on every query, refer to database/cache.go
+	dbOpts.CacheSize = 10000
+	dbOpts.RegisterFlags(flag.CommandLine)
+	reloadInterval := flag.Duration("reloadInterval", 10*time.Second, "-reloadInterval=<interval_between_checks_for_a_newly_published_index,_0_to_disable>")
+	allowBackup := flag.Bool("allowBackup", false, "-allowBackup=<serve_backup_of_the_index_on_/backup_or_not>")
+	flag.Parse()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		log.Printf("$PORT must be set")
@@ -95,17 +162,15 @@ func main() {
 	// initialise db connection
 	ctx, cancel := context.WithCancel(context.TODO())
 	log_, _ := logger.New("test", 1)
+	defer cancel()
 	var err error
-	inv, forw, err = db.DB_init(ctx, log_)
+	served, err = db.OpenServed(ctx, log_, dbOpts)
 	if err != nil {
 		panic(err)
 	}
-
-	for _, bdb_i := range inv {
-		defer bdb_i.Close(ctx, cancel)
-	}
-	for _, bdb := range forw {
-		defer bdb.Close(ctx, cancel)
+	defer served.Close()
+	if *reloadInterval > 0 {
+		go served.Watch(*reloadInterval)
 	}
 
 	// initialise server
@@ -113,6 +178,10 @@ func main() {
 	router.HandleFunc("/query", GetWebpages)
 	router.HandleFunc("/query/{terms}", GetWebpages).Methods("GET")
 	router.HandleFunc("/wordlist/{pre}", GetWordList).Methods("GET")
+	router.HandleFunc("/stats/cache", GetCacheStats).Methods("GET")
+	if *allowBackup {
+		router.HandleFunc("/backup", GetBackup).Methods("GET")
+	}
 
 	// render react app
 	buildPath := "./interface/build/"
@@ -52,7 +52,8 @@ func fanInData(dataIn []<-chan *scrapedData) <-chan *scrapedData {
 	return c
 }
 
-func ParseODP(ctx context.Context, inv []db.DB, forw []db.DB) {
+// ParseODP scrapes the ODP directory and stores the keywords of every topic, for the topic-sensitive pagerank
+func ParseODP(ctx context.Context, tables *db.Tables) error {
 	timer := time.Now()
 	var collector []*scrapedData
 
@@ -67,7 +68,7 @@ func ParseODP(ctx context.Context, inv []db.DB, forw []db.DB) {
 			if link, found := el.DOM.Find("a[href]:nth-of-type(1)").Attr("href"); found {
 				u, err := url.Parse(link)
 				if err != nil {
-					panic(err)
+					return
 				}
 				listTopic = append(listTopic, u)
 				// parseTopic(u)
@@ -94,7 +95,7 @@ func ParseODP(ctx context.Context, inv []db.DB, forw []db.DB) {
 	fmt.Println("\nTime to completely crawl ODP: ", time.Since(timer))
 	timer = time.Now()
 
-	bw_forw := forw[5].BatchWrite_init(ctx)
+	bw_forw := tables.TopicMetadata.Raw().BatchWrite_init(ctx)
 	defer bw_forw.Cancel(ctx)
 
 	// aggregate scraped ODP data
@@ -106,7 +107,7 @@ func ParseODP(ctx context.Context, inv []db.DB, forw []db.DB) {
 			"wordCount": float64(len(data.Values)),
 		}
 		if err := bw_forw.BatchSet(ctx, data.Category, metadata); err != nil {
-			panic(err)
+			return err
 		}
 
 		for keyword, freq := range data.Values {
@@ -122,23 +123,24 @@ func ParseODP(ctx context.Context, inv []db.DB, forw []db.DB) {
 
 	// batch write the number of pages contained in each category
 	if err := bw_forw.Flush(ctx); err != nil {
-		panic(err)
+		return err
 	}
 
-	bw := inv[2].BatchWrite_init(ctx)
+	bw := tables.TopicKeywords.Raw().BatchWrite_init(ctx)
 	defer bw.Cancel(ctx)
 
 	// write aggregated data to db
 	for k, v := range final {
 		if err := bw.BatchSet(ctx, k, v); err != nil {
-			panic(err)
+			return err
 		}
 	}
 	if err := bw.Flush(ctx); err != nil {
-		panic(err)
+		return err
 	}
 
 	fmt.Println("\nTime to put it into db: ", time.Since(timer))
+	return nil
 }
 
 func parseTopic(u <-chan *url.URL) <-chan *scrapedData {
@@ -193,7 +195,8 @@ func parseTopic(u <-chan *url.URL) <-chan *scrapedData {
 					htmlReader := bytes.NewReader(r.Body)
 					doc, err := html.Parse(htmlReader)
 					if err != nil {
-						panic(err)
+						// resource not made of HTML, leave it out
+						return
 					}
 
 					titleInfo, bodyInfo, _, _ := parser.Parse(doc, r.Request.URL.String())
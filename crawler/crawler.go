@@ -2,142 +2,87 @@ package crawler
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"github.com/eapache/channels"
 	"github.com/nwihardjo/SpaghettiSearch/database"
 	"github.com/nwihardjo/SpaghettiSearch/indexer"
+	"github.com/nwihardjo/SpaghettiSearch/parser"
+	"github.com/pkg/errors"
 	"golang.org/x/net/html"
-	"golang.org/x/sync/semaphore"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
-	"regexp"
-	"strings"
 	"sync"
 	"time"
 )
 
-func EnqueueChildren(n *html.Node, baseURL string, queue *channels.InfiniteChannel, children map[string]bool) {
+// EnqueueChildren pushes the links of the page to the frontier, and collects them in children
+// links are canonicalised against the base of the page, refer to parser/canonical.go
+func EnqueueChildren(n *html.Node, base *url.URL, pageURL string, frontier *Frontier, children map[string]bool) {
 	if n.Type == html.ElementNode && n.Data == "a" {
-		for a := 0; a < len(n.Attr); a++ {
-			if n.Attr[a].Key == "href" {
-				urlRe := regexp.MustCompile("[^A-Za-z0-9-._~:/?#[]@!$&'()\\*\\+,;=]|\r?\n| ")
-
-				/* Skip if no href or if href is anchor */
-				if n.Attr[a].Val == "" ||
-					n.Attr[a].Val[0] == '#' ||
-					strings.HasPrefix(n.Attr[a].Val, "javascript") ||
-					strings.HasPrefix(n.Attr[a].Val, "mailto") {
-					continue
-				}
-
-				thisURL := ""
-				/* Make sure the URL ends without '/' */
-				if n.Attr[a].Val[len(n.Attr[a].Val)-1] == '/' {
-					thisURL = n.Attr[a].Val[:len(n.Attr[a].Val)-1]
-				} else {
-					thisURL = n.Attr[a].Val
-				}
-
-				/* Ignore media files */
-				isMedia := false
-				mediaExs := []string{
-					".mp3", ".pdf", ".png", ".jpg", ".mp4", ".avi",
-					".zip", ".pptx", ".ppt", ".rar", ".doc", ".docx",
-					".tar", ".gz", ".xz", ".bz", ".7z",
-				}
-				for _, ex := range mediaExs {
-					if strings.HasSuffix(strings.ToLower(thisURL), ex) {
-						isMedia = true
-						break
-					}
+		for _, attr := range n.Attr {
+			if attr.Key == "href" {
+				/* Skip links to other schemes, media files and the page itself */
+				if link, ok := parser.LinkURL(base, pageURL, attr.Val); ok {
+					frontier.Push(pageURL, link)
+					children[link] = true
 				}
-				if isMedia {
-					continue
-				}
-
-				/*
-					If the href does not start with 'http' or 'www',
-					append this to baseURL
-					Example:
-						baseURL = "https://example.com"
-						href = "/admin"
-						nextURL = "https://example.com/admin"
-				*/
-				if len(thisURL) == 0 {
-					continue
-				}
-				if len(thisURL) < 4 ||
-					(thisURL[:4] != "http" && thisURL[:4] != "www.") {
-
-					baseURLtype, e := url.Parse(baseURL)
-					if e != nil {
-						panic(e)
-					}
-					hn := baseURLtype.Hostname()
-					sc := baseURLtype.Scheme
-
-					if thisURL[0] != '/' {
-						head := urlRe.ReplaceAllString(baseURL, "")
-						tail := urlRe.ReplaceAllString(baseURL+"/"+thisURL, "")
-						queue.In() <- []string{head, tail}
-						children[tail] = true
-					} else {
-						head := urlRe.ReplaceAllString(baseURL, "")
-						tail := urlRe.ReplaceAllString(sc+"://"+hn+thisURL, "")
-						queue.In() <- []string{head, tail}
-						children[tail] = true
-					}
-				} else {
-					if thisURL == baseURL {
-						continue
-					}
-					head := urlRe.ReplaceAllString(baseURL, "")
-					tail := urlRe.ReplaceAllString(thisURL, "")
-					queue.In() <- []string{head, tail}
-					children[tail] = true
-				}
-
 				break
 			}
 		}
 	}
 	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		EnqueueChildren(c, baseURL, queue, children)
+		EnqueueChildren(c, base, pageURL, frontier, children)
 	}
 }
 
-func Crawl(sem *semaphore.Weighted, parentURL string,
-	currentURL string, errorsChannel *channels.InfiniteChannel, client *http.Client,
-	lock2 *sync.RWMutex, queue *channels.InfiniteChannel, mutex *sync.Mutex,
-	inv []database.DB, forw []database.DB) {
-
-	defer sem.Release(1)
+// Crawl fetches and indexes the page, pushing its children to the frontier
+// the frontier hands the page out once robots.txt allows it and the host is ready
+// an error is returned if the page cannot be fetched, parsed or indexed, nothing else is affected
+// the error is a Throttled if the host asks to slow down, the page is not indexed then
+// a page fetched before is requested conditionally, and only its check is recorded if it has not changed
+func Crawl(parentURL string,
+	currentURL string, client *http.Client, robots *Robots,
+	lock2 *sync.RWMutex, frontier *Frontier,
+	tables *database.Tables) error {
 
 	innerStart := time.Now()
 	req, e := http.NewRequest("GET", currentURL, nil)
 	if e != nil {
-		panic(e)
+		return errors.Wrapf(e, "failed to request %s", currentURL)
 	}
+	req.Header.Set("User-Agent", robots.UserAgent())
 	req.Header.Add("Accept", "text/html, application/xhtml+xml, application/xml;q=0.9")
 	req.Header.Add("Accept-Language", "en")
+	prev, fetched := previousFetch(currentURL, tables)
+	if fetched {
+		req.Header.Set("If-Modified-Since", prev.Mod_date.Format(http.TimeFormat))
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+	}
 	resp, err := client.Do(req)
 	fmt.Println("Visited " + currentURL + " (elapsed time: " + time.Now().Sub(innerStart).String() + ")")
 
 	if err != nil {
-		errorsChannel.In() <- currentURL
-		fmt.Println(err)
-		return
+		return errors.Wrapf(err, "failed to fetch %s", currentURL)
+	}
+	defer resp.Body.Close()
+	if err = newThrottled(resp); err != nil {
+		return errors.Wrapf(err, "failed to fetch %s", currentURL)
+	}
+	if resp.StatusCode == http.StatusNotModified && fetched {
+		fmt.Println("Not Modified: " + currentURL)
+		return notModified(currentURL, prev, resp.Header.Get("ETag"), frontier, tables)
 	}
 
 	fmt.Print("Last Modified: ")
 	ps := resp.Header.Get("Content-Length")
 	lms := resp.Header.Get("Last-Modified")
-	lm := time.Now().In(time.UTC)
-	if lms != "" {
-		lm, _ = time.Parse(time.RFC1123, lms)
-		lm = lm.In(time.UTC)
+	// pages without a valid Last-Modified are dated by their fetch
+	lm := innerStart.In(time.UTC)
+	if t, err := http.ParseTime(lms); err == nil {
+		lm = t.In(time.UTC)
 	}
 	fmt.Println(lm.String())
 	fmt.Print("File Size: ")
@@ -149,29 +94,57 @@ func Crawl(sem *semaphore.Weighted, parentURL string,
 
 	htmlData, er := ioutil.ReadAll(resp.Body)
 	if er != nil {
-		panic(er)
-		os.Exit(1)
+		return errors.Wrapf(er, "failed to read %s", currentURL)
 	}
 	htmlReader := bytes.NewReader(htmlData)
 
 	doc, err := html.Parse(htmlReader)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return errors.Wrapf(err, "failed to parse %s", currentURL)
 	}
 
 	children := make(map[string]bool)
 
-	EnqueueChildren(doc, currentURL, queue, children)
+	base, err := parser.BaseURL(doc, currentURL)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse %s", currentURL)
+	}
+	EnqueueChildren(doc, base, currentURL, frontier, children)
 
 	var childsArr []string
 	for k, _ := range children {
 		childsArr = append(childsArr, k)
 	}
 
-	// mutex.Lock()
-	indexer.Index(htmlData, doc, currentURL, lm, ps, mutex, inv, forw, parentURL, childsArr)
-	// mutex.Unlock()
+	return indexer.Index(htmlData, doc, currentURL, lm, ps, resp.Header.Get("ETag"), tables, parentURL, childsArr)
+}
+
+// previousFetch returns the DocInfo of the page if it has been fetched before, i.e. it is not a placeholder
+func previousFetch(currentURL string, tables *database.Tables) (database.DocInfo, bool) {
+	ctx := context.TODO()
+	docID, err := tables.DocIDs.ID(ctx, currentURL)
+	if err != nil {
+		return database.DocInfo{}, false
+	}
+	info, err := tables.Docs.Get(ctx, docID)
+	if err != nil || info.Mod_date.IsZero() {
+		return database.DocInfo{}, false
+	}
+	return info, true
+}
 
-	resp.Body.Close()
+// notModified records the check of a page answered 304 Not Modified, and pushes its children as stored
+func notModified(currentURL string, prev database.DocInfo, etag string, frontier *Frontier, tables *database.Tables) error {
+	if err := indexer.Touch(currentURL, etag, tables); err != nil {
+		return err
+	}
+	ctx := context.TODO()
+	for _, c := range prev.Children {
+		child, err := tables.DocIDs.URL(ctx, c)
+		if err != nil {
+			continue
+		}
+		frontier.Push(currentURL, child)
+	}
+	return nil
 }
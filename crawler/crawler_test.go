@@ -0,0 +1,146 @@
+package crawler
+
+import (
+	"context"
+	"github.com/apsdehal/go-logger"
+	"github.com/nwihardjo/SpaghettiSearch/database"
+	"github.com/nwihardjo/SpaghettiSearch/indexer"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const page = `<html><head><title>Page</title></head><body>spaghetti <a href="/child">child</a></body></html>`
+
+var lastModified = time.Date(2019, 4, 1, 10, 0, 0, 0, time.UTC)
+
+// crawlOnce crawls the URL with a new frontier, which is returned with the pushed children as its level
+func crawlOnce(t *testing.T, srv *httptest.Server, rawURL string, tables *database.Tables) *Frontier {
+	robots := NewRobots(srv.Client(), "spaghettibot")
+	frontier := NewFrontier(FrontierOptions{MaxPerHost: 1, MaxAttempts: 1}, robots, func(*url.URL) bool { return true })
+	if err := Crawl("", rawURL, srv.Client(), robots, &sync.RWMutex{}, frontier, tables); err != nil {
+		t.Fatal(err)
+	}
+	frontier.NextLevel()
+	return frontier
+}
+
+func docInfo(t *testing.T, rawURL string, tables *database.Tables) database.DocInfo {
+	ctx := context.Background()
+	docID, err := tables.DocIDs.ID(ctx, rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := tables.Docs.Get(ctx, docID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestCrawlConditional(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crawl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	docsDir := indexer.DocsDir
+	indexer.DocsDir = filepath.Join(dir, "docs") + "/"
+	defer func() { indexer.DocsDir = docsDir }()
+	// stop words are read relative to the project root
+	wd, _ := os.Getwd()
+	if err = os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	log, _ := logger.New("test", 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := database.DefaultDBOptions()
+	opts.Dir, opts.LoadMode, opts.GCInterval = filepath.Join(dir, "index"), database.LoadMemoryMap, 0
+	tables, err := database.OpenTables(ctx, log, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, d := range tables.All() {
+			d.Close(ctx, cancel)
+		}
+	}()
+
+	var requests []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			requests = append(requests, r.Header)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.Header().Set("ETag", `"v2"`)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		case "/rfc850":
+			w.Header().Set("Last-Modified", lastModified.Format(time.RFC850))
+		case "/invalid":
+			w.Header().Set("Last-Modified", "yesterday")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(page))
+	}))
+	defer srv.Close()
+	home, child := srv.URL+"/", srv.URL+"/child"
+
+	// first fetch is not conditional
+	crawlOnce(t, srv, home, tables)
+	if h := requests[0]; h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != "" {
+		t.Errorf("first fetch sent If-None-Match %q and If-Modified-Since %q, want none", h.Get("If-None-Match"), h.Get("If-Modified-Since"))
+	}
+	fetched := docInfo(t, home, tables)
+	if !fetched.Mod_date.Equal(lastModified) || fetched.ETag != `"v1"` || len(fetched.Children) != 1 {
+		t.Fatalf("got Mod_date %v, ETag %q and %d children, want %v, \"v1\" and 1", fetched.Mod_date, fetched.ETag, len(fetched.Children), lastModified)
+	}
+
+	// recrawl is answered 304, which only records the check and the new ETag
+	docID, _ := tables.DocIDs.ID(ctx, home)
+	fetched.Checked = lastModified
+	if err = tables.Docs.Put(ctx, docID, fetched); err != nil {
+		t.Fatal(err)
+	}
+	frontier := crawlOnce(t, srv, home, tables)
+	if h := requests[1]; h.Get("If-None-Match") != `"v1"` || h.Get("If-Modified-Since") != lastModified.Format(http.TimeFormat) {
+		t.Errorf("recrawl sent If-None-Match %q and If-Modified-Since %q, want \"v1\" and %s",
+			h.Get("If-None-Match"), h.Get("If-Modified-Since"), lastModified.Format(http.TimeFormat))
+	}
+	checked := docInfo(t, home, tables)
+	if checked.ETag != `"v2"` || !checked.Checked.After(fetched.Checked) {
+		t.Errorf("got ETag %q checked at %v, want \"v2\" checked after %v", checked.ETag, checked.Checked, fetched.Checked)
+	}
+	if !checked.Mod_date.Equal(fetched.Mod_date) || len(checked.Page_title) != len(fetched.Page_title) || len(checked.Words_mapping) != len(fetched.Words_mapping) {
+		t.Errorf("got %+v after 304, want the page of %+v", checked, fetched)
+	}
+
+	// crawl goes on through the stored children
+	if e, ok := frontier.Next(ctx); !ok || e.URL != child || e.Parent != home {
+		t.Errorf("got %v (%v) pushed after 304, want %s from %s", e, ok, child, home)
+	}
+
+	// Last-Modified in any HTTP date format, otherwise the fetch time
+	crawlOnce(t, srv, srv.URL+"/rfc850", tables)
+	if lm := docInfo(t, srv.URL+"/rfc850", tables).Mod_date; !lm.Equal(lastModified) {
+		t.Errorf("got Mod_date %v for an RFC 850 Last-Modified, want %v", lm, lastModified)
+	}
+	before := time.Now()
+	crawlOnce(t, srv, srv.URL+"/invalid", tables)
+	if lm := docInfo(t, srv.URL+"/invalid", tables).Mod_date; lm.Before(before.Add(-time.Second)) || lm.After(time.Now()) {
+		t.Errorf("got Mod_date %v for an invalid Last-Modified, want the fetch time %v", lm, before)
+	}
+}
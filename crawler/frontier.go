@@ -0,0 +1,422 @@
+package crawler
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/nwihardjo/SpaghettiSearch/database"
+	"github.com/nwihardjo/SpaghettiSearch/parser"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+=============================== FRONTIER ==========================================
+	Frontier holds the URLs to be crawled, level by level, in one queue per host:
+		- Push adds a link to the next level, once per URL, if the accept function of the crawl keeps it
+		- NextLevel moves the next level into the host queues, once the current level is done
+		- Next hands out the next URL of the current level whose host is ready, and Done gives the host back
+		- Checkpoint and Restore save and reload the levels and the URLs seen, refer to database/crawl_frontier.go
+	A host is ready when it has fewer than MaxPerHost requests in flight, and its delay has elapsed since
+	the previous request handed out. The delay of a host is the largest of MinDelay, the Crawl-delay of its
+	robots.txt, and its backoff.
+	A host answering 429 or 503 (refer to Throttled) gets a backoff, doubled on every further 429 or 503
+	up to MaxBackoff, or the Retry-After it asks for if longer. Every successful request halves the
+	backoff, which drops once below MinDelay. The URL is handed out again, MaxAttempts times at most.
+*/
+
+type (
+	FrontierOptions struct {
+		// requests in flight to the same host
+		MaxPerHost int
+		// minimum interval between two requests to the same host
+		MinDelay time.Duration
+		// longest backoff of a host answering 429 or 503
+		MaxBackoff time.Duration
+		// times a URL is fetched while its host answers 429 or 503, before giving up on it
+		MaxAttempts int
+	}
+
+	// Edge is a link to be crawled, with the page it was found on
+	Edge struct {
+		Parent string
+		URL    string
+		// previous fetches of the URL answered with 429 or 503
+		Attempts int
+
+		host string
+	}
+
+	// Throttled is returned by Crawl when the host answers 429 Too Many Requests or 503 Service Unavailable
+	Throttled struct {
+		Status int
+		// wait asked for by the Retry-After header, 0 if none
+		RetryAfter time.Duration
+	}
+
+	Frontier struct {
+		opts   FrontierOptions
+		robots *Robots
+		accept func(u *url.URL) bool
+
+		mutex sync.Mutex
+		// signalled whenever a host may have become ready, or the level done
+		wake chan struct{}
+		// URLs pushed once, accepted or not
+		seen  map[[md5.Size]byte]bool
+		hosts map[string]*hostQueue
+		// URLs of the current level not handed out yet, and handed out but not done
+		queued   int
+		inFlight map[*Edge]bool
+		next     []*Edge
+	}
+
+	hostQueue struct {
+		pending []*Edge
+		active  int
+		// earliest time to hand out the next URL of the host
+		ready      time.Time
+		crawlDelay time.Duration
+		backoff    time.Duration
+	}
+)
+
+// DefaultFrontierOptions returns the politeness settings used by the crawler
+func DefaultFrontierOptions() FrontierOptions {
+	return FrontierOptions{
+		MaxPerHost:  2,
+		MinDelay:    500 * time.Millisecond,
+		MaxBackoff:  5 * time.Minute,
+		MaxAttempts: 3,
+	}
+}
+
+// RegisterFlags binds the settings to command line flags, the current values are used as the flag defaults
+func (opts *FrontierOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&opts.MaxPerHost, "maxPerHost", opts.MaxPerHost, "-maxPerHost=<requests_in_flight_to_the_same_host>")
+	fs.DurationVar(&opts.MinDelay, "minHostDelay", opts.MinDelay, "-minHostDelay=<minimum_interval_between_two_requests_to_the_same_host>")
+	fs.DurationVar(&opts.MaxBackoff, "maxHostBackoff", opts.MaxBackoff, "-maxHostBackoff=<longest_wait_of_a_host_answering_429_or_503>")
+	fs.IntVar(&opts.MaxAttempts, "maxAttempts", opts.MaxAttempts, "-maxAttempts=<fetches_of_a_url_whose_host_answers_429_or_503>")
+}
+
+func (t *Throttled) Error() string {
+	return "host answered " + strconv.Itoa(t.Status) + " " + http.StatusText(t.Status)
+}
+
+// newThrottled returns the Throttled error of the response, nil if the host does not ask to slow down
+func newThrottled(resp *http.Response) error {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+	t := &Throttled{Status: resp.StatusCode}
+	// Retry-After is either a number of seconds or a date
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			t.RetryAfter = time.Duration(secs) * time.Second
+		} else if at, err := http.ParseTime(v); err == nil {
+			t.RetryAfter = time.Until(at)
+		}
+	}
+	return t
+}
+
+/*
+NewFrontier returns an empty frontier
+\params: politeness settings, robots.txt of the crawl, function telling whether a URL is to be crawled
+\return: frontier
+*/
+func NewFrontier(opts FrontierOptions, robots *Robots, accept func(u *url.URL) bool) *Frontier {
+	if opts.MaxPerHost < 1 {
+		opts.MaxPerHost = 1
+	}
+	return &Frontier{
+		opts:     opts,
+		robots:   robots,
+		accept:   accept,
+		wake:     make(chan struct{}, 1),
+		seen:     make(map[[md5.Size]byte]bool),
+		hosts:    make(map[string]*hostQueue),
+		inFlight: make(map[*Edge]bool),
+	}
+}
+
+// Push adds the link to the next level, unless the URL has been pushed before or is not accepted
+func (f *Frontier) Push(parentURL string, currentURL string) {
+	hash := md5.Sum([]byte(currentURL))
+	f.mutex.Lock()
+	seen := f.seen[hash]
+	f.seen[hash] = true
+	f.mutex.Unlock()
+	if seen {
+		return
+	}
+
+	u, err := url.Parse(currentURL)
+	if err != nil || u.Host == "" || !f.accept(u) {
+		return
+	}
+	// robots.txt has been fetched by the accept function, if it checks it
+	h := f.host(u)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.next = append(f.next, &Edge{Parent: parentURL, URL: currentURL, host: h})
+}
+
+// host returns the name of the host of the URL, and registers its queue on first use
+func (f *Frontier) host(u *url.URL) string {
+	crawlDelay := f.robots.Delay(u)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	h, ok := f.hosts[u.Host]
+	if !ok {
+		h = &hostQueue{}
+		f.hosts[u.Host] = h
+	}
+	h.crawlDelay = crawlDelay
+	return u.Host
+}
+
+// NextLevel makes the links pushed since the previous call the current level, and returns their number
+func (f *Frontier) NextLevel() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, e := range f.next {
+		h := f.hosts[e.host]
+		h.pending = append(h.pending, e)
+	}
+	f.queued += len(f.next)
+	n := len(f.next)
+	f.next = nil
+	return n
+}
+
+/*
+Next waits for a host of the current level to be ready, and hands out its next URL
+Done must be called once the URL is crawled
+\params: context
+\return: link to be crawled, false once every URL of the current level is done or the context is cancelled
+*/
+func (f *Frontier) Next(ctx context.Context) (*Edge, bool) {
+	for {
+		f.mutex.Lock()
+		if f.queued == 0 && len(f.inFlight) == 0 {
+			f.mutex.Unlock()
+			return nil, false
+		}
+
+		now := time.Now()
+		var ready *hostQueue
+		var wait time.Duration = -1
+		for _, h := range f.hosts {
+			if len(h.pending) == 0 || h.active >= f.opts.MaxPerHost {
+				continue
+			}
+			if d := h.ready.Sub(now); d > 0 {
+				if wait < 0 || d < wait {
+					wait = d
+				}
+				continue
+			}
+			// the host waiting the longest goes first
+			if ready == nil || h.ready.Before(ready.ready) {
+				ready = h
+			}
+		}
+
+		if ready != nil {
+			e := ready.pending[0]
+			ready.pending = ready.pending[1:]
+			ready.active++
+			ready.ready = now.Add(f.delay(ready))
+			f.queued--
+			f.inFlight[e] = true
+			f.mutex.Unlock()
+			return e, true
+		}
+		f.mutex.Unlock()
+
+		// nothing ready, wait for a delay to elapse or a URL to be done
+		var timer *time.Timer
+		var elapsed <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			elapsed = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-f.wake:
+		case <-elapsed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil, false
+		}
+	}
+}
+
+/*
+Done gives the host of the link back, and adjusts its backoff to the error of the crawl
+\params: link handed out by Next, error returned by Crawl
+\return: whether the URL has been queued again, because its host answered 429 or 503
+*/
+func (f *Frontier) Done(e *Edge, err error) bool {
+	f.mutex.Lock()
+	defer func() {
+		f.mutex.Unlock()
+		select {
+		case f.wake <- struct{}{}:
+		default:
+		}
+	}()
+
+	h := f.hosts[e.host]
+	h.active--
+	delete(f.inFlight, e)
+
+	t, throttled := errors.Cause(err).(*Throttled)
+	if !throttled {
+		if h.backoff /= 2; h.backoff < f.opts.MinDelay {
+			h.backoff = 0
+		}
+		return false
+	}
+
+	h.backoff *= 2
+	if h.backoff < f.opts.MinDelay {
+		h.backoff = f.opts.MinDelay
+	}
+	if h.backoff < time.Second {
+		h.backoff = time.Second
+	}
+	if h.backoff > f.opts.MaxBackoff {
+		h.backoff = f.opts.MaxBackoff
+	}
+	wait := h.backoff
+	if t.RetryAfter > wait {
+		wait = t.RetryAfter
+	}
+	if ready := time.Now().Add(wait); ready.After(h.ready) {
+		h.ready = ready
+	}
+	fmt.Println("Backing off " + e.host + " for " + wait.String() + ": " + t.Error())
+
+	if e.Attempts++; e.Attempts >= f.opts.MaxAttempts {
+		return false
+	}
+	// retried before the rest of the host, as it comes first in the level
+	h.pending = append([]*Edge{e}, h.pending...)
+	f.queued++
+	return true
+}
+
+// delay returns the interval to keep between two requests to the host
+func (f *Frontier) delay(h *hostQueue) time.Duration {
+	d := f.opts.MinDelay
+	if h.crawlDelay > d {
+		d = h.crawlDelay
+	}
+	if h.backoff > d {
+		d = h.backoff
+	}
+	return d
+}
+
+/*
+Checkpoint records the URLs of the frontier in the checkpoint, refer to database/crawl_frontier.go
+URLs handed out but not done yet are recorded in the current level, to be crawled again on resume
+\params: checkpoint whose Current, Next and Seen are replaced
+\return: number of URLs in flight handed out for the first time, to be uncounted from the pages visited
+*/
+func (f *Frontier) Checkpoint(cp *database.CrawlCheckpoint) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	toCrawlEdge := func(e *Edge) database.CrawlEdge {
+		return database.CrawlEdge{Parent: e.Parent, URL: e.URL, Attempts: e.Attempts}
+	}
+	firsts := 0
+	cp.Current = make([]database.CrawlEdge, 0, f.queued+len(f.inFlight))
+	for e := range f.inFlight {
+		cp.Current = append(cp.Current, toCrawlEdge(e))
+		if e.Attempts == 0 {
+			firsts++
+		}
+	}
+	for _, h := range f.hosts {
+		for _, e := range h.pending {
+			cp.Current = append(cp.Current, toCrawlEdge(e))
+		}
+	}
+	cp.Next = make([]database.CrawlEdge, 0, len(f.next))
+	for _, e := range f.next {
+		cp.Next = append(cp.Next, toCrawlEdge(e))
+	}
+	cp.Seen = make([]string, 0, len(f.seen))
+	for hash := range f.seen {
+		cp.Seen = append(cp.Seen, hex.EncodeToString(hash[:]))
+	}
+	return firsts
+}
+
+/*
+Restore fills an empty frontier with the URLs of a checkpoint, which are not checked by the accept function again
+\params: checkpoint
+\return: number of URLs of the current level, error if the checkpoint is corrupted
+*/
+func (f *Frontier) Restore(cp *database.CrawlCheckpoint) (int, error) {
+	seen := make([][md5.Size]byte, len(cp.Seen))
+	for i, v := range cp.Seen {
+		b, err := hex.DecodeString(v)
+		if err != nil || len(b) != md5.Size {
+			return 0, errors.Errorf("invalid URL hash %q in the checkpoint", v)
+		}
+		copy(seen[i][:], b)
+	}
+
+	// checkpoints of older builds hold the URLs as linked, canonicalised as they would be pushed now
+	edges := func(list []database.CrawlEdge) []*Edge {
+		ret := make([]*Edge, 0, len(list))
+		for _, v := range list {
+			if canonical, err := parser.CanonicalURL(v.URL); err == nil {
+				v.URL = canonical
+			}
+			if canonical, err := parser.CanonicalURL(v.Parent); err == nil {
+				v.Parent = canonical
+			}
+			if u, err := url.Parse(v.URL); err == nil && u.Host != "" {
+				ret = append(ret, &Edge{Parent: v.Parent, URL: v.URL, Attempts: v.Attempts, host: f.host(u)})
+			}
+		}
+		return ret
+	}
+	current, next := edges(cp.Current), edges(cp.Next)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, hash := range seen {
+		f.seen[hash] = true
+	}
+	// seen URLs of older builds are hashed as linked, so that the canonical URLs queued would be pushed again
+	for _, list := range [][]*Edge{current, next} {
+		for _, e := range list {
+			f.seen[md5.Sum([]byte(e.URL))] = true
+		}
+	}
+	for _, e := range current {
+		h := f.hosts[e.host]
+		h.pending = append(h.pending, e)
+	}
+	f.queued += len(current)
+	f.next = append(f.next, next...)
+	return len(current), nil
+}
@@ -0,0 +1,215 @@
+package crawler
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/nwihardjo/SpaghettiSearch/database"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripper answers every request without network
+type roundTripper func(*http.Request) *http.Response
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req), nil
+}
+
+// testFrontier returns a frontier accepting every URL, whose hosts have no robots.txt
+func testFrontier(opts FrontierOptions) *Frontier {
+	client := &http.Client{Transport: roundTripper(func(req *http.Request) *http.Response {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}
+	})}
+	return NewFrontier(opts, NewRobots(client, "spaghettibot"), func(*url.URL) bool { return true })
+}
+
+// next hands out the next URL, failing if none is ready within a second
+func next(t *testing.T, f *Frontier) *Edge {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	e, ok := f.Next(ctx)
+	if !ok {
+		t.Fatal("no URL handed out")
+	}
+	return e
+}
+
+// blocked tells whether Next hands out nothing for a while
+func blocked(f *Frontier) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, ok := f.Next(ctx)
+	return !ok && ctx.Err() != nil
+}
+
+func TestFrontierPerHost(t *testing.T) {
+	f := testFrontier(FrontierOptions{MaxPerHost: 2, MaxBackoff: time.Minute, MaxAttempts: 3})
+	for _, u := range []string{"http://a.test/1", "http://a.test/2", "http://a.test/3", "http://b.test/1", "http://a.test/1"} {
+		f.Push("http://a.test/", u)
+	}
+	if n := f.NextLevel(); n != 4 {
+		t.Fatalf("got %d URLs in the level, want 4 as a.test/1 is pushed twice", n)
+	}
+
+	active := make(map[string][]*Edge)
+	for i := 0; i < 3; i++ {
+		e := next(t, f)
+		active[e.host] = append(active[e.host], e)
+	}
+	if len(active["a.test"]) != 2 || len(active["b.test"]) != 1 {
+		t.Fatalf("got %d URLs of a.test and %d of b.test in flight, want 2 and 1", len(active["a.test"]), len(active["b.test"]))
+	}
+	if !blocked(f) {
+		t.Fatal("third URL of a.test handed out while two are in flight")
+	}
+
+	// a URL done gives the host back
+	f.Done(active["a.test"][0], nil)
+	if e := next(t, f); e.URL != "http://a.test/3" {
+		t.Errorf("got %s, want http://a.test/3", e.URL)
+	} else {
+		f.Done(e, nil)
+	}
+	f.Done(active["a.test"][1], nil)
+	if !blocked(f) {
+		t.Fatal("URL handed out while the level is empty")
+	}
+	f.Done(active["b.test"][0], nil)
+
+	// level is drained, Next returns without waiting for the context
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, ok := f.Next(ctx); ok || ctx.Err() != nil {
+		t.Errorf("Next of a drained level returned %v (%v), want false at once", ok, ctx.Err())
+	}
+}
+
+func TestFrontierDelay(t *testing.T) {
+	f := testFrontier(FrontierOptions{MaxPerHost: 2, MinDelay: 100 * time.Millisecond, MaxBackoff: time.Minute, MaxAttempts: 3})
+	f.Push("", "http://a.test/1")
+	f.Push("", "http://a.test/2")
+	f.NextLevel()
+
+	first := time.Now()
+	next(t, f)
+	next(t, f)
+	if elapsed := time.Since(first); elapsed < 100*time.Millisecond {
+		t.Errorf("second URL of the host handed out after %v, want at least the minimum delay", elapsed)
+	}
+}
+
+func TestFrontierBackoff(t *testing.T) {
+	f := testFrontier(FrontierOptions{MaxPerHost: 1, MinDelay: 10 * time.Millisecond, MaxBackoff: 3 * time.Second, MaxAttempts: 3})
+	f.Push("", "http://a.test/1")
+	f.Push("", "http://a.test/2")
+	f.NextLevel()
+	h := f.hosts["a.test"]
+
+	// handed out at once, whatever the backoff of the host
+	handOut := func() *Edge {
+		f.mutex.Lock()
+		h.ready = time.Time{}
+		f.mutex.Unlock()
+		return next(t, f)
+	}
+
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		e := handOut()
+		if e.URL != "http://a.test/1" {
+			t.Fatalf("got %s, want the throttled URL first", e.URL)
+		}
+		requeued := f.Done(e, errors.Wrap(&Throttled{Status: http.StatusTooManyRequests}, "crawl failed"))
+		if h.backoff != want {
+			t.Errorf("got backoff %v after %d throttled requests, want %v", h.backoff, i+1, want)
+		}
+		if wantRequeued := i+1 < f.opts.MaxAttempts; requeued != wantRequeued {
+			t.Errorf("URL throttled %d times is queued again: %v, want %v", i+1, requeued, wantRequeued)
+		}
+		if i == 0 && !blocked(f) {
+			t.Error("URL handed out before the backoff has elapsed")
+		}
+	}
+
+	// Retry-After longer than the backoff is waited for
+	e := handOut()
+	f.Done(e, &Throttled{Status: http.StatusServiceUnavailable, RetryAfter: time.Hour})
+	if wait := time.Until(h.ready); wait < 59*time.Minute {
+		t.Errorf("host ready in %v, want the Retry-After of an hour", wait)
+	}
+
+	// successful requests halve the backoff, which drops below the minimum delay
+	for _, want := range []time.Duration{1500 * time.Millisecond, 750 * time.Millisecond} {
+		f.Push("", "http://a.test/"+want.String())
+		f.NextLevel()
+		f.Done(handOut(), nil)
+		if h.backoff != want {
+			t.Errorf("got backoff %v after a success, want %v", h.backoff, want)
+		}
+	}
+	h.backoff = 15 * time.Millisecond
+	f.Push("", "http://a.test/last")
+	f.NextLevel()
+	f.Done(handOut(), nil)
+	if h.backoff != 0 {
+		t.Errorf("got backoff %v, want 0 once below the minimum delay", h.backoff)
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	for _, c := range []struct {
+		status     int
+		retryAfter string
+		want       time.Duration
+	}{
+		{http.StatusTooManyRequests, "", 0},
+		{http.StatusServiceUnavailable, "120", 2 * time.Minute},
+		{http.StatusTooManyRequests, "soon", 0},
+	} {
+		resp := &http.Response{StatusCode: c.status, Header: http.Header{}}
+		resp.Header.Set("Retry-After", c.retryAfter)
+		err := newThrottled(resp)
+		if throttled, ok := err.(*Throttled); !ok || throttled.RetryAfter != c.want {
+			t.Errorf("got %v for %d with Retry-After %q, want a wait of %v", err, c.status, c.retryAfter, c.want)
+		}
+	}
+	if err := newThrottled(&http.Response{StatusCode: http.StatusOK}); err != nil {
+		t.Errorf("got %v for 200, want nil", err)
+	}
+}
+
+func md5Hex(s string) string {
+	hash := md5.Sum([]byte(s))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestFrontierRestore(t *testing.T) {
+	f := testFrontier(FrontierOptions{MaxPerHost: 1, MaxAttempts: 3})
+	// checkpoint of an older build, holding the URLs as linked
+	n, err := f.Restore(&database.CrawlCheckpoint{
+		Current: []database.CrawlEdge{{Parent: "HTTP://A.test:80/", URL: "http://A.test/x#top", Attempts: 1}},
+		Next:    []database.CrawlEdge{{Parent: "http://a.test/x", URL: "http://a.test:80/y?utm_source=z"}},
+		Seen:    []string{md5Hex("http://A.test/x#top"), md5Hex("http://a.test:80/y?utm_source=z")},
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("got %d (%v) URLs of the current level, want 1", n, err)
+	}
+	if e := next(t, f); e.URL != "http://a.test/x" || e.Parent != "http://a.test/" || e.Attempts != 1 {
+		t.Errorf("got %+v, want http://a.test/x from http://a.test/ attempted once", e)
+	}
+	if f.next[0].URL != "http://a.test/y" {
+		t.Errorf("got %s in the next level, want http://a.test/y", f.next[0].URL)
+	}
+
+	// queued URLs are seen as canonicalised, whatever the seen URLs of the checkpoint
+	f.Push("http://a.test/x", "http://a.test/x")
+	f.Push("http://a.test/x", "http://a.test/y")
+	if len(f.next) != 1 {
+		t.Errorf("got %d URLs in the next level, want the restored one only", len(f.next))
+	}
+}
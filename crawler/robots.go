@@ -0,0 +1,117 @@
+package crawler
+
+import (
+	"fmt"
+	"github.com/temoto/robotstxt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+/*
+=============================== ROBOTS.TXT ==========================================
+	Robots fetches the robots.txt of every host once per crawl, and keeps it for the rest of the crawl.
+	Rules of the group matching the user-agent token are applied, the group of "*" otherwise:
+		- Allow and Disallow rules, the most specific one wins
+		- Crawl-delay, the minimum interval between two requests to the host, capped to maxCrawlDelay,
+		  kept by the frontier
+	robots.txt answering 4xx allows everything. 5xx, or a robots.txt which cannot be fetched at all,
+	disallows the whole host, as Google does.
+*/
+
+const (
+	// larger robots.txt are truncated, as Google does
+	maxRobotsSize = 500 * 1024
+
+	// a larger Crawl-delay would stall the crawl, the host is crawled at this interval instead
+	maxCrawlDelay = time.Minute
+)
+
+type (
+	Robots struct {
+		client    *http.Client
+		userAgent string
+
+		mutex sync.Mutex
+		hosts map[string]*robotsHost
+	}
+
+	robotsHost struct {
+		// robots.txt is fetched by the first caller, the others wait for it
+		fetched sync.Once
+		rules   *robotstxt.RobotsData
+		group   *robotstxt.Group
+	}
+)
+
+// NewRobots returns a robots.txt cache fetching with the client, and matching the rules against the user-agent token
+func NewRobots(client *http.Client, userAgent string) *Robots {
+	return &Robots{client: client, userAgent: userAgent, hosts: make(map[string]*robotsHost)}
+}
+
+// UserAgent returns the user-agent token sent with every request
+func (r *Robots) UserAgent() string {
+	return r.userAgent
+}
+
+// Allowed tells whether robots.txt of the host allows fetching the URL
+func (r *Robots) Allowed(u *url.URL) bool {
+	path := u.EscapedPath()
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return r.host(u).rules.TestAgent(path, r.userAgent)
+}
+
+// Delay returns the Crawl-delay of the host, 0 if there is none
+func (r *Robots) Delay(u *url.URL) time.Duration {
+	delay := r.host(u).group.CrawlDelay
+	if delay > maxCrawlDelay {
+		return maxCrawlDelay
+	}
+	return delay
+}
+
+// host returns the rules of the host of the URL, fetching its robots.txt on first use
+func (r *Robots) host(u *url.URL) *robotsHost {
+	key := u.Scheme + "://" + u.Host
+	r.mutex.Lock()
+	h, ok := r.hosts[key]
+	if !ok {
+		h = &robotsHost{}
+		r.hosts[key] = h
+	}
+	r.mutex.Unlock()
+
+	h.fetched.Do(func() {
+		rules, err := r.fetch(key + "/robots.txt")
+		if err != nil {
+			fmt.Println("Disallowing " + key + ", failed to fetch robots.txt: " + err.Error())
+			rules, _ = robotstxt.FromStatusAndBytes(http.StatusServiceUnavailable, nil)
+		}
+		h.rules, h.group = rules, rules.FindGroup(r.userAgent)
+	})
+	return h
+}
+
+func (r *Robots) fetch(robotsURL string) (*robotstxt.RobotsData, error) {
+	req, err := http.NewRequest("GET", robotsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", r.userAgent)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRobotsSize))
+	if err != nil {
+		return nil, err
+	}
+	return robotstxt.FromStatusAndBytes(resp.StatusCode, body)
+}
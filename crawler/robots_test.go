@@ -0,0 +1,124 @@
+package crawler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const robotsTxt = `User-agent: *
+Disallow: /
+
+User-agent: spaghettibot
+Disallow: /private/
+Allow: /private/public
+Crawl-delay: 120
+`
+
+// robotsServer answers /robots.txt with the status and body, and counts the requests for it
+func robotsServer(status int, body string, fetches *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			atomic.AddInt32(fetches, 1)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestRobotsRules(t *testing.T) {
+	var fetches int32
+	srv := robotsServer(http.StatusOK, robotsTxt, &fetches)
+	defer srv.Close()
+
+	robots := NewRobots(srv.Client(), "spaghettibot")
+	for path, want := range map[string]bool{
+		"/":                   true,
+		"/index.html":         true,
+		"/private/":           false,
+		"/private/secret":     false,
+		"/private/public":     true,
+		"/private/public/doc": true,
+	} {
+		if got := robots.Allowed(mustParse(t, srv.URL+path)); got != want {
+			t.Errorf("%s allowed is %v, want %v", path, got, want)
+		}
+	}
+	if delay := robots.Delay(mustParse(t, srv.URL+"/")); delay != maxCrawlDelay {
+		t.Errorf("got Crawl-delay %v, want it capped to %v", delay, maxCrawlDelay)
+	}
+
+	// agents without a group of their own follow the one of "*"
+	other := NewRobots(srv.Client(), "otherbot")
+	if other.Allowed(mustParse(t, srv.URL+"/index.html")) {
+		t.Error("/index.html allowed to otherbot, disallowed by the group of *")
+	}
+	if delay := other.Delay(mustParse(t, srv.URL+"/")); delay != 0 {
+		t.Errorf("got Crawl-delay %v for otherbot, want 0", delay)
+	}
+	if atomic.LoadInt32(&fetches) != 2 {
+		t.Errorf("robots.txt fetched %d times by two caches, want 2", fetches)
+	}
+}
+
+func TestRobotsFetchedOnce(t *testing.T) {
+	var fetches int32
+	srv := robotsServer(http.StatusOK, robotsTxt, &fetches)
+	defer srv.Close()
+
+	robots := NewRobots(srv.Client(), "spaghettibot")
+	index, other := mustParse(t, srv.URL+"/index.html"), mustParse(t, srv.URL+"/other.html")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			robots.Allowed(index)
+			robots.Delay(other)
+		}()
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&fetches) != 1 {
+		t.Errorf("robots.txt fetched %d times, want once per host", fetches)
+	}
+}
+
+func TestRobotsStatus(t *testing.T) {
+	for _, c := range []struct {
+		status  int
+		allowed bool
+	}{
+		{http.StatusNotFound, true},
+		{http.StatusForbidden, true},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+	} {
+		var fetches int32
+		srv := robotsServer(c.status, robotsTxt, &fetches)
+		robots := NewRobots(srv.Client(), "otherbot")
+		if got := robots.Allowed(mustParse(t, srv.URL+"/index.html")); got != c.allowed {
+			t.Errorf("robots.txt answering %d: allowed is %v, want %v", c.status, got, c.allowed)
+		}
+		srv.Close()
+	}
+
+	// host which cannot be reached is disallowed
+	srv := robotsServer(http.StatusOK, "", new(int32))
+	srv.Close()
+	robots := NewRobots(&http.Client{Timeout: time.Second}, "spaghettibot")
+	if robots.Allowed(mustParse(t, srv.URL+"/index.html")) {
+		t.Error("host failing to serve robots.txt is allowed")
+	}
+}
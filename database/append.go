@@ -0,0 +1,359 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+=============================== POSTING LIST APPENDS ==========================================
+	Append adds postings to the posting list of a word without reading the list. The postings are
+	written as a fragment under a delta key next to the posting list:
+		<wordHash>				: posting list folded so far
+		<wordHash> 0x00 <seq, uint64 big-endian>	: fragment appended afterwards
+	Delta keys sort right after their posting list, as wordHash never contains 0x00.
+
+	Reads (Get, scans, Iterate) fold the fragments into the posting list in order of seq:
+		- postings of a docID in a fragment replace the ones of the same docID
+		- a docID with an empty list removes the docID from the posting list
+		- a posting list left without any docID does not exist
+	Fragments of different docIDs commute, only appends for the same docID need to be ordered
+	by the caller. Set and Delete drop the fragments of the key, looking them up only for the keys
+	which may have some: the ones having fragments when the table is opened, or appended to since.
+	Once a key has collected
+	compactThreshold fragments, they are folded into the posting list in a single transaction,
+	which does not conflict with concurrent appends. CompactPostings folds the whole table.
+*/
+
+const (
+	deltaSep byte = 0x00
+
+	// number of fragments appended to a key by this process before they are folded
+	compactThreshold = 64
+)
+
+var ErrAppendNotSupported = errors.New("Append is only supported by tables of posting lists (value type postings)")
+
+type deltaCounter struct {
+	mutex  sync.Mutex
+	counts map[string]int
+	// keys which may have fragments, a key is never removed as an append may be running concurrently
+	keys map[string]bool
+}
+
+func (bdb *BadgerDB) appendable() bool {
+	return isPostings(bdb.valCodec)
+}
+
+func (bdb *BadgerDB) nextDeltaKey(key []byte) []byte {
+	// sequence only needs to be increasing across restarts, same as the journal
+	if atomic.LoadUint64(&bdb.deltaSeq) == 0 {
+		atomic.CompareAndSwapUint64(&bdb.deltaSeq, 0, uint64(time.Now().UnixNano()))
+	}
+	return deltaKey(key, atomic.AddUint64(&bdb.deltaSeq, 1))
+}
+
+func deltaKey(key []byte, seq uint64) []byte {
+	k := make([]byte, len(key)+1+8)
+	copy(k, key)
+	k[len(key)] = deltaSep
+	binary.BigEndian.PutUint64(k[len(key)+1:], seq)
+	return k
+}
+
+// baseKey strips the delta suffix, keys of posting lists are returned as they are
+func baseKey(k []byte) []byte {
+	if i := bytes.IndexByte(k, deltaSep); i >= 0 {
+		return k[:i]
+	}
+	return k
+}
+
+// foldPostings applies the fragment to the posting list in place, refer to the description above
+func foldPostings(postings map[uint32][]float32, fragment map[uint32][]float32) {
+	for docID, list := range fragment {
+		if len(list) == 0 {
+			delete(postings, docID)
+		} else {
+			postings[docID] = list
+		}
+	}
+}
+
+// foldValues decodes the posting list and its fragments, given in key order, into a single posting list
+// returns nil if nothing is left
+func foldValues(values [][]byte) (map[uint32][]float32, error) {
+	ret := make(map[uint32][]float32)
+	for _, v := range values {
+		p, err := DecodePostings(v)
+		if err != nil {
+			return nil, err
+		}
+		foldPostings(ret, p)
+	}
+	if len(ret) == 0 {
+		return nil, nil
+	}
+	return ret, nil
+}
+
+// readFolded reads the posting list of the key and all of its fragments within the transaction
+// \return: folded posting list (nil if it does not exist), delta keys read, error
+func readFolded(txn *badger.Txn, key []byte) (map[uint32][]float32, [][]byte, error) {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	var values, deltas [][]byte
+	for it.Seek(key); it.ValidForPrefix(key); it.Next() {
+		item := it.Item()
+		k := item.Key()
+		if len(k) > len(key) && k[len(key)] != deltaSep {
+			// another key sharing the prefix, every delta key of the posting list comes before it
+			break
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		values = append(values, v)
+		if len(k) > len(key) {
+			deltas = append(deltas, item.KeyCopy(nil))
+		}
+	}
+
+	postings, err := foldValues(values)
+	return postings, deltas, err
+}
+
+// loadFragmented records the keys having fragments, once when the table is opened
+func (bdb *BadgerDB) loadFragmented() error {
+	keys := make(map[string]bool)
+	err := bdb.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			k := it.Item().Key()
+			if base := baseKey(k); len(base) != len(k) {
+				keys[string(base)] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	bdb.deltas.mutex.Lock()
+	bdb.deltas.keys = keys
+	bdb.deltas.mutex.Unlock()
+	return nil
+}
+
+// fragmented records that the key is about to be appended to
+func (bdb *BadgerDB) fragmented(key []byte) {
+	bdb.deltas.mutex.Lock()
+	if bdb.deltas.keys == nil {
+		bdb.deltas.keys = make(map[string]bool)
+	}
+	bdb.deltas.keys[string(key)] = true
+	bdb.deltas.mutex.Unlock()
+}
+
+// mayHaveDeltas reports whether the key of a table of posting lists may have fragments to be dropped
+func (bdb *BadgerDB) mayHaveDeltas(key []byte) bool {
+	if !bdb.appendable() {
+		return false
+	}
+	bdb.deltas.mutex.Lock()
+	defer bdb.deltas.mutex.Unlock()
+	return bdb.deltas.keys[string(key)]
+}
+
+// deltaKeys lists the delta keys of the key, without their values
+func (bdb *BadgerDB) deltaKeys(key []byte) ([][]byte, error) {
+	prefix := append(append([]byte{}, key...), deltaSep)
+	var keys [][]byte
+	err := bdb.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Append adds the postings (type: map[uint32][]float32) to the posting list of the key, refer to the description above
+func (bdb *BadgerDB) Append(ctx context.Context, key_ interface{}, value_ interface{}) error {
+	if !bdb.appendable() {
+		return ErrAppendNotSupported
+	}
+	key, value, err := marshalPair(bdb.keyCodec, key_, bdb.valCodec, value_)
+	if err != nil {
+		return err
+	}
+
+	bdb.addKey(key)
+	bdb.fragmented(key)
+	err = bdb.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(bdb.nextDeltaKey(key), value)
+	})
+	if err != nil {
+		return err
+	}
+	return bdb.appended(key)
+}
+
+// appended counts the fragments appended to the key, and folds them once there are enough
+func (bdb *BadgerDB) appended(key []byte) error {
+	bdb.deltas.mutex.Lock()
+	if bdb.deltas.counts == nil {
+		bdb.deltas.counts = make(map[string]int)
+	}
+	bdb.deltas.counts[string(key)]++
+	compact := bdb.deltas.counts[string(key)] >= compactThreshold
+	if compact {
+		delete(bdb.deltas.counts, string(key))
+	}
+	bdb.deltas.mutex.Unlock()
+
+	if compact {
+		return bdb.compactKey(key)
+	}
+	return nil
+}
+
+// compactKey folds the fragments of the key into its posting list
+// fragments appended meanwhile have not been read by the transaction, and are kept
+func (bdb *BadgerDB) compactKey(key []byte) error {
+	for {
+		err := bdb.db.Update(func(txn *badger.Txn) error {
+			postings, deltas, err := readFolded(txn, key)
+			if err != nil || len(deltas) == 0 {
+				return err
+			}
+
+			for _, d := range deltas {
+				if err = txn.Delete(d); err != nil {
+					return err
+				}
+			}
+			if postings == nil {
+				return txn.Delete(key)
+			}
+			value, err := EncodePostings(postings)
+			if err != nil {
+				return err
+			}
+			return txn.Set(key, value)
+		})
+
+		// key rewritten by a concurrent Set or Delete, fold again
+		if err != badger.ErrConflict {
+			return err
+		}
+	}
+}
+
+// CompactPostings folds every fragment of a table of posting lists into the posting lists
+// returns the number of posting lists rewritten
+func CompactPostings(ctx context.Context, table DB) (int, error) {
+	// shards are compacted one after the other, refer to shard.go
+	if s, ok := table.(*ShardedDB); ok {
+		total := 0
+		for _, shard := range s.shards {
+			n, err := CompactPostings(ctx, shard)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+		return total, nil
+	}
+
+	bdb, ok := table.(*BadgerDB)
+	if !ok {
+		// tables other than BadgerDB fold on append
+		return 0, nil
+	}
+	if !bdb.appendable() {
+		return 0, ErrAppendNotSupported
+	}
+
+	// collect the keys having fragments first, the table is rewritten afterwards
+	var keys [][]byte
+	err := bdb.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			k := it.Item().Key()
+			base := baseKey(k)
+			if len(base) != len(k) && (len(keys) == 0 || !bytes.Equal(keys[len(keys)-1], base)) {
+				keys = append(keys, append([]byte{}, base...))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, k := range keys {
+		if err = bdb.compactKey(k); err != nil {
+			return 0, err
+		}
+	}
+
+	bdb.deltas.mutex.Lock()
+	bdb.deltas.counts = nil
+	bdb.deltas.mutex.Unlock()
+	return len(keys), nil
+}
+
+// scanGroup collects the posting list and the fragments of one key during a scan
+type scanGroup struct {
+	key    []byte
+	values map[string][]byte
+}
+
+func (g *scanGroup) add(k []byte, v []byte) {
+	g.values[string(k)] = v
+}
+
+// fold in key order, fragments are visited in reverse order by reverse scans
+func (g *scanGroup) fold() (map[uint32][]float32, error) {
+	keys := make([]string, 0, len(g.values))
+	for k := range g.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = g.values[k]
+	}
+	return foldValues(values)
+}
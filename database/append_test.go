@@ -0,0 +1,160 @@
+package database
+
+import (
+	"context"
+	"github.com/apsdehal/go-logger"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const (
+	docA uint32 = 1
+	docB uint32 = 2
+
+	// md5 of "a" and "b", keys of the tables keyed by hash
+	hashA = "0cc175b9c0f1b6a831c399e269772661"
+	hashB = "92eb5ffee6ae2fec3ad71c777531578f"
+)
+
+func TestAppendPostings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "append")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, _ := logger.New("test", 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := DefaultDBOptions()
+	opts.GCInterval = 0
+	table, err := NewBadgerDB(ctx, dir, log, LoadMemoryMap, "string", "postings", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close(ctx, cancel)
+
+	if err = table.Append(ctx, "w", map[uint32][]float32{docA: {0.5, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	table.Append(ctx, "w", map[uint32][]float32{docB: {1, 2, 3}})
+	table.Append(ctx, "w", map[uint32][]float32{docA: {0.25, 7}})
+	table.Append(ctx, "x", map[uint32][]float32{docA: {1}})
+
+	want := map[uint32][]float32{docA: {0.25, 7}, docB: {1, 2, 3}}
+	if v, err := table.Get(ctx, "w"); err != nil || !reflect.DeepEqual(v, want) {
+		t.Errorf("got %v (%v), want %v", v, err, want)
+	}
+
+	// scans see each posting list once, folded
+	var keys []string
+	table.Iterate(ctx, func(k interface{}, v interface{}) error {
+		keys = append(keys, k.(string))
+		return nil
+	})
+	if !reflect.DeepEqual(keys, []string{"w", "x"}) {
+		t.Errorf("got keys %v, want [w x]", keys)
+	}
+	keys = nil
+	table.ScanPrefix(ctx, "", func(k interface{}, v interface{}) error {
+		keys = append(keys, k.(string))
+		if !reflect.DeepEqual(v, want) && k == "w" {
+			t.Errorf("reverse scan got %v, want %v", v, want)
+		}
+		return nil
+	}, ScanOptions{Reverse: true, Limit: 2})
+	if !reflect.DeepEqual(keys, []string{"x", "w"}) {
+		t.Errorf("got keys %v, want [x w]", keys)
+	}
+
+	// empty list removes the docID, posting list without docID is gone
+	table.Append(ctx, "x", map[uint32][]float32{docA: nil})
+	if _, err = table.Get(ctx, "x"); err != ErrNotFound {
+		t.Errorf("got error %v, want %v", err, ErrNotFound)
+	}
+
+	// Set replaces the fragments
+	table.Set(ctx, "w", map[uint32][]float32{docB: {1}})
+	if v, _ := table.Get(ctx, "w"); !reflect.DeepEqual(v, map[uint32][]float32{docB: {1}}) {
+		t.Errorf("got %v after Set", v)
+	}
+
+	// fragments are folded once there are enough of them
+	for i := 0; i < compactThreshold; i++ {
+		table.Append(ctx, "y", map[uint32][]float32{docA: {float32(i)}})
+	}
+	if deltas, _ := table.(*BadgerDB).deltaKeys([]byte("y")); len(deltas) != 0 {
+		t.Errorf("got %d fragments after compaction, want 0", len(deltas))
+	}
+	if v, _ := table.Get(ctx, "y"); !reflect.DeepEqual(v, map[uint32][]float32{docA: {compactThreshold - 1}}) {
+		t.Errorf("got %v after compaction", v)
+	}
+
+	if err = table.Append(ctx, "w", "not postings"); err != ErrValTypeNotMatch {
+		t.Errorf("got error %v, want %v", err, ErrValTypeNotMatch)
+	}
+}
+
+func TestUnitOfWorkAppend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	inv, forw, _ := MemoryDB_init(ctx)
+	defer inv[0].Close(ctx, cancel)
+
+	inv[0].Set(ctx, "w", map[uint32][]float32{docA: {1}, docB: {1}})
+
+	uow := NewUnitOfWork()
+	uow.Append(ctx, inv[0], "w", map[uint32][]float32{docA: nil})
+	uow.Append(ctx, inv[0], "w", map[uint32][]float32{docA: {0.5, 2}})
+	uow.Append(ctx, inv[0], "w", map[uint32][]float32{docB: nil})
+	if err := uow.Append(ctx, forw[0], "w", map[uint32][]float32{}); err != ErrAppendNotSupported {
+		t.Errorf("got error %v, want %v", err, ErrAppendNotSupported)
+	}
+
+	want := map[uint32][]float32{docA: {0.5, 2}}
+	if v, err := uow.Get(ctx, inv[0], "w"); err != nil || !reflect.DeepEqual(v, want) {
+		t.Errorf("got %v (%v) before commit, want %v", v, err, want)
+	}
+	if err := uow.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := inv[0].Get(ctx, "w"); err != nil || !reflect.DeepEqual(v, want) {
+		t.Errorf("got %v (%v) after commit, want %v", v, err, want)
+	}
+}
+
+func TestFragmentedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "append")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, _ := logger.New("test", 1)
+	opts := DefaultDBOptions()
+	opts.GCInterval = 0
+	open := func() (*BadgerDB, context.Context, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		table, err := NewBadgerDB(ctx, dir, log, LoadMemoryMap, "string", "postings", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return table.(*BadgerDB), ctx, cancel
+	}
+
+	table, ctx, cancel := open()
+	table.Set(ctx, "set", map[uint32][]float32{docA: {1}})
+	table.Append(ctx, "appended", map[uint32][]float32{docA: {1}})
+	table.Close(ctx, cancel)
+
+	// keys having fragments are found again when the table is opened, the others are not looked up
+	table, ctx, cancel = open()
+	defer table.Close(ctx, cancel)
+	if !table.mayHaveDeltas([]byte("appended")) || table.mayHaveDeltas([]byte("set")) {
+		t.Errorf("keys which may have fragments are %v, want [appended]", table.deltas.keys)
+	}
+	table.Set(ctx, "appended", map[uint32][]float32{docB: {1}})
+	if v, _ := table.Get(ctx, "appended"); !reflect.DeepEqual(v, map[uint32][]float32{docB: {1}}) {
+		t.Errorf("got %v after Set, fragments of the previous run are left", v)
+	}
+}
@@ -0,0 +1,428 @@
+package database
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/apsdehal/go-logger"
+	"github.com/dgraph-io/badger"
+	"github.com/dgraph-io/badger/pb"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+=============================== BACKUP ARCHIVE ==========================================
+	Backup writes every table opened by DB_init, the journal, and the page cache into a single
+	gzipped tar archive:
+		manifest.json		: BackupManifest, always the first entry
+		tables/<table name>	: table content in the format of badger's DB.Backup, loaded back with DB.Load
+		tables/<table name>/shard-<i>	: same for every shard of a posting table, refer to shard.go
+		docs/<docHash>		: page cache of indexer.DocsDir
+	Snapshots of every table are taken while no unit of work is being committed, so that the tables
+	in the archive are consistent with each other. Writes through a BatchWriter are not covered:
+	a batch is written in several transactions, and may be flushed while the snapshots are taken.
+	An archive taken during a ranking update (ranking/) may hold old and new ranks, back up once
+	the update is done. Pages in the cache are copied as they are, the cache may be slightly ahead
+	of the tables.
+*/
+
+const (
+	// bump whenever the layout of the archive changes
+	BackupFormat = 1
+
+	manifestEntry = "manifest.json"
+	tablesEntry   = "tables/"
+	docsEntry     = "docs/"
+
+	// number of key-value pairs per KVList written to the archive
+	backupChunkSize = 1000
+)
+
+var (
+	ErrBackupFormat = errors.New("Archive is not a backup or was created by a newer build")
+
+	ErrRestoreTarget = errors.New("Directory to be restored to already contains an index, restore into an empty directory")
+
+	ErrRestoreDocs = errors.New("Page cache directory to be restored to is not empty, restore into an empty directory or overwrite its pages")
+)
+
+type (
+	BackupManifest struct {
+		Format        int       `json:"Format"`
+		SchemaVersion int       `json:"SchemaVersion"`
+		Created       time.Time `json:"Created"`
+		// number of keys in every table, shards are tables of their own
+		Tables map[string]int `json:"Tables"`
+		// number of shards of each posting table, refer to shard.go
+		Shards int `json:"Shards,omitempty"`
+		// number of pages in the cache when the backup started
+		Docs int `json:"Docs"`
+	}
+
+	// table snapshot dumped to a temporary file, tar needs the size of an entry up front
+	tableDump struct {
+		name string
+		file *os.File
+		keys int
+	}
+)
+
+/*
+Backup writes a consistent snapshot of the tables and the page cache to w, refer to the description above
+tables can be written concurrently while the backup is running, batch writes may be half-included
+\params: context, writer of the archive, tables opened by DB_init (inv and forw), page cache directory
+\return: manifest of the archive, error
+*/
+func Backup(ctx context.Context, w io.Writer, tables []DB, docsDir string) (*BackupManifest, error) {
+	snapshots := make(map[string]*badger.Txn)
+	defer func() {
+		for _, txn := range snapshots {
+			txn.Discard()
+		}
+	}()
+
+	// read transactions of every table are opened between two commits
+	// snapshots are read from the table itself (refer to cache.go), and from every shard (refer to shard.go)
+	var shards int
+	var flat []DB
+	for _, t := range tables {
+		switch t := t.(type) {
+		case *CachedDB:
+			flat = append(flat, t.Unwrap())
+		case *ShardedDB:
+			flat = append(flat, t.shards...)
+			shards = len(t.shards)
+		default:
+			flat = append(flat, t)
+		}
+	}
+
+	commitLock.Lock()
+	var j *journal
+	for _, t := range flat {
+		bdb, ok := t.(*BadgerDB)
+		if !ok {
+			commitLock.Unlock()
+			return nil, ErrTableNotSupported
+		}
+		snapshots[bdb.name] = bdb.db.NewTransaction(false)
+		if bdb.journal != nil {
+			j = bdb.journal
+		}
+	}
+	// commits which failed halfway are still in the journal, and replayed after the restore
+	if j != nil {
+		snapshots[strings.TrimSuffix(journalDir, "/")] = j.db.NewTransaction(false)
+	}
+	commitLock.Unlock()
+
+	manifest := &BackupManifest{
+		Format:        BackupFormat,
+		SchemaVersion: SchemaVersion,
+		Created:       time.Now().UTC(),
+		Tables:        make(map[string]int),
+		Shards:        shards,
+	}
+
+	var dumps []tableDump
+	defer func() {
+		for _, d := range dumps {
+			d.file.Close()
+			os.Remove(d.file.Name())
+		}
+	}()
+	for name, txn := range snapshots {
+		f, err := ioutil.TempFile("", "backup-"+strings.Replace(name, "/", "-", -1)+"-")
+		if err != nil {
+			return nil, err
+		}
+		dumps = append(dumps, tableDump{name: name, file: f})
+
+		if dumps[len(dumps)-1].keys, err = dumpTable(ctx, txn, f); err != nil {
+			return nil, errors.Wrapf(err, "failed to back up table %s", name)
+		}
+		manifest.Tables[name] = dumps[len(dumps)-1].keys
+	}
+
+	docs, err := ioutil.ReadDir(docsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	// manifest comes first so that Restore can refuse an archive before reading all of it
+	for _, d := range docs {
+		if d.Mode().IsRegular() {
+			manifest.Docs++
+		}
+	}
+	content, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	if err = writeEntry(tw, manifestEntry, int64(len(content)), bytes.NewReader(content)); err != nil {
+		return nil, err
+	}
+
+	for _, d := range dumps {
+		info, err := d.file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = d.file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err = writeEntry(tw, tablesEntry+d.name, info.Size(), d.file); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, d := range docs {
+		if !d.Mode().IsRegular() {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		// page may be rewritten by the indexer meanwhile, copy the content read at once
+		content, err := ioutil.ReadFile(filepath.Join(docsDir, d.Name()))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err = writeEntry(tw, docsEntry+d.Name(), int64(len(content)), bytes.NewReader(content)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// dumpTable writes every live key-value pair visible to the transaction as length-prefixed KVLists
+// \return: number of keys written, error
+func dumpTable(ctx context.Context, txn *badger.Txn, w io.Writer) (int, error) {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	keys := 0
+	list := &pb.KVList{}
+	for it.Rewind(); it.Valid(); it.Next() {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		default:
+		}
+
+		item := it.Item()
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return 0, err
+		}
+		list.Kv = append(list.Kv, &pb.KV{
+			Key:       item.KeyCopy(nil),
+			Value:     value,
+			UserMeta:  []byte{item.UserMeta()},
+			Version:   item.Version(),
+			ExpiresAt: item.ExpiresAt(),
+		})
+		keys++
+
+		if len(list.Kv) >= backupChunkSize {
+			if err = writeKVList(w, list); err != nil {
+				return 0, err
+			}
+			list = &pb.KVList{}
+		}
+	}
+
+	if len(list.Kv) > 0 {
+		if err := writeKVList(w, list); err != nil {
+			return 0, err
+		}
+	}
+	return keys, nil
+}
+
+// same framing as badger's DB.Backup, i.e. little-endian uint64 size followed by the protobuf-encoded list
+func writeKVList(w io.Writer, list *pb.KVList) error {
+	buf, err := list.Marshal()
+	if err != nil {
+		return err
+	}
+	if err = binary.Write(w, binary.LittleEndian, uint64(len(buf))); err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+func writeEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+/*
+Restore rebuilds the index of a Backup archive into the data directory of the options
+the directory must not contain an index yet, the tables are closed once restored
+the page cache directory must be empty, unless its pages are to be overwritten by the ones of the archive
+index of an older schema is restored as it is, and migrated when opened with AutoMigrate
+\params: context, logger, reader of the archive, options (Dir is the target), page cache directory, overwrite pages or not
+\return: manifest of the archive, error
+*/
+func Restore(ctx context.Context, logger *logger.Logger, r io.Reader, opts DBOptions, docsDir string, overwrite bool) (*BackupManifest, error) {
+	base_dir := opts.baseDir()
+	if rec, err := readSchema(base_dir); err != nil {
+		return nil, err
+	} else if rec.Version != 0 {
+		return nil, ErrRestoreTarget
+	}
+	if docs, err := ioutil.ReadDir(docsDir); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if len(docs) > 0 && !overwrite {
+		return nil, ErrRestoreDocs
+	}
+
+	// name of every table the archive may contain
+	known := map[string]bool{strings.TrimSuffix(journalDir, "/"): true}
+	for _, v := range append(append([][]string{}, invertedTables...), forwardTables...) {
+		known[strings.TrimSuffix(v[0], "/")] = true
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, ErrBackupFormat
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	var manifest *BackupManifest
+	restored := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		switch {
+		case hdr.Name == manifestEntry:
+			manifest = &BackupManifest{}
+			if err = json.NewDecoder(tr).Decode(manifest); err != nil || manifest.Format != BackupFormat {
+				return nil, ErrBackupFormat
+			}
+			if manifest.SchemaVersion > SchemaVersion {
+				return nil, ErrSchemaTooNew
+			}
+			for _, v := range shardedTables {
+				for i := 0; i < manifest.Shards; i++ {
+					known[v+fmt.Sprintf(shardDirFormat, i)] = true
+				}
+			}
+			// archive of an index keyed by docHash, migrated when opened. Refer to docid.go
+			if manifest.SchemaVersion < docIDVersion {
+				for _, v := range legacyDocTables {
+					known[strings.TrimSuffix(v, "/")] = true
+				}
+			}
+
+		case manifest == nil:
+			return nil, ErrBackupFormat
+
+		case strings.HasPrefix(hdr.Name, tablesEntry):
+			name := strings.TrimPrefix(hdr.Name, tablesEntry)
+			if !known[name] {
+				return nil, errors.Errorf("Archive contains unknown table %s", name)
+			}
+			if err = loadTable(base_dir+name+"/", opts, tr); err != nil {
+				return nil, errors.Wrapf(err, "failed to restore table %s", name)
+			}
+			logger.Infof("Restored table %s, %d keys", name, manifest.Tables[name])
+			restored++
+
+		case strings.HasPrefix(hdr.Name, docsEntry):
+			// base name only, entries must not escape the page cache directory
+			name := filepath.Base(hdr.Name)
+			if err = os.MkdirAll(docsDir, 0755); err != nil {
+				return nil, err
+			}
+			f, err := os.OpenFile(filepath.Join(docsDir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(f, tr)
+			if e := f.Close(); err == nil {
+				err = e
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if manifest == nil || restored != len(manifest.Tables) {
+		return nil, ErrBackupFormat
+	}
+
+	// tables are recorded with the schema they were backed up with, DB_init takes care of the rest
+	if err = writeSchema(base_dir, manifest.SchemaVersion, manifest.Shards); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func loadTable(dir string, opts DBOptions, r io.Reader) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	dbOpts := opts
+	dbOpts.ReadOnly = false
+	db, err := badger.Open(getOpts(opts.loadModeOf(filepath.Base(dir)), dir, dbOpts))
+	if err != nil {
+		return err
+	}
+
+	if err = db.Load(r, 16); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
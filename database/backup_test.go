@@ -0,0 +1,97 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"github.com/apsdehal/go-logger"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, _ := logger.New("test", 1)
+	ctx := context.Background()
+	opts := DefaultDBOptions()
+	opts.Dir, opts.LoadMode, opts.GCInterval = filepath.Join(dir, "index"), LoadMemoryMap, 0
+	docsDir := filepath.Join(dir, "docs")
+	page := filepath.Join(docsDir, DocHash("https://a.com/"))
+
+	// closing the tables cancels the context they have been opened with
+	tablesCtx, cancel := context.WithCancel(ctx)
+	inv, forw, err := DB_init(tablesCtx, log, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uow := NewUnitOfWork()
+	uow.Set(ctx, forw[6], "https://a.com/", docA)
+	uow.Set(ctx, forw[7], docA, "https://a.com/")
+	uow.Append(ctx, inv[1], "w", map[uint32][]float32{docA: {1, 0}})
+	if err = uow.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(docsDir, 0755)
+	ioutil.WriteFile(page, []byte("<html>a</html>"), 0644)
+
+	var archive bytes.Buffer
+	manifest, err := Backup(ctx, &archive, append(inv, forw...), docsDir)
+	for _, d := range append(inv, forw...) {
+		d.Close(ctx, cancel)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Docs != 1 || manifest.Tables["DocID_url"] != 1 {
+		t.Errorf("got manifest %+v, want 1 page and 1 URL", manifest)
+	}
+
+	// neither the index nor its page cache are overwritten
+	if _, err = Restore(ctx, log, bytes.NewReader(archive.Bytes()), opts, filepath.Join(dir, "other"), false); err != ErrRestoreTarget {
+		t.Errorf("got error %v restoring over an index, want %v", err, ErrRestoreTarget)
+	}
+	restored := opts
+	restored.Dir = filepath.Join(dir, "restored")
+	if _, err = Restore(ctx, log, bytes.NewReader(archive.Bytes()), restored, docsDir, false); err != ErrRestoreDocs {
+		t.Errorf("got error %v restoring over a page cache, want %v", err, ErrRestoreDocs)
+	}
+
+	ioutil.WriteFile(page, []byte("<html>changed</html>"), 0644)
+	if _, err = Restore(ctx, log, bytes.NewReader(archive.Bytes()), restored, docsDir, true); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(page); string(content) != "<html>a</html>" {
+		t.Errorf("got page %q, want the one of the archive", content)
+	}
+
+	tablesCtx, cancel = context.WithCancel(ctx)
+	inv, forw, err = DB_init(tablesCtx, log, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, d := range append(inv, forw...) {
+			d.Close(ctx, cancel)
+		}
+	}()
+	for _, c := range []struct {
+		table DB
+		key   interface{}
+		want  interface{}
+	}{
+		{forw[6], "https://a.com/", docA},
+		{forw[7], docA, "https://a.com/"},
+		{inv[1], "w", map[uint32][]float32{docA: {1, 0}}},
+	} {
+		if v, err := c.table.Get(ctx, c.key); err != nil || !reflect.DeepEqual(v, c.want) {
+			t.Errorf("got %v (%v) for %v, want %v", v, err, c.key, c.want)
+		}
+	}
+}
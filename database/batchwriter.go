@@ -20,18 +20,15 @@ type (
 
 	// wrapper around badger WriteBatch to support type checking
 	BadgerBatchWriter struct {
+		table       *BadgerDB
 		batchWriter *badger.WriteBatch
-		keyType     string
-		valType     string
+		keyCodec    Codec
+		valCodec    Codec
 	}
 )
 
 func (bwb *BadgerBatchWriter) Flush(ctx context.Context) error {
-	if err := bwb.batchWriter.Flush(); err != nil {
-		panic(err)
-		return err
-	}
-	return nil
+	return bwb.batchWriter.Flush()
 }
 
 func (bwb *BadgerBatchWriter) Cancel(ctx context.Context) {
@@ -39,11 +36,29 @@ func (bwb *BadgerBatchWriter) Cancel(ctx context.Context) {
 }
 
 func (bwb *BadgerBatchWriter) BatchSet(ctx context.Context, key_ interface{}, value_ interface{}) error {
-	key, value, err := checkMarshal(key_, bwb.keyType, value_, bwb.valType)
+	key, value, err := marshalPair(bwb.keyCodec, key_, bwb.valCodec, value_)
 	if err != nil {
 		return err
 	}
 
+	// fragments appended to the posting list are replaced as well, refer to append.go
+	if bwb.table != nil && bwb.table.mayHaveDeltas(key) {
+		deltas, err := bwb.table.deltaKeys(key)
+		if err != nil {
+			return err
+		}
+		for _, d := range deltas {
+			if err = bwb.batchWriter.Delete(d); err != nil {
+				return err
+			}
+		}
+	}
+
+	// key is added to the Bloom filter of the table before it is written, refer to bloom.go
+	if bwb.table != nil {
+		bwb.table.addKey(key)
+	}
+
 	// pass the key-value pairs in []byte to the batch writer
 	if err = bwb.batchWriter.Set(key, value); err != nil {
 		return err
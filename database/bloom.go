@@ -0,0 +1,252 @@
+package database
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+	"hash/fnv"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+=============================== BLOOM FILTERS ==========================================
+	Most query terms and most words of a document being indexed are looked up in tables which do not
+	have them. The inverted tables and the word table keep a Bloom filter over their keys, so that Get
+	and Has return ErrNotFound and false for such keys without reading the table:
+		- every key written by Set, Append, a batch writer or a unit of work is added, deleted keys stay
+		  in the filter and only cost a read
+		- the filter is written to <table>/bloom.filter on Close. Tables opened for writing load and
+		  remove the file, so that a crash leaves no filter missing the keys written since
+		- without the file, or once the filter holds more keys than it has been sized for, the filter
+		  is rebuilt from the keys of the table
+	Keys of posting list fragments are added as the key of their posting list, refer to append.go
+*/
+
+const (
+	bloomFile = "bloom.filter"
+
+	// ratio of keys not in the table the filter lets through, at the capacity of the filter
+	bloomFalsePositive = 0.01
+
+	// filters are sized for twice the keys of the table, and at least for this number of keys
+	bloomMinCapacity = 1 << 16
+)
+
+var (
+	filteredTables = []string{"invKeyword_title/", "invKeyword_body/", "WordHash_word/"}
+
+	ErrBloomFile = errors.New("Bloom filter file is corrupted, remove it to rebuild the filter from the table")
+)
+
+type (
+	bloomFilter struct {
+		mutex sync.RWMutex
+		bits  []uint64
+		// number of hash functions
+		k uint32
+		// number of keys the filter is sized for, and number of keys added
+		capacity uint64
+		keys     uint64
+	}
+
+	// header of the filter file, followed by the bits
+	bloomHeader struct {
+		K        uint32
+		Capacity uint64
+		Keys     uint64
+		Words    uint64
+	}
+)
+
+// newBloomFilter sizes the filter for bloomFalsePositive at the given number of keys
+func newBloomFilter(capacity uint64) *bloomFilter {
+	m := math.Ceil(-float64(capacity) * math.Log(bloomFalsePositive) / (math.Ln2 * math.Ln2))
+	words := (uint64(m) + 63) / 64
+	k := uint32(math.Round(float64(words*64) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]uint64, words), k: k, capacity: capacity}
+}
+
+// bit positions of the key, derived from two hashes as in Kirsch and Mitzenmacher
+func (f *bloomFilter) positions(key []byte, fn func(word int, mask uint64)) {
+	h := fnv.New128a()
+	h.Write(key)
+	sum := h.Sum(nil)
+	h1, h2 := binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:])
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % m
+		fn(int(bit/64), 1<<(bit%64))
+	}
+}
+
+func (f *bloomFilter) add(key []byte) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	added := false
+	f.positions(key, func(word int, mask uint64) {
+		if f.bits[word]&mask == 0 {
+			f.bits[word] |= mask
+			added = true
+		}
+	})
+	// keys already in the filter do not set any bit, keys are counted only once
+	if added {
+		f.keys++
+	}
+}
+
+func (f *bloomFilter) mayContain(key []byte) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	ok := true
+	f.positions(key, func(word int, mask uint64) {
+		ok = ok && f.bits[word]&mask != 0
+	})
+	return ok
+}
+
+// reset removes every key, the size of the filter is kept
+func (f *bloomFilter) reset() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.bits = make([]uint64, len(f.bits))
+	f.keys = 0
+}
+
+func (f *bloomFilter) full() bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.keys > f.capacity
+}
+
+// save writes the filter under a temporary name first, so that a half-written filter is never loaded
+func (f *bloomFilter) save(path string) error {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	out, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	header := bloomHeader{K: f.k, Capacity: f.capacity, Keys: f.keys, Words: uint64(len(f.bits))}
+	if err = binary.Write(w, binary.LittleEndian, header); err == nil {
+		if err = binary.Write(w, binary.LittleEndian, f.bits); err == nil {
+			err = w.Flush()
+		}
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func loadBloomFilter(path string) (*bloomFilter, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	r := bufio.NewReader(in)
+
+	var header bloomHeader
+	if err = binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, ErrBloomFile
+	}
+	if fi, err := in.Stat(); err != nil {
+		return nil, err
+	} else if header.K == 0 || header.Words == 0 || uint64(fi.Size()) != uint64(binary.Size(header))+header.Words*8 {
+		return nil, ErrBloomFile
+	}
+	f := &bloomFilter{bits: make([]uint64, header.Words), k: header.K, capacity: header.Capacity, keys: header.Keys}
+	if err = binary.Read(r, binary.LittleEndian, f.bits); err != nil {
+		return nil, ErrBloomFile
+	}
+	return f, nil
+}
+
+/*
+openFilter loads the Bloom filter of the table from its directory, or builds it from the keys of the table
+\params: directory of the table, table is opened read-only
+\return: error
+*/
+func (bdb *BadgerDB) openFilter(dir string, readOnly bool) error {
+	path := filepath.Join(dir, bloomFile)
+	f, err := loadBloomFilter(path)
+	if err != nil && !os.IsNotExist(err) {
+		bdb.logger.Warningf("Rebuilding the Bloom filter of %s: %v", bdb.name, err)
+	}
+	if f == nil || f.full() {
+		if f, err = bdb.buildFilter(); err != nil {
+			return err
+		}
+	}
+
+	// filter on disk would miss the keys written from now on if the process crashes
+	if !readOnly {
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		bdb.filterPath = path
+	}
+	bdb.filter = f
+	return nil
+}
+
+// buildFilter adds every key of the table to a new filter, sized after a first pass counting the keys
+func (bdb *BadgerDB) buildFilter() (*bloomFilter, error) {
+	count := uint64(0)
+	if err := bdb.scanKeys(func(k []byte) { count++ }); err != nil {
+		return nil, err
+	}
+	capacity := 2 * count
+	if capacity < bloomMinCapacity {
+		capacity = bloomMinCapacity
+	}
+	f := newBloomFilter(capacity)
+	if err := bdb.scanKeys(f.add); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// scanKeys calls fn on every key of the table without reading the values
+func (bdb *BadgerDB) scanKeys(fn func(k []byte)) error {
+	return bdb.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			k := it.Item().Key()
+			if bdb.appendable() {
+				k = baseKey(k)
+			}
+			fn(k)
+		}
+		return nil
+	})
+}
+
+// mayContain tells whether the key may be in the table, i.e. always for tables without filter
+func (bdb *BadgerDB) mayContain(key []byte) bool {
+	return bdb.filter == nil || bdb.filter.mayContain(key)
+}
+
+func (bdb *BadgerDB) addKey(key []byte) {
+	if bdb.filter != nil {
+		bdb.filter.add(key)
+	}
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"context"
+	"github.com/apsdehal/go-logger"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bloom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, _ := logger.New("test", 1)
+	opts := DefaultDBOptions()
+	opts.Dir, opts.GCInterval = dir, 0
+	filterFile := filepath.Join(dir, "WordHash_word", bloomFile)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tables, err := OpenTables(ctx, log, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables.Words.Put(ctx, hashA, "a")
+	tables.TitlePostings.Append(ctx, hashA, map[uint32][]float32{docB: {1, 2}})
+	if err = tables.Close(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filterFile); err != nil {
+		t.Fatalf("filter not saved on close: %v", err)
+	}
+
+	// filter is loaded from the file, and the file removed until the tables are closed again
+	ctx, cancel = context.WithCancel(context.Background())
+	if tables, err = OpenTables(ctx, log, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filterFile); !os.IsNotExist(err) {
+		t.Errorf("filter file kept while the table is open for writing: %v", err)
+	}
+	for _, table := range []DB{tables.Words.Raw(), tables.TitlePostings.Raw()} {
+		if has, _ := table.Has(ctx, hashA); !has {
+			t.Errorf("key written before close filtered out of %s", table.(*BadgerDB).name)
+		}
+	}
+	bw := tables.Words.Raw().BatchWrite_init(ctx)
+	bw.BatchSet(ctx, hashB, "b")
+	bw.Flush(ctx)
+	if has, _ := tables.Words.Has(ctx, hashB); !has {
+		t.Error("key written by a batch writer filtered out")
+	}
+	tables.Close(ctx, cancel)
+
+	// corrupted file is rebuilt from the keys of the table
+	ioutil.WriteFile(filterFile, []byte("corrupted"), 0644)
+	ctx, cancel = context.WithCancel(context.Background())
+	if tables, err = OpenTables(ctx, log, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer tables.Close(ctx, cancel)
+	for _, wordHash := range []string{hashA, hashB} {
+		if has, _ := tables.Words.Has(ctx, wordHash); !has {
+			t.Errorf("%s missing from the rebuilt filter", wordHash)
+		}
+	}
+
+	missed := 0
+	for i := 0; i < 1000; i++ {
+		if !tables.Words.Raw().(*BadgerDB).mayContain([]byte(hashOf(string(rune(i))))) {
+			missed++
+		}
+	}
+	if missed < 950 {
+		t.Errorf("filter lets %d of 1000 missing keys through", 1000-missed)
+	}
+}
@@ -0,0 +1,300 @@
+package database
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+)
+
+/*
+=============================== CACHE ==========================================
+	CachedDB keeps the values decoded by Get of any DB, so that the documents, words and ranks resolved
+	for every query are not read and decoded again. At most capacity values are kept per table, the least
+	recently used one is evicted first. Keys not found are cached as well.
+	Values are shared by every caller of Get, they must not be modified. DB_init therefore caches the
+	forward tables only if they are opened read-only, refer to DBOptions.CacheSize.
+	Writes going through the CachedDB invalidate the keys written: Set, Delete, Append, the batch
+	writers on Flush and the units of work on commit. Writes to the wrapped DB are not seen.
+*/
+
+var cachedTables = []string{"WordHash_word/", "DocID_docInfo/", "DocID_rank/", "DocID_magnitude/", "DocID_url/"}
+
+type (
+	CachedDB struct {
+		DB
+		name     string
+		keyCodec Codec
+
+		mutex    sync.Mutex
+		capacity int
+		entries  map[string]*list.Element
+		// most recently used first
+		lru *list.List
+		// incremented on every invalidation, so that a value read before a write is not cached after it
+		gen   uint64
+		stats CacheStats
+	}
+
+	cacheEntry struct {
+		key   string
+		value interface{}
+		// key not found in the table
+		missing bool
+	}
+
+	CacheStats struct {
+		Name      string
+		Hits      uint64
+		Misses    uint64
+		Evictions uint64
+		Entries   int
+		Capacity  int
+	}
+
+	// batch writer recording the keys to be invalidated on flush
+	cachedBatchWriter struct {
+		BatchWriter
+		cache *CachedDB
+		keys  []string
+	}
+)
+
+/*
+NewCachedDB wraps the table with a cache of the values it returns
+\params: table, maximum number of values cached
+\return: cached table
+*/
+func NewCachedDB(db DB, capacity int) *CachedDB {
+	c := &CachedDB{
+		DB:       db,
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+	if rt, ok := db.(rawTable); ok {
+		c.name = rt.tableName()
+		c.keyCodec, _ = rt.schema()
+	}
+	return c
+}
+
+// HitRate returns the ratio of Get answered by the cache, 0 if nothing has been looked up
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// CacheStats returns the number of hits, misses and evictions since the table has been opened
+func (c *CachedDB) CacheStats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s := c.stats
+	s.Name, s.Entries, s.Capacity = c.name, c.lru.Len(), c.capacity
+	return s
+}
+
+// Unwrap returns the table being cached
+func (c *CachedDB) Unwrap() DB {
+	return c.DB
+}
+
+// keys are cached in their stored representation, the one a unit of work passes to writeRaw
+func (c *CachedDB) cacheKey(key interface{}) (string, error) {
+	if c.keyCodec == nil {
+		return fmt.Sprint(key), nil
+	}
+	k, _, err := marshalPair(c.keyCodec, key, nil, nil)
+	return string(k), err
+}
+
+func (c *CachedDB) lookup(key string) (*cacheEntry, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.stats.Hits++
+		return el.Value.(*cacheEntry), c.gen
+	}
+	c.stats.Misses++
+	return nil, c.gen
+}
+
+// store caches the entry unless the table has been written since gen
+func (c *CachedDB) store(e *cacheEntry, gen uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if gen != c.gen || c.capacity <= 0 {
+		return
+	}
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+func (c *CachedDB) invalidate(keys ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.gen++
+	for _, k := range keys {
+		if el, ok := c.entries[k]; ok {
+			c.lru.Remove(el)
+			delete(c.entries, k)
+		}
+	}
+}
+
+func (c *CachedDB) purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.gen++
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+func (c *CachedDB) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	k, err := c.cacheKey(key)
+	if err != nil {
+		return nil, err
+	}
+	e, gen := c.lookup(k)
+	if e != nil {
+		if e.missing {
+			return nil, ErrNotFound
+		}
+		return e.value, nil
+	}
+
+	value, err := c.DB.Get(ctx, key)
+	if err == ErrNotFound {
+		c.store(&cacheEntry{key: k, missing: true}, gen)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	c.store(&cacheEntry{key: k, value: value}, gen)
+	return value, nil
+}
+
+func (c *CachedDB) Has(ctx context.Context, key interface{}) (bool, error) {
+	k, err := c.cacheKey(key)
+	if err != nil {
+		return false, err
+	}
+	c.mutex.Lock()
+	el, ok := c.entries[k]
+	c.mutex.Unlock()
+	if ok {
+		return !el.Value.(*cacheEntry).missing, nil
+	}
+	return c.DB.Has(ctx, key)
+}
+
+func (c *CachedDB) Set(ctx context.Context, key interface{}, value interface{}) error {
+	k, err := c.cacheKey(key)
+	if err != nil {
+		return err
+	}
+	defer c.invalidate(k)
+	return c.DB.Set(ctx, key, value)
+}
+
+func (c *CachedDB) Delete(ctx context.Context, key interface{}) error {
+	k, err := c.cacheKey(key)
+	if err != nil {
+		return err
+	}
+	defer c.invalidate(k)
+	return c.DB.Delete(ctx, key)
+}
+
+func (c *CachedDB) Append(ctx context.Context, key interface{}, value interface{}) error {
+	k, err := c.cacheKey(key)
+	if err != nil {
+		return err
+	}
+	defer c.invalidate(k)
+	return c.DB.Append(ctx, key, value)
+}
+
+func (c *CachedDB) DropTable(ctx context.Context) error {
+	defer c.purge()
+	return c.DB.DropTable(ctx)
+}
+
+func (c *CachedDB) Close(ctx context.Context, cancel context.CancelFunc) error {
+	c.purge()
+	return c.DB.Close(ctx, cancel)
+}
+
+func (c *CachedDB) BatchWrite_init(ctx context.Context) BatchWriter {
+	return &cachedBatchWriter{BatchWriter: c.DB.BatchWrite_init(ctx), cache: c}
+}
+
+func (cbw *cachedBatchWriter) BatchSet(ctx context.Context, key interface{}, value interface{}) error {
+	k, err := cbw.cache.cacheKey(key)
+	if err != nil {
+		return err
+	}
+	if err = cbw.BatchWriter.BatchSet(ctx, key, value); err != nil {
+		return err
+	}
+	cbw.keys = append(cbw.keys, k)
+	return nil
+}
+
+func (cbw *cachedBatchWriter) Flush(ctx context.Context) error {
+	defer cbw.cache.invalidate(cbw.keys...)
+	return cbw.BatchWriter.Flush(ctx)
+}
+
+// units of work write through the wrapped table, refer to journal.go
+func (c *CachedDB) tableName() string {
+	return c.name
+}
+
+func (c *CachedDB) schema() (Codec, Codec) {
+	if rt, ok := c.DB.(rawTable); ok {
+		return rt.schema()
+	}
+	return invalidCodec{"", ErrTableNotSupported}, invalidCodec{"", ErrTableNotSupported}
+}
+
+func (c *CachedDB) tableJournal() *journal {
+	if rt, ok := c.DB.(rawTable); ok {
+		return rt.tableJournal()
+	}
+	return nil
+}
+
+func (c *CachedDB) sync() error {
+	rt, ok := c.DB.(rawTable)
+	if !ok {
+		return ErrTableNotSupported
+	}
+	return rt.sync()
+}
+
+func (c *CachedDB) writeRaw(ops []journalOp) error {
+	rt, ok := c.DB.(rawTable)
+	if !ok {
+		return ErrTableNotSupported
+	}
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = string(op.Key)
+	}
+	defer c.invalidate(keys...)
+	return rt.writeRaw(ops)
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCachedDB(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	_, forw, _ := MemoryDB_init(ctx)
+	cache := NewCachedDB(forw[0], 2)
+	defer cache.Close(ctx, cancel)
+
+	cache.Set(ctx, hashA, "a")
+	for i := 0; i < 3; i++ {
+		if v, err := cache.Get(ctx, hashA); err != nil || v != "a" {
+			t.Fatalf("got %v (%v), want a", v, err)
+		}
+	}
+	if _, err := cache.Get(ctx, hashB); err != ErrNotFound {
+		t.Errorf("got error %v, want %v", err, ErrNotFound)
+	}
+	if s := cache.CacheStats(); s.Hits != 2 || s.Misses != 2 || s.Entries != 2 {
+		t.Errorf("got %+v, want 2 hits and 2 misses", s)
+	}
+
+	// every way of writing invalidates the value cached
+	cache.Set(ctx, hashB, "b")
+	if v, _ := cache.Get(ctx, hashB); v != "b" {
+		t.Errorf("got %v after Set, want b", v)
+	}
+	bw := cache.BatchWrite_init(ctx)
+	bw.BatchSet(ctx, hashA, "c")
+	if v, _ := cache.Get(ctx, hashA); v != "a" {
+		t.Errorf("got %v before Flush, want a", v)
+	}
+	if err := bw.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := cache.Get(ctx, hashA); v != "c" {
+		t.Errorf("got %v after Flush, want c", v)
+	}
+	uow := NewUnitOfWork()
+	uow.Delete(ctx, cache, hashA)
+	if err := uow.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := cache.Has(ctx, hashA); has {
+		t.Error("key deleted by a unit of work is still cached")
+	}
+
+	// least recently used value is evicted
+	cache.Get(ctx, hashA)
+	cache.Get(ctx, hashB)
+	cache.Set(ctx, hashOf("c"), "c")
+	cache.Get(ctx, hashOf("c"))
+	if s := cache.CacheStats(); s.Entries != 2 || s.Evictions != 1 {
+		t.Errorf("got %+v, want 2 entries after eviction", s)
+	}
+	if _, err := cache.Get(ctx, hashB); err != nil {
+		t.Errorf("recently used value evicted: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package database
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"reflect"
+	"strconv"
+)
+
+/*
+=============================== CODECS ==========================================
+	Every table converts its keys and values with a Codec, which enforces the schema of the table.
+	Codecs are looked up by the type name used in the table definitions (database.go), the same
+	name is recorded in schema.json. To support a new type, implement Codec and register it in codecs.
+		string			: stored as it is
+		uint32			: 4 bytes big-endian, so that keys sort by value (docIDs)
+		float64			: decimal representation
+		postings		: binary posting list, refer to postings.go
+		DocInfo, CrawlCheckpoint,
+		slices, maps		: JSON
+*/
+
+var ErrInvalidUint32 = errors.New("Invalid uint32, stored value must be 4 bytes long")
+
+// Codec converts the keys or the values of a table between their Go type and their stored representation
+type Codec interface {
+	// name of the type, as used in the table definitions and recorded in schema.json
+	Name() string
+
+	// Encode returns ErrValTypeNotMatch if v is not of the type of the codec
+	Encode(v interface{}) ([]byte, error)
+
+	Decode(b []byte) (interface{}, error)
+}
+
+type (
+	stringCodec struct{}
+
+	uint32Codec struct{}
+
+	float64Codec struct{}
+
+	postingsCodec struct{}
+
+	// JSON representation of any type, values must be of exactly that type
+	jsonCodec struct {
+		name string
+		typ  reflect.Type
+	}
+
+	// codec of an unknown type name, every conversion fails
+	invalidCodec struct {
+		name string
+		err  error
+	}
+)
+
+var codecs = map[string]Codec{
+	"string":               stringCodec{},
+	"uint32":               uint32Codec{},
+	"float64":              float64Codec{},
+	"postings":             postingsCodec{},
+	"[]string":             newJSONCodec("[]string", []string{}),
+	"[]uint32":             newJSONCodec("[]uint32", []uint32{}),
+	"map[string][]float32": newJSONCodec("map[string][]float32", map[string][]float32{}),
+	"map[string][]uint32":  newJSONCodec("map[string][]uint32", map[string][]uint32{}),
+	"map[string]uint32":    newJSONCodec("map[string]uint32", map[string]uint32{}),
+	"map[string]float64":   newJSONCodec("map[string]float64", map[string]float64{}),
+	"DocInfo":              newJSONCodec("DocInfo", DocInfo{}),
+	"CrawlCheckpoint":      newJSONCodec("CrawlCheckpoint", CrawlCheckpoint{}),
+}
+
+func newJSONCodec(name string, sample interface{}) jsonCodec {
+	return jsonCodec{name, reflect.TypeOf(sample)}
+}
+
+// lookupCodec returns the codec registered for the type name, or a codec failing with notFound
+func lookupCodec(name string, notFound error) Codec {
+	if c, ok := codecs[name]; ok {
+		return c
+	}
+	return invalidCodec{name, notFound}
+}
+
+func isPostings(c Codec) bool {
+	_, ok := c.(postingsCodec)
+	return ok
+}
+
+// helper function for type checking and conversion to support schema enforcement
+// nil codec skips the conversion of the corresponding key or value
+// @return array of bytes, error
+func marshalPair(keyCodec Codec, k interface{}, valCodec Codec, v interface{}) (key []byte, val []byte, err error) {
+	if keyCodec != nil {
+		if key, err = keyCodec.Encode(k); err == ErrValTypeNotMatch {
+			return nil, nil, ErrKeyTypeNotMatch
+		} else if err == ErrValTypeNotFound {
+			return nil, nil, ErrKeyTypeNotFound
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// don't need to check the value type if the key does not matched
+	if valCodec != nil {
+		if val, err = valCodec.Encode(v); err != nil {
+			return nil, nil, err
+		}
+	}
+	return key, val, nil
+}
+
+// rangeBound encodes a bound of ScanRange, nil leaves the range unbounded on that side
+func rangeBound(keyCodec Codec, k interface{}) ([]byte, error) {
+	if k == nil {
+		return nil, nil
+	}
+	key, _, err := marshalPair(keyCodec, k, nil, nil)
+	return key, err
+}
+
+func (stringCodec) Name() string { return "string" }
+
+func (stringCodec) Encode(v interface{}) ([]byte, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, ErrValTypeNotMatch
+	}
+	return []byte(s), nil
+}
+
+func (stringCodec) Decode(b []byte) (interface{}, error) {
+	return string(b), nil
+}
+
+func (uint32Codec) Name() string { return "uint32" }
+
+func (uint32Codec) Encode(v interface{}) ([]byte, error) {
+	n, ok := v.(uint32)
+	if !ok {
+		return nil, ErrValTypeNotMatch
+	}
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b, nil
+}
+
+func (uint32Codec) Decode(b []byte) (interface{}, error) {
+	if len(b) != 4 {
+		return nil, ErrInvalidUint32
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func (float64Codec) Name() string { return "float64" }
+
+func (float64Codec) Encode(v interface{}) ([]byte, error) {
+	f, ok := v.(float64)
+	if !ok {
+		return nil, ErrValTypeNotMatch
+	}
+	return []byte(strconv.FormatFloat(f, 'f', -1, 64)), nil
+}
+
+func (float64Codec) Decode(b []byte) (interface{}, error) {
+	return strconv.ParseFloat(string(b), 64)
+}
+
+func (postingsCodec) Name() string { return "postings" }
+
+func (postingsCodec) Encode(v interface{}) ([]byte, error) {
+	p, ok := v.(map[uint32][]float32)
+	if !ok {
+		return nil, ErrValTypeNotMatch
+	}
+	return EncodePostings(p)
+}
+
+func (postingsCodec) Decode(b []byte) (interface{}, error) {
+	return DecodePostings(b)
+}
+
+func (c jsonCodec) Name() string { return c.name }
+
+func (c jsonCodec) Encode(v interface{}) ([]byte, error) {
+	if reflect.TypeOf(v) != c.typ {
+		return nil, ErrValTypeNotMatch
+	}
+	return json.Marshal(v)
+}
+
+func (c jsonCodec) Decode(b []byte) (interface{}, error) {
+	ptr := reflect.New(c.typ)
+	if err := json.Unmarshal(b, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+func (c invalidCodec) Name() string { return c.name }
+
+func (c invalidCodec) Encode(v interface{}) ([]byte, error) {
+	return nil, c.err
+}
+
+func (c invalidCodec) Decode(b []byte) (interface{}, error) {
+	return nil, c.err
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"context"
+	"github.com/apsdehal/go-logger"
+	"os"
+	"time"
+)
+
+/*
+=============================== CRAWL CHECKPOINT ==========================================
+	The crawler checkpoints its frontier in the Crawl_frontier table of the data directory, so that a
+	crashed or interrupted crawl can be resumed (cmd/crawl -resume). The table is not part of the
+	index: it is not recorded in schema.json, and is left out of backups and published copies.
+	It holds a single CrawlCheckpoint, overwritten by every checkpoint, so that a checkpoint is
+	never half-written. Refer to crawler/frontier.go for the levels and the URLs seen.
+*/
+
+const (
+	crawlFrontierDir = "Crawl_frontier/"
+
+	// key of the latest checkpoint
+	crawlCheckpointKey = "checkpoint"
+)
+
+type (
+	// CrawlEdge is a link left to be crawled, with the page it was found on
+	CrawlEdge struct {
+		Parent string
+		URL    string
+		// fetches answered with 429 or 503 so far
+		Attempts int
+	}
+
+	// CrawlCheckpoint is the state of a crawl when checkpointed
+	CrawlCheckpoint struct {
+		Saved    time.Time
+		StartURL string
+		Depth    int
+		// pages handed out to be crawled, and pages failing, which are replaced by other pages
+		Visited  int
+		Replaced int
+		// URLs dropped as disallowed by robots.txt
+		Disallowed int64
+		// URLs of the current depth not crawled yet, and URLs of the next depth
+		Current []CrawlEdge
+		Next    []CrawlEdge
+		// md5 in hex of every URL seen by the frontier, crawled, queued or dropped
+		Seen []string
+	}
+
+	// CrawlFrontierTable holds the checkpoint of the crawl, "checkpoint" -> CrawlCheckpoint
+	CrawlFrontierTable struct {
+		table
+		// stops the value log GC of the table
+		cancel context.CancelFunc
+	}
+)
+
+/*
+OpenCrawlFrontier opens the checkpoint table of the data directory, created if it does not exist
+\params: context, logger, options of the index
+\return: checkpoint table, to be closed by the caller, error
+*/
+func OpenCrawlFrontier(ctx context.Context, logger *logger.Logger, opts DBOptions) (CrawlFrontierTable, error) {
+	dir := opts.baseDir() + crawlFrontierDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return CrawlFrontierTable{}, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	db, err := NewBadgerDB(ctx, dir, logger, opts.loadModeOf(crawlFrontierDir), "string", "CrawlCheckpoint", opts)
+	if err != nil {
+		cancel()
+	}
+	return CrawlFrontierTable{table{db}, cancel}, err
+}
+
+// Load returns the latest checkpoint, ErrNotFound if the crawl has never been checkpointed
+func (t CrawlFrontierTable) Load(ctx context.Context) (*CrawlCheckpoint, error) {
+	v, err := t.db.Get(ctx, crawlCheckpointKey)
+	if err != nil {
+		return nil, err
+	}
+	cp, ok := v.(CrawlCheckpoint)
+	if !ok {
+		return nil, ErrValTypeNotMatch
+	}
+	return &cp, nil
+}
+
+// Save replaces the latest checkpoint, stamping the time it is saved
+func (t CrawlFrontierTable) Save(ctx context.Context, cp *CrawlCheckpoint) error {
+	cp.Saved = time.Now().UTC()
+	return t.db.Set(ctx, crawlCheckpointKey, *cp)
+}
+
+// Close closes the table, the context it has been opened with is left running
+func (t CrawlFrontierTable) Close(ctx context.Context) error {
+	return t.db.Close(ctx, t.cancel)
+}
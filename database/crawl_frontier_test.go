@@ -0,0 +1,63 @@
+package database
+
+import (
+	"context"
+	"github.com/apsdehal/go-logger"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCrawlFrontier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "frontier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, _ := logger.New("test", 1)
+	opts := DefaultDBOptions()
+	opts.Dir, opts.GCInterval = filepath.Join(dir, "staging"), 0
+	ctx := context.Background()
+
+	frontier, err := OpenCrawlFrontier(ctx, log, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = frontier.Load(ctx); err != ErrNotFound {
+		t.Errorf("got error %v loading an empty table, want %v", err, ErrNotFound)
+	}
+	cp := &CrawlCheckpoint{
+		StartURL: "https://a.com/",
+		Depth:    2,
+		Visited:  10,
+		Current:  []CrawlEdge{{Parent: "https://a.com/", URL: "https://a.com/b", Attempts: 1}},
+		Next:     []CrawlEdge{{Parent: "https://a.com/b", URL: "https://a.com/c"}},
+		Seen:     []string{DocHash("https://a.com/"), DocHash("https://a.com/b"), DocHash("https://a.com/c")},
+	}
+	if err = frontier.Save(ctx, cp); err != nil {
+		t.Fatal(err)
+	}
+	if err = frontier.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// checkpoint survives the crawler, but is not published with the index
+	if frontier, err = OpenCrawlFrontier(ctx, log, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer frontier.Close(ctx)
+	if got, err := frontier.Load(ctx); err != nil || !reflect.DeepEqual(got, cp) {
+		t.Errorf("got checkpoint %+v (%v), want %+v", got, err, cp)
+	}
+
+	published, err := Publish(opts.Dir, "", filepath.Join(dir, "served"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(published, crawlFrontierDir)); !os.IsNotExist(err) {
+		t.Errorf("checkpoint published with the index: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -8,22 +9,15 @@ import (
 	"github.com/dgraph-io/badger"
 	"github.com/dgraph-io/badger/options"
 	bpb "github.com/dgraph-io/badger/pb"
-	"github.com/eapache/channels"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 )
 
-const (
-	// Default values are used. For garbage-collection purposes
-	// TODO: to be fine-tuned
-	badgerDiscardRatio = 0.5
-	badgerGCInterval   = 2 * time.Hour
-)
-
 var (
 	// BadgerAlertNamespace defines the alerts BadgerDB namespace
 	BadgerAlertNamespace = []byte("alerts")
@@ -35,31 +29,69 @@ var (
 	ErrKeyTypeNotFound = errors.New("Key type not found, double check the type variable passed")
 
 	ErrValTypeNotFound = errors.New("Value type not found, double check the type variable passed")
+
+	// ErrNotFound is returned by Get when the key does not exist in the table, for every implementation of DB
+	// errors.Cause of it is badger.ErrKeyNotFound
+	ErrNotFound = errors.Wrap(badger.ErrKeyNotFound, "Key not found in the table")
+
+	// ErrStopScan can be returned by a ScanFunc to end the scan early without an error
+	ErrStopScan = errors.New("Scan stopped by the callback")
+)
+
+var (
+	// directory of table is mapped to the key data type and value data type. Data type is stored to support schema enforcement
+	invertedTables = [][]string{
+		[]string{"invKeyword_title/", "string", "postings"},
+		[]string{"invKeyword_body/", "string", "postings"},
+		[]string{"invTopic_PR/", "string", "map[string]uint32"},
+	}
+
+	forwardTables = [][]string{
+		[]string{"WordHash_word/", "string", "string"},
+		[]string{"DocID_docInfo/", "uint32", "DocInfo"},
+		[]string{"DocID_children/", "uint32", "[]uint32"},
+		[]string{"DocID_rank/", "uint32", "map[string]float64"},
+		[]string{"DocID_magnitude/", "uint32", "map[string]float64"},
+		[]string{"Topic_metadata/", "string", "map[string]float64"},
+		[]string{"URL_docID/", "string", "uint32"},
+		[]string{"DocID_url/", "uint32", "string"},
+	}
 )
 
 type (
 	// TODO: add logger debug in each function
 	DB interface {
-		// TODO: integrate prefix search
-		// return nil if key not found
+		// return ErrNotFound if key not found
 		Get(ctx context.Context, key interface{}) (value interface{}, err error)
 
 		Set(ctx context.Context, key interface{}, value interface{}) error
 
-		// return nil if key not found
+		// return false if key not found
 		Has(ctx context.Context, key interface{}) (bool, error)
 
 		// delete an key-value pair in the table, given the key
 		Delete(ctx context.Context, key interface{}) error
 
+		// add postings to the posting list of the key without reading it, refer to append.go
+		// only supported by tables of posting lists, ErrAppendNotSupported otherwise
+		Append(ctx context.Context, key interface{}, value interface{}) error
+
 		// will call cancel which aborts all process running on the ctx
 		Close(ctx context.Context, cancel context.CancelFunc) error
 
 		// DropTable will remove all data in a table (directory)
 		DropTable(ctx context.Context) error
 
-		// data is in random , due to concurrency
-		Iterate(ctx context.Context) (*Collector, error)
+		// call fn on every key-value pair of the table, one pair at a time
+		// data is in random order, due to concurrency. Iteration stops when ctx is done
+		Iterate(ctx context.Context, fn ScanFunc) error
+
+		// call fn on each key-value pair whose key starts with prefix, in key order
+		ScanPrefix(ctx context.Context, prefix interface{}, fn ScanFunc, opt ScanOptions) error
+
+		// call fn on each key-value pair with start <= key < end, in key order
+		// empty or nil start or end leaves the range unbounded on that side, tables keyed by docID take nil
+		ScanRange(ctx context.Context, start interface{}, end interface{}, fn ScanFunc, opt ScanOptions) error
 
 		// initialise BadgerWriteBatch object for the corresponding table
 		BatchWrite_init(ctx context.Context) BatchWriter
@@ -67,6 +99,9 @@ type (
 		// ONLY USE FOR DEBUGGING PURPOSES
 		Debug_Print(ctx context.Context) error
 
+		// number of keys and size of the table, refer to inspect.go
+		Stats(ctx context.Context) (TableStats, error)
+
 		// db iterate for server
 		IterateInv(ctx context.Context, pre string, frw0 DB) ([]string, error)
 
@@ -74,100 +109,187 @@ type (
 		Iterate_QuickFix(ctx context.Context) (map[string]map[string]float64, error)
 	}
 
+	// ScanFunc receives the decoded key and value of each pair visited by a scan
+	// return ErrStopScan to end the scan early, any other error aborts the scan and is returned
+	ScanFunc func(key interface{}, value interface{}) error
+
+	ScanOptions struct {
+		// maximum number of key-value pairs passed to the ScanFunc, 0 means no limit
+		Limit int
+		// iterate in descending key order
+		Reverse bool
+	}
+
 	BadgerDB struct {
-		db      *badger.DB
-		logger  *logger.Logger
-		keyType string
-		valType string
+		db       *badger.DB
+		logger   *logger.Logger
+		name     string
+		keyCodec Codec
+		valCodec Codec
+		journal  *journal
+
+		// sequence and number of the fragments appended, refer to append.go
+		deltaSeq uint64
+		deltas   deltaCounter
+
+		gcInterval     time.Duration
+		gcDiscardRatio float64
+
+		// Bloom filter over the keys, and the file it is written to on Close. Refer to bloom.go
+		filter     *bloomFilter
+		filterPath string
 	}
 )
 
 /*
 	object passed on DB_init should be used as global variable, only call DB_init once (operation on database object can be concurrent)
-refer to `noschema_schema.go` for each table's key and value data types
-	\params: context, logger
+refer to `noschema_schema.go` for each table's key and value data types, use OpenTables for typed handles (tables.go)
+	\params: context, logger, options (use DefaultDBOptions for ./db_data/)
 	\return: list of inverted tables, list of forward tables (type: []DB), error
 		inv[0]: inverted table for keywords in title section
 		inv[1]: inverted table for keywords in body section
 		inv[2]: inverted table for keywords on each category in topic-sensitive pageRank
 		forw[0]: forward table for wordHash (wordId) to word mapping
-		forw[1]: forward table for docHash (docId) to DocInfo mapping
-		forw[2]: forward table for docHash to list of its child
-		forw[3]: forward table for docHash to pageRank value
-		forw[4]: forward table for docHash to its page magnitude for vector space model calculation
+		forw[1]: forward table for docID to DocInfo mapping
+		forw[2]: forward table for docID to list of its child
+		forw[3]: forward table for docID to pageRank value
+		forw[4]: forward table for docID to its page magnitude for vector space model calculation
 		forw[5]: forward table for universal damping vector for each category in topic-sensitive pageRank
+		forw[6]: forward table for URL to docID mapping, refer to docid.go
+		forw[7]: forward table for docID to URL mapping
 */
 
-func DB_init(ctx context.Context, logger *logger.Logger) (inv []DB, forw []DB, err error) {
-	base_dir := "./db_data/"
-
-	// table loading mode
-	// default is MemoryMap, 1 is LoadToRAM (most optimised), 2 is FileIO (all disk)
-	loadMode := 1
-
-	// directory of table is mapped to the configurations (table loading mode, key data type, and value data type). Data type is stored to support schema enforcement
-	inverted := [][]string{
-		[]string{"invKeyword_title/", strconv.Itoa(loadMode), "string", "map[string][]float32"},
-		[]string{"invKeyword_body/", strconv.Itoa(loadMode), "string", "map[string][]float32"},
-		[]string{"invTopic_PR/", strconv.Itoa(loadMode), "string", "map[string]uint32"},
+func DB_init(ctx context.Context, logger *logger.Logger, opts DBOptions) (inv []DB, forw []DB, err error) {
+	base_dir := opts.baseDir()
+	if err = opts.validate(); err != nil {
+		return nil, nil, err
 	}
 
-	forward := [][]string{
-		[]string{"WordHash_word/", strconv.Itoa(loadMode), "string", "string"},
-		[]string{"DocHash_docInfo/", strconv.Itoa(loadMode), "string", "DocInfo"},
-		[]string{"DocHash_children/", strconv.Itoa(loadMode), "string", "[]string"},
-		[]string{"DocHash_rank/", strconv.Itoa(loadMode), "string", "map[string]float64"},
-		[]string{"DocHash_magnitude/", strconv.Itoa(loadMode), "string", "map[string]float64"},
-		[]string{"Topic_metadata/", strconv.Itoa(loadMode), "string", "map[string]float64"},
+	// refuse index built with another schema, unless it can be migrated. Refer to schema_version.go
+	version, shards, err := checkSchema(base_dir, opts)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// create directory if not exist
-	for _, d := range inverted {
-		if _, err := os.Stat(base_dir + d[0]); os.IsNotExist(err) {
-			os.MkdirAll(base_dir+d[0], 0755)
+	// create directory if not exist, tables opened as read-only have to exist already
+	if !opts.ReadOnly {
+		for _, d := range invertedTables {
+			if _, err := os.Stat(base_dir + d[0]); os.IsNotExist(err) {
+				os.MkdirAll(base_dir+d[0], 0755)
+			}
 		}
-	}
 
-	for _, d := range forward {
-		if _, err := os.Stat(base_dir + d[0]); os.IsNotExist(err) {
-			os.MkdirAll(base_dir+d[0], 0755)
+		for _, d := range forwardTables {
+			if _, err := os.Stat(base_dir + d[0]); os.IsNotExist(err) {
+				os.MkdirAll(base_dir+d[0], 0755)
+			}
 		}
 	}
 
-	// initiate table object
-	for _, v := range inverted {
-		// get the table loading method first
-		tempMethod, err := strconv.Atoi(v[1])
-		if err != nil {
+	// journal shared by every table for atomic commits across tables, refer to journal.go
+	// read-only tables are never written, hence no journal
+	var j *journal
+	if !opts.ReadOnly {
+		if j, err = openJournal(base_dir+journalDir, logger); err != nil {
 			return nil, nil, err
 		}
+	}
 
-		temp, err := NewBadgerDB(ctx, base_dir+v[0], logger, tempMethod, v[2], v[3], base_dir)
+	// initiate table object, posting tables may be split into shards. Refer to shard.go
+	for _, v := range invertedTables {
+		var temp DB
+		if shards > 1 && isSharded(v[0]) {
+			temp, err = openShards(ctx, base_dir+v[0], logger, v, shards, opts)
+		} else {
+			temp, err = NewBadgerDB(ctx, base_dir+v[0], logger, opts.loadModeOf(v[0]), v[1], v[2], opts)
+		}
 		if err != nil {
 			return nil, nil, err
 		}
 		inv = append(inv, temp)
 	}
 
-	for _, v := range forward {
-		// get the table loading method first
-		tempMethod, err := strconv.Atoi(v[1])
+	for _, v := range forwardTables {
+		temp, err := NewBadgerDB(ctx, base_dir+v[0], logger, opts.loadModeOf(v[0]), v[1], v[2], opts)
 		if err != nil {
 			return nil, nil, err
 		}
+		forw = append(forw, temp)
+	}
 
-		temp, err := NewBadgerDB(ctx, base_dir+v[0], logger, tempMethod, v[2], v[3], base_dir)
+	// filters are loaded before the journal is replayed, so that the keys replayed are added
+	// shards are named after their directory, e.g. invKeyword_title/shard-00
+	all := append(append([]DB{}, inv...), forw...)
+	for _, bdb := range badgerTables(all) {
+		for _, v := range filteredTables {
+			if strings.HasPrefix(bdb.name+"/", v) {
+				if err = bdb.openFilter(base_dir+bdb.name+"/", opts.ReadOnly); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	if j != nil {
+		for _, bdb := range badgerTables(all) {
+			bdb.journal = j
+			j.acquire()
+		}
+		tables := make(map[string]rawTable)
+		for _, t := range all {
+			rt := t.(rawTable)
+			tables[rt.tableName()] = rt
+		}
+		j.tables = tables
+
+		// commits of an index keyed by docHash name tables which no longer exist, refer to docid.go
+		if version != 0 && version < docIDVersion {
+			empty, err := j.empty()
+			if err != nil {
+				return nil, nil, err
+			}
+			if !empty {
+				return nil, nil, ErrJournalLegacy
+			}
+		}
+
+		// replay the commits interrupted by a crash
+		replayed, err := j.replay(tables)
 		if err != nil {
 			return nil, nil, err
 		}
-		forw = append(forw, temp)
+		if replayed > 0 {
+			logger.Infof("Replayed %d interrupted commits from the journal", replayed)
+		}
+	}
+
+	if version != 0 && version < SchemaVersion {
+		if err = runMigrations(ctx, logger, version, opts, inv, forw); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !opts.ReadOnly && version != SchemaVersion {
+		if err = writeSchema(base_dir, SchemaVersion, shards); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// values cached are shared by every reader, hence only for tables never written. Refer to cache.go
+	if opts.ReadOnly && opts.CacheSize > 0 {
+		for i, v := range forwardTables {
+			for _, c := range cachedTables {
+				if v[0] == c {
+					forw[i] = NewCachedDB(forw[i], opts.CacheSize)
+				}
+			}
+		}
 	}
 
 	return inv, forw, nil
 }
 
-func NewBadgerDB(ctx context.Context, dir string, logger *logger.Logger, loadMethod int, keyType string, valType string, path string) (DB, error) {
-	opts := getOpts(loadMethod, dir)
+func NewBadgerDB(ctx context.Context, dir string, logger *logger.Logger, loadMethod int, keyType string, valType string, dbOpts DBOptions) (DB, error) {
+	opts := getOpts(loadMethod, dir, dbOpts)
 
 	badgerDB, err := badger.Open(opts)
 	if err != nil {
@@ -175,30 +297,44 @@ func NewBadgerDB(ctx context.Context, dir string, logger *logger.Logger, loadMet
 	}
 
 	bdb := &BadgerDB{
-		db:      badgerDB,
-		logger:  logger,
-		keyType: keyType,
-		valType: valType,
+		db:             badgerDB,
+		logger:         logger,
+		name:           filepath.Base(dir),
+		keyCodec:       lookupCodec(keyType, ErrKeyTypeNotFound),
+		valCodec:       lookupCodec(valType, ErrValTypeNotFound),
+		gcInterval:     dbOpts.GCInterval,
+		gcDiscardRatio: dbOpts.GCDiscardRatio,
 	}
 
-	// run garbage collection in advance
-	go bdb.runGC(ctx)
+	// fragments are only dropped by writes, refer to append.go
+	if !dbOpts.ReadOnly && bdb.appendable() {
+		if err = bdb.loadFragmented(); err != nil {
+			badgerDB.Close()
+			return nil, err
+		}
+	}
+
+	// run garbage collection in advance, value log cannot be rewritten in read-only mode
+	if !dbOpts.ReadOnly && dbOpts.GCInterval > 0 {
+		go bdb.runGC(ctx)
+	}
 	return bdb, nil
 }
 
 // helper function for ease of DB configurations tuning
-func getOpts(loadMethod int, dir string) (opts badger.Options) {
+func getOpts(loadMethod int, dir string, dbOpts DBOptions) (opts badger.Options) {
 	opts = badger.DefaultOptions(dir)
 	opts.Dir, opts.ValueDir = dir, dir
 
 	// if false, SyncWrites write into tables in RAM, write to disk when full. Increase performance but may cause loss of data
-	opts.SyncWrites = false
+	opts.SyncWrites = dbOpts.SyncWrites
+	opts.ReadOnly = dbOpts.ReadOnly
 
 	// loadMethod: default is MemoryMap, 1 for loading to memory (LoadToRAM), 2 for storing all into disk (FileIO) which resulted in extensive disk IO
 	switch loadMethod {
-	case 1:
+	case LoadToRAM:
 		opts.TableLoadingMode = options.LoadToRAM
-	case 2:
+	case LoadFileIO:
 		opts.TableLoadingMode, opts.ValueLogLoadingMode = options.FileIO, options.FileIO
 	}
 	return opts
@@ -206,25 +342,47 @@ func getOpts(loadMethod int, dir string) (opts badger.Options) {
 
 func (bdb *BadgerDB) BatchWrite_init(ctx context.Context) BatchWriter {
 	bwb := &BadgerBatchWriter{
+		table:       bdb,
 		batchWriter: bdb.db.NewWriteBatch(),
-		keyType:     bdb.keyType,
-		valType:     bdb.valType,
+		keyCodec:    bdb.keyCodec,
+		valCodec:    bdb.valCodec,
 	}
 
 	return bwb
 }
 
 func (bdb *BadgerDB) DropTable(ctx context.Context) error {
+	if bdb.filter != nil {
+		bdb.filter.reset()
+	}
 	return bdb.db.DropAll()
 }
 
 func (bdb *BadgerDB) Get(ctx context.Context, key_ interface{}) (value_ interface{}, err error) {
 	// key and value has type of []byte, for the passing to transactions
 	var value []byte
-	key, _, err := checkMarshal(key_, bdb.keyType, nil, "")
+	key, _, err := marshalPair(bdb.keyCodec, key_, nil, nil)
 	if err != nil {
 		return nil, err
 	}
+	if !bdb.mayContain(key) {
+		return nil, ErrNotFound
+	}
+
+	// posting lists are folded with their fragments, refer to append.go
+	if bdb.appendable() {
+		var postings map[uint32][]float32
+		err = bdb.db.View(func(txn *badger.Txn) (err error) {
+			postings, _, err = readFolded(txn, key)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		} else if postings == nil {
+			return nil, ErrNotFound
+		}
+		return postings, nil
+	}
 
 	err = bdb.db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(key)
@@ -245,11 +403,13 @@ func (bdb *BadgerDB) Get(ctx context.Context, key_ interface{}) (value_ interfac
 		return nil
 	})
 
-	if err != nil {
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
 		return nil, err
 	}
 
-	value_, err = checkUnmarshal(value, bdb.valType)
+	value_, err = bdb.valCodec.Decode(value)
 	if err != nil {
 		return nil, err
 	}
@@ -258,12 +418,26 @@ func (bdb *BadgerDB) Get(ctx context.Context, key_ interface{}) (value_ interfac
 }
 
 func (bdb *BadgerDB) Set(ctx context.Context, key_ interface{}, value_ interface{}) error {
-	key, value, err := checkMarshal(key_, bdb.keyType, value_, bdb.valType)
+	key, value, err := marshalPair(bdb.keyCodec, key_, bdb.valCodec, value_)
 	if err != nil {
 		return err
 	}
 
+	// fragments appended to the posting list are replaced as well
+	var deltas [][]byte
+	if bdb.mayHaveDeltas(key) {
+		if deltas, err = bdb.deltaKeys(key); err != nil {
+			return err
+		}
+	}
+
+	bdb.addKey(key)
 	err = bdb.db.Update(func(txn *badger.Txn) error {
+		for _, d := range deltas {
+			if err := txn.Delete(d); err != nil {
+				return err
+			}
+		}
 		return txn.Set(key, value)
 	})
 
@@ -275,14 +449,14 @@ func (bdb *BadgerDB) Set(ctx context.Context, key_ interface{}, value_ interface
 }
 
 func (bdb *BadgerDB) Has(ctx context.Context, key_ interface{}) (ok bool, err error) {
-	_, _, err = checkMarshal(key_, bdb.keyType, nil, "")
+	_, _, err = marshalPair(bdb.keyCodec, key_, nil, nil)
 	if err != nil {
 		return false, err
 	}
 
 	_, err = bdb.Get(ctx, key_)
 	switch err {
-	case badger.ErrKeyNotFound:
+	case ErrNotFound:
 		return false, nil
 	case nil:
 		return true, nil
@@ -291,12 +465,24 @@ func (bdb *BadgerDB) Has(ctx context.Context, key_ interface{}) (ok bool, err er
 }
 
 func (bdb *BadgerDB) Delete(ctx context.Context, key_ interface{}) error {
-	key, _, err := checkMarshal(key_, bdb.keyType, nil, "")
+	key, _, err := marshalPair(bdb.keyCodec, key_, nil, nil)
 	if err != nil {
 		return err
 	}
 
+	var deltas [][]byte
+	if bdb.mayHaveDeltas(key) {
+		if deltas, err = bdb.deltaKeys(key); err != nil {
+			return err
+		}
+	}
+
 	err = bdb.db.Update(func(txn *badger.Txn) error {
+		for _, d := range deltas {
+			if err := txn.Delete(d); err != nil {
+				return err
+			}
+		}
 		err := txn.Delete(key)
 		if err != nil {
 			bdb.logger.Debugf("Failed to delete key: %v")
@@ -309,15 +495,90 @@ func (bdb *BadgerDB) Delete(ctx context.Context, key_ interface{}) error {
 
 func (bdb *BadgerDB) Close(ctx context.Context, cancel context.CancelFunc) error {
 	cancel()
-	return bdb.db.Close()
+	if bdb.filterPath != "" {
+		if err := bdb.filter.save(bdb.filterPath); err != nil {
+			bdb.logger.Warningf("Failed to save the Bloom filter of %s, rebuilt on next open: %v", bdb.name, err)
+		}
+	}
+	if err := bdb.db.Close(); err != nil {
+		return err
+	}
+	if bdb.journal != nil {
+		return bdb.journal.release()
+	}
+	return nil
+}
+
+func (bdb *BadgerDB) tableName() string {
+	return bdb.name
+}
+
+func (bdb *BadgerDB) schema() (Codec, Codec) {
+	return bdb.keyCodec, bdb.valCodec
+}
+
+func (bdb *BadgerDB) tableJournal() *journal {
+	return bdb.journal
+}
+
+func (bdb *BadgerDB) sync() error {
+	return bdb.db.Sync()
+}
+
+func (bdb *BadgerDB) writeRaw(ops []journalOp) error {
+	wb := bdb.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	var appended [][]byte
+	for _, op := range ops {
+		var err error
+		if !op.Delete {
+			bdb.addKey(op.Key)
+		}
+		if op.Append {
+			bdb.fragmented(op.Key)
+			err = wb.Set(bdb.nextDeltaKey(op.Key), op.Value)
+			appended = append(appended, op.Key)
+		} else if bdb.mayHaveDeltas(op.Key) {
+			// fragments are dropped by Set and Delete
+			var deltas [][]byte
+			if deltas, err = bdb.deltaKeys(op.Key); err != nil {
+				return err
+			}
+			for _, d := range deltas {
+				if err = wb.Delete(d); err != nil {
+					return err
+				}
+			}
+		}
+		if err == nil && op.Delete {
+			err = wb.Delete(op.Key)
+		} else if err == nil && !op.Append {
+			err = wb.Set(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	for _, k := range appended {
+		if err := bdb.appended(k); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (bdb *BadgerDB) runGC(ctx context.Context) {
-	ticker := time.NewTicker(badgerGCInterval)
+	ticker := time.NewTicker(bdb.gcInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			err := bdb.db.RunValueLogGC(badgerDiscardRatio)
+			err := bdb.db.RunValueLogGC(bdb.gcDiscardRatio)
 			if err != nil {
 				if err == badger.ErrNoRewrite {
 					bdb.logger.Debugf("No BadgerDB GC occured: %v", err)
@@ -331,30 +592,204 @@ func (bdb *BadgerDB) runGC(ctx context.Context) {
 	}
 }
 
-type Collector struct {
-	KV []*bpb.KV
+func (bdb *BadgerDB) ScanPrefix(ctx context.Context, prefix_ interface{}, fn ScanFunc, opt ScanOptions) error {
+	prefix, _, err := marshalPair(bdb.keyCodec, prefix_, nil, nil)
+	if err != nil {
+		return err
+	}
+	return bdb.scan(ctx, prefix, nil, nil, fn, opt)
+}
+
+func (bdb *BadgerDB) ScanRange(ctx context.Context, start_ interface{}, end_ interface{}, fn ScanFunc, opt ScanOptions) error {
+	start, err := rangeBound(bdb.keyCodec, start_)
+	if err != nil {
+		return err
+	}
+	end, err := rangeBound(bdb.keyCodec, end_)
+	if err != nil {
+		return err
+	}
+	return bdb.scan(ctx, nil, start, end, fn, opt)
+}
+
+// scan walks the keys having the given prefix and lying in [start, end) using badger iterator
+// nil prefix, start, or end means no restriction
+func (bdb *BadgerDB) scan(ctx context.Context, prefix []byte, start []byte, end []byte, fn ScanFunc, opt ScanOptions) error {
+	count := 0
+	emit := func(k []byte, value interface{}) error {
+		key, err := bdb.keyCodec.Decode(k)
+		if err != nil {
+			return err
+		}
+		if err = fn(key, value); err != nil {
+			return err
+		}
+		count++
+		if opt.Limit > 0 && count >= opt.Limit {
+			return ErrStopScan
+		}
+		return nil
+	}
+
+	// posting list and its fragments are adjacent, they are folded before being passed to fn
+	var group *scanGroup
+	emitGroup := func() error {
+		if group == nil {
+			return nil
+		}
+		postings, err := group.fold()
+		k := group.key
+		group = nil
+		if err != nil || postings == nil {
+			return err
+		}
+		return emit(k, postings)
+	}
+
+	err := bdb.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = opt.Reverse
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// in reverse mode, seek lands on the largest key less than or equal to the seek key
+		// nil seek key rewinds to the last key
+		var seekKey []byte
+		switch {
+		case !opt.Reverse && len(start) > 0 && bytes.Compare(start, prefix) > 0:
+			seekKey = start
+		case !opt.Reverse:
+			seekKey = prefix
+		case len(end) > 0:
+			seekKey = end
+		case len(prefix) > 0:
+			seekKey = prefixEnd(prefix)
+		}
+
+		it.Seek(seekKey)
+		if opt.Reverse && len(seekKey) > 0 && it.Valid() && bytes.Equal(it.Item().Key(), seekKey) {
+			// the seek key itself is past the keys scanned
+			it.Next()
+		}
+		for ; it.ValidForPrefix(prefix); it.Next() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			item := it.Item()
+			k := item.Key()
+			if bdb.appendable() {
+				k = baseKey(k)
+			}
+			if len(end) > 0 && bytes.Compare(k, end) >= 0 {
+				if opt.Reverse {
+					continue
+				}
+				break
+			}
+			if len(start) > 0 && bytes.Compare(k, start) < 0 {
+				if opt.Reverse {
+					break
+				}
+				continue
+			}
+
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			if bdb.appendable() {
+				if group != nil && !bytes.Equal(group.key, k) {
+					if err = emitGroup(); err != nil {
+						return err
+					}
+				}
+				if group == nil {
+					group = &scanGroup{key: append([]byte{}, k...), values: make(map[string][]byte)}
+				}
+				group.add(item.KeyCopy(nil), v)
+				continue
+			}
+
+			value, err := bdb.valCodec.Decode(v)
+			if err != nil {
+				return err
+			}
+			if err = emit(item.KeyCopy(nil), value); err != nil {
+				return err
+			}
+		}
+		return emitGroup()
+	})
+
+	if err == ErrStopScan {
+		return nil
+	}
+	return err
 }
 
-func (c *Collector) Send(list *bpb.KVList) error {
-	c.KV = append(c.KV, list.Kv...)
+// prefixEnd returns the first key after every key having the prefix, nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
 	return nil
 }
 
-func (bdb *BadgerDB) Iterate(ctx context.Context) (*Collector, error) {
+// Iterate streams the table using Badger Stream framework. Stream sends the batches serially, and
+// the next batch is only read once fn has returned for every pair of the current one (backpressure)
+// posting lists are scanned in key order instead, as the stream may split a posting list from its fragments
+func (bdb *BadgerDB) Iterate(ctx context.Context, fn ScanFunc) error {
+	if bdb.appendable() {
+		return bdb.scan(ctx, nil, nil, nil, fn, ScanOptions{})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	stream := bdb.db.NewStream()
 	stream.LogPrefix = "Iterating using Stream framework"
 
-	c := &Collector{}
-
+	var stopped bool
 	stream.Send = func(list *bpb.KVList) error {
-		return c.Send(list)
+		for _, kv := range list.Kv {
+			if stopped {
+				return nil
+			}
+
+			key, err := bdb.keyCodec.Decode(kv.Key)
+			if err != nil {
+				return err
+			}
+			value, err := bdb.valCodec.Decode(kv.Value)
+			if err != nil {
+				return err
+			}
+
+			if err = fn(key, value); err == ErrStopScan {
+				// stop producing more batches, the pending ones are discarded
+				stopped = true
+				cancel()
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
 	err := stream.Orchestrate(ctx)
-	if err != nil {
-		return nil, err
+	if stopped {
+		return nil
 	}
-	return c, nil
+	return err
 }
 
 func (bdb *BadgerDB) Iterate_QuickFix(ctx context.Context) (map[string]map[string]float64, error) {
@@ -411,9 +846,42 @@ func (bdb *BadgerDB) Debug_Print(ctx context.Context) error {
 	return err
 }
 
+func (bdb *BadgerDB) Stats(ctx context.Context) (TableStats, error) {
+	ret := TableStats{Name: bdb.name}
+	ret.LSMSize, ret.VlogSize = bdb.db.Size()
+
+	// keys only, fragments are counted apart from the posting list they belong to
+	err := bdb.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			k := it.Item().Key()
+			if bdb.appendable() && len(baseKey(k)) != len(k) {
+				ret.Fragments++
+			} else {
+				ret.Keys++
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// IterateInv returns the words of the posting lists whose word starts with pre, looked up in the word table frw0
+// posting lists without word are skipped, any other error of the lookups is returned
 func (bdb *BadgerDB) IterateInv(ctx context.Context, pre string, frw0 DB) ([]string, error) {
 	var retVal []string
-	arrChan := channels.NewInfiniteChannel()
+	var mutex sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
 
 	err := bdb.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
@@ -421,34 +889,50 @@ func (bdb *BadgerDB) IterateInv(ctx context.Context, pre string, frw0 DB) ([]str
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
-		var wg sync.WaitGroup
+		var prev []byte
 		for it.Rewind(); it.Valid(); it.Next() {
+			// stop spawning lookups once one has failed
+			select {
+			case <-gctx.Done():
+				return nil
+			default:
+			}
+
 			item := it.Item()
-			wg.Add(1)
-			go func(k string) {
-				defer wg.Done()
-				w_, e := frw0.Get(ctx, k)
-				if e != nil {
-					panic(e)
+			// fragments of a posting list share the key of the list, refer to append.go
+			k := baseKey(item.Key())
+			if prev != nil && bytes.Equal(prev, k) {
+				continue
+			}
+			prev = append(prev[:0], k...)
+
+			key := string(k)
+			g.Go(func() error {
+				w_, err := frw0.Get(gctx, key)
+				if err == ErrNotFound {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				w, ok := w_.(string)
+				if !ok {
+					return ErrValTypeNotMatch
 				}
-				w := w_.(string)
 				if strings.HasPrefix(w, pre) {
-					arrChan.In() <- w
+					mutex.Lock()
+					retVal = append(retVal, w)
+					mutex.Unlock()
 				}
-			}(string(item.Key()))
-		}
-		wg.Wait()
-		for arrChan.Len() > 0 {
-			if x, ok := (<-arrChan.Out()).(string); ok {
-				retVal = append(retVal, x)
-			}
+				return nil
+			})
 		}
-
 		return nil
 	})
+	if e := g.Wait(); err == nil {
+		err = e
+	}
 	if err != nil {
 		return nil, err
-	} else {
-		return retVal, nil
 	}
+	return retVal, nil
 }
@@ -0,0 +1,690 @@
+package database
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/dgraph-io/badger"
+	"github.com/nwihardjo/SpaghettiSearch/parser"
+	"github.com/pkg/errors"
+	"math"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+=============================== DOCUMENT IDS ==========================================
+	Documents are identified by a docID, a dense uint32 assigned the first time the URL of the
+	document is registered, instead of the md5 of their URL (docHash). The registry is kept in two
+	forward tables:
+		URL_docID	: canonical URL, as given to the indexer -> docID
+		DocID_url	: docID -> URL, the reverse lookup
+	docIDs are assigned from 1 in increasing order, 0 is never assigned. The reverse entry is written
+	first, so that a crash between the two writes only leaves a docID unused. docIDs are not reused,
+	the registry keeps the URL of documents removed by CollectPlaceholders.
+	Pages of the page cache are still named after the docHash of their URL, refer to DocHash.
+*/
+
+// first schema version identifying the documents by docID
+const docIDVersion = 6
+
+var (
+	ErrDocIDsExhausted = errors.New("Every docID has been assigned, the registry cannot hold more than 2^32-1 documents")
+
+	// tables keyed by docHash before docIDs, rewritten by migrateToDocIDs
+	legacyDocTables = []string{"DocHash_docInfo/", "DocHash_children/", "DocHash_rank/", "DocHash_magnitude/"}
+)
+
+// DocRegistry assigns the docIDs, and resolves them in both directions
+type DocRegistry struct {
+	ids  DB
+	urls DB
+
+	mutex sync.Mutex
+	// last docID assigned, read from DocID_url on the first assignment
+	last   uint32
+	loaded bool
+}
+
+func newDocRegistry(ids DB, urls DB) *DocRegistry {
+	return &DocRegistry{ids: ids, urls: urls}
+}
+
+// DocHash returns the hex representation of the md5 of the URL, which names the cached page of the document
+func DocHash(url string) string {
+	h := md5.Sum([]byte(url))
+	return hex.EncodeToString(h[:])
+}
+
+// ID returns the docID assigned to the URL, ErrNotFound if the URL has not been registered
+func (r *DocRegistry) ID(ctx context.Context, url string) (uint32, error) {
+	v, err := r.ids.Get(ctx, url)
+	if err != nil {
+		return 0, err
+	}
+	docID, ok := v.(uint32)
+	if !ok {
+		return 0, ErrValTypeNotMatch
+	}
+	return docID, nil
+}
+
+// URL returns the URL the docID is assigned to, ErrNotFound if the docID has not been assigned
+func (r *DocRegistry) URL(ctx context.Context, docID uint32) (string, error) {
+	v, err := r.urls.Get(ctx, docID)
+	if err != nil {
+		return "", err
+	}
+	return asWord(v)
+}
+
+/*
+Assign returns the docID of the URL, and assigns the next docID to the URL if it has none yet
+\params: context, URL as given to the indexer
+\return: docID, error
+*/
+func (r *DocRegistry) Assign(ctx context.Context, url string) (uint32, error) {
+	if docID, err := r.ID(ctx, url); err != ErrNotFound {
+		return docID, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// assigned meanwhile by another goroutine
+	if docID, err := r.ID(ctx, url); err != ErrNotFound {
+		return docID, err
+	}
+	if !r.loaded {
+		err := r.urls.ScanRange(ctx, nil, nil, func(k interface{}, _ interface{}) error {
+			r.last = k.(uint32)
+			return ErrStopScan
+		}, ScanOptions{Limit: 1, Reverse: true})
+		if err != nil {
+			return 0, err
+		}
+		r.loaded = true
+	}
+	if r.last == math.MaxUint32 {
+		return 0, ErrDocIDsExhausted
+	}
+
+	docID := r.last + 1
+	if err := r.urls.Set(ctx, docID, url); err != nil {
+		return 0, err
+	}
+	r.last = docID
+	return docID, r.ids.Set(ctx, url, docID)
+}
+
+// put registers the URL under the given docID in both directions, the docID must not be assigned yet
+func (r *DocRegistry) put(ctx context.Context, docID uint32, url string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.urls.Set(ctx, docID, url); err != nil {
+		return err
+	}
+	if docID > r.last {
+		r.last = docID
+	}
+	return r.ids.Set(ctx, url, docID)
+}
+
+// Scan calls fn on every docID assigned and its URL, in docID order
+func (r *DocRegistry) Scan(ctx context.Context, fn func(docID uint32, url string) error) error {
+	return r.urls.ScanRange(ctx, nil, nil, func(k interface{}, v interface{}) error {
+		url, err := asWord(v)
+		if err != nil {
+			return err
+		}
+		return fn(k.(uint32), url)
+	}, ScanOptions{})
+}
+
+// Raw returns the tables of the registry, URL_docID first
+func (r *DocRegistry) Raw() (ids DB, urls DB) {
+	return r.ids, r.urls
+}
+
+/*
+migrateToDocIDs assigns a docID to every document of an index keyed by docHash, in docHash order, and
+rewrites the documents, their children, pageRanks and magnitudes, and the posting lists with them.
+Documents of any older version are read, JSON posting lists and DocInfos without discovery time
+included. docHashes without DocInfo are left out, as Fsck would remove them. The tables keyed by
+docHash are removed once rewritten.
+\params: context, options the tables are opened with, tables of this build
+\return: error
+*/
+func migrateToDocIDs(ctx context.Context, opts DBOptions, inv []DB, forw []DB) error {
+	dir := opts.baseDir()
+	tables, err := NewTables(inv, forw)
+	if err != nil {
+		return err
+	}
+	legacy := make([]map[string][]byte, len(legacyDocTables))
+	for i, name := range legacyDocTables {
+		if legacy[i], err = readLegacyTable(dir + name); err != nil {
+			return errors.Wrapf(err, "failed to read %s", name)
+		}
+	}
+	docs, children, ranks, magnitudes := legacy[0], legacy[1], legacy[2], legacy[3]
+
+	hashes := sortedKeys(docs)
+	ids := make(map[string]uint32, len(hashes))
+	for i, docHash := range hashes {
+		ids[docHash] = uint32(i + 1)
+	}
+	toIDs := func(docHashes []string) []uint32 {
+		ret := make([]uint32, 0, len(docHashes))
+		for _, h := range docHashes {
+			if id, ok := ids[h]; ok {
+				ret = append(ret, id)
+			}
+		}
+		return ret
+	}
+
+	writers := make(map[DB]BatchWriter)
+	for _, t := range forw {
+		writers[t] = t.BatchWrite_init(ctx)
+		defer writers[t].Cancel(ctx)
+	}
+	set := func(t DB, key interface{}, value interface{}) error {
+		return writers[t].BatchSet(ctx, key, value)
+	}
+	byURL, byID := tables.DocIDs.Raw()
+
+	// the age of the documents without discovery time counts from the migration
+	now := time.Now().UTC()
+	for _, docHash := range hashes {
+		docID := ids[docHash]
+
+		// references to other documents are rewritten in the JSON, the rest is decoded as it is
+		var fields map[string]json.RawMessage
+		var refs struct {
+			Url      string
+			Children []string
+			Parents  map[string][]string
+		}
+		if err = json.Unmarshal(docs[docHash], &fields); err != nil {
+			return errors.Wrapf(err, "failed to read DocInfo of %s", docHash)
+		}
+		if err = json.Unmarshal(docs[docHash], &refs); err != nil {
+			return errors.Wrapf(err, "failed to read DocInfo of %s", docHash)
+		}
+		parents := make(map[uint32][]string, len(refs.Parents))
+		for p, anchor := range refs.Parents {
+			if id, ok := ids[p]; ok {
+				parents[id] = anchor
+			}
+		}
+		if fields["Children"], err = json.Marshal(toIDs(refs.Children)); err != nil {
+			return err
+		}
+		if fields["Parents"], err = json.Marshal(parents); err != nil {
+			return err
+		}
+		raw, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		var info DocInfo
+		if err = json.Unmarshal(raw, &info); err != nil {
+			return errors.Wrapf(err, "failed to read DocInfo of %s", docHash)
+		}
+		if info.Discovered.IsZero() {
+			info.Discovered = now
+		}
+
+		if err = set(byID, docID, refs.Url); err != nil {
+			return err
+		}
+		if err = set(byURL, refs.Url, docID); err != nil {
+			return err
+		}
+		if err = set(tables.Docs.db, docID, info); err != nil {
+			return err
+		}
+	}
+
+	for docHash, v := range children {
+		docID, ok := ids[docHash]
+		if !ok {
+			continue
+		}
+		var list []string
+		if err = json.Unmarshal(v, &list); err != nil {
+			return errors.Wrapf(err, "failed to read the children of %s", docHash)
+		}
+		if err = set(tables.Children.db, docID, toIDs(list)); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range []struct {
+		values map[string][]byte
+		table  DocRankTable
+	}{{ranks, tables.Rank}, {magnitudes, tables.Magnitude}} {
+		for docHash, v := range t.values {
+			docID, ok := ids[docHash]
+			if !ok {
+				continue
+			}
+			var value map[string]float64
+			if err = json.Unmarshal(v, &value); err != nil {
+				return errors.Wrapf(err, "failed to read the rank of %s", docHash)
+			}
+			if err = set(t.table.db, docID, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, bdb := range badgerTables(inv[:2]) {
+		if err = migratePostings(bdb, ids); err != nil {
+			return errors.Wrapf(err, "failed to rewrite %s", bdb.name)
+		}
+	}
+
+	for _, t := range forw {
+		if err = writers[t].Flush(ctx); err != nil {
+			return err
+		}
+	}
+	for _, name := range legacyDocTables {
+		if err = os.RemoveAll(dir + name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLegacyTable reads every key-value pair of a table as stored, nothing if the table does not exist
+func readLegacyTable(dir string) (map[string][]byte, error) {
+	ret := make(map[string][]byte)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return ret, nil
+	}
+
+	db, err := badger.Open(getOpts(LoadFileIO, dir, DBOptions{}))
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			ret[string(it.Item().Key())] = v
+		}
+		return nil
+	})
+	if e := db.Close(); err == nil {
+		err = e
+	}
+	return ret, err
+}
+
+// migratePostings folds every posting list keyed by docHash with its fragments, and rewrites it keyed by docID
+func migratePostings(bdb *BadgerDB, ids map[string]uint32) error {
+	type group struct {
+		key    []byte
+		deltas [][]byte
+		values [][]byte
+	}
+	var groups []*group
+	err := bdb.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		// fragments sort right after their posting list, refer to append.go
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			k := item.KeyCopy(nil)
+			base := baseKey(k)
+			if len(groups) == 0 || string(groups[len(groups)-1].key) != string(base) {
+				groups = append(groups, &group{key: base})
+			}
+			g := groups[len(groups)-1]
+			if len(base) != len(k) {
+				g.deltas = append(g.deltas, k)
+			}
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			g.values = append(g.values, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	wb := bdb.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, g := range groups {
+		folded := make(map[string][]float32)
+		for _, v := range g.values {
+			fragment, err := decodeLegacyPostings(v)
+			if err != nil {
+				return err
+			}
+			for docHash, list := range fragment {
+				if len(list) == 0 {
+					delete(folded, docHash)
+				} else {
+					folded[docHash] = list
+				}
+			}
+		}
+
+		postings := make(map[uint32][]float32, len(folded))
+		for docHash, list := range folded {
+			if id, ok := ids[docHash]; ok {
+				postings[id] = list
+			}
+		}
+		for _, d := range g.deltas {
+			if err = wb.Delete(d); err != nil {
+				return err
+			}
+		}
+		if len(postings) == 0 {
+			if err = wb.Delete(g.key); err != nil {
+				return err
+			}
+			continue
+		}
+		value, err := EncodePostings(postings)
+		if err != nil {
+			return err
+		}
+		if err = wb.Set(g.key, value); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+/*
+migrateToCanonicalURLs registers every document under the canonical form of its URL, refer to
+parser/canonical.go. Documents registered under several spellings of a URL are merged into the one
+fetched last (the lowest docID if none has been fetched): the others are removed from the posting
+lists, the Children and Parents of every document, the ranks and magnitudes, and their parents and
+anchor text are given to the document kept. Their docIDs stay in DocID_url with the canonical URL, so
+that they are not assigned again. Cached pages are renamed in DBOptions.DocsDir, if set. URLs which
+cannot be canonicalised, e.g. of other schemes, are kept as they are. Every document kept is committed
+in a unit of work with the documents merged into it and their URLs, an interrupted migration is
+completed by the next one and a completed one changes nothing when run again.
+\params: context, options the tables are opened with, tables of this build
+\return: error
+*/
+func migrateToCanonicalURLs(ctx context.Context, opts DBOptions, inv []DB, forw []DB) error {
+	tables, err := NewTables(inv, forw)
+	if err != nil {
+		return err
+	}
+
+	// docIDs of every canonical URL, in docID order
+	urls, canonicals := make(map[uint32]string), make(map[uint32]string)
+	groups := make(map[string][]uint32)
+	err = tables.DocIDs.Scan(ctx, func(docID uint32, url string) error {
+		canonical, err := parser.CanonicalURL(url)
+		if err != nil {
+			canonical = url
+		}
+		urls[docID], canonicals[docID] = url, canonical
+		groups[canonical] = append(groups[canonical], docID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	docs := make(map[uint32]DocInfo)
+	err = tables.Docs.Scan(ctx, func(docID uint32, info DocInfo) error {
+		docs[docID] = info
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// docID every docID is merged into, itself if kept
+	merged := make(map[uint32]uint32, len(urls))
+	for _, ids := range groups {
+		kept := ids[0]
+		for _, docID := range ids[1:] {
+			info, ok := docs[docID]
+			if ok && info.Mod_date.After(docs[kept].Mod_date) {
+				kept = docID
+			}
+		}
+		for _, docID := range ids {
+			merged[docID] = kept
+		}
+	}
+	mergedID := func(docID uint32) uint32 {
+		if kept, ok := merged[docID]; ok {
+			return kept
+		}
+		return docID
+	}
+
+	// postings of a merged docID are moved to the docID kept, unless it has its own
+	// empty list removes the docID when appended, refer to append.go
+	for _, postings := range []PostingTable{tables.TitlePostings, tables.BodyPostings} {
+		moved := make(map[string]map[uint32][]float32)
+		err = postings.Scan(ctx, func(wordHash string, list map[uint32][]float32) error {
+			for docID, positions := range list {
+				kept := mergedID(docID)
+				if kept == docID {
+					continue
+				}
+				if moved[wordHash] == nil {
+					moved[wordHash] = make(map[uint32][]float32)
+				}
+				moved[wordHash][docID] = nil
+				if _, ok := list[kept]; !ok {
+					moved[wordHash][kept] = positions
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, wordHash := range sortedKeys(moved) {
+			uow := NewUnitOfWork()
+			if err = postings.AppendIn(ctx, uow, wordHash, moved[wordHash]); err != nil {
+				return err
+			}
+			if err = uow.Commit(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	// docIDs merged into each docID kept
+	losers := make(map[uint32][]uint32)
+	for _, docID := range sortedIDs(merged) {
+		if kept := merged[docID]; kept != docID {
+			losers[kept] = append(losers[kept], docID)
+		}
+	}
+	ids := make(map[uint32]bool, len(docs)+len(merged))
+	for docID := range docs {
+		ids[docID] = true
+	}
+	for docID := range merged {
+		ids[docID] = true
+	}
+
+	// every document kept is committed with the ones merged into it and their registry entries, so that
+	// an interrupted migration leaves no document both merged and kept
+	byURL, byID := tables.DocIDs.Raw()
+	for _, docID := range sortedIDs(ids) {
+		if mergedID(docID) != docID {
+			continue
+		}
+		uow := NewUnitOfWork()
+		if err = mergeDocument(ctx, uow, tables, docID, losers[docID], docs, mergedID, canonicals); err != nil {
+			uow.Discard()
+			return err
+		}
+
+		renamed := false
+		for _, d := range append([]uint32{docID}, losers[docID]...) {
+			if _, ok := urls[d]; !ok || urls[d] == canonicals[d] {
+				continue
+			}
+			renamed = true
+			if err = uow.Delete(ctx, byURL, urls[d]); err == nil {
+				err = uow.Set(ctx, byID, d, canonicals[d])
+			}
+			if err != nil {
+				uow.Discard()
+				return err
+			}
+		}
+		if renamed || len(losers[docID]) > 0 {
+			if err = uow.Set(ctx, byURL, canonicals[docID], docID); err != nil {
+				uow.Discard()
+				return err
+			}
+		}
+
+		// pages are renamed before the registry, which tells the next migration which pages are left
+		if renamed && opts.DocsDir != "" {
+			if err = renameCachedPages(opts.DocsDir, docID, losers[docID], urls, canonicals); err != nil {
+				uow.Discard()
+				return err
+			}
+		}
+		if err = uow.Commit(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeDocument stages the document kept with its references rewritten, the parents, discovery, rank and
+// magnitude of the documents merged into it, and the removal of the documents merged
+func mergeDocument(ctx context.Context, uow *UnitOfWork, tables *Tables, docID uint32, losers []uint32,
+	docs map[uint32]DocInfo, mergedID func(uint32) uint32, canonicals map[uint32]string) error {
+
+	if prev, ok := docs[docID]; ok {
+		info := prev
+		parents := make(map[uint32][]string, len(prev.Parents))
+		for p, anchor := range prev.Parents {
+			parents[p] = append([]string{}, anchor...)
+		}
+		for _, l := range losers {
+			loser, ok := docs[l]
+			if !ok {
+				continue
+			}
+			for p, anchor := range loser.Parents {
+				parents[p] = append(parents[p], anchor...)
+			}
+			if info.Discovered.IsZero() || (!loser.Discovered.IsZero() && loser.Discovered.Before(info.Discovered)) {
+				info.Discovered = loser.Discovered
+			}
+		}
+
+		// references to the documents merged are rewritten, a document merged with its own child links to itself
+		seen := make(map[uint32]bool, len(prev.Children))
+		info.Children = make([]uint32, 0, len(prev.Children))
+		for _, c := range prev.Children {
+			if c = mergedID(c); c != docID && !seen[c] {
+				seen[c] = true
+				info.Children = append(info.Children, c)
+			}
+		}
+		info.Parents = make(map[uint32][]string, len(parents))
+		for p, anchor := range parents {
+			if p = mergedID(p); p != docID {
+				info.Parents[p] = append(info.Parents[p], anchor...)
+			}
+		}
+		if canonical, ok := canonicals[docID]; ok {
+			if u, err := url.Parse(canonical); err == nil {
+				info.Url = *u
+			}
+		}
+
+		if !reflect.DeepEqual(info, prev) {
+			if err := tables.Docs.PutIn(ctx, uow, docID, info); err != nil {
+				return err
+			}
+			// the indexer writes the children of every document it fetched
+			if !info.Mod_date.IsZero() {
+				if err := tables.Children.PutIn(ctx, uow, docID, info.Children); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, l := range losers {
+		for _, t := range []DocRankTable{tables.Rank, tables.Magnitude} {
+			value, err := t.Get(ctx, l)
+			if err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if has, err := t.Has(ctx, docID); err != nil {
+				return err
+			} else if !has {
+				if err = t.PutIn(ctx, uow, docID, value); err != nil {
+					return err
+				}
+			}
+			if err = t.DeleteIn(ctx, uow, l); err != nil {
+				return err
+			}
+		}
+		if _, ok := docs[l]; !ok {
+			continue
+		}
+		if err := tables.Children.DeleteIn(ctx, uow, l); err != nil {
+			return err
+		}
+		if err := tables.Docs.DeleteIn(ctx, uow, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameCachedPages removes the pages of the documents merged, then gives the page of the document kept its
+// canonical name. Pages already renamed are skipped
+func renameCachedPages(docsDir string, docID uint32, losers []uint32, urls map[uint32]string, canonicals map[uint32]string) error {
+	docsDir = strings.TrimSuffix(docsDir, "/") + "/"
+	for _, l := range losers {
+		if urls[l] == canonicals[l] {
+			continue
+		}
+		if err := os.Remove(docsDir + DocHash(urls[l])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if urls[docID] == canonicals[docID] {
+		return nil
+	}
+	err := os.Rename(docsDir+DocHash(urls[docID]), docsDir+DocHash(canonicals[docID]))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
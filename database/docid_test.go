@@ -0,0 +1,283 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/apsdehal/go-logger"
+	"github.com/dgraph-io/badger"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDocRegistry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	inv, forw, _ := MemoryDB_init(ctx)
+	tables, _ := NewTables(inv, forw)
+	defer tables.Close(ctx, cancel)
+
+	for i, u := range []string{"https://a.com/", "https://a.com/b", "https://a.com/"} {
+		docID, err := tables.DocIDs.Assign(ctx, u)
+		if want := []uint32{1, 2, 1}[i]; err != nil || docID != want {
+			t.Errorf("got docID %d (%v) for %s, want %d", docID, err, u, want)
+		}
+	}
+	if u, err := tables.DocIDs.URL(ctx, 2); err != nil || u != "https://a.com/b" {
+		t.Errorf("got URL %q (%v), want https://a.com/b", u, err)
+	}
+	if _, err := tables.DocIDs.ID(ctx, "https://a.com/c"); err != ErrNotFound {
+		t.Errorf("got error %v, want %v", err, ErrNotFound)
+	}
+
+	// another registry over the same tables continues after the last docID
+	other, _ := NewTables(inv, forw)
+	if docID, err := other.DocIDs.Assign(ctx, "https://a.com/c"); err != nil || docID != 3 {
+		t.Errorf("got docID %d (%v), want 3", docID, err)
+	}
+}
+
+func TestMigrateToDocIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// index of schema version 5, keyed by docHash
+	parent, kid, gone := DocHash("https://a.com/"), DocHash("https://a.com/b"), DocHash("https://a.com/gone")
+	legacy := map[string]map[string]string{
+		"DocHash_docInfo": {
+			parent: `{"Url":"https://a.com/","Page_title":["A"],"Children":["` + kid + `","` + gone + `"]}`,
+			kid:    `{"Url":"https://a.com/b","Parents":{"` + parent + `":["b"]}}`,
+		},
+		"DocHash_children": {parent: `["` + kid + `","` + gone + `"]`},
+		"DocHash_rank":     {parent: `{"Arts":0.5}`, gone: `{"Arts":0.1}`},
+		"invKeyword_body":  {hashA: `{"` + parent + `":[1,0],"` + gone + `":[1,2]}`},
+	}
+	for name, pairs := range legacy {
+		db, err := badger.Open(getOpts(LoadFileIO, filepath.Join(dir, name), DBOptions{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Update(func(txn *badger.Txn) error {
+			for k, v := range pairs {
+				if err := txn.Set([]byte(k), []byte(v)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if e := db.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writeSchema(dir+"/", 5, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	log, _ := logger.New("test", 1)
+	opts := DefaultDBOptions()
+	opts.Dir, opts.GCInterval, opts.AutoMigrate = dir, 0, true
+	ctx, cancel := context.WithCancel(context.Background())
+	tables, err := OpenTables(ctx, log, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tables.Close(ctx, cancel)
+
+	// docIDs are assigned in docHash order, references to documents without DocInfo are dropped
+	ids := map[string]uint32{parent: 1, kid: 2}
+	if parent > kid {
+		ids = map[string]uint32{parent: 2, kid: 1}
+	}
+	info, err := tables.Docs.Get(ctx, ids[parent])
+	if err != nil || info.Url.String() != "https://a.com/" || !reflect.DeepEqual(info.Children, []uint32{ids[kid]}) ||
+		info.Discovered.IsZero() {
+		t.Errorf("got DocInfo %+v (%v) of the parent", info, err)
+	}
+	if info, err = tables.Docs.Get(ctx, ids[kid]); err != nil || !reflect.DeepEqual(info.Parents, map[uint32][]string{ids[parent]: {"b"}}) {
+		t.Errorf("got DocInfo %+v (%v) of the child", info, err)
+	}
+	if docID, err := tables.DocIDs.ID(ctx, "https://a.com/b"); err != nil || docID != ids[kid] {
+		t.Errorf("got docID %d (%v) for the child, want %d", docID, err, ids[kid])
+	}
+	if children, err := tables.Children.Get(ctx, ids[parent]); err != nil || !reflect.DeepEqual(children, []uint32{ids[kid]}) {
+		t.Errorf("got children %v (%v)", children, err)
+	}
+	if rank, err := tables.Rank.Get(ctx, ids[parent]); err != nil || rank["Arts"] != 0.5 {
+		t.Errorf("got rank %v (%v)", rank, err)
+	}
+	if list, err := tables.BodyPostings.Get(ctx, hashA); err != nil || !reflect.DeepEqual(list, map[uint32][]float32{ids[parent]: {1, 0}}) {
+		t.Errorf("got postings %v (%v)", list, err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "DocHash_docInfo")); !os.IsNotExist(err) {
+		t.Errorf("table keyed by docHash kept after the migration: %v", err)
+	}
+}
+
+func TestMigrateToCanonicalURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canonical")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, _ := logger.New("test", 1)
+	opts := DefaultDBOptions()
+	opts.Dir, opts.LoadMode, opts.GCInterval, opts.AutoMigrate = filepath.Join(dir, "index"), LoadMemoryMap, 0, true
+	opts.DocsDir = filepath.Join(dir, "docs")
+	os.MkdirAll(opts.DocsDir, 0755)
+
+	// index of schema version 7, registered with the URLs as linked
+	urls := []string{"https://A.com/", "https://a.com/b", "https://a.com:443/b#x", "https://a.com/c", "mailto:x@a.com"}
+	discovered := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	docs := []DocInfo{
+		{Mod_date: discovered, Children: []uint32{2, 3}},
+		{Parents: map[uint32][]string{1: {"b"}}, Discovered: discovered},
+		{Mod_date: discovered.Add(time.Hour), Children: []uint32{1}, Parents: map[uint32][]string{1: {"bee"}}, Discovered: discovered.Add(time.Hour)},
+		{Mod_date: discovered, Children: []uint32{2}},
+		{},
+	}
+	tablesCtx, cancel := context.WithCancel(context.Background())
+	tables, err := OpenTables(tablesCtx, log, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i, u := range urls {
+		docID, _ := tables.DocIDs.Assign(ctx, u)
+		parsed, _ := url.Parse(u)
+		docs[i].Url = *parsed
+		tables.Docs.Put(ctx, docID, docs[i])
+		if !docs[i].Mod_date.IsZero() {
+			tables.Children.Put(ctx, docID, docs[i].Children)
+			ioutil.WriteFile(filepath.Join(opts.DocsDir, DocHash(u)), []byte(u), 0644)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(opts.DocsDir, DocHash("https://a.com/b")), []byte("https://a.com/b"), 0644)
+	tables.BodyPostings.Put(ctx, "w", map[uint32][]float32{2: {1}, 3: {2}})
+	tables.BodyPostings.Put(ctx, "x", map[uint32][]float32{2: {5}})
+	tables.Rank.Put(ctx, 2, map[string]float64{"Arts": 0.5})
+	tables.Close(ctx, cancel)
+	if err = writeSchema(opts.baseDir(), 7, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	tablesCtx, cancel = context.WithCancel(ctx)
+	if tables, err = OpenTables(tablesCtx, log, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tables.Close(ctx, cancel) }()
+
+	// both spellings of /b are merged into the one fetched
+	for _, c := range []struct {
+		url   string
+		docID uint32
+	}{{"https://a.com/", 1}, {"https://a.com/b", 3}, {"https://a.com/c", 4}, {"mailto:x@a.com", 5}} {
+		if docID, err := tables.DocIDs.ID(ctx, c.url); err != nil || docID != c.docID {
+			t.Errorf("got docID %d (%v) for %s, want %d", docID, err, c.url, c.docID)
+		}
+	}
+	for _, u := range []string{"https://A.com/", "https://a.com:443/b#x"} {
+		if docID, err := tables.DocIDs.ID(ctx, u); err != ErrNotFound {
+			t.Errorf("got docID %d (%v) for %s, want %v", docID, err, u, ErrNotFound)
+		}
+	}
+	if u, err := tables.DocIDs.URL(ctx, 2); err != nil || u != "https://a.com/b" {
+		t.Errorf("got URL %q (%v) of the docID merged, want https://a.com/b kept in the registry", u, err)
+	}
+	if _, err = tables.Docs.Get(ctx, 2); err != ErrNotFound {
+		t.Errorf("got error %v for the DocInfo merged, want %v", err, ErrNotFound)
+	}
+
+	for _, c := range []struct {
+		docID    uint32
+		url      string
+		children []uint32
+		parents  map[uint32][]string
+	}{
+		{1, "https://a.com/", []uint32{3}, map[uint32][]string{}},
+		{3, "https://a.com/b", []uint32{1}, map[uint32][]string{1: {"bee", "b"}}},
+		{4, "https://a.com/c", []uint32{3}, map[uint32][]string{}},
+	} {
+		info, err := tables.Docs.Get(ctx, c.docID)
+		if err != nil || info.Url.String() != c.url || !reflect.DeepEqual(info.Children, c.children) || !reflect.DeepEqual(info.Parents, c.parents) {
+			t.Errorf("got DocInfo %+v (%v) of %d, want %s with children %v and parents %v", info, err, c.docID, c.url, c.children, c.parents)
+		}
+		if children, err := tables.Children.Get(ctx, c.docID); err != nil || !reflect.DeepEqual(children, c.children) {
+			t.Errorf("got children %v (%v) of %d, want %v", children, err, c.docID, c.children)
+		}
+	}
+	if info, _ := tables.Docs.Get(ctx, 3); !info.Discovered.Equal(discovered) {
+		t.Errorf("got discovery %v of the document kept, want the earliest %v", info.Discovered, discovered)
+	}
+
+	for _, c := range []struct {
+		wordHash string
+		want     map[uint32][]float32
+	}{{"w", map[uint32][]float32{3: {2}}}, {"x", map[uint32][]float32{3: {5}}}} {
+		if list, err := tables.BodyPostings.Get(ctx, c.wordHash); err != nil || !reflect.DeepEqual(list, c.want) {
+			t.Errorf("got postings %v (%v) of %s, want %v", list, err, c.wordHash, c.want)
+		}
+	}
+	if rank, err := tables.Rank.Get(ctx, 3); err != nil || rank["Arts"] != 0.5 {
+		t.Errorf("got rank %v (%v) of the document kept, want the one merged", rank, err)
+	}
+	if has, _ := tables.Rank.Has(ctx, 2); has {
+		t.Error("rank of the document merged kept")
+	}
+
+	// pages kept are cached under their canonical URL
+	for u, want := range map[string]string{
+		"https://a.com/":        "https://A.com/",
+		"https://a.com/b":       "https://a.com:443/b#x",
+		"https://A.com/":        "",
+		"https://a.com:443/b#x": "",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(opts.DocsDir, DocHash(u)))
+		if string(content) != want || (want == "") != os.IsNotExist(err) {
+			t.Errorf("got cached page %q (%v) for %s, want %q", content, err, u, want)
+		}
+	}
+
+	// migration completed changes nothing when run again
+	before := snapshot(t, tables)
+	tables.Close(ctx, cancel)
+	if err = writeSchema(opts.baseDir(), 7, 1); err != nil {
+		t.Fatal(err)
+	}
+	tablesCtx, cancel = context.WithCancel(ctx)
+	if tables, err = OpenTables(tablesCtx, log, opts); err != nil {
+		t.Fatal(err)
+	}
+	if after := snapshot(t, tables); !reflect.DeepEqual(after, before) {
+		t.Errorf("got tables %v after migrating twice, want %v", after, before)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(opts.DocsDir, DocHash("https://a.com/b"))); string(content) != "https://a.com:443/b#x" {
+		t.Errorf("got cached page %q after migrating twice, want the one of https://a.com:443/b#x", content)
+	}
+}
+
+// snapshot returns the content of every table by name
+func snapshot(t *testing.T, tables *Tables) map[string]map[string]interface{} {
+	ret := make(map[string]map[string]interface{})
+	for _, d := range tables.All() {
+		content := make(map[string]interface{})
+		err := d.Iterate(context.Background(), func(k interface{}, v interface{}) error {
+			content[fmt.Sprint(k)] = v
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret[d.(rawTable).tableName()] = content
+	}
+	return ret
+}
@@ -0,0 +1,554 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+=============================== JSONL DUMP ==========================================
+	Export writes the index as JSON lines, one record per line, with URLs and words in place of
+	their docIDs and md5 hashes. Every record has a Type, the header always comes first:
+		{"Type":"header","Format":1,"SchemaVersion":8,"Created":"<RFC 3339>"}
+		{"Type":"doc","Url":"<url>","Title":["..."],"ModDate":"<RFC 3339>","Discovered":"<RFC 3339>","Size":0,
+			"ETag":"<entity tag>","Checked":"<RFC 3339>",
+			"Children":["<url>"],"Parents":{"<url>":["<anchor word>"]},"Words":{"<word>":<freq>},
+			"Rank":{"<topic>":<pageRank>},"Magnitude":{"title":<x>,"body":<x>}}
+		{"Type":"term","Word":"<word>","Title":[<posting>],"Body":[<posting>]}
+			posting: {"Url":"<url>","Weight":<norm tf*idf>,"Positions":[<position>]}
+		{"Type":"topic","Category":"<category>","Metadata":{"numPages":<x>,"wordCount":<x>}}
+		{"Type":"keyword","Keyword":"<keyword>","Topics":{"<category>":<freq>}}
+	A document not fetched yet has a zero ModDate. Documents without Discovered, written before it was
+	recorded, are imported as discovered at the time of the import. A document referenced by the index but missing
+	from DocID_url is written as "docID:<docID>", a word missing from WordHash_word as "md5:<hash>", so that
+	nothing is lost. Documents are sorted by docID and the other records by hash, two dumps of the same index
+	are identical besides Created.
+	Import rebuilds every table from a dump, except the page cache which is not part of it. docIDs are
+	assigned anew, in the order the URLs appear in the dump.
+*/
+
+const (
+	// bump whenever the layout of the records changes
+	ExportFormat = 1
+
+	unresolvedPrefix = "md5:"
+
+	unresolvedDocPrefix = "docID:"
+)
+
+var (
+	ErrExportFormat = errors.New("Dump is not an index export or was created by a newer build")
+
+	ErrImportTarget = errors.New("Tables to be imported to already contain documents, import into an empty index")
+)
+
+type (
+	ExportSummary struct {
+		Docs     int
+		Terms    int
+		Topics   int
+		Keywords int
+	}
+
+	exportHeader struct {
+		Type          string
+		Format        int
+		SchemaVersion int
+		Created       time.Time
+	}
+
+	exportDoc struct {
+		Type       string
+		Url        string
+		Title      []string
+		ModDate    time.Time
+		Discovered time.Time
+		Size       uint32
+		ETag       string `json:",omitempty"`
+		Checked    time.Time
+		Children   []string            `json:",omitempty"`
+		Parents    map[string][]string `json:",omitempty"`
+		Words      map[string]uint32   `json:",omitempty"`
+		Rank       map[string]float64  `json:",omitempty"`
+		Magnitude  map[string]float64  `json:",omitempty"`
+	}
+
+	exportPosting struct {
+		Url       string
+		Weight    float32
+		Positions []float32
+	}
+
+	exportTerm struct {
+		Type  string
+		Word  string
+		Title []exportPosting `json:",omitempty"`
+		Body  []exportPosting `json:",omitempty"`
+	}
+
+	exportTopic struct {
+		Type     string
+		Category string
+		Metadata map[string]float64
+	}
+
+	exportKeyword struct {
+		Type    string
+		Keyword string
+		Topics  map[string]uint32
+	}
+
+	// resolves docIDs and wordHashes while exporting
+	resolver struct {
+		ctx  context.Context
+		urls map[uint32]string
+		t    *Tables
+	}
+)
+
+/*
+Export writes every table but the page cache as JSON lines to w, refer to the description above
+\params: context, writer of the dump, tables
+\return: number of records written, error
+*/
+func Export(ctx context.Context, w io.Writer, tables *Tables) (*ExportSummary, error) {
+	summary := &ExportSummary{}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	res := &resolver{ctx: ctx, urls: make(map[uint32]string), t: tables}
+
+	err := enc.Encode(exportHeader{"header", ExportFormat, SchemaVersion, time.Now().UTC()})
+	if err != nil {
+		return nil, err
+	}
+
+	// URLs are needed by every other record, they are kept in memory
+	err = tables.DocIDs.Scan(ctx, func(docID uint32, url string) error {
+		res.urls[docID] = url
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tables.Docs.Raw().ScanRange(ctx, nil, nil, func(k interface{}, v interface{}) error {
+		info := v.(DocInfo)
+		rec := exportDoc{
+			Type:       "doc",
+			Url:        info.Url.String(),
+			Title:      info.Page_title,
+			ModDate:    info.Mod_date,
+			Discovered: info.Discovered,
+			Size:       info.Page_size,
+			ETag:       info.ETag,
+			Checked:    info.Checked,
+		}
+		for _, c := range info.Children {
+			rec.Children = append(rec.Children, res.url(c))
+		}
+		if len(info.Parents) > 0 {
+			rec.Parents = make(map[string][]string, len(info.Parents))
+			for p, anchor := range info.Parents {
+				rec.Parents[res.url(p)] = anchor
+			}
+		}
+		if len(info.Words_mapping) > 0 {
+			rec.Words = make(map[string]uint32, len(info.Words_mapping))
+			for wordHash, freq := range info.Words_mapping {
+				word, err := res.word(wordHash)
+				if err != nil {
+					return err
+				}
+				rec.Words[word] = freq
+			}
+		}
+
+		var err error
+		if rec.Rank, err = tables.Rank.Get(ctx, k.(uint32)); err != nil && err != ErrNotFound {
+			return err
+		}
+		if rec.Magnitude, err = tables.Magnitude.Get(ctx, k.(uint32)); err != nil && err != ErrNotFound {
+			return err
+		}
+		summary.Docs++
+		return enc.Encode(rec)
+	}, ScanOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = exportTerms(ctx, enc, res, summary); err != nil {
+		return nil, err
+	}
+
+	err = tables.TopicMetadata.Raw().ScanRange(ctx, "", "", func(k interface{}, v interface{}) error {
+		summary.Topics++
+		return enc.Encode(exportTopic{"topic", k.(string), v.(map[string]float64)})
+	}, ScanOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tables.TopicKeywords.Raw().ScanRange(ctx, "", "", func(k interface{}, v interface{}) error {
+		summary.Keywords++
+		return enc.Encode(exportKeyword{"keyword", k.(string), v.(map[string]uint32)})
+	}, ScanOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return summary, bw.Flush()
+}
+
+// exportTerms writes a record per word, merging its title and body posting lists
+func exportTerms(ctx context.Context, enc *json.Encoder, res *resolver, summary *ExportSummary) error {
+	// words of the title posting lists are collected first, the two tables are then walked together
+	titles := make(map[string]bool)
+	err := res.t.TitlePostings.Raw().ScanRange(ctx, "", "", func(k interface{}, _ interface{}) error {
+		titles[k.(string)] = true
+		return nil
+	}, ScanOptions{})
+	if err != nil {
+		return err
+	}
+
+	write := func(wordHash string) error {
+		word, err := res.word(wordHash)
+		if err != nil {
+			return err
+		}
+		rec := exportTerm{Type: "term", Word: word}
+		if rec.Title, err = res.postings(res.t.TitlePostings, wordHash); err != nil {
+			return err
+		}
+		if rec.Body, err = res.postings(res.t.BodyPostings, wordHash); err != nil {
+			return err
+		}
+		summary.Terms++
+		return enc.Encode(rec)
+	}
+
+	// words of the titles are merged with the words of the body in hash order, words of both are written once
+	var pending []string
+	for wordHash := range titles {
+		pending = append(pending, wordHash)
+	}
+	sort.Strings(pending)
+
+	err = res.t.BodyPostings.Raw().ScanRange(ctx, "", "", func(k interface{}, _ interface{}) error {
+		wordHash := k.(string)
+		for len(pending) > 0 && pending[0] <= wordHash {
+			if pending[0] != wordHash {
+				if err := write(pending[0]); err != nil {
+					return err
+				}
+			}
+			pending = pending[1:]
+		}
+		return write(wordHash)
+	}, ScanOptions{})
+	if err != nil {
+		return err
+	}
+	for _, wordHash := range pending {
+		if err = write(wordHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *resolver) url(docID uint32) string {
+	if u, ok := r.urls[docID]; ok {
+		return u
+	}
+	return unresolvedDocPrefix + strconv.FormatUint(uint64(docID), 10)
+}
+
+func (r *resolver) word(wordHash string) (string, error) {
+	word, err := r.t.Words.Get(r.ctx, wordHash)
+	if err == ErrNotFound {
+		return unresolvedPrefix + wordHash, nil
+	}
+	return word, err
+}
+
+func (r *resolver) postings(table PostingTable, wordHash string) ([]exportPosting, error) {
+	list, err := table.Get(r.ctx, wordHash)
+	if err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ret := make([]exportPosting, 0, len(list))
+	for docID, l := range list {
+		p := exportPosting{Url: r.url(docID), Positions: []float32{}}
+		if len(l) > 0 {
+			p.Weight, p.Positions = l[0], l[1:]
+		}
+		ret = append(ret, p)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Url < ret[j].Url })
+	return ret, nil
+}
+
+// hashOf reverses the resolution of Export for words, md5 of the word unless it could not be resolved
+func hashOf(s string) string {
+	if strings.HasPrefix(s, unresolvedPrefix) {
+		return strings.TrimPrefix(s, unresolvedPrefix)
+	}
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+/*
+Import rebuilds the tables from a dump written by Export, the tables must not contain any document
+the page cache is not part of the dump, summaries of the results stay empty until the pages are crawled again
+\params: context, reader of the dump, tables to write to
+\return: number of records read, error
+*/
+func Import(ctx context.Context, r io.Reader, tables *Tables) (*ExportSummary, error) {
+	empty := true
+	err := tables.Docs.Raw().ScanRange(ctx, nil, nil, func(_ interface{}, _ interface{}) error {
+		empty = false
+		return ErrStopScan
+	}, ScanOptions{Limit: 1})
+	if err != nil {
+		return nil, err
+	} else if !empty {
+		return nil, ErrImportTarget
+	}
+
+	// every table is written through a batch writer, nothing is visible before the final flush
+	writers := make(map[DB]BatchWriter)
+	for _, t := range tables.All() {
+		writers[t] = t.BatchWrite_init(ctx)
+		defer writers[t].Cancel(ctx)
+	}
+	set := func(t table, key interface{}, value interface{}) error {
+		return writers[t.db].BatchSet(ctx, key, value)
+	}
+
+	// URLs are registered in the order they appear, unresolved documents get a docID without URL
+	byURL, byID := tables.DocIDs.Raw()
+	ids := make(map[string]uint32)
+	docID := func(u string) (uint32, error) {
+		if id, ok := ids[u]; ok {
+			return id, nil
+		}
+		id := uint32(len(ids) + 1)
+		ids[u] = id
+		if strings.HasPrefix(u, unresolvedDocPrefix) {
+			return id, nil
+		}
+		if err := writers[byID].BatchSet(ctx, id, u); err != nil {
+			return 0, err
+		}
+		return id, writers[byURL].BatchSet(ctx, u, id)
+	}
+	words := make(map[string]bool)
+	setWord := func(word string) error {
+		if strings.HasPrefix(word, unresolvedPrefix) || words[word] {
+			return nil
+		}
+		words[word] = true
+		return set(tables.Words.table, hashOf(word), word)
+	}
+
+	summary := &ExportSummary{}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	header := false
+	for {
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(ErrExportFormat, err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		var kind struct{ Type string }
+		if err = json.Unmarshal(raw, &kind); err != nil {
+			return nil, ErrExportFormat
+		}
+		if !header && kind.Type != "header" {
+			return nil, ErrExportFormat
+		}
+
+		switch kind.Type {
+		case "header":
+			var rec exportHeader
+			if err = json.Unmarshal(raw, &rec); err != nil || rec.Format != ExportFormat {
+				return nil, ErrExportFormat
+			}
+			header = true
+
+		case "doc":
+			var rec exportDoc
+			if err = json.Unmarshal(raw, &rec); err != nil {
+				return nil, ErrExportFormat
+			}
+			if err = importDoc(tables, rec, set, setWord, docID); err != nil {
+				return nil, err
+			}
+			summary.Docs++
+
+		case "term":
+			var rec exportTerm
+			if err = json.Unmarshal(raw, &rec); err != nil {
+				return nil, ErrExportFormat
+			}
+			if err = setWord(rec.Word); err != nil {
+				return nil, err
+			}
+			for _, p := range []struct {
+				table    PostingTable
+				postings []exportPosting
+			}{{tables.TitlePostings, rec.Title}, {tables.BodyPostings, rec.Body}} {
+				if len(p.postings) == 0 {
+					continue
+				}
+				list := make(map[uint32][]float32, len(p.postings))
+				for _, posting := range p.postings {
+					id, err := docID(posting.Url)
+					if err != nil {
+						return nil, err
+					}
+					list[id] = append([]float32{posting.Weight}, posting.Positions...)
+				}
+				if err = set(p.table.table, hashOf(rec.Word), list); err != nil {
+					return nil, err
+				}
+			}
+			summary.Terms++
+
+		case "topic":
+			var rec exportTopic
+			if err = json.Unmarshal(raw, &rec); err != nil {
+				return nil, ErrExportFormat
+			}
+			if err = set(tables.TopicMetadata.table, rec.Category, rec.Metadata); err != nil {
+				return nil, err
+			}
+			summary.Topics++
+
+		case "keyword":
+			var rec exportKeyword
+			if err = json.Unmarshal(raw, &rec); err != nil {
+				return nil, ErrExportFormat
+			}
+			if err = set(tables.TopicKeywords.table, rec.Keyword, rec.Topics); err != nil {
+				return nil, err
+			}
+			summary.Keywords++
+
+		default:
+			return nil, errors.Errorf("Dump contains a record of unknown type %q", kind.Type)
+		}
+	}
+	if !header {
+		return nil, ErrExportFormat
+	}
+
+	for _, t := range tables.All() {
+		if err = writers[t].Flush(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return summary, nil
+}
+
+// importDoc writes DocInfo, and the children, rank and magnitude of a doc record
+func importDoc(tables *Tables, rec exportDoc, set func(table, interface{}, interface{}) error, setWord func(string) error,
+	docID func(string) (uint32, error)) error {
+
+	id, err := docID(rec.Url)
+	if err != nil {
+		return err
+	}
+	info := DocInfo{
+		Page_title: rec.Title,
+		Mod_date:   rec.ModDate,
+		Page_size:  rec.Size,
+		Discovered: rec.Discovered,
+		ETag:       rec.ETag,
+		Checked:    rec.Checked,
+	}
+	if info.Discovered.IsZero() {
+		info.Discovered = time.Now().UTC()
+	}
+	u, err := url.Parse(rec.Url)
+	if err != nil {
+		return err
+	}
+	info.Url = *u
+	for _, c := range rec.Children {
+		child, err := docID(c)
+		if err != nil {
+			return err
+		}
+		info.Children = append(info.Children, child)
+	}
+	if rec.Parents != nil {
+		info.Parents = make(map[uint32][]string, len(rec.Parents))
+		// parents are registered in URL order, so that importing the same dump assigns the same docIDs
+		parents := make([]string, 0, len(rec.Parents))
+		for p := range rec.Parents {
+			parents = append(parents, p)
+		}
+		sort.Strings(parents)
+		for _, p := range parents {
+			parent, err := docID(p)
+			if err != nil {
+				return err
+			}
+			info.Parents[parent] = rec.Parents[p]
+		}
+	}
+	if rec.Words != nil {
+		info.Words_mapping = make(map[string]uint32, len(rec.Words))
+		for word, freq := range rec.Words {
+			if err := setWord(word); err != nil {
+				return err
+			}
+			info.Words_mapping[hashOf(word)] = freq
+		}
+	}
+
+	if err = set(tables.Docs.table, id, info); err != nil {
+		return err
+	}
+	// the indexer writes the children of every document it fetched
+	if !rec.ModDate.IsZero() {
+		if err := set(tables.Children.table, id, info.Children); err != nil {
+			return err
+		}
+	}
+	if rec.Rank != nil {
+		if err := set(tables.Rank.table, id, rec.Rank); err != nil {
+			return err
+		}
+	}
+	if rec.Magnitude != nil {
+		if err := set(tables.Magnitude.table, id, rec.Magnitude); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	inv, forw, _ := MemoryDB_init(ctx)
+	tables, _ := NewTables(inv, forw)
+	defer tables.Close(ctx, cancel)
+
+	u, _ := url.Parse("https://a.com/")
+	child, _ := url.Parse("https://a.com/b")
+	parent, _ := tables.DocIDs.Assign(ctx, u.String())
+	kid, _ := tables.DocIDs.Assign(ctx, child.String())
+	word, title := hashOf("word"), hashOf("titl")
+	tables.Docs.Put(ctx, parent, DocInfo{Url: *u, Page_title: []string{"Title"}, Mod_date: time.Unix(1e9, 0).UTC(),
+		Children: []uint32{kid}, Words_mapping: map[string]uint32{word: 1}, Discovered: time.Unix(9e8, 0).UTC(),
+		ETag: `"v1"`, Checked: time.Unix(2e9, 0).UTC()})
+	tables.Docs.Put(ctx, kid, DocInfo{Url: *child, Parents: map[uint32][]string{parent: {"word"}}, Discovered: time.Unix(1e9, 0).UTC()})
+	tables.Children.Put(ctx, parent, []uint32{kid})
+	tables.Rank.Put(ctx, parent, map[string]float64{"Arts": 0.5})
+	tables.Magnitude.Put(ctx, parent, map[string]float64{"body": 1})
+	tables.Words.Put(ctx, word, "word")
+	tables.Words.Put(ctx, title, "titl")
+	tables.BodyPostings.Put(ctx, word, map[uint32][]float32{parent: {1, 0}})
+	tables.TitlePostings.Put(ctx, title, map[uint32][]float32{parent: {1, 0}})
+	// posting of a document without URL keeps its docID, the next one so that the import assigns the same
+	tables.TitlePostings.Put(ctx, word, map[uint32][]float32{kid: {1, -100}, 3: {1, 2}})
+	tables.TopicMetadata.Put(ctx, "Arts", map[string]float64{"numPages": 1, "wordCount": 1})
+	tables.TopicKeywords.Put(ctx, "word", map[string]uint32{"Arts": 3})
+
+	var dump bytes.Buffer
+	summary, err := Export(ctx, &dump, tables)
+	if err != nil || *summary != (ExportSummary{Docs: 2, Terms: 2, Topics: 1, Keywords: 1}) {
+		t.Fatalf("got %+v (%v)", summary, err)
+	}
+	if !strings.Contains(dump.String(), `"Url":"docID:3"`) {
+		t.Errorf("unresolved document not written as its docID:\n%s", dump.String())
+	}
+
+	if _, err = Import(ctx, bytes.NewReader(dump.Bytes()), tables); err != ErrImportTarget {
+		t.Errorf("got error %v, want %v", err, ErrImportTarget)
+	}
+
+	inv, forw, _ = MemoryDB_init(ctx)
+	imported, _ := NewTables(inv, forw)
+	if _, err = Import(ctx, bytes.NewReader(dump.Bytes()), imported); err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if _, err = Export(ctx, &again, imported); err != nil {
+		t.Fatal(err)
+	}
+
+	// identical besides the time of the export in the header
+	strip := func(s string) string { return s[strings.Index(s, "\n"):] }
+	if strip(dump.String()) != strip(again.String()) {
+		t.Errorf("dump of the imported index differs:\n%s\nwant:\n%s", again.String(), dump.String())
+	}
+	// the page cache is not part of the dump
+	report, err := Fsck(ctx, imported, "", false)
+	if found, _ := report.Count(CheckDocs); err != nil || report.Remaining() != 2 || found != 1 {
+		t.Errorf("got %v (%v), want the posting without DocInfo and the missing page", report.Violations, err)
+	}
+}
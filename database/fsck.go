@@ -0,0 +1,411 @@
+package database
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+=============================== CONSISTENCY CHECK ==========================================
+	Fsck cross-checks the tables opened by DB_init and the page cache. A document is indexed once
+	the crawler has fetched it (non-zero Mod_date), children not fetched yet only have a DocInfo
+	holding their URL and parents. Violations and their repair:
+		postings	: docID in a posting list without DocInfo, removed from the posting list
+		words		: WordHash_word entry not referenced by any posting list or DocInfo, deleted
+		children	: DocID_children differs from DocInfo.Children, rewritten from DocInfo
+		registry	: DocInfo whose docID has no URL in DocID_url, registered with the URL of the DocInfo
+		rank		: indexed document without pageRank, or pageRank without DocInfo (deleted)
+		magnitude	: indexed document with words but without magnitude, or magnitude without DocInfo (deleted)
+		docs		: indexed document without cached page, or cached page without indexed DocInfo (removed)
+	Missing pageRank, magnitude and cached pages cannot be rebuilt from the tables, they need another
+	crawl. Run Fsck while nothing else writes to the index.
+*/
+
+const (
+	CheckPostings  = "postings"
+	CheckWords     = "words"
+	CheckChildren  = "children"
+	CheckRegistry  = "registry"
+	CheckRank      = "rank"
+	CheckMagnitude = "magnitude"
+	CheckDocs      = "docs"
+)
+
+type (
+	Violation struct {
+		// one of the Check constants
+		Check string
+		// key of the offending entry, or name of the cached page
+		Key    string
+		Detail string
+		// Fsck is able to repair the violation
+		Repairable bool
+		Repaired   bool
+	}
+
+	FsckReport struct {
+		Violations []Violation
+		// number of documents and words checked
+		Docs  int
+		Words int
+	}
+
+	// what the checks need to know of every DocInfo
+	docSummary struct {
+		indexed  bool
+		hasWords bool
+		children []uint32
+		url      string
+	}
+)
+
+// Count returns the number of violations of the check, repaired ones included
+func (r *FsckReport) Count(check string) (found int, repaired int) {
+	for _, v := range r.Violations {
+		if v.Check == check {
+			found++
+			if v.Repaired {
+				repaired++
+			}
+		}
+	}
+	return found, repaired
+}
+
+// Remaining returns the number of violations left in the index
+func (r *FsckReport) Remaining() int {
+	n := 0
+	for _, v := range r.Violations {
+		if !v.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+/*
+Fsck checks the consistency of the index, refer to the description above
+\params: context, tables, page cache directory, repair the repairable violations or only report them
+\return: report listing every violation, error
+*/
+func Fsck(ctx context.Context, tables *Tables, docsDir string, repair bool) (*FsckReport, error) {
+	report := &FsckReport{}
+
+	docs := make(map[uint32]docSummary)
+	referenced := make(map[string]bool)
+	err := tables.Docs.Scan(ctx, func(docID uint32, info DocInfo) error {
+		docs[docID] = docSummary{
+			indexed:  !info.Mod_date.IsZero(),
+			hasWords: len(info.Words_mapping) > 0,
+			children: info.Children,
+			url:      info.Url.String(),
+		}
+		for wordHash := range info.Words_mapping {
+			referenced[wordHash] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Docs = len(docs)
+
+	for _, postings := range []PostingTable{tables.TitlePostings, tables.BodyPostings} {
+		if err = fsckPostings(ctx, postings, docs, referenced, repair, report); err != nil {
+			return nil, err
+		}
+	}
+
+	// words are deleted after the scan, the table is not written while being iterated
+	var unreferenced []string
+	err = tables.Words.Scan(ctx, func(wordHash string, word string) error {
+		report.Words++
+		if !referenced[wordHash] {
+			unreferenced = append(unreferenced, wordHash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(unreferenced)
+	for _, wordHash := range unreferenced {
+		v := Violation{Check: CheckWords, Key: wordHash, Detail: "word not referenced by any posting list or document", Repairable: true}
+		if repair {
+			if err = tables.Words.Delete(ctx, wordHash); err != nil {
+				return nil, err
+			}
+			v.Repaired = true
+		}
+		report.Violations = append(report.Violations, v)
+	}
+
+	if err = fsckChildren(ctx, tables.Children, docs, repair, report); err != nil {
+		return nil, err
+	}
+	if err = fsckCoverage(ctx, CheckRank, tables.Rank, docs, func(d docSummary) bool { return d.indexed }, repair, report); err != nil {
+		return nil, err
+	}
+	if err = fsckCoverage(ctx, CheckMagnitude, tables.Magnitude, docs, func(d docSummary) bool { return d.indexed && d.hasWords }, repair, report); err != nil {
+		return nil, err
+	}
+	urls, err := fsckRegistry(ctx, tables.DocIDs, docs, repair, report)
+	if err != nil {
+		return nil, err
+	}
+	if err = fsckDocs(docsDir, docs, urls, repair, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// fsckPostings removes docIDs without DocInfo from the posting lists, and collects the words referenced
+func fsckPostings(ctx context.Context, postings PostingTable, docs map[uint32]docSummary, referenced map[string]bool,
+	repair bool, report *FsckReport) error {
+
+	dangling := make(map[string]map[uint32][]float32)
+	err := postings.Scan(ctx, func(wordHash string, list map[uint32][]float32) error {
+		referenced[wordHash] = true
+		for docID := range list {
+			if _, ok := docs[docID]; ok {
+				continue
+			}
+			if dangling[wordHash] == nil {
+				dangling[wordHash] = make(map[uint32][]float32)
+			}
+			// empty list removes the docID when appended, refer to append.go
+			dangling[wordHash][docID] = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, wordHash := range sortedKeys(dangling) {
+		if repair {
+			if err = postings.Append(ctx, wordHash, dangling[wordHash]); err != nil {
+				return err
+			}
+		}
+		for _, docID := range sortedIDs(dangling[wordHash]) {
+			report.Violations = append(report.Violations, Violation{
+				Check:      CheckPostings,
+				Key:        wordHash,
+				Detail:     "posting of document " + docKey(docID) + " without DocInfo",
+				Repairable: true,
+				Repaired:   repair,
+			})
+		}
+	}
+	return nil
+}
+
+// fsckChildren makes DocID_children follow DocInfo.Children, which the indexer writes at the same time
+func fsckChildren(ctx context.Context, children ChildrenTable, docs map[uint32]docSummary, repair bool, report *FsckReport) error {
+	stored := make(map[uint32][]uint32)
+	err := children.Scan(ctx, func(docID uint32, list []uint32) error {
+		stored[docID] = list
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, docID := range sortedIDs(stored) {
+		if _, ok := docs[docID]; !ok {
+			v := Violation{Check: CheckChildren, Key: docKey(docID), Detail: "children without DocInfo", Repairable: true}
+			if repair {
+				if err = children.Delete(ctx, docID); err != nil {
+					return err
+				}
+				v.Repaired = true
+			}
+			report.Violations = append(report.Violations, v)
+		}
+	}
+
+	for _, docID := range sortedIDs(docs) {
+		d := docs[docID]
+		list, ok := stored[docID]
+		if !d.indexed && !ok && len(d.children) == 0 {
+			// not fetched yet, nothing to compare
+			continue
+		}
+		if ok && sameSet(list, d.children) {
+			continue
+		}
+
+		v := Violation{Check: CheckChildren, Key: docKey(docID), Detail: "children differ from DocInfo.Children", Repairable: true}
+		if !ok {
+			v.Detail = "DocInfo.Children not in the children table"
+		}
+		if repair {
+			if err = children.Put(ctx, docID, append([]uint32{}, d.children...)); err != nil {
+				return err
+			}
+			v.Repaired = true
+		}
+		report.Violations = append(report.Violations, v)
+	}
+	return nil
+}
+
+// fsckCoverage checks that the table has an entry for every document needing one, and none for unknown documents
+func fsckCoverage(ctx context.Context, check string, table DocRankTable, docs map[uint32]docSummary, needed func(docSummary) bool,
+	repair bool, report *FsckReport) error {
+
+	present := make(map[uint32]bool)
+	err := table.Scan(ctx, func(docID uint32, _ map[string]float64) error {
+		present[docID] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, docID := range sortedIDs(present) {
+		if _, ok := docs[docID]; ok {
+			continue
+		}
+		v := Violation{Check: check, Key: docKey(docID), Detail: check + " without DocInfo", Repairable: true}
+		if repair {
+			if err = table.Delete(ctx, docID); err != nil {
+				return err
+			}
+			v.Repaired = true
+		}
+		report.Violations = append(report.Violations, v)
+	}
+
+	for _, docID := range sortedIDs(docs) {
+		if needed(docs[docID]) && !present[docID] {
+			report.Violations = append(report.Violations, Violation{
+				Check:  check,
+				Key:    docKey(docID),
+				Detail: "indexed document without " + check + ", crawl again to rebuild it",
+			})
+		}
+	}
+	return nil
+}
+
+// fsckRegistry registers the URL of the documents whose docID has none, and returns the URL of every docID
+func fsckRegistry(ctx context.Context, registry *DocRegistry, docs map[uint32]docSummary, repair bool,
+	report *FsckReport) (map[uint32]string, error) {
+
+	urls := make(map[uint32]string)
+	err := registry.Scan(ctx, func(docID uint32, url string) error {
+		urls[docID] = url
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, docID := range sortedIDs(docs) {
+		if _, ok := urls[docID]; ok {
+			continue
+		}
+		v := Violation{Check: CheckRegistry, Key: docKey(docID), Detail: "document without URL in DocID_url", Repairable: true}
+		if repair {
+			if err = registry.put(ctx, docID, docs[docID].url); err != nil {
+				return nil, err
+			}
+			v.Repaired = true
+		}
+		// cached page is named after the URL of the DocInfo until registered
+		urls[docID] = docs[docID].url
+		report.Violations = append(report.Violations, v)
+	}
+	return urls, nil
+}
+
+// fsckDocs compares the page cache, named after the docHash of the URLs, with the indexed documents
+func fsckDocs(docsDir string, docs map[uint32]docSummary, urls map[uint32]string, repair bool, report *FsckReport) error {
+	files, err := ioutil.ReadDir(docsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	byHash := make(map[string]uint32, len(urls))
+	for docID, url := range urls {
+		byHash[DocHash(url)] = docID
+	}
+	cached := make(map[string]bool)
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		cached[f.Name()] = true
+		if docID, ok := byHash[f.Name()]; ok && docs[docID].indexed {
+			continue
+		}
+
+		v := Violation{Check: CheckDocs, Key: f.Name(), Detail: "cached page without indexed DocInfo", Repairable: true}
+		if repair {
+			if err = os.Remove(filepath.Join(docsDir, f.Name())); err != nil {
+				return err
+			}
+			v.Repaired = true
+		}
+		report.Violations = append(report.Violations, v)
+	}
+
+	for _, docID := range sortedIDs(docs) {
+		if docs[docID].indexed && !cached[DocHash(urls[docID])] {
+			report.Violations = append(report.Violations, Violation{
+				Check:  CheckDocs,
+				Key:    docKey(docID),
+				Detail: "indexed document without cached page in " + strings.TrimSuffix(docsDir, "/"),
+			})
+		}
+	}
+	return nil
+}
+
+func sameSet(a []uint32, b []uint32) bool {
+	set := make(map[uint32]bool, len(a))
+	for _, s := range a {
+		set[s] = true
+	}
+	other := make(map[uint32]bool, len(b))
+	for _, s := range b {
+		if !set[s] {
+			return false
+		}
+		other[s] = true
+	}
+	return len(set) == len(other)
+}
+
+// docKey is the key of a violation concerning a document
+func docKey(docID uint32) string {
+	return strconv.FormatUint(uint64(docID), 10)
+}
+
+// sortedIDs returns the keys of a map keyed by docID, in increasing order
+func sortedIDs(m interface{}) []uint32 {
+	var ids []uint32
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		ids = append(ids, uint32(k.Uint()))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// sortedKeys returns the keys of a map keyed by string, violations are reported in key order
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
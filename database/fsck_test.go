@@ -0,0 +1,79 @@
+package database
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFsck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	inv, forw, _ := MemoryDB_init(ctx)
+	tables, _ := NewTables(inv, forw)
+	defer tables.Close(ctx, cancel)
+
+	// docA is indexed with a single child docB, docB is not fetched yet
+	urlA, _ := url.Parse("https://a.com/")
+	urlB, _ := url.Parse("https://a.com/b")
+	tables.DocIDs.Assign(ctx, urlA.String())
+	tables.DocIDs.Assign(ctx, urlB.String())
+	tables.Docs.Put(ctx, docA, DocInfo{Url: *urlA, Mod_date: time.Now(), Children: []uint32{docB}, Words_mapping: map[string]uint32{"w": 1}})
+	tables.Docs.Put(ctx, docB, DocInfo{Url: *urlB, Parents: map[uint32][]string{docA: nil}})
+	tables.Children.Put(ctx, docA, []uint32{docB})
+	tables.Rank.Put(ctx, docA, map[string]float64{"topic": 1})
+	tables.Magnitude.Put(ctx, docA, map[string]float64{"body": 1})
+	tables.Words.Put(ctx, "w", "word")
+	tables.BodyPostings.Put(ctx, "w", map[uint32][]float32{docA: {1, 0}})
+	ioutil.WriteFile(filepath.Join(dir, DocHash(urlA.String())), []byte("<html></html>"), 0644)
+
+	report, err := Fsck(ctx, tables, dir, false)
+	if err != nil || len(report.Violations) != 0 {
+		t.Fatalf("got %v (%v) on a consistent index", report.Violations, err)
+	}
+
+	// leftovers of a crashed crawl
+	orphan, urlC := uint32(9), &url.URL{Scheme: "https", Host: "a.com", Path: "/c"}
+	tables.BodyPostings.Append(ctx, "w", map[uint32][]float32{orphan: {1, 2}})
+	tables.Words.Put(ctx, "x", "unused")
+	tables.Children.Put(ctx, docA, nil)
+	tables.Rank.Put(ctx, orphan, map[string]float64{"topic": 1})
+	tables.Magnitude.Delete(ctx, docA)
+	tables.Docs.Put(ctx, 3, DocInfo{Url: *urlC, Parents: map[uint32][]string{docA: nil}})
+	ioutil.WriteFile(filepath.Join(dir, DocHash("https://a.com/orphan")), []byte("<html></html>"), 0644)
+
+	want := map[string][2]int{
+		CheckPostings:  {1, 1},
+		CheckWords:     {1, 1},
+		CheckChildren:  {1, 1},
+		CheckRank:      {1, 1},
+		CheckMagnitude: {1, 0},
+		CheckDocs:      {1, 1},
+		CheckRegistry:  {1, 1},
+	}
+	if report, err = Fsck(ctx, tables, dir, true); err != nil {
+		t.Fatal(err)
+	}
+	for check, w := range want {
+		if found, repaired := report.Count(check); found != w[0] || repaired != w[1] {
+			t.Errorf("%s: got %d violations and %d repaired, want %d and %d", check, found, repaired, w[0], w[1])
+		}
+	}
+
+	// only the missing magnitude is left
+	if report, err = Fsck(ctx, tables, dir, false); err != nil || report.Remaining() != 1 {
+		t.Errorf("got %v (%v) after repair, want the missing magnitude only", report.Violations, err)
+	}
+	if docID, err := tables.DocIDs.ID(ctx, urlC.String()); err != nil || docID != 3 {
+		t.Errorf("got docID %d (%v) for the URL registered by the repair, want 3", docID, err)
+	}
+}
@@ -0,0 +1,197 @@
+package database
+
+import (
+	"context"
+	"flag"
+	"time"
+)
+
+/*
+=============================== PLACEHOLDER COLLECTION ==========================================
+	The indexer stores a placeholder DocInfo for every child not fetched yet (zero Mod_date), holding
+	its URL and the anchor text given by its parents, and appends the anchor text to the title posting
+	lists. CollectPlaceholders removes the placeholders unlikely to be fetched ever:
+		- orphans, which no parent links to anymore
+		- placeholders discovered longer than MaxAge ago, if MaxAge is set
+		- placeholders linked by fewer than MinParents parents, if MinParents is set
+	Together with a placeholder, its anchor text postings, its pageRank and magnitude, and its docID
+	in the Children and Parents of every other document are removed. The registry keeps its docID, so
+	that a later link to the same URL gets it back. Placeholders are deleted last, an interrupted
+	collection is completed by the next one. Run it while nothing else writes to the index, e.g. after
+	crawling and before ranking.
+*/
+
+type (
+	PlaceholderOptions struct {
+		// placeholders discovered longer ago are removed, 0 disables the age threshold
+		MaxAge time.Duration
+		// placeholders linked by fewer parents are removed, 0 disables the link-count threshold
+		MinParents int
+		// only report the placeholders to be removed
+		DryRun bool
+	}
+
+	PlaceholderReport struct {
+		// number of documents and placeholders checked
+		Docs         int
+		Placeholders int
+		// placeholders removed, or to be removed on a dry run
+		Removed []DocLink
+		// anchor text postings, pageRanks and magnitudes removed with them
+		Postings   int
+		Ranks      int
+		Magnitudes int
+		// documents whose Children or Parents referenced a removed placeholder
+		Pruned int
+	}
+)
+
+// RegisterFlags binds the thresholds to command line flags, the current values are used as the flag defaults
+func (opts *PlaceholderOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&opts.MaxAge, "maxPlaceholderAge", opts.MaxAge, "-maxPlaceholderAge=<age_of_children_not_fetched_to_be_removed,_0_keeps_them>")
+	fs.IntVar(&opts.MinParents, "minPlaceholderParents", opts.MinParents, "-minPlaceholderParents=<children_not_fetched_with_fewer_parents_are_removed>")
+}
+
+// collects tells whether the DocInfo is a placeholder to be removed
+func (opts PlaceholderOptions) collects(info DocInfo, now time.Time) bool {
+	switch {
+	case !info.Mod_date.IsZero():
+		return false
+	case len(info.Parents) == 0:
+		return true
+	case opts.MaxAge > 0 && now.Sub(info.Discovered) > opts.MaxAge:
+		return true
+	}
+	return opts.MinParents > 0 && len(info.Parents) < opts.MinParents
+}
+
+/*
+CollectPlaceholders removes the placeholders of children not fetched yet, refer to the description above
+\params: context, tables, thresholds
+\return: report listing the placeholders removed, error
+*/
+func CollectPlaceholders(ctx context.Context, tables *Tables, opts PlaceholderOptions) (*PlaceholderReport, error) {
+	report := &PlaceholderReport{}
+	now := time.Now().UTC()
+
+	removed := make(map[uint32]DocInfo)
+	err := tables.Docs.Scan(ctx, func(docID uint32, info DocInfo) error {
+		report.Docs++
+		if info.Mod_date.IsZero() {
+			report.Placeholders++
+		}
+		if opts.collects(info, now) {
+			removed[docID] = info
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, docID := range sortedIDs(removed) {
+		u := removed[docID].Url
+		report.Removed = append(report.Removed, DocLink{DocID: docID, Url: u.String()})
+	}
+	if len(removed) == 0 {
+		return report, nil
+	}
+
+	// documents referencing the placeholders are rewritten after the scan
+	pruned := make(map[uint32]DocInfo)
+	err = tables.Docs.Scan(ctx, func(docID uint32, info DocInfo) error {
+		if _, ok := removed[docID]; ok {
+			return nil
+		}
+		changed := false
+		children := make([]uint32, 0, len(info.Children))
+		for _, c := range info.Children {
+			if _, ok := removed[c]; ok {
+				changed = true
+				continue
+			}
+			children = append(children, c)
+		}
+		for p := range info.Parents {
+			if _, ok := removed[p]; ok {
+				delete(info.Parents, p)
+				changed = true
+			}
+		}
+		if changed {
+			info.Children = children
+			pruned[docID] = info
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Pruned = len(pruned)
+
+	// anchor text of every parent has been appended to the title posting lists, refer to indexer.setAnchor
+	// empty list removes the docID when appended, refer to append.go
+	anchors := make(map[string]map[uint32][]float32)
+	for docID, info := range removed {
+		for _, anchor := range info.Parents {
+			for _, word := range anchor {
+				wordHash := hashOf(word)
+				if anchors[wordHash] == nil {
+					anchors[wordHash] = make(map[uint32][]float32)
+				}
+				anchors[wordHash][docID] = nil
+			}
+		}
+	}
+	for _, list := range anchors {
+		report.Postings += len(list)
+	}
+
+	for _, docID := range sortedIDs(removed) {
+		for _, t := range []struct {
+			table DocRankTable
+			count *int
+		}{{tables.Rank, &report.Ranks}, {tables.Magnitude, &report.Magnitudes}} {
+			has, err := t.table.Has(ctx, docID)
+			if err != nil {
+				return nil, err
+			}
+			if !has {
+				continue
+			}
+			*t.count++
+			if opts.DryRun {
+				continue
+			}
+			if err = t.table.Delete(ctx, docID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+
+	for _, docID := range sortedIDs(pruned) {
+		info := pruned[docID]
+		if err = tables.Docs.Put(ctx, docID, info); err != nil {
+			return nil, err
+		}
+		// the indexer writes the children of every document it fetched
+		if !info.Mod_date.IsZero() {
+			if err = tables.Children.Put(ctx, docID, info.Children); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, wordHash := range sortedKeys(anchors) {
+		if err = tables.TitlePostings.Append(ctx, wordHash, anchors[wordHash]); err != nil {
+			return nil, err
+		}
+	}
+	for _, docID := range sortedIDs(removed) {
+		if err = tables.Docs.Delete(ctx, docID); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCollectPlaceholders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	inv, forw, _ := MemoryDB_init(ctx)
+	tables, _ := NewTables(inv, forw)
+	defer tables.Close(ctx, cancel)
+
+	// docA is indexed with an old child docB and a fresh child docC, docD is linked by nobody anymore
+	docC, docD := uint32(3), uint32(4)
+	old, fresh := time.Now().Add(-48*time.Hour), time.Now()
+	tables.Docs.Put(ctx, docA, DocInfo{Mod_date: fresh, Children: []uint32{docB, docC}, Discovered: old})
+	tables.Docs.Put(ctx, docB, DocInfo{Parents: map[uint32][]string{docA: {"old"}}, Discovered: old})
+	tables.Docs.Put(ctx, docC, DocInfo{Parents: map[uint32][]string{docA: {"fresh"}}, Discovered: fresh})
+	tables.Docs.Put(ctx, docD, DocInfo{Discovered: fresh})
+	tables.Children.Put(ctx, docA, []uint32{docB, docC})
+	tables.TitlePostings.Put(ctx, hashOf("old"), map[uint32][]float32{docB: {1, -100}})
+	tables.TitlePostings.Put(ctx, hashOf("fresh"), map[uint32][]float32{docC: {1, -100}})
+	tables.Rank.Put(ctx, docB, map[string]float64{"topic": 1})
+
+	opts := PlaceholderOptions{MaxAge: 24 * time.Hour, DryRun: true}
+	report, err := CollectPlaceholders(ctx, tables, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) != 2 || report.Placeholders != 3 || report.Postings != 1 || report.Ranks != 1 || report.Pruned != 1 {
+		t.Errorf("got %+v on a dry run", report)
+	}
+	if has, _ := tables.Docs.Has(ctx, docB); !has {
+		t.Fatal("dry run removed a placeholder")
+	}
+
+	opts.DryRun = false
+	if _, err = CollectPlaceholders(ctx, tables, opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, docID := range []uint32{docB, docD} {
+		if has, _ := tables.Docs.Has(ctx, docID); has {
+			t.Errorf("placeholder %d not removed", docID)
+		}
+	}
+	if has, _ := tables.Rank.Has(ctx, docB); has {
+		t.Error("pageRank of the placeholder not removed")
+	}
+	if list, err := tables.TitlePostings.Get(ctx, hashOf("old")); err == nil && len(list) > 0 {
+		t.Errorf("got postings %v of the placeholder", list)
+	}
+	if info, _ := tables.Docs.Get(ctx, docA); !reflect.DeepEqual(info.Children, []uint32{docC}) {
+		t.Errorf("got children %v in DocInfo, want the fresh child only", info.Children)
+	}
+	if children, _ := tables.Children.Get(ctx, docA); !reflect.DeepEqual(children, []uint32{docC}) {
+		t.Errorf("got children %v in the children table, want the fresh child only", children)
+	}
+	if has, _ := tables.Docs.Has(ctx, docC); !has {
+		t.Error("fresh placeholder removed")
+	}
+}
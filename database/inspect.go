@@ -0,0 +1,272 @@
+package database
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"time"
+)
+
+/*
+=============================== INSPECTION ==========================================
+	Views of the index for cmd/inspect, each of them reads only what it shows:
+		Stats		: number of keys and on-disk size of every table
+		TopTerms	: terms with the highest document frequency in a posting table
+		InspectDoc	: DocInfo of a document with the URLs of its children and parents, and its words
+		InspectTerm	: posting lists of a word with the URLs of the documents
+	URLs are resolved by the registry of docIDs. Documents or words referenced but missing from the
+	tables are shown with an empty URL or word, run cmd/fsck to find out why.
+*/
+
+type (
+	TableStats struct {
+		Name string
+		Keys int
+		// posting list fragments not folded yet, refer to append.go
+		Fragments int
+		// on-disk size of the LSM tree and of the value log in bytes, as last computed by badger
+		LSMSize  int64
+		VlogSize int64
+	}
+
+	IndexStats struct {
+		SchemaVersion int
+		Tables        []TableStats
+		// number of distinct words and documents known to the index
+		Vocabulary int
+		Documents  int
+	}
+
+	TermFrequency struct {
+		WordHash string
+		Word     string
+		// number of documents containing the word
+		Docs int
+	}
+
+	DocLink struct {
+		DocID uint32
+		Url   string
+		// anchor text given by the parent
+		Anchor []string `json:",omitempty"`
+	}
+
+	WordCount struct {
+		Word string
+		Freq uint32
+	}
+
+	DocView struct {
+		DocID     uint32
+		Url       string
+		Title     []string
+		ModDate   time.Time
+		Size      uint32
+		Children  []DocLink
+		Parents   []DocLink
+		Words     []WordCount
+		Rank      map[string]float64
+		Magnitude map[string]float64
+	}
+
+	Posting struct {
+		DocID     uint32
+		Url       string
+		Weight    float32
+		Positions []float32
+	}
+
+	TermView struct {
+		WordHash string
+		Word     string
+		Title    []Posting
+		Body     []Posting
+	}
+
+	// min-heap on the document frequency, keeps the top N terms while scanning
+	termHeap []TermFrequency
+)
+
+// Stats collects the statistics of every table, scanning the keys of each
+func Stats(ctx context.Context, tables *Tables) (*IndexStats, error) {
+	ret := &IndexStats{SchemaVersion: SchemaVersion}
+	for _, t := range tables.All() {
+		s, err := t.Stats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ret.Tables = append(ret.Tables, s)
+
+		if t == tables.Words.Raw() {
+			ret.Vocabulary = s.Keys
+		} else if t == tables.Docs.Raw() {
+			ret.Documents = s.Keys
+		}
+	}
+	return ret, nil
+}
+
+/*
+TopTerms returns the n terms contained in the most documents, in descending order of document frequency
+\params: context, posting table to rank the terms of, word table to resolve the words, n
+\return: terms, error
+*/
+func TopTerms(ctx context.Context, postings PostingTable, words WordTable, n int) ([]TermFrequency, error) {
+	h := &termHeap{}
+	err := postings.Scan(ctx, func(wordHash string, list map[uint32][]float32) error {
+		t := TermFrequency{WordHash: wordHash, Docs: len(list)}
+		if h.Len() < n {
+			heap.Push(h, t)
+		} else if n > 0 && termLess((*h)[0], t) {
+			(*h)[0] = t
+			heap.Fix(h, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]TermFrequency, h.Len())
+	for i := len(ret) - 1; i >= 0; i-- {
+		ret[i] = heap.Pop(h).(TermFrequency)
+		if ret[i].Word, err = words.Get(ctx, ret[i].WordHash); err != nil && err != ErrNotFound {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// InspectDoc resolves the DocInfo of the document, ErrNotFound if the document is unknown
+func InspectDoc(ctx context.Context, tables *Tables, docID uint32) (*DocView, error) {
+	info, err := tables.Docs.Get(ctx, docID)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &DocView{
+		DocID:   docID,
+		Url:     info.Url.String(),
+		Title:   info.Page_title,
+		ModDate: info.Mod_date,
+		Size:    info.Page_size,
+	}
+	for _, c := range info.Children {
+		url, err := docUrl(ctx, tables.DocIDs, c)
+		if err != nil {
+			return nil, err
+		}
+		ret.Children = append(ret.Children, DocLink{DocID: c, Url: url})
+	}
+	for p, anchor := range info.Parents {
+		url, err := docUrl(ctx, tables.DocIDs, p)
+		if err != nil {
+			return nil, err
+		}
+		ret.Parents = append(ret.Parents, DocLink{DocID: p, Url: url, Anchor: anchor})
+	}
+	sort.Slice(ret.Parents, func(i, j int) bool { return ret.Parents[i].Url < ret.Parents[j].Url })
+
+	for wordHash, freq := range info.Words_mapping {
+		word, err := tables.Words.Get(ctx, wordHash)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		ret.Words = append(ret.Words, WordCount{word, freq})
+	}
+	sort.Slice(ret.Words, func(i, j int) bool {
+		if ret.Words[i].Freq != ret.Words[j].Freq {
+			return ret.Words[i].Freq > ret.Words[j].Freq
+		}
+		return ret.Words[i].Word < ret.Words[j].Word
+	})
+
+	if ret.Rank, err = tables.Rank.Get(ctx, docID); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	if ret.Magnitude, err = tables.Magnitude.Get(ctx, docID); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// InspectTerm resolves the posting lists of the word, ErrNotFound if no document contains it
+func InspectTerm(ctx context.Context, tables *Tables, wordHash string) (*TermView, error) {
+	ret := &TermView{WordHash: wordHash}
+	word, err := tables.Words.Get(ctx, wordHash)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	ret.Word = word
+
+	found := false
+	for _, p := range []struct {
+		table PostingTable
+		out   *[]Posting
+	}{{tables.TitlePostings, &ret.Title}, {tables.BodyPostings, &ret.Body}} {
+		list, err := p.table.Get(ctx, wordHash)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		found = true
+
+		for docID, l := range list {
+			url, err := docUrl(ctx, tables.DocIDs, docID)
+			if err != nil {
+				return nil, err
+			}
+			// first entry is the weight, refer to noschema_schema.go
+			posting := Posting{DocID: docID, Url: url}
+			if len(l) > 0 {
+				posting.Weight, posting.Positions = l[0], l[1:]
+			}
+			*p.out = append(*p.out, posting)
+		}
+		postings := *p.out
+		sort.Slice(postings, func(i, j int) bool {
+			if postings[i].Weight != postings[j].Weight {
+				return postings[i].Weight > postings[j].Weight
+			}
+			return postings[i].Url < postings[j].Url
+		})
+	}
+
+	if !found {
+		return nil, ErrNotFound
+	}
+	return ret, nil
+}
+
+// docUrl returns the URL of the document, empty if the docID has not been assigned
+func docUrl(ctx context.Context, registry *DocRegistry, docID uint32) (string, error) {
+	url, err := registry.URL(ctx, docID)
+	if err == ErrNotFound {
+		return "", nil
+	}
+	return url, err
+}
+
+func (h termHeap) Len() int { return len(h) }
+
+func (h termHeap) Less(i, j int) bool { return termLess(h[i], h[j]) }
+
+// ties are broken on the wordHash, so that the top terms do not depend on the scan order
+func termLess(a TermFrequency, b TermFrequency) bool {
+	if a.Docs != b.Docs {
+		return a.Docs < b.Docs
+	}
+	return a.WordHash > b.WordHash
+}
+
+func (h termHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *termHeap) Push(x interface{}) { *h = append(*h, x.(TermFrequency)) }
+
+func (h *termHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	inv, forw, _ := MemoryDB_init(ctx)
+	tables, _ := NewTables(inv, forw)
+	defer tables.Close(ctx, cancel)
+
+	// docB is linked but its URL has not been registered
+	u, _ := url.Parse("https://a.com/")
+	tables.DocIDs.Assign(ctx, u.String())
+	tables.Docs.Put(ctx, docA, DocInfo{Url: *u, Children: []uint32{docB}, Words_mapping: map[string]uint32{"w": 2, "x": 1}})
+	tables.Words.Put(ctx, "w", "word")
+	tables.Words.Put(ctx, "x", "other")
+	tables.BodyPostings.Put(ctx, "w", map[uint32][]float32{docA: {0.5, 1, 4}, docB: {1, 2}})
+	tables.BodyPostings.Put(ctx, "x", map[uint32][]float32{docA: {1, 3}})
+
+	stats, err := Stats(ctx, tables)
+	if err != nil || stats.Vocabulary != 2 || stats.Documents != 1 || len(stats.Tables) != len(tables.All()) {
+		t.Errorf("got %+v (%v)", stats, err)
+	}
+
+	terms, err := TopTerms(ctx, tables.BodyPostings, tables.Words, 1)
+	if want := []TermFrequency{{"w", "word", 2}}; err != nil || !reflect.DeepEqual(terms, want) {
+		t.Errorf("got %v (%v), want %v", terms, err, want)
+	}
+
+	doc, err := InspectDoc(ctx, tables, docA)
+	if err != nil || doc.Url != u.String() || !reflect.DeepEqual(doc.Children, []DocLink{{DocID: docB}}) ||
+		!reflect.DeepEqual(doc.Words, []WordCount{{"word", 2}, {"other", 1}}) {
+		t.Errorf("got %+v (%v)", doc, err)
+	}
+
+	term, err := InspectTerm(ctx, tables, "w")
+	want := []Posting{{docB, "", 1, []float32{2}}, {docA, u.String(), 0.5, []float32{1, 4}}}
+	if err != nil || term.Word != "word" || len(term.Title) != 0 || !reflect.DeepEqual(term.Body, want) {
+		t.Errorf("got %+v (%v), want body %v", term, err, want)
+	}
+}
@@ -0,0 +1,582 @@
+package database
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/apsdehal/go-logger"
+	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+=============================== WRITE-AHEAD JOURNAL ==========================================
+	Every table opened by DB_init lives in its own Badger instance, so a write touching several
+	tables cannot be committed in a single Badger transaction. A UnitOfWork collects the
+	mutations of several tables, and on commit:
+		1. writes all of them as one record to the journal (synced to disk)
+		2. applies them to each table
+		3. syncs the tables touched, as they are opened without SyncWrites
+		4. removes the record from the journal
+	A record left in the journal means the process stopped in between, DB_init replays it the
+	next time the tables are opened. Mutations carry the full encoded value, replaying them is
+	idempotent. If the process stops before the record is written, nothing has been applied.
+	Each commit costs one fsync to write the record, one per table touched (per shard of a sharded
+	table) and one to remove the record, e.g. 7 for a page indexed into Words, Docs, Children and the
+	two posting tables. Commits are not batched, so indexing is bound by the fsync latency of the disk;
+	BenchmarkCommit compares a commit with the same writes made without a unit of work.
+
+	Records are removed in order of sequence: a record applied is kept as long as an earlier one
+	is not, so that a record left in the journal is always followed by every later record. Replay
+	applies them in order of sequence and skips the mutations of a key which a later record sets
+	or deletes, hence a stale record never overwrites a newer commit of the same key.
+	If a commit fails to apply its record, the tables are left half-written: the next commit
+	replays the whole journal before its own record.
+
+	Schema for the journal table (journal/):
+		key	: sequence number (type: uint64, big-endian)
+		value	: list of mutations (type: []journalOp, JSON)
+*/
+
+const journalDir = "journal/"
+
+// commits hold it for reading while writing to the tables, Backup holds it for writing while taking its snapshots
+var commitLock sync.RWMutex
+
+var (
+	ErrJournalMismatch = errors.New("Tables in a unit of work must be opened by the same DB_init call")
+
+	ErrTableNotSupported = errors.New("Table does not support units of work")
+
+	ErrUnitOfWorkDone = errors.New("Unit of work has already been committed or discarded")
+
+	ErrJournalLegacy = errors.New("Journal holds interrupted commits of an older schema, open the index with the build which wrote it before migrating")
+)
+
+type (
+	// mutation of a single key, with key and value already marshalled according to the table schema
+	journalOp struct {
+		Table  string `json:"Table"`
+		Key    []byte `json:"Key"`
+		Value  []byte `json:"Value,omitempty"`
+		Delete bool   `json:"Delete,omitempty"`
+		// Value is a fragment of the posting list, refer to append.go
+		Append bool `json:"Append,omitempty"`
+	}
+
+	journal struct {
+		db     *badger.DB
+		logger *logger.Logger
+		refs   int32
+
+		mutex sync.Mutex
+		seq   uint64
+		// records not removed yet by sequence number, true once applied and synced
+		records map[uint64]bool
+		// a commit failed to apply its record, the journal is replayed before the next commit
+		failed bool
+		// every table opened by DB_init by name, to replay the journal
+		tables map[string]rawTable
+	}
+
+	// implemented by the tables of this package to let a UnitOfWork write already-marshalled pairs
+	rawTable interface {
+		tableName() string
+		schema() (keyCodec Codec, valCodec Codec)
+		tableJournal() *journal
+		writeRaw(ops []journalOp) error
+		// flush the writes to disk
+		sync() error
+	}
+
+	// UnitOfWork collects mutations across several tables, and commits all of them or none
+	// safe for concurrent use
+	UnitOfWork struct {
+		mutex   sync.Mutex
+		ops     []journalOp
+		pending map[string]map[string]int
+		tables  map[string]rawTable
+		done    bool
+	}
+)
+
+func openJournal(dir string, logger *logger.Logger) (*journal, error) {
+	opts := badger.DefaultOptions(dir)
+	opts.Dir, opts.ValueDir = dir, dir
+	// the journal is only useful if the record is on disk before the tables are touched
+	opts.SyncWrites = true
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// sequence only needs to be increasing across restarts
+	return &journal{db: db, logger: logger, seq: uint64(time.Now().UnixNano()), records: make(map[uint64]bool)}, nil
+}
+
+func (j *journal) acquire() {
+	atomic.AddInt32(&j.refs, 1)
+}
+
+// journal is closed together with the last table using it
+func (j *journal) release() error {
+	if atomic.AddInt32(&j.refs, -1) == 0 {
+		return j.db.Close()
+	}
+	return nil
+}
+
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// append writes the record, returns its sequence number
+func (j *journal) append(ops []journalOp) (uint64, error) {
+	val, err := json.Marshal(ops)
+	if err != nil {
+		return 0, err
+	}
+
+	// sequence is registered before the record is written, so that no later record is removed before it
+	j.mutex.Lock()
+	j.seq++
+	seq := j.seq
+	j.records[seq] = false
+	j.mutex.Unlock()
+
+	err = j.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(seqKey(seq), val)
+	})
+	if err != nil {
+		j.mutex.Lock()
+		delete(j.records, seq)
+		j.mutex.Unlock()
+		return 0, err
+	}
+	return seq, nil
+}
+
+// applied marks the record as applied and synced, and removes the records applied before the oldest one which is not
+func (j *journal) applied(seq uint64) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.records[seq] = true
+	seqs := make([]uint64, 0, len(j.records))
+	for s := range j.records {
+		seqs = append(seqs, s)
+	}
+	sort.Slice(seqs, func(a, b int) bool { return seqs[a] < seqs[b] })
+
+	var removed []uint64
+	for _, s := range seqs {
+		if !j.records[s] {
+			break
+		}
+		removed = append(removed, s)
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	err := j.db.Update(func(txn *badger.Txn) error {
+		for _, s := range removed {
+			if err := txn.Delete(seqKey(s)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range removed {
+		delete(j.records, s)
+	}
+	return nil
+}
+
+// fail marks the journal to be replayed before the next commit
+func (j *journal) fail() {
+	j.mutex.Lock()
+	j.failed = true
+	j.mutex.Unlock()
+}
+
+// recover replays the journal if a commit has failed, no other commit runs meanwhile
+func (j *journal) recover() error {
+	j.mutex.Lock()
+	failed := j.failed
+	j.mutex.Unlock()
+	if !failed {
+		return nil
+	}
+
+	commitLock.Lock()
+	defer commitLock.Unlock()
+	replayed, err := j.replay(j.tables)
+	if err != nil {
+		return err
+	}
+	j.logger.Infof("Replayed %d commits of the journal after a failed commit", replayed)
+	return nil
+}
+
+// empty reports whether the journal holds no record
+func (j *journal) empty() (bool, error) {
+	empty := true
+	err := j.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{})
+		defer it.Close()
+
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	return empty, err
+}
+
+// replay applies every record left in the journal in order, syncs the tables, then removes the records
+// returns the number of records replayed
+func (j *journal) replay(tables map[string]rawTable) (int, error) {
+	type record struct {
+		key []byte
+		ops []journalOp
+	}
+
+	var records []record
+	err := j.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			var ops []journalOp
+			err := item.Value(func(v []byte) error {
+				return json.Unmarshal(v, &ops)
+			})
+			if err != nil {
+				return err
+			}
+			records = append(records, record{item.KeyCopy(nil), ops})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// sequence check: a Set or Delete of a later record supersedes the mutations of the same key
+	latest := make(map[string]int)
+	for i, r := range records {
+		for _, op := range r.ops {
+			if !op.Append {
+				latest[op.Table+"/"+string(op.Key)] = i
+			}
+		}
+	}
+
+	touched := make(map[string]bool)
+	for i, r := range records {
+		var ops []journalOp
+		for _, op := range r.ops {
+			if last, ok := latest[op.Table+"/"+string(op.Key)]; ok && last > i {
+				continue
+			}
+			ops = append(ops, op)
+			touched[op.Table] = true
+		}
+		if err = applyOps(tables, ops); err != nil {
+			return 0, err
+		}
+	}
+	for name := range touched {
+		if err = tables[name].sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	err = j.db.Update(func(txn *badger.Txn) error {
+		for _, r := range records {
+			if err := txn.Delete(r.key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	j.mutex.Lock()
+	for _, r := range records {
+		delete(j.records, binary.BigEndian.Uint64(r.key))
+	}
+	j.failed = false
+	j.mutex.Unlock()
+	return len(records), nil
+}
+
+// group the mutations by table and apply them
+func applyOps(tables map[string]rawTable, ops []journalOp) error {
+	grouped := make(map[string][]journalOp)
+	var order []string
+	for _, op := range ops {
+		if _, ok := grouped[op.Table]; !ok {
+			order = append(order, op.Table)
+		}
+		grouped[op.Table] = append(grouped[op.Table], op)
+	}
+
+	for _, name := range order {
+		table, ok := tables[name]
+		if !ok {
+			return errors.Errorf("Table %s in the journal is not opened", name)
+		}
+		if err := table.writeRaw(grouped[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewUnitOfWork() *UnitOfWork {
+	return &UnitOfWork{
+		pending: make(map[string]map[string]int),
+		tables:  make(map[string]rawTable),
+	}
+}
+
+// register the table in the unit of work, and marshal key and value according to its schema
+func (u *UnitOfWork) prepare(table DB, key_ interface{}, value_ interface{}, isDelete bool) (rawTable, []byte, []byte, error) {
+	rt, ok := table.(rawTable)
+	if !ok {
+		return nil, nil, nil, ErrTableNotSupported
+	}
+
+	keyCodec, valCodec := rt.schema()
+	if isDelete {
+		valCodec = nil
+	}
+	key, value, err := marshalPair(keyCodec, key_, valCodec, value_)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return rt, key, value, nil
+}
+
+func (u *UnitOfWork) record(rt rawTable, op journalOp) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.done {
+		return ErrUnitOfWorkDone
+	}
+
+	u.tables[op.Table] = rt
+	if u.pending[op.Table] == nil {
+		u.pending[op.Table] = make(map[string]int)
+	}
+
+	// later mutation of the same key replaces the earlier one, appended fragments are folded into it
+	if idx, ok := u.pending[op.Table][string(op.Key)]; ok {
+		if op.Append {
+			var err error
+			if op, err = foldOp(u.ops[idx], op); err != nil {
+				return err
+			}
+		}
+		u.ops[idx] = op
+	} else {
+		u.pending[op.Table][string(op.Key)] = len(u.ops)
+		u.ops = append(u.ops, op)
+	}
+	return nil
+}
+
+// Set the key-value pair of the table once the unit of work is committed
+func (u *UnitOfWork) Set(ctx context.Context, table DB, key interface{}, value interface{}) error {
+	rt, k, v, err := u.prepare(table, key, value, false)
+	if err != nil {
+		return err
+	}
+	return u.record(rt, journalOp{Table: rt.tableName(), Key: k, Value: v})
+}
+
+// Append the postings to the posting list of the table once the unit of work is committed, refer to append.go
+func (u *UnitOfWork) Append(ctx context.Context, table DB, key interface{}, value interface{}) error {
+	if rt, ok := table.(rawTable); ok {
+		if _, valCodec := rt.schema(); !isPostings(valCodec) {
+			return ErrAppendNotSupported
+		}
+	}
+
+	rt, k, v, err := u.prepare(table, key, value, false)
+	if err != nil {
+		return err
+	}
+	return u.record(rt, journalOp{Table: rt.tableName(), Key: k, Value: v, Append: true})
+}
+
+// foldOp folds the appended fragment into the pending mutation of the same key
+func foldOp(pending journalOp, fragment journalOp) (journalOp, error) {
+	// two fragments still have to be appended, the empty lists removing docIDs are kept
+	if pending.Append {
+		older, err := DecodePostings(pending.Value)
+		if err != nil {
+			return pending, err
+		}
+		newer, err := DecodePostings(fragment.Value)
+		if err != nil {
+			return pending, err
+		}
+		for docID, list := range newer {
+			older[docID] = list
+		}
+		pending.Value, err = EncodePostings(older)
+		return pending, err
+	}
+
+	// pending Set or Delete replaces the posting list, the fragment is folded into it
+	values := [][]byte{fragment.Value}
+	if !pending.Delete {
+		values = [][]byte{pending.Value, fragment.Value}
+	}
+	postings, err := foldValues(values)
+	if err != nil {
+		return pending, err
+	}
+	if postings == nil {
+		return journalOp{Table: pending.Table, Key: pending.Key, Delete: true}, nil
+	}
+	value, err := EncodePostings(postings)
+	if err != nil {
+		return pending, err
+	}
+	return journalOp{Table: pending.Table, Key: pending.Key, Value: value}, nil
+}
+
+// Delete the key of the table once the unit of work is committed
+func (u *UnitOfWork) Delete(ctx context.Context, table DB, key interface{}) error {
+	rt, k, _, err := u.prepare(table, key, nil, true)
+	if err != nil {
+		return err
+	}
+	return u.record(rt, journalOp{Table: rt.tableName(), Key: k, Delete: true})
+}
+
+// Get returns the value of the key as it will be after the commit
+// mutations pending in the unit of work take precedence over the table content
+func (u *UnitOfWork) Get(ctx context.Context, table DB, key interface{}) (interface{}, error) {
+	rt, k, _, err := u.prepare(table, key, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	u.mutex.Lock()
+	idx, ok := u.pending[rt.tableName()][string(k)]
+	var op journalOp
+	if ok {
+		op = u.ops[idx]
+	}
+	u.mutex.Unlock()
+
+	if !ok {
+		return table.Get(ctx, key)
+	}
+	if op.Delete {
+		return nil, ErrNotFound
+	}
+	_, valCodec := rt.schema()
+	if !op.Append {
+		return valCodec.Decode(op.Value)
+	}
+
+	// pending fragment is folded into the posting list of the table
+	value, err := table.Get(ctx, key)
+	if err == ErrNotFound {
+		value, err = map[uint32][]float32{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	fragment, err := DecodePostings(op.Value)
+	if err != nil {
+		return nil, err
+	}
+	postings := value.(map[uint32][]float32)
+	foldPostings(postings, fragment)
+	if len(postings) == 0 {
+		return nil, ErrNotFound
+	}
+	return postings, nil
+}
+
+// Commit writes every pending mutation to the tables atomically, refer to the journal description above
+func (u *UnitOfWork) Commit(ctx context.Context) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.done {
+		return ErrUnitOfWorkDone
+	}
+	u.done = true
+
+	if len(u.ops) == 0 {
+		return nil
+	}
+
+	// every table has to share the same journal, tables without journal (e.g. MemoryDB) are not crash-prone
+	var j *journal
+	first := true
+	for _, rt := range u.tables {
+		if first {
+			j, first = rt.tableJournal(), false
+		} else if rt.tableJournal() != j {
+			return ErrJournalMismatch
+		}
+	}
+	if j == nil {
+		return applyOps(u.tables, u.ops)
+	}
+
+	// tables half-written by a failed commit are repaired first
+	if err := j.recover(); err != nil {
+		return err
+	}
+
+	commitLock.RLock()
+	defer commitLock.RUnlock()
+
+	seq, err := j.append(u.ops)
+	if err != nil {
+		return err
+	}
+
+	// record stays in the journal, it is replayed by the next commit or when the tables are opened again
+	if err = applyOps(u.tables, u.ops); err != nil {
+		j.fail()
+		return err
+	}
+	for _, rt := range u.tables {
+		if err = rt.sync(); err != nil {
+			j.fail()
+			return err
+		}
+	}
+	return j.applied(seq)
+}
+
+// Discard drops every pending mutation
+func (u *UnitOfWork) Discard() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.done = true
+	u.ops, u.pending = nil, nil
+}
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"context"
+	"github.com/apsdehal/go-logger"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// failingTable fails to apply the mutations of a unit of work
+type failingTable struct {
+	*BadgerDB
+}
+
+func (failingTable) writeRaw(ops []journalOp) error {
+	return errors.New("write failed")
+}
+
+func openJournalTest(t testing.TB, dir string) (inv []DB, forw []DB, j *journal, close func()) {
+	log, _ := logger.New("test", 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := DefaultDBOptions()
+	opts.Dir, opts.LoadMode, opts.GCInterval = dir, LoadMemoryMap, 0
+
+	inv, forw, err := DB_init(ctx, log, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inv, forw, forw[0].(rawTable).tableJournal(), func() {
+		for _, d := range append(inv, forw...) {
+			d.Close(ctx, cancel)
+		}
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	inv, forw, j, close := openJournalTest(t, dir)
+	forw[7].Set(ctx, uint32(2), "gone")
+
+	// first commit crashes once its record is written, the second one is applied
+	first := NewUnitOfWork()
+	first.Set(ctx, forw[7], uint32(1), "a")
+	first.Set(ctx, forw[6], "a", uint32(1))
+	first.Append(ctx, inv[1], "w", map[uint32][]float32{docA: {1}})
+	first.Delete(ctx, forw[7], uint32(2))
+	if _, err = j.append(first.ops); err != nil {
+		t.Fatal(err)
+	}
+	second := NewUnitOfWork()
+	second.Set(ctx, forw[7], uint32(1), "b")
+	if err = second.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// second record is kept as long as the first one, so that replay does not overwrite it
+	if empty, _ := j.empty(); empty {
+		t.Fatal("records removed before the interrupted commit is applied")
+	}
+	close()
+
+	inv, forw, j, close = openJournalTest(t, dir)
+	defer close()
+
+	for _, c := range []struct {
+		table DB
+		key   interface{}
+		want  interface{}
+	}{
+		{forw[7], uint32(1), "b"},
+		{forw[6], "a", uint32(1)},
+		{inv[1], "w", map[uint32][]float32{docA: {1}}},
+	} {
+		if v, err := c.table.Get(ctx, c.key); err != nil || !reflect.DeepEqual(v, c.want) {
+			t.Errorf("got %v (%v) for %v, want %v", v, err, c.key, c.want)
+		}
+	}
+	if _, err = forw[7].Get(ctx, uint32(2)); err != ErrNotFound {
+		t.Errorf("got error %v for a deleted key, want %v", err, ErrNotFound)
+	}
+	if empty, err := j.empty(); err != nil || !empty {
+		t.Errorf("journal not emptied by the replay (%v)", err)
+	}
+}
+
+func TestJournalFailedCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	_, forw, j, close := openJournalTest(t, dir)
+	defer close()
+
+	failed := NewUnitOfWork()
+	failed.Set(ctx, forw[6], "a", uint32(1))
+	failed.Set(ctx, failingTable{forw[7].(*BadgerDB)}, uint32(1), "a")
+	if err = failed.Commit(ctx); err == nil {
+		t.Fatal("commit failing to write a table succeeded")
+	}
+
+	// next commit replays the half-applied one first
+	next := NewUnitOfWork()
+	next.Set(ctx, forw[6], "b", uint32(2))
+	if err = next.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := forw[7].Get(ctx, uint32(1)); err != nil || v != "a" {
+		t.Errorf("got %v (%v) for 1, want a", v, err)
+	}
+	if v, err := forw[6].Get(ctx, "b"); err != nil || v != uint32(2) {
+		t.Errorf("got %v (%v) for b, want 2", v, err)
+	}
+	if empty, err := j.empty(); err != nil || !empty {
+		t.Errorf("journal not emptied after the recovery (%v)", err)
+	}
+}
+
+// BenchmarkCommit writes what the indexer writes for a page, committed through a unit of work or set directly
+func BenchmarkCommit(b *testing.B) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		name   string
+		commit bool
+	}{
+		{"unitOfWork", true},
+		{"direct", false},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "journal")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			inv, forw, _, close := openJournalTest(b, dir)
+			defer close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				docID := uint32(i)
+				uow := NewUnitOfWork()
+				writes := []struct {
+					table DB
+					key   interface{}
+					value interface{}
+				}{
+					{forw[0], hashA, "word"},
+					{forw[1], docID, DocInfo{Page_title: []string{"word"}}},
+					{forw[2], docID, []uint32{docID + 1}},
+				}
+				for _, w := range writes {
+					if c.commit {
+						err = uow.Set(ctx, w.table, w.key, w.value)
+					} else {
+						err = w.table.Set(ctx, w.key, w.value)
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				for _, d := range inv[:2] {
+					postings := map[uint32][]float32{docID: {1}}
+					if c.commit {
+						err = uow.Append(ctx, d, hashA, postings)
+					} else {
+						err = d.Append(ctx, hashA, postings)
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				if c.commit {
+					err = uow.Commit(ctx)
+				} else {
+					uow.Discard()
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
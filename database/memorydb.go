@@ -0,0 +1,360 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	// map-backed implementation of DB, nothing is persisted to disk
+	// values are stored marshalled to enforce the same schema as BadgerDB
+	MemoryDB struct {
+		mutex    sync.RWMutex
+		data     map[string][]byte
+		name     string
+		keyCodec Codec
+		valCodec Codec
+	}
+
+	// collects the key-value pairs and writes them to the MemoryDB on flush
+	MemoryBatchWriter struct {
+		mutex   sync.Mutex
+		mdb     *MemoryDB
+		pending map[string][]byte
+	}
+)
+
+/*
+	in-memory counterpart of DB_init, used for testing and throwaway indexes
+	\return: list of inverted tables, list of forward tables (type: []DB), error
+		tables are ordered the same way as DB_init
+*/
+func MemoryDB_init(ctx context.Context) (inv []DB, forw []DB, err error) {
+	for _, v := range invertedTables {
+		mdb := NewMemoryDB(v[1], v[2])
+		mdb.name = strings.TrimSuffix(v[0], "/")
+		inv = append(inv, mdb)
+	}
+	for _, v := range forwardTables {
+		mdb := NewMemoryDB(v[1], v[2])
+		mdb.name = strings.TrimSuffix(v[0], "/")
+		forw = append(forw, mdb)
+	}
+	return inv, forw, nil
+}
+
+func NewMemoryDB(keyType string, valType string) *MemoryDB {
+	return &MemoryDB{
+		data:     make(map[string][]byte),
+		keyCodec: lookupCodec(keyType, ErrKeyTypeNotFound),
+		valCodec: lookupCodec(valType, ErrValTypeNotFound),
+	}
+}
+
+func (mdb *MemoryDB) BatchWrite_init(ctx context.Context) BatchWriter {
+	return &MemoryBatchWriter{
+		mdb:     mdb,
+		pending: make(map[string][]byte),
+	}
+}
+
+func (mdb *MemoryDB) DropTable(ctx context.Context) error {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+	mdb.data = make(map[string][]byte)
+	return nil
+}
+
+func (mdb *MemoryDB) Get(ctx context.Context, key_ interface{}) (value_ interface{}, err error) {
+	key, _, err := marshalPair(mdb.keyCodec, key_, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	mdb.mutex.RLock()
+	value, ok := mdb.data[string(key)]
+	mdb.mutex.RUnlock()
+
+	// same error as BadgerDB so that callers can treat both implementations alike
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return mdb.valCodec.Decode(value)
+}
+
+func (mdb *MemoryDB) Set(ctx context.Context, key_ interface{}, value_ interface{}) error {
+	key, value, err := marshalPair(mdb.keyCodec, key_, mdb.valCodec, value_)
+	if err != nil {
+		return err
+	}
+
+	mdb.mutex.Lock()
+	mdb.data[string(key)] = value
+	mdb.mutex.Unlock()
+	return nil
+}
+
+func (mdb *MemoryDB) Has(ctx context.Context, key_ interface{}) (bool, error) {
+	key, _, err := marshalPair(mdb.keyCodec, key_, nil, nil)
+	if err != nil {
+		return false, err
+	}
+
+	mdb.mutex.RLock()
+	_, ok := mdb.data[string(key)]
+	mdb.mutex.RUnlock()
+	return ok, nil
+}
+
+func (mdb *MemoryDB) Delete(ctx context.Context, key_ interface{}) error {
+	key, _, err := marshalPair(mdb.keyCodec, key_, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	mdb.mutex.Lock()
+	delete(mdb.data, string(key))
+	mdb.mutex.Unlock()
+	return nil
+}
+
+// fragments are folded into the posting list right away, there is no read to be saved in memory
+func (mdb *MemoryDB) Append(ctx context.Context, key_ interface{}, value_ interface{}) error {
+	if !isPostings(mdb.valCodec) {
+		return ErrAppendNotSupported
+	}
+	key, value, err := marshalPair(mdb.keyCodec, key_, mdb.valCodec, value_)
+	if err != nil {
+		return err
+	}
+	return mdb.writeRaw([]journalOp{{Key: key, Value: value, Append: true}})
+}
+
+func (mdb *MemoryDB) Close(ctx context.Context, cancel context.CancelFunc) error {
+	cancel()
+	return nil
+}
+
+// tables created with NewMemoryDB have no name, the address keeps them apart within a unit of work
+func (mdb *MemoryDB) tableName() string {
+	if mdb.name == "" {
+		return fmt.Sprintf("memory-%p", mdb)
+	}
+	return mdb.name
+}
+
+func (mdb *MemoryDB) schema() (Codec, Codec) {
+	return mdb.keyCodec, mdb.valCodec
+}
+
+// memory tables cannot be left half-written by a crash, no journal needed
+func (mdb *MemoryDB) tableJournal() *journal {
+	return nil
+}
+
+// writes are never on disk, there is nothing to sync
+func (mdb *MemoryDB) sync() error {
+	return nil
+}
+
+func (mdb *MemoryDB) writeRaw(ops []journalOp) error {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+	for _, op := range ops {
+		if op.Append {
+			var values [][]byte
+			if v, ok := mdb.data[string(op.Key)]; ok {
+				values = append(values, v)
+			}
+			postings, err := foldValues(append(values, op.Value))
+			if err != nil {
+				return err
+			}
+			if postings == nil {
+				delete(mdb.data, string(op.Key))
+				continue
+			}
+			if op.Value, err = EncodePostings(postings); err != nil {
+				return err
+			}
+		}
+
+		if op.Delete {
+			delete(mdb.data, string(op.Key))
+		} else {
+			mdb.data[string(op.Key)] = op.Value
+		}
+	}
+	return nil
+}
+
+func (mdb *MemoryDB) Iterate(ctx context.Context, fn ScanFunc) error {
+	return mdb.scan(ctx, "", "", "", fn, ScanOptions{})
+}
+
+func (mdb *MemoryDB) ScanPrefix(ctx context.Context, prefix_ interface{}, fn ScanFunc, opt ScanOptions) error {
+	prefix, _, err := marshalPair(mdb.keyCodec, prefix_, nil, nil)
+	if err != nil {
+		return err
+	}
+	return mdb.scan(ctx, string(prefix), "", "", fn, opt)
+}
+
+func (mdb *MemoryDB) ScanRange(ctx context.Context, start_ interface{}, end_ interface{}, fn ScanFunc, opt ScanOptions) error {
+	start, err := rangeBound(mdb.keyCodec, start_)
+	if err != nil {
+		return err
+	}
+	end, err := rangeBound(mdb.keyCodec, end_)
+	if err != nil {
+		return err
+	}
+	return mdb.scan(ctx, "", string(start), string(end), fn, opt)
+}
+
+// scan works on a sorted snapshot of the keys, so fn is free to write to the table
+func (mdb *MemoryDB) scan(ctx context.Context, prefix string, start string, end string, fn ScanFunc, opt ScanOptions) error {
+	type kv struct {
+		key   string
+		value []byte
+	}
+
+	mdb.mutex.RLock()
+	snapshot := make([]kv, 0, len(mdb.data))
+	for k, v := range mdb.data {
+		if !strings.HasPrefix(k, prefix) || (start != "" && k < start) || (end != "" && k >= end) {
+			continue
+		}
+		snapshot = append(snapshot, kv{k, v})
+	}
+	mdb.mutex.RUnlock()
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		if opt.Reverse {
+			return snapshot[i].key > snapshot[j].key
+		}
+		return snapshot[i].key < snapshot[j].key
+	})
+
+	for i, pair := range snapshot {
+		if opt.Limit > 0 && i >= opt.Limit {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		key, err := mdb.keyCodec.Decode([]byte(pair.key))
+		if err != nil {
+			return err
+		}
+		value, err := mdb.valCodec.Decode(pair.value)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(key, value); err == ErrStopScan {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mdb *MemoryDB) Iterate_QuickFix(ctx context.Context) (map[string]map[string]float64, error) {
+	ret := make(map[string]map[string]float64)
+	err := mdb.Iterate(ctx, func(k interface{}, v interface{}) error {
+		temp, ok := v.(map[string]float64)
+		if !ok {
+			return ErrValTypeNotMatch
+		}
+		ret[k.(string)] = temp
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (mdb *MemoryDB) Debug_Print(ctx context.Context) error {
+	mdb.mutex.RLock()
+	defer mdb.mutex.RUnlock()
+	for k, v := range mdb.data {
+		fmt.Printf("\tkey=%s, value=%s\n", k, v)
+	}
+	return nil
+}
+
+// MemoryDB folds fragments on append, the size is the size of the marshalled keys and values
+func (mdb *MemoryDB) Stats(ctx context.Context) (TableStats, error) {
+	mdb.mutex.RLock()
+	defer mdb.mutex.RUnlock()
+
+	ret := TableStats{Name: mdb.tableName(), Keys: len(mdb.data)}
+	for k, v := range mdb.data {
+		ret.LSMSize += int64(len(k) + len(v))
+	}
+	return ret, nil
+}
+
+func (mdb *MemoryDB) IterateInv(ctx context.Context, pre string, frw0 DB) ([]string, error) {
+	var retVal []string
+	err := mdb.Iterate(ctx, func(k interface{}, _ interface{}) error {
+		w_, err := frw0.Get(ctx, k)
+		if err == ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if w, ok := w_.(string); !ok {
+			return ErrValTypeNotMatch
+		} else if strings.HasPrefix(w, pre) {
+			retVal = append(retVal, w)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return retVal, nil
+}
+
+func (mbw *MemoryBatchWriter) BatchSet(ctx context.Context, key_ interface{}, value_ interface{}) error {
+	key, value, err := marshalPair(mbw.mdb.keyCodec, key_, mbw.mdb.valCodec, value_)
+	if err != nil {
+		return err
+	}
+
+	mbw.mutex.Lock()
+	mbw.pending[string(key)] = value
+	mbw.mutex.Unlock()
+	return nil
+}
+
+func (mbw *MemoryBatchWriter) Flush(ctx context.Context) error {
+	mbw.mutex.Lock()
+	defer mbw.mutex.Unlock()
+
+	mbw.mdb.mutex.Lock()
+	for k, v := range mbw.pending {
+		mbw.mdb.data[k] = v
+	}
+	mbw.mdb.mutex.Unlock()
+
+	mbw.pending = make(map[string][]byte)
+	return nil
+}
+
+func (mbw *MemoryBatchWriter) Cancel(ctx context.Context) {
+	mbw.mutex.Lock()
+	mbw.pending = make(map[string][]byte)
+	mbw.mutex.Unlock()
+}
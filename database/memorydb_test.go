@@ -0,0 +1,58 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryDB(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	inv, forw, err := MemoryDB_init(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forw[0].Close(ctx, cancel)
+
+	// schema is enforced the same way as BadgerDB
+	if err = forw[0].Set(ctx, "0cc175b9c0f1b6a831c399e269772661", 42); err != ErrValTypeNotMatch {
+		t.Errorf("got error %v, want %v", err, ErrValTypeNotMatch)
+	}
+	if _, err = forw[0].Get(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("got error %v, want %v", err, ErrNotFound)
+	}
+
+	postings := map[uint32][]float32{1: []float32{0.5, 1, 4}}
+	bw := inv[0].BatchWrite_init(ctx)
+	for _, k := range []string{"b", "a", "c"} {
+		if err = bw.BatchSet(ctx, k, postings); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, _ := inv[0].Has(ctx, "a"); ok {
+		t.Error("batch written value is visible before flush")
+	}
+	if err = bw.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := inv[0].Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, postings) {
+		t.Errorf("got %v, want %v", v, postings)
+	}
+
+	var keys []string
+	err = inv[0].ScanRange(ctx, "", "c", func(k interface{}, _ interface{}) error {
+		keys = append(keys, k.(string))
+		return nil
+	}, ScanOptions{Reverse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"b", "a"}) {
+		t.Errorf("got keys %v, want [b a]", keys)
+	}
+}
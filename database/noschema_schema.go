@@ -10,24 +10,42 @@ import (
 
 /*
 =============================== SCHEMA DEFINITION ==========================================
+	Key and value type of every table is persisted in `schema.json` of the data directory, refer to
+	schema_version.go. Bump SchemaVersion whenever any of the types below, or DocInfo, changes.
+	Keys and values are converted by the codec of their type (codec.go), tables are accessed by name
+	through the typed handles of tables.go.
 	Schema for inverted table for both body and title page schema:
 		key	: wordHash (type: string)
-		value	: map of docHash to list of positions (type: map[string][]uint32)
+		value	: map of docID to weight followed by list of positions (type: map[uint32][]float32)
+			  stored as binary posting list, refer to `postings.go` for the encoding
+			  postings are appended as fragments under delta keys, refer to `append.go`
 	Schema for forward table forw[0]:
 		key	: wordHash (type: string)
 		value	: word (type: string)
 	Schema for forward table forw[1]:
-		key	: docHash (type: string)
+		key	: docID (type: uint32)
 		value	: document info including the URL (type: DocInfo)
 	Schema for forward table forw[2]:
-		key	: docHash (type: string)
-		value	: list of children's docHash (type: []string)
+		key	: docID (type: uint32)
+		value	: list of children's docID (type: []uint32)
+	Schema for inverted table inv[2]:
+		key	: keyword (type: string)
+		value	: map of category to the keyword frequency in it (type: map[string]uint32)
 	Schema for forward table forw[3]:
-		key	: docHash (type: string)
-		value	: pageRank value (type: float64)
+		key	: docID (type: uint32)
+		value	: pageRank value of every topic (type: map[string]float64)
 	Schema for forward table forw[4]:
-		key	: docHash (type: string)
+		key	: docID (type: uint32)
 		value	: page magnitude (type: map[string]float64)
+	Schema for forward table forw[5]:
+		key	: category (type: string)
+		value	: number of pages and word count of the category (type: map[string]float64)
+	Schema for forward table forw[6]:
+		key	: URL (type: string)
+		value	: docID assigned to the URL (type: uint32), refer to `docid.go`
+	Schema for forward table forw[7]:
+		key	: docID (type: uint32)
+		value	: URL the docID is assigned to (type: string)
 */
 
 // DocInfo describes the document info and statistics, which serves as the value of forw[2] table (URL -> DocInfo)
@@ -36,11 +54,17 @@ type DocInfo struct {
 	Page_title []string  `json:"Page_title"`
 	Mod_date   time.Time `json:"Mod_date"`
 	Page_size  uint32    `json:"Page_size"`
-	Children   []string  `json:"Children"`
-	// mapping from parent Hash to anchor texts
-	Parents map[string][]string `json:"Parents"`
+	Children   []uint32  `json:"Children"`
+	// mapping from parent docID to anchor texts
+	Parents map[uint32][]string `json:"Parents"`
 	//mapping for wordHash to wordFrequency
 	Words_mapping map[string]uint32 `json:"Words_mapping"`
+	// time the URL was first seen, either as a child or as a fetched document
+	Discovered time.Time `json:"Discovered"`
+	// entity tag of the page as last fetched, sent back by the crawler as If-None-Match
+	ETag string `json:"ETag"`
+	// time the page was last fetched, or confirmed unchanged by a 304 Not Modified. Zero if never fetched
+	Checked time.Time `json:"Checked"`
 }
 
 // override json.Marshal to support marshalling of DocInfo type
@@ -50,11 +74,15 @@ func (u DocInfo) MarshalJSON() ([]byte, error) {
 		Page_title    []string            `json:"Page_title"`
 		Mod_date      string              `json:"Mod_date"`
 		Page_size     uint32              `json:"Page_size"`
-		Children      []string            `json:"Children"`
-		Parents       map[string][]string `json:"Parents"`
+		Children      []uint32            `json:"Children"`
+		Parents       map[uint32][]string `json:"Parents"`
 		Words_mapping map[string]uint32   `json:"Words_mapping"`
+		Discovered    string              `json:"Discovered"`
+		ETag          string              `json:"ETag"`
+		Checked       string              `json:"Checked"`
 	}{u.Url.String(), u.Page_title, u.Mod_date.Format(time.RFC1123), u.Page_size,
-		u.Children, u.Parents, u.Words_mapping}
+		u.Children, u.Parents, u.Words_mapping, u.Discovered.Format(time.RFC1123),
+		u.ETag, u.Checked.Format(time.RFC1123)}
 
 	return json.Marshal(basicDocInfo)
 }
@@ -88,23 +116,39 @@ func (u *DocInfo) UnmarshalJSON(j []byte) error {
 			if u.Mod_date, err = time.Parse(time.RFC1123, v.(string)); err != nil {
 				return err
 			}
+		case "discovered":
+			if u.Discovered, err = time.Parse(time.RFC1123, v.(string)); err != nil {
+				return err
+			}
+		case "etag":
+			u.ETag = v.(string)
+		case "checked":
+			if u.Checked, err = time.Parse(time.RFC1123, v.(string)); err != nil {
+				return err
+			}
 		case "page_size":
 			u.Page_size = uint32(v.(float64))
 		case "children":
-			u.Children = make([]string, len(v.([]interface{})))
+			u.Children = make([]uint32, len(v.([]interface{})))
 			for k_, v_ := range v.([]interface{}) {
-				u.Children[k_] = v_.(string)
+				u.Children[k_] = uint32(v_.(float64))
 			}
 		case "parents":
-			u.Parents = make(map[string][]string)
+			u.Parents = make(map[uint32][]string)
 			for k_, v_ := range v.(map[string]interface{}) {
+				// JSON object keys are the decimal representation of the docIDs
+				parent, err := strconv.ParseUint(k_, 10, 32)
+				if err != nil {
+					return err
+				}
+				p := uint32(parent)
 				if v_ != nil {
-					u.Parents[k_] = make([]string, len(v_.([]interface{})))
+					u.Parents[p] = make([]string, len(v_.([]interface{})))
 					for k2, v2 := range v_.([]interface{}) {
-						u.Parents[k_][k2] = v2.(string)
+						u.Parents[p][k2] = v2.(string)
 					}
 				} else {
-					u.Parents[k_] = []string{}
+					u.Parents[p] = []string{}
 				}
 			}
 		case "words_mapping":
@@ -117,144 +161,3 @@ func (u *DocInfo) UnmarshalJSON(j []byte) error {
 
 	return nil
 }
-
-// helper function for type checking and conversion to support schema enforcement
-// uses string approach for primitive data type to be converted to []byte
-// uses json marshal function for complex / struct to be converted to []byte
-// @return array of bytes, error
-func checkMarshal(k interface{}, kType string, v interface{}, vType string) (key []byte, val []byte, err error) {
-	err = nil
-
-	// check the key type
-	if kType != "" {
-		switch kType {
-		case "string":
-			tempKey, ok := k.(string)
-			if !ok {
-				return nil, nil, ErrKeyTypeNotMatch
-			}
-			key = []byte(tempKey)
-		default:
-			return nil, nil, ErrKeyTypeNotFound
-		}
-	} else {
-		key = nil
-	}
-
-	// don't need to check the value type if the key does not matched
-	if err != nil {
-		return nil, nil, ErrKeyTypeNotMatch
-	}
-
-	if vType != "" {
-		switch vType {
-		case "string":
-			tempVal, ok := v.(string)
-			if !ok {
-				return nil, nil, ErrValTypeNotMatch
-			}
-			val = []byte(tempVal)
-		case "[]string":
-			tempVal, ok := v.([]string)
-			if !ok {
-				return nil, nil, ErrValTypeNotMatch
-			}
-			val, err = json.Marshal(tempVal)
-		case "float64":
-			tempVal, ok := v.(float64)
-			if !ok {
-				return nil, nil, ErrValTypeNotMatch
-			}
-			val, err = []byte(strconv.FormatFloat(tempVal, 'f', -1, 64)), nil
-		case "map[string][]float32":
-			tempVal, ok := v.(map[string][]float32)
-			if !ok {
-				return nil, nil, ErrValTypeNotMatch
-			}
-			val, err = json.Marshal(tempVal)
-		case "map[string][]uint32":
-			tempVal, ok := v.(map[string][]uint32)
-			if !ok {
-				return nil, nil, ErrValTypeNotMatch
-			}
-			val, err = json.Marshal(tempVal)
-		case "map[string]uint32":
-			tempVal, ok := v.(map[string]uint32)
-			if !ok {
-				return nil, nil, ErrValTypeNotMatch
-			}
-			val, err = json.Marshal(tempVal)
-		case "map[string]float64":
-			tempVal, ok := v.(map[string]float64)
-			if !ok {
-				return nil, nil, ErrValTypeNotMatch
-			}
-			val, err = json.Marshal(tempVal)
-		case "DocInfo":
-			tempVal, ok := v.(DocInfo)
-			if !ok {
-				return nil, nil, ErrValTypeNotMatch
-			}
-			val, err = json.Marshal(tempVal)
-		default:
-			return nil, nil, ErrValTypeNotFound
-		}
-	} else {
-		val = nil
-	}
-
-	return
-}
-
-// helper function for type checking and conversion to support schema enforcement
-func checkUnmarshal(v []byte, valType string) (val interface{}, err error) {
-	switch valType {
-	case "string":
-		return string(v), nil
-	case "[]string":
-		var tempVal []string
-		if err = json.Unmarshal(v, &tempVal); err != nil {
-			return nil, err
-		}
-		return tempVal, nil
-	case "float64":
-		return strconv.ParseFloat(string(v), 64)
-	case "map[string][]float32":
-		tempVal := make(map[string][]float32)
-		err = json.Unmarshal(v, &tempVal)
-		if err != nil {
-			return nil, err
-		}
-		return tempVal, nil
-	case "map[string][]uint32":
-		tempVal := make(map[string][]uint32)
-		err = json.Unmarshal(v, &tempVal)
-		if err != nil {
-			return nil, err
-		}
-		return tempVal, nil
-	case "map[string]uint32":
-		tempVal := make(map[string]uint32)
-		err = json.Unmarshal(v, &tempVal)
-		if err != nil {
-			return nil, err
-		}
-		return tempVal, nil
-	case "map[string]float64":
-		tempVal := make(map[string]float64)
-		err = json.Unmarshal(v, &tempVal)
-		if err != nil {
-			return nil, err
-		}
-		return tempVal, nil
-	case "DocInfo":
-		var tempVal DocInfo
-		err = json.Unmarshal(v, &tempVal)
-		if err != nil {
-			return nil, err
-		}
-		return tempVal, nil
-	default:
-		return nil, ErrValTypeNotFound
-	}
-}
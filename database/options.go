@@ -0,0 +1,183 @@
+package database
+
+import (
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default values are used. For garbage-collection purposes
+	// TODO: to be fine-tuned
+	badgerDiscardRatio = 0.5
+	badgerGCInterval   = 2 * time.Hour
+)
+
+// table loading mode
+// default is MemoryMap, 1 is LoadToRAM (most optimised), 2 is FileIO (all disk)
+const (
+	LoadMemoryMap = iota
+	LoadToRAM
+	LoadFileIO
+)
+
+var ErrLoadMode = errors.New("Invalid table loading mode, accepted values are 0 (memory map), 1 (load to RAM) and 2 (file IO)")
+
+// DBOptions configures the tables opened by DB_init
+type DBOptions struct {
+	// directory containing the directory of every table
+	Dir string
+
+	// loading mode of every table, refer to the LoadMemoryMap, LoadToRAM, and LoadFileIO constants
+	LoadMode int
+
+	// loading mode of specific tables, overriding LoadMode. Keyed by table name, e.g. "invKeyword_body"
+	TableLoadMode map[string]int
+
+	// if false, write into tables in RAM, write to disk when full. Increase performance but may cause loss of data
+	// writes through a unit of work are synced whatever SyncWrites: a commit syncs the journal twice and every
+	// table it touches once, i.e. about 7 fsyncs per page indexed, or more with -shards. Refer to BenchmarkCommit
+	SyncWrites bool
+
+	// open the tables without write access, value log GC is disabled as well
+	ReadOnly bool
+
+	// interval between two value log garbage collections, GC is disabled if it is not positive
+	GCInterval time.Duration
+
+	// a value log file is rewritten if at least this ratio of it can be discarded
+	GCDiscardRatio float64
+
+	// migrate index built with an older schema in place instead of refusing to open it, refer to schema_version.go
+	AutoMigrate bool
+
+	// number of decoded values cached for each of the words, docInfo, pageRank, magnitude and URL tables
+	// only used for tables opened read-only, 0 disables the cache. Refer to cache.go
+	CacheSize int
+
+	// number of shards of each posting table of a new index. Index built already keeps its number of shards,
+	// 0 opens it with the number it has been built with. Refer to shard.go
+	Shards int
+
+	// page cache of the index, whose pages are renamed by migrations changing the URLs of the documents
+	// empty leaves the page cache as it is. Refer to migrateToCanonicalURLs
+	DocsDir string
+}
+
+// DefaultDBOptions returns the options DB_init has been using, i.e. ./db_data/ loaded to RAM
+func DefaultDBOptions() DBOptions {
+	return DBOptions{
+		Dir:            "./db_data/",
+		LoadMode:       LoadToRAM,
+		SyncWrites:     false,
+		ReadOnly:       false,
+		GCInterval:     badgerGCInterval,
+		GCDiscardRatio: badgerDiscardRatio,
+		DocsDir:        "docs/", // default of indexer.DocsDir
+	}
+}
+
+// RegisterFlags binds the options to command line flags, so that every cmd accepts the same set of flags
+// the current values of the options are used as the flag defaults
+func (opts *DBOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.Dir, "dbDir", opts.Dir, "-dbDir=<directory_containing_the_tables>")
+	fs.Var((*loadModeFlag)(&opts.LoadMode), "loadMode", "-loadMode=<0_memory_map_1_load_to_RAM_2_file_IO>")
+	fs.Var((*tableLoadModeFlag)(&opts.TableLoadMode), "tableLoadMode", "-tableLoadMode=<table:mode,table:mode,...>")
+	fs.BoolVar(&opts.SyncWrites, "syncWrites", opts.SyncWrites, "-syncWrites=<sync_every_write_to_disk_or_not>")
+	fs.BoolVar(&opts.ReadOnly, "readOnly", opts.ReadOnly, "-readOnly=<open_tables_without_write_access_or_not>")
+	fs.DurationVar(&opts.GCInterval, "gcInterval", opts.GCInterval, "-gcInterval=<interval_between_value_log_GC>")
+	fs.Float64Var(&opts.GCDiscardRatio, "gcDiscardRatio", opts.GCDiscardRatio, "-gcDiscardRatio=<ratio_of_value_log_to_be_discarded>")
+	fs.BoolVar(&opts.AutoMigrate, "autoMigrate", opts.AutoMigrate, "-autoMigrate=<migrate_index_of_older_schema_or_not>")
+	fs.IntVar(&opts.Shards, "shards", opts.Shards, "-shards=<number_of_shards_of_each_posting_table_of_a_new_index>")
+	fs.IntVar(&opts.CacheSize, "cacheSize", opts.CacheSize, "-cacheSize=<number_of_values_cached_per_forward_table_when_read_only>")
+}
+
+// validate checks the loading modes, which would otherwise fall back to memory map
+func (opts DBOptions) validate() error {
+	if !validLoadMode(opts.LoadMode) {
+		return errors.Wrapf(ErrLoadMode, "loading mode %d", opts.LoadMode)
+	}
+	for table, mode := range opts.TableLoadMode {
+		if !validLoadMode(mode) {
+			return errors.Wrapf(ErrLoadMode, "loading mode %d of table %s", mode, table)
+		}
+	}
+	return nil
+}
+
+func validLoadMode(mode int) bool {
+	return mode >= LoadMemoryMap && mode <= LoadFileIO
+}
+
+// data directory with trailing slash
+func (opts DBOptions) baseDir() string {
+	if !strings.HasSuffix(opts.Dir, "/") {
+		return opts.Dir + "/"
+	}
+	return opts.Dir
+}
+
+// loading mode used for the given table directory
+func (opts DBOptions) loadModeOf(table string) int {
+	if mode, ok := opts.TableLoadMode[strings.TrimSuffix(table, "/")]; ok {
+		return mode
+	}
+	return opts.LoadMode
+}
+
+// flag.Value parsing a loading mode, refusing the ones not listed in ErrLoadMode
+type loadModeFlag int
+
+func (f *loadModeFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strconv.Itoa(int(*f))
+}
+
+func (f *loadModeFlag) Set(s string) error {
+	mode, err := strconv.Atoi(s)
+	if err != nil || !validLoadMode(mode) {
+		return errors.Wrapf(ErrLoadMode, "loading mode %q", s)
+	}
+	*f = loadModeFlag(mode)
+	return nil
+}
+
+// flag.Value parsing comma-separated table:mode pairs
+type tableLoadModeFlag map[string]int
+
+func (f *tableLoadModeFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var pairs []string
+	for table, mode := range *f {
+		pairs = append(pairs, table+":"+strconv.Itoa(mode))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f *tableLoadModeFlag) Set(s string) error {
+	if *f == nil {
+		*f = make(map[string]int)
+	}
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid table loading mode %q, expected <table>:<mode>", pair)
+		}
+		mode, err := strconv.Atoi(kv[1])
+		if err != nil || !validLoadMode(mode) {
+			return errors.Wrapf(ErrLoadMode, "loading mode %q of table %s", kv[1], kv[0])
+		}
+		(*f)[strings.TrimSuffix(kv[0], "/")] = mode
+	}
+	return nil
+}
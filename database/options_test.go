@@ -0,0 +1,36 @@
+package database
+
+import (
+	"context"
+	"flag"
+	"github.com/apsdehal/go-logger"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestLoadModeFlags(t *testing.T) {
+	for _, args := range [][]string{{"-loadMode=3"}, {"-loadMode=ram"}, {"-tableLoadMode=DocID_url:-1"}} {
+		opts := DefaultDBOptions()
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		opts.RegisterFlags(fs)
+		if err := fs.Parse(args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+
+	opts := DefaultDBOptions()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-loadMode=2"}); err != nil || opts.LoadMode != LoadFileIO {
+		t.Errorf("got loading mode %d (%v), want %d", opts.LoadMode, err, LoadFileIO)
+	}
+
+	// options set without flags are refused before anything is opened
+	log, _ := logger.New("test", 1)
+	opts.Dir, opts.LoadMode = "/nonexistent", 7
+	if _, _, err := DB_init(context.Background(), log, opts); errors.Cause(err) != ErrLoadMode {
+		t.Errorf("got error %v, want %v", err, ErrLoadMode)
+	}
+}
@@ -0,0 +1,198 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"sort"
+)
+
+/*
+=============================== POSTING LIST ENCODING ==========================================
+	Value of the inverted tables for title and body (value type "postings") is a binary posting list.
+	On the Go side it is exposed as map[uint32][]float32 (docID -> [weight, pos...]).
+
+	byte 0			: format version (postingsFormatV2)
+	uvarint			: number of documents
+	for each document, sorted by docID:
+		uvarint		: delta of the docID to the previous one (first is relative to 0)
+		uvarint		: length of the original list (weight + positions), 0 is allowed
+		4 bytes		: weight (little-endian float32 bits), only present if length > 0
+		varint		: zigzag-encoded delta of each position to the previous one (first is relative to 0)
+
+	Indexes older than docIDs store the posting lists keyed by docHash, either as JSON, which always
+	starts with '{', or in format postingsFormatV1 (16 bytes md5 digest in place of the docID delta).
+	Those are only read by the migration to docIDs, refer to docid.go.
+*/
+
+const (
+	postingsFormatV1 byte = 0x01
+	postingsFormatV2 byte = 0x02
+
+	// docHash is the hex representation of a md5 digest
+	docHashLen = 16
+)
+
+var (
+	ErrInvalidPosition = errors.New("Invalid position in posting list, position must be an integer value")
+
+	ErrCorruptPostings = errors.New("Posting list is corrupted or has an unknown format version")
+)
+
+type posting struct {
+	doc  uint32
+	list []float32
+}
+
+// EncodePostings converts the posting list of a term into its binary representation
+func EncodePostings(postings map[uint32][]float32) ([]byte, error) {
+	sorted := make([]posting, 0, len(postings))
+	for docID, list := range postings {
+		sorted = append(sorted, posting{docID, list})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].doc < sorted[j].doc
+	})
+
+	// rough estimation of the size needed, most docID deltas and positions fit in a single byte
+	size := 1 + binary.MaxVarintLen64
+	for _, p := range sorted {
+		size += 2 + binary.MaxVarintLen64 + 4 + 2*len(p.list)
+	}
+
+	buf := make([]byte, 0, size)
+	tmp := make([]byte, binary.MaxVarintLen64)
+
+	buf = append(buf, postingsFormatV2)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(len(sorted)))]...)
+
+	var prevDoc uint32
+	for _, p := range sorted {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(p.doc-prevDoc))]...)
+		prevDoc = p.doc
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(len(p.list)))]...)
+		if len(p.list) == 0 {
+			continue
+		}
+
+		// first entry of the list is the weight (normalised tf or tf-idf)
+		binary.LittleEndian.PutUint32(tmp, math.Float32bits(p.list[0]))
+		buf = append(buf, tmp[:4]...)
+
+		var prev int64
+		for _, pos := range p.list[1:] {
+			cur := int64(pos)
+			if float32(cur) != pos {
+				return nil, ErrInvalidPosition
+			}
+			buf = append(buf, tmp[:binary.PutVarint(tmp, cur-prev)]...)
+			prev = cur
+		}
+	}
+
+	return buf, nil
+}
+
+// DecodePostings converts the value of an inverted table back into the posting list of a term
+func DecodePostings(v []byte) (map[uint32][]float32, error) {
+	if len(v) == 0 || v[0] != postingsFormatV2 {
+		return nil, ErrCorruptPostings
+	}
+
+	r := bytes.NewReader(v[1:])
+	numDocs, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrCorruptPostings
+	}
+
+	// each document takes at least 2 bytes, guard the allocation against corrupted values
+	if numDocs > uint64(len(v)) {
+		return nil, ErrCorruptPostings
+	}
+
+	ret := make(map[uint32][]float32, numDocs)
+	var doc uint64
+	for i := uint64(0); i < numDocs; i++ {
+		delta, err := binary.ReadUvarint(r)
+		if err != nil || doc+delta > math.MaxUint32 {
+			return nil, ErrCorruptPostings
+		}
+		doc += delta
+
+		list, err := readPostingList(r)
+		if err != nil {
+			return nil, err
+		}
+		ret[uint32(doc)] = list
+	}
+
+	return ret, nil
+}
+
+// readPostingList reads the weight and the positions of a document, shared by every binary format
+func readPostingList(r *bytes.Reader) ([]float32, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len())+1 {
+		return nil, ErrCorruptPostings
+	}
+
+	list := make([]float32, n)
+	if n == 0 {
+		return list, nil
+	}
+	weight := make([]byte, 4)
+	if _, err = io.ReadFull(r, weight); err != nil {
+		return nil, ErrCorruptPostings
+	}
+	list[0] = math.Float32frombits(binary.LittleEndian.Uint32(weight))
+
+	var prev int64
+	for j := uint64(1); j < n; j++ {
+		delta, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, ErrCorruptPostings
+		}
+		prev += delta
+		list[j] = float32(prev)
+	}
+	return list, nil
+}
+
+// decodeLegacyPostings converts a posting list keyed by docHash, in JSON or in format postingsFormatV1
+func decodeLegacyPostings(v []byte) (map[string][]float32, error) {
+	if len(v) > 0 && v[0] == '{' {
+		ret := make(map[string][]float32)
+		if err := json.Unmarshal(v, &ret); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+
+	if len(v) == 0 || v[0] != postingsFormatV1 {
+		return nil, ErrCorruptPostings
+	}
+
+	r := bytes.NewReader(v[1:])
+	numDocs, err := binary.ReadUvarint(r)
+	if err != nil || numDocs > uint64(len(v)) {
+		return nil, ErrCorruptPostings
+	}
+
+	ret := make(map[string][]float32, numDocs)
+	doc := make([]byte, docHashLen)
+	for i := uint64(0); i < numDocs; i++ {
+		if _, err = io.ReadFull(r, doc); err != nil {
+			return nil, ErrCorruptPostings
+		}
+		list, err := readPostingList(r)
+		if err != nil {
+			return nil, err
+		}
+		ret[hex.EncodeToString(doc)] = list
+	}
+	return ret, nil
+}
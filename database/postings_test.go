@@ -0,0 +1,71 @@
+package database
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestPostingsRoundTrip(t *testing.T) {
+	in := map[uint32][]float32{
+		1:       []float32{0.5, 3, 7, 120, -100},
+		300:     []float32{1.25},
+		1 << 30: []float32{},
+	}
+
+	enc, err := EncodePostings(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := DecodePostings(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("decoded postings %v, want %v", out, in)
+	}
+}
+
+func TestPostingsLegacy(t *testing.T) {
+	in := map[string][]float32{"0cc175b9c0f1b6a831c399e269772661": []float32{0.5, 1, 3}}
+	legacy, _ := json.Marshal(in)
+
+	out, err := decodeLegacyPostings(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("decoded JSON postings %v, want %v", out, in)
+	}
+
+	// same list in the binary format keyed by docHash
+	doc, _ := hex.DecodeString("0cc175b9c0f1b6a831c399e269772661")
+	v1 := append([]byte{postingsFormatV1, 1}, doc...)
+	v1 = append(v1, 3)
+	weight := make([]byte, 4)
+	binary.LittleEndian.PutUint32(weight, math.Float32bits(0.5))
+	v1 = append(append(v1, weight...), 2, 4)
+
+	if out, err = decodeLegacyPostings(v1); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("decoded binary postings %v, want %v", out, in)
+	}
+	if _, err = DecodePostings(v1); err != ErrCorruptPostings {
+		t.Errorf("got error %v decoding legacy postings, want %v", err, ErrCorruptPostings)
+	}
+}
+
+func TestPostingsInvalid(t *testing.T) {
+	if _, err := EncodePostings(map[uint32][]float32{1: []float32{1, 0.5}}); err != ErrInvalidPosition {
+		t.Errorf("got error %v, want %v", err, ErrInvalidPosition)
+	}
+	if _, err := DecodePostings([]byte{postingsFormatV2, 3, 1}); err != ErrCorruptPostings {
+		t.Errorf("got error %v, want %v", err, ErrCorruptPostings)
+	}
+}
@@ -0,0 +1,393 @@
+package database
+
+import (
+	"context"
+	"github.com/apsdehal/go-logger"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+=============================== PUBLISHING ==========================================
+	Badger locks the directory of a table for the process writing to it, so the crawler and the server
+	cannot open the same tables. The crawler builds the index in its own directory, and publishes a
+	copy of it once the tables are closed:
+		<link>-<timestamp>/	: copy of the tables, the journal and the schema record, one per publish
+		<link>-<timestamp>/docs/: page cache of the index as published, hard-linked if possible
+		<link>			: symlink to the latest copy, replaced at once by a rename
+	The server opens <link> read-only through Served, and reopens it as soon as the symlink points to
+	a newer copy. Queries running on the previous copy finish on it before it is closed. Publish
+	removes every copy but the latest two, and the ones still served: Served holds a marker file
+	served-<pid> in the copy it has open, refreshed every servedLease/3 and removed once the copy is
+	closed. A marker not refreshed for servedLease is left by a server which is gone, and ignored.
+	The server removes the copy it has closed itself if a publish had to keep it.
+	Served opens a copy with the page cache of the copy, so that the crawler rewriting or renaming
+	pages of its own page cache meanwhile does not change the pages served. The indexer replaces a
+	page by renaming a new file over it, hence pages hard-linked into a copy are never rewritten.
+*/
+
+const (
+	publishTimeFormat = "20060102T150405.000000000"
+
+	// badger's lock file of every table directory
+	badgerLockFile = "LOCK"
+
+	// page cache of a copy
+	publishedDocsDir = "docs"
+
+	// marker of a copy being served, followed by the pid of the server
+	servedMarkerPrefix = "served-"
+
+	// a copy whose marker has not been refreshed for that long is no longer served
+	servedLease = 10 * time.Minute
+)
+
+var ErrPublishTarget = errors.New("Path to be published to is not a symlink, move the index out of the way first")
+
+type (
+	// Served holds the tables of a published index opened read-only, and reopens them when a new copy is published
+	Served struct {
+		ctx    context.Context
+		logger *logger.Logger
+		opts   DBOptions
+
+		mu      sync.RWMutex
+		current *servedTables
+		// Reload is called by Watch and by the owner, one at a time
+		reloading sync.Mutex
+		// closed by Close, stops refreshing the marker
+		closed chan struct{}
+	}
+
+	// tables of a copy, with the queries running on them
+	servedTables struct {
+		tables *Tables
+		dir    string
+		cancel context.CancelFunc
+		inUse  sync.WaitGroup
+	}
+)
+
+/*
+Publish copies the index in srcDir and its page cache to a new directory next to link, and points link to it
+\params: directory of the index, closed; page cache of the index, not copied if empty; path of the symlink the server opens
+\return: directory of the copy, error
+*/
+func Publish(srcDir string, docsDir string, link string) (string, error) {
+	link = strings.TrimSuffix(link, "/")
+	if fi, err := os.Lstat(link); err == nil && fi.Mode()&os.ModeSymlink == 0 {
+		return "", ErrPublishTarget
+	} else if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	// the copy is written under a temporary name, so that a half-written copy is never published
+	dst := link + "-" + time.Now().UTC().Format(publishTimeFormat)
+	err := copyIndex(srcDir, dst+".tmp")
+	if err == nil && docsDir != "" {
+		err = linkPages(docsDir, filepath.Join(dst+".tmp", publishedDocsDir))
+	}
+	if err != nil {
+		os.RemoveAll(dst + ".tmp")
+		return "", err
+	}
+	if err := os.Rename(dst+".tmp", dst); err != nil {
+		return "", err
+	}
+
+	// symlink is relative to its own directory, so that the copies can be moved together with it
+	tmpLink := link + ".tmp"
+	os.Remove(tmpLink)
+	if err := os.Symlink(filepath.Base(dst), tmpLink); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpLink, link); err != nil {
+		return "", err
+	}
+
+	return dst, prunePublished(link, true)
+}
+
+// copyIndex copies every file of the index but the lock files of badger, and the checkpoint of the crawl
+func copyIndex(srcDir string, dst string) error {
+	return filepath.Walk(srcDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir() && rel == strings.TrimSuffix(crawlFrontierDir, "/"):
+			return filepath.SkipDir
+		case fi.IsDir():
+			return os.MkdirAll(target, 0755)
+		case !fi.Mode().IsRegular() || fi.Name() == badgerLockFile:
+			return nil
+		}
+		return copyFile(path, target, fi.Mode().Perm())
+	})
+}
+
+// linkPages hard-links every page of the page cache into dst, copying them if they cannot be linked
+// e.g. across file systems. A page cache not created yet is published empty, pages being written are left out
+func linkPages(docsDir string, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	pages, err := ioutil.ReadDir(docsDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range pages {
+		if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), ".tmp") {
+			continue
+		}
+		src, target := filepath.Join(docsDir, fi.Name()), filepath.Join(dst, fi.Name())
+		if err = os.Link(src, target); err == nil {
+			continue
+		}
+		if err = copyFile(src, target, fi.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the file to a new file, synced to disk
+func copyFile(path string, target string, perm os.FileMode) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// prunePublished removes the copies older than the previous one which are not served, and the leftovers of
+// failed publishes if asked to, i.e. by Publish only as a publish may be running otherwise
+func prunePublished(link string, leftovers bool) error {
+	copies, err := filepath.Glob(link + "-*")
+	if err != nil {
+		return err
+	}
+	// other directories named alike are left alone
+	var done []string
+	for _, c := range copies {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(c, link+"-"), ".tmp")
+		if _, err := time.Parse(publishTimeFormat, stamp); err != nil {
+			continue
+		}
+		if strings.HasSuffix(c, ".tmp") {
+			if leftovers {
+				os.RemoveAll(c)
+			}
+		} else {
+			done = append(done, c)
+		}
+	}
+
+	// timestamps sort in publishing order
+	sort.Strings(done)
+	for i := 0; i < len(done)-2; i++ {
+		if isServed(done[i]) {
+			continue
+		}
+		if err = os.RemoveAll(done[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isServed reports whether a server holds a marker of the copy refreshed within servedLease
+func isServed(dir string) bool {
+	markers, _ := filepath.Glob(filepath.Join(dir, servedMarkerPrefix+"*"))
+	for _, m := range markers {
+		if fi, err := os.Stat(m); err == nil && time.Since(fi.ModTime()) < servedLease {
+			return true
+		}
+	}
+	return false
+}
+
+// marker of the copy held by this process
+func servedMarker(dir string) string {
+	return filepath.Join(dir, servedMarkerPrefix+strconv.Itoa(os.Getpid()))
+}
+
+// markServed creates or refreshes the marker of the copy
+func markServed(dir string) error {
+	f, err := os.OpenFile(servedMarker(dir), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(servedMarker(dir), now, now)
+}
+
+/*
+OpenServed opens the tables of opts.Dir read-only, following the symlink written by Publish if any
+\params: context, logger, options of the tables
+\return: served tables, error
+*/
+func OpenServed(ctx context.Context, logger *logger.Logger, opts DBOptions) (*Served, error) {
+	opts.ReadOnly = true
+	s := &Served{ctx: ctx, logger: logger, opts: opts, closed: make(chan struct{})}
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+	go s.hold()
+	return s, nil
+}
+
+// hold refreshes the marker of the copy being served until the context is done, refer to the description above
+func (s *Served) hold() {
+	ticker := time.NewTicker(servedLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			if err := markServed(s.Dir()); err != nil {
+				s.logger.Warningf("Failed to refresh the marker of the index being served: %v", err)
+			}
+		}
+	}
+}
+
+// Acquire returns the tables to run a query on, release must be called once the query is done
+func (s *Served) Acquire() (tables *Tables, release func()) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cur := s.current
+	cur.inUse.Add(1)
+	return cur.tables, cur.inUse.Done
+}
+
+/*
+Reload opens the copy opts.Dir points to if it is not the one being served, and closes the previous
+one once the queries running on it are done
+\return: the tables have been reopened, error. The previous tables are still served on error
+*/
+func (s *Served) Reload() (bool, error) {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+
+	dir, err := filepath.EvalSymlinks(strings.TrimSuffix(s.opts.Dir, "/"))
+	if err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	same := s.current != nil && s.current.dir == dir
+	s.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+
+	// marked before it is opened, so that a publish meanwhile does not remove it
+	if err = markServed(dir); err != nil {
+		return false, err
+	}
+	opts := s.opts
+	opts.Dir = dir
+	// copies published without their page cache, e.g. by older builds, are served with the shared one
+	if fi, err := os.Stat(filepath.Join(dir, publishedDocsDir)); err == nil && fi.IsDir() {
+		opts.DocsDir = filepath.Join(dir, publishedDocsDir)
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	tables, err := OpenTables(ctx, s.logger, opts)
+	if err != nil {
+		cancel()
+		os.Remove(servedMarker(dir))
+		return false, err
+	}
+
+	s.mu.Lock()
+	prev := s.current
+	s.current = &servedTables{tables: tables, dir: dir, cancel: cancel}
+	s.mu.Unlock()
+
+	if prev != nil {
+		prev.inUse.Wait()
+		if err = prev.tables.Close(s.ctx, prev.cancel); err != nil {
+			return true, errors.Wrapf(err, "failed to close %s", prev.dir)
+		}
+		os.Remove(servedMarker(prev.dir))
+		// copies kept by publishes as long as they were served
+		if err = prunePublished(strings.TrimSuffix(s.opts.Dir, "/"), false); err != nil {
+			s.logger.Warningf("Failed to remove the copies no longer served: %v", err)
+		}
+	}
+	return true, nil
+}
+
+// Watch reloads the tables every interval until the context is done, errors are logged and retried
+func (s *Served) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if reloaded, err := s.Reload(); err != nil {
+				s.logger.Errorf("Failed to reload the index: %v", err)
+			} else if reloaded {
+				s.logger.Infof("Reloaded the index from %s", s.Dir())
+			}
+		}
+	}
+}
+
+// Dir returns the directory of the copy being served
+func (s *Served) Dir() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current.dir
+}
+
+// Close closes the tables being served once the queries running on them are done
+func (s *Served) Close() error {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+	close(s.closed)
+	s.mu.Lock()
+	cur := s.current
+	s.mu.Unlock()
+	cur.inUse.Wait()
+	err := cur.tables.Close(s.ctx, cur.cancel)
+	os.Remove(servedMarker(cur.dir))
+	return err
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"context"
+	"github.com/apsdehal/go-logger"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, _ := logger.New("test", 1)
+	opts := DefaultDBOptions()
+	opts.Dir, opts.GCInterval = filepath.Join(dir, "staging"), 0
+	link := filepath.Join(dir, "served")
+	docsDir := filepath.Join(dir, "docs")
+	if err = os.MkdirAll(docsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// crawls wordHash into the staging index and publishes it
+	crawl := func(wordHash string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		tables, err := OpenTables(ctx, log, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables.Words.Put(ctx, wordHash, "word")
+		ioutil.WriteFile(filepath.Join(docsDir, wordHash), []byte(wordHash), 0644)
+		if err = tables.Close(ctx, cancel); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = Publish(opts.Dir, docsDir, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	crawl(hashA)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served, err := OpenServed(ctx, log, DBOptions{Dir: link, LoadMode: LoadMemoryMap})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, release := served.Acquire()
+	if err = tables.Words.Put(ctx, hashB, "word"); err == nil {
+		t.Error("served tables are writable")
+	}
+	release()
+
+	// pages are served from the page cache of the copy, whatever the crawler does with its own
+	if want := filepath.Join(served.Dir(), publishedDocsDir) + "/"; tables.DocsDir != want {
+		t.Errorf("got page cache %s, want %s", tables.DocsDir, want)
+	}
+	ioutil.WriteFile(filepath.Join(docsDir, hashA+".tmp"), []byte("rewritten"), 0644)
+	os.Rename(filepath.Join(docsDir, hashA+".tmp"), filepath.Join(docsDir, hashA))
+	if page, err := ioutil.ReadFile(tables.DocsDir + hashA); err != nil || string(page) != hashA {
+		t.Errorf("got page %q (%v), want the page as published", page, err)
+	}
+
+	// copy being served is kept by publishes, and removed once the server is done with it
+	first := served.Dir()
+	crawl(hashB)
+	crawl(hashB)
+	if _, err = os.Stat(first); err != nil {
+		t.Errorf("copy being served removed by publishes: %v", err)
+	}
+	if reloaded, err := served.Reload(); !reloaded || err != nil {
+		t.Fatalf("got %v (%v) on reload after publishing", reloaded, err)
+	}
+	tables, release = served.Acquire()
+	for _, wordHash := range []string{hashA, hashB} {
+		if has, _ := tables.Words.Has(ctx, wordHash); !has {
+			t.Errorf("%s missing from the reloaded index", wordHash)
+		}
+	}
+	release()
+
+	if copies, _ := filepath.Glob(link + "-*"); len(copies) != 2 {
+		t.Errorf("got copies %v, want the latest two", copies)
+	}
+	if err = served.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// marker of a server which is gone is ignored
+	current := served.Dir()
+	markServed(current)
+	stale := time.Now().Add(-servedLease)
+	os.Chtimes(servedMarker(current), stale, stale)
+	crawl(hashA)
+	crawl(hashA)
+	if _, err = os.Stat(current); !os.IsNotExist(err) {
+		t.Errorf("copy with a stale marker kept: %v", err)
+	}
+}
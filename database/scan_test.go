@@ -0,0 +1,216 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/apsdehal/go-logger"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// scanTables returns a BadgerDB and a MemoryDB of the given types, removed by the returned function
+func scanTables(t *testing.T, valType string) (map[string]DB, func()) {
+	dir, err := ioutil.TempDir("", "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, _ := logger.New("test", 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := DefaultDBOptions()
+	opts.GCInterval = 0
+	bdb, err := NewBadgerDB(ctx, dir, log, LoadMemoryMap, "string", valType, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdb := NewMemoryDB("string", valType)
+
+	return map[string]DB{"BadgerDB": bdb, "MemoryDB": mdb}, func() {
+		bdb.Close(ctx, cancel)
+		mdb.Close(ctx, cancel)
+		os.RemoveAll(dir)
+	}
+}
+
+func scanKeys(t *testing.T, scan func(ScanFunc) error) []string {
+	keys := []string{}
+	if err := scan(func(k interface{}, _ interface{}) error {
+		keys = append(keys, k.(string))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestScan(t *testing.T) {
+	tables, cleanup := scanTables(t, "string")
+	defer cleanup()
+	ctx := context.Background()
+
+	for name, table := range tables {
+		for _, k := range []string{"a", "p", "p\x00", "p\x01", "pa", "pz", "p\xff", "p\xff\x01", "q", "z"} {
+			if err := table.Set(ctx, k, "v"+k); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, c := range []struct {
+			desc string
+			scan func(ScanFunc) error
+			want []string
+		}{
+			{"prefix", func(fn ScanFunc) error {
+				return table.ScanPrefix(ctx, "p", fn, ScanOptions{})
+			}, []string{"p", "p\x00", "p\x01", "pa", "pz", "p\xff", "p\xff\x01"}},
+			{"reverse prefix", func(fn ScanFunc) error {
+				return table.ScanPrefix(ctx, "p", fn, ScanOptions{Reverse: true})
+			}, []string{"p\xff\x01", "p\xff", "pz", "pa", "p\x01", "p\x00", "p"}},
+			{"reverse prefix without upper bound", func(fn ScanFunc) error {
+				return table.ScanPrefix(ctx, "p\xff", fn, ScanOptions{Reverse: true})
+			}, []string{"p\xff\x01", "p\xff"}},
+			{"limited prefix", func(fn ScanFunc) error {
+				return table.ScanPrefix(ctx, "p", fn, ScanOptions{Limit: 2, Reverse: true})
+			}, []string{"p\xff\x01", "p\xff"}},
+			{"empty prefix", func(fn ScanFunc) error {
+				return table.ScanPrefix(ctx, "y", fn, ScanOptions{Reverse: true})
+			}, []string{}},
+			{"range", func(fn ScanFunc) error {
+				return table.ScanRange(ctx, "pa", "q", fn, ScanOptions{})
+			}, []string{"pa", "pz", "p\xff", "p\xff\x01"}},
+			{"reverse range", func(fn ScanFunc) error {
+				return table.ScanRange(ctx, "pa", "q", fn, ScanOptions{Reverse: true})
+			}, []string{"p\xff\x01", "p\xff", "pz", "pa"}},
+			{"unbounded range", func(fn ScanFunc) error {
+				return table.ScanRange(ctx, nil, "p", fn, ScanOptions{})
+			}, []string{"a"}},
+			{"limited range", func(fn ScanFunc) error {
+				return table.ScanRange(ctx, "q", nil, fn, ScanOptions{Limit: 1, Reverse: true})
+			}, []string{"z"}},
+		} {
+			if got := scanKeys(t, c.scan); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%s: %s scanned %q, want %q", name, c.desc, got, c.want)
+			}
+		}
+
+		// values are passed along with their keys
+		table.ScanPrefix(ctx, "pz", func(k interface{}, v interface{}) error {
+			if v != "vpz" {
+				t.Errorf("%s: got value %v for %v, want vpz", name, v, k)
+			}
+			return nil
+		}, ScanOptions{})
+	}
+}
+
+func TestScanPostings(t *testing.T) {
+	tables, cleanup := scanTables(t, "postings")
+	defer cleanup()
+	ctx := context.Background()
+
+	for name, table := range tables {
+		for i, k := range []string{"p", "pa", "pb", "q"} {
+			if err := table.Set(ctx, k, map[uint32][]float32{docA: {float32(i)}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := table.Append(ctx, k, map[uint32][]float32{docB: {1}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// posting lists and their fragments are scanned once, in both directions
+		if got := scanKeys(t, func(fn ScanFunc) error {
+			return table.ScanPrefix(ctx, "p", fn, ScanOptions{Reverse: true})
+		}); !reflect.DeepEqual(got, []string{"pb", "pa", "p"}) {
+			t.Errorf("%s: reverse prefix scanned %q, want [pb pa p]", name, got)
+		}
+		if got := scanKeys(t, func(fn ScanFunc) error {
+			return table.ScanRange(ctx, "pa", "q", fn, ScanOptions{Reverse: true, Limit: 1})
+		}); !reflect.DeepEqual(got, []string{"pb"}) {
+			t.Errorf("%s: limited reverse range scanned %q, want [pb]", name, got)
+		}
+
+		want := map[uint32][]float32{docA: {2}, docB: {1}}
+		table.ScanRange(ctx, "pb", "q", func(k interface{}, v interface{}) error {
+			if !reflect.DeepEqual(v, want) {
+				t.Errorf("%s: got posting list %v for %v, want %v", name, v, k, want)
+			}
+			return nil
+		}, ScanOptions{})
+	}
+}
+
+func TestIterateStop(t *testing.T) {
+	ctx := context.Background()
+	errCallback := errors.New("callback failed")
+
+	for _, valType := range []string{"string", "postings"} {
+		tables, cleanup := scanTables(t, valType)
+		defer cleanup()
+
+		for name, table := range tables {
+			for i := 0; i < 100; i++ {
+				var v interface{} = "v"
+				if valType == "postings" {
+					v = map[uint32][]float32{docA: {1}}
+				}
+				if err := table.Set(ctx, fmt.Sprintf("k%03d", i), v); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, c := range []struct {
+				ret  error
+				want error
+			}{{ErrStopScan, nil}, {errCallback, errCallback}} {
+				calls := 0
+				err := table.Iterate(ctx, func(_ interface{}, _ interface{}) error {
+					calls++
+					if calls == 3 {
+						return c.ret
+					}
+					return nil
+				})
+				if err != c.want || calls != 3 {
+					t.Errorf("%s of %s: callback returning %v called %d times, returned %v, want 3 times and %v",
+						name, valType, c.ret, calls, err, c.want)
+				}
+			}
+		}
+	}
+}
+
+// failingWords fails every lookup
+type failingWords struct {
+	DB
+}
+
+func (failingWords) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	return nil, errors.New("lookup failed")
+}
+
+func TestIterateInv(t *testing.T) {
+	tables, cleanup := scanTables(t, "postings")
+	defer cleanup()
+	ctx := context.Background()
+
+	words := NewMemoryDB("string", "string")
+	words.Set(ctx, hashA, "apple")
+	words.Set(ctx, hashB, "banana")
+
+	for name, table := range tables {
+		// posting list of hashC has no word, e.g. left by a crashed crawl
+		for _, k := range []string{hashA, hashB, "hashC"} {
+			table.Set(ctx, k, map[uint32][]float32{docA: {1}})
+		}
+
+		if got, err := table.IterateInv(ctx, "app", words); err != nil || !reflect.DeepEqual(got, []string{"apple"}) {
+			t.Errorf("%s: got words %v (%v), want [apple]", name, got, err)
+		}
+		if _, err := table.IterateInv(ctx, "", failingWords{words}); err == nil {
+			t.Errorf("%s: failed lookups are not returned", name)
+		}
+	}
+}
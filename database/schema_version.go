@@ -0,0 +1,228 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/apsdehal/go-logger"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+=============================== SCHEMA VERSIONING ==========================================
+	The version of the schema, and the key and value data type of every table, are persisted in
+	`schema.json` inside the data directory. DB_init compares it against the schema of this build:
+		- same version		: tables are opened as usual
+		- older version		: tables are migrated in place if DBOptions.AutoMigrate is set,
+					  otherwise DB_init refuses to open them (run cmd/migrate)
+		- newer version		: DB_init always refuses, the index was built by a newer build
+	Data directory without record but with tables in it predates the versioning, i.e. version 1.
+
+	Version history:
+		1: posting lists of the inverted tables are JSON
+		2: posting lists of the inverted tables are binary, refer to postings.go
+		3: posting lists of the inverted tables may have appended fragments, refer to append.go
+		4: DocInfo records when the document was discovered, refer to gc.go
+		5: posting tables may be split into shards, whose number is recorded. Refer to shard.go
+		6: documents are identified by docIDs of a registry instead of docHashes, refer to docid.go
+		7: DocInfo records the ETag of the page and when it was last checked, for conditional recrawls
+		8: URLs of the registry are canonical, refer to parser/canonical.go and migrateToCanonicalURLs
+
+	Bump SchemaVersion and append to migrations whenever the encoding of a table or DocInfo changes.
+*/
+
+const (
+	SchemaVersion = 8
+
+	schemaFile = "schema.json"
+)
+
+var (
+	ErrSchemaMismatch = errors.New("Index was built with an older schema, run cmd/migrate or open it with AutoMigrate")
+
+	ErrSchemaTooNew = errors.New("Index was built with a newer schema than this build supports")
+
+	ErrSchemaTables = errors.New("Tables of the index do not match the schema of this build")
+)
+
+type (
+	tableType struct {
+		Key   string `json:"Key"`
+		Value string `json:"Value"`
+	}
+
+	schemaRecord struct {
+		Version int                  `json:"Version"`
+		Updated time.Time            `json:"Updated"`
+		Tables  map[string]tableType `json:"Tables"`
+		// number of shards of each posting table, no record means a single one
+		Shards int `json:"Shards,omitempty"`
+	}
+
+	// migration upgrades the tables from version to version+1, opened with the options
+	migration struct {
+		version     int
+		description string
+		run         func(ctx context.Context, opts DBOptions, inv []DB, forw []DB) error
+	}
+)
+
+var migrations = []migration{
+	// JSON posting lists are rewritten by the migration to docIDs, which reads every older encoding
+	{1, "JSON posting lists of the inverted tables, deferred to the docID migration (5) which rewrites them in binary", func(ctx context.Context, opts DBOptions, inv []DB, forw []DB) error {
+		return nil
+	}},
+	// older builds would read the fragments as posting lists, the index itself needs no rewrite
+	{2, "fragments appended to the posting lists, nothing to rewrite", func(ctx context.Context, opts DBOptions, inv []DB, forw []DB) error {
+		return nil
+	}},
+	// discovery time is stamped by the migration to docIDs, the age of the documents counts from then
+	{3, "discovery time of every document, deferred to the docID migration (5) which stamps it", func(ctx context.Context, opts DBOptions, inv []DB, forw []DB) error {
+		return nil
+	}},
+	// older builds would open an empty table in the directory of the shards, the index itself needs no rewrite
+	{4, "posting tables split into shards, nothing to rewrite", func(ctx context.Context, opts DBOptions, inv []DB, forw []DB) error {
+		return nil
+	}},
+	{5, "identify the documents by docIDs of a registry, rewrite the posting lists in binary and stamp the discovery time", migrateToDocIDs},
+	// documents fetched before are fetched in full once more by the next crawl, which records their ETag
+	{6, "ETag and last check of every document, nothing to rewrite as the next crawl records them", func(ctx context.Context, opts DBOptions, inv []DB, forw []DB) error {
+		return nil
+	}},
+	{7, "canonicalise the URLs of the registry and merge the documents registered under several spellings", migrateToCanonicalURLs},
+}
+
+// schema record of this build
+func currentSchema() schemaRecord {
+	rec := schemaRecord{Version: SchemaVersion, Tables: make(map[string]tableType)}
+	for _, v := range append(append([][]string{}, invertedTables...), forwardTables...) {
+		rec.Tables[strings.TrimSuffix(v[0], "/")] = tableType{v[1], v[2]}
+	}
+	return rec
+}
+
+// readSchema returns the version of the index in the data directory, 0 if the directory holds no index yet
+func readSchema(dir string) (schemaRecord, error) {
+	var rec schemaRecord
+
+	content, err := ioutil.ReadFile(dir + schemaFile)
+	if err == nil {
+		err = json.Unmarshal(content, &rec)
+		return rec, err
+	} else if !os.IsNotExist(err) {
+		return rec, err
+	}
+
+	// no record, check whether any table has been written before the versioning
+	for _, v := range append(append([][]string{}, invertedTables...), forwardTables...) {
+		files, err := ioutil.ReadDir(dir + v[0])
+		if err == nil && len(files) > 0 {
+			rec.Version = 1
+			return rec, nil
+		}
+	}
+	return rec, nil
+}
+
+// writeSchema records the tables of this build with the given schema version and number of shards
+func writeSchema(dir string, version int, shards int) error {
+	rec := currentSchema()
+	rec.Version, rec.Updated = version, time.Now().UTC()
+	if shards > 1 {
+		rec.Shards = shards
+	}
+
+	content, err := json.MarshalIndent(rec, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// write to temporary file first, so that the record is never half-written
+	if err = ioutil.WriteFile(dir+schemaFile+".tmp", content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(dir+schemaFile+".tmp", dir+schemaFile)
+}
+
+// checkSchema returns the schema version and the number of shards of the index, refusing the ones which
+// cannot be opened with the options
+func checkSchema(dir string, opts DBOptions) (int, int, error) {
+	rec, err := readSchema(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch {
+	case rec.Version == 0 || rec.Version == SchemaVersion:
+		for name, t := range currentSchema().Tables {
+			if recT, ok := rec.Tables[name]; ok && recT != t {
+				return 0, 0, ErrSchemaTables
+			}
+		}
+	case rec.Version > SchemaVersion:
+		return 0, 0, ErrSchemaTooNew
+	case !opts.AutoMigrate || opts.ReadOnly:
+		return 0, 0, ErrSchemaMismatch
+	}
+
+	// number of shards of a new index is given by the options
+	shards := rec.Shards
+	if shards == 0 {
+		shards = 1
+	}
+	switch {
+	case rec.Version == 0 && opts.Shards > 0:
+		shards = opts.Shards
+	case rec.Version != 0 && opts.Shards > 0 && opts.Shards != shards:
+		return 0, 0, ErrShardCount
+	}
+	return rec.Version, shards, nil
+}
+
+// runMigrations upgrades opened tables from the given version to SchemaVersion
+func runMigrations(ctx context.Context, logger *logger.Logger, from int, opts DBOptions, inv []DB, forw []DB) error {
+	for _, m := range migrations {
+		if m.version < from {
+			continue
+		}
+		logger.Infof("Migrating schema from version %d to %d: %s", m.version, m.version+1, m.description)
+		if err := m.run(ctx, opts, inv, forw); err != nil {
+			return errors.Wrapf(err, "migration from schema version %d failed", m.version)
+		}
+	}
+	return nil
+}
+
+// SchemaVersionOf returns the schema version of the index in the data directory without opening it
+// 0 means there is no index yet
+func SchemaVersionOf(opts DBOptions) (int, error) {
+	rec, err := readSchema(opts.baseDir())
+	return rec.Version, err
+}
+
+// Migrate upgrades the index in the data directory in place to SchemaVersion, and closes it
+// \return: schema version before the migration, error
+func Migrate(ctx context.Context, logger *logger.Logger, opts DBOptions) (int, error) {
+	from, err := SchemaVersionOf(opts)
+	if err != nil {
+		return 0, err
+	}
+
+	opts.AutoMigrate, opts.ReadOnly = true, false
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	inv, forw, err := DB_init(ctx, logger, opts)
+	if err != nil {
+		return from, err
+	}
+
+	for _, t := range append(inv, forw...) {
+		if e := t.Close(ctx, cancel); e != nil && err == nil {
+			err = e
+		}
+	}
+	return from, err
+}
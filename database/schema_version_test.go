@@ -0,0 +1,69 @@
+package database
+
+import (
+	"context"
+	"github.com/apsdehal/go-logger"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSchemaVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, _ := logger.New("test", 1)
+	opts := DefaultDBOptions()
+	opts.Dir, opts.LoadMode, opts.GCInterval = dir, LoadMemoryMap, 0
+	open := func(opts DBOptions) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		inv, forw, err := DB_init(ctx, log, opts)
+		for _, d := range append(inv, forw...) {
+			d.Close(ctx, cancel)
+		}
+		return err
+	}
+
+	// new index is recorded with the schema of this build, and opened as it is afterwards
+	for i := 0; i < 2; i++ {
+		if err = open(opts); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := SchemaVersionOf(opts); err != nil || v != SchemaVersion {
+			t.Fatalf("got schema version %d (%v), want %d", v, err, SchemaVersion)
+		}
+	}
+
+	writeSchema(opts.baseDir(), SchemaVersion+1, 0)
+	if err = open(opts); err != ErrSchemaTooNew {
+		t.Errorf("got error %v opening a newer index, want %v", err, ErrSchemaTooNew)
+	}
+	opts.AutoMigrate = true
+	if err = open(opts); err != ErrSchemaTooNew {
+		t.Errorf("got error %v migrating a newer index, want %v", err, ErrSchemaTooNew)
+	}
+
+	// older index is only migrated if asked to, and never when read-only
+	writeSchema(opts.baseDir(), SchemaVersion-1, 0)
+	for _, o := range []DBOptions{{AutoMigrate: false}, {AutoMigrate: true, ReadOnly: true}} {
+		refused := opts
+		refused.AutoMigrate, refused.ReadOnly = o.AutoMigrate, o.ReadOnly
+		if err = open(refused); err != ErrSchemaMismatch {
+			t.Errorf("got error %v opening an older index with %+v, want %v", err, o, ErrSchemaMismatch)
+		}
+	}
+	if v, _ := SchemaVersionOf(opts); v != SchemaVersion-1 {
+		t.Errorf("refused index recorded with schema version %d, want %d", v, SchemaVersion-1)
+	}
+
+	if err = open(opts); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := SchemaVersionOf(opts); err != nil || v != SchemaVersion {
+		t.Errorf("got schema version %d (%v) after migration, want %d", v, err, SchemaVersion)
+	}
+}
@@ -0,0 +1,449 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/apsdehal/go-logger"
+	"github.com/pkg/errors"
+	"hash/fnv"
+	"os"
+	"strings"
+	"sync"
+)
+
+/*
+=============================== SHARDS ==========================================
+	The posting tables can be hash-partitioned across several Badger instances, so that writes to
+	different words go to different value logs and write batches. Every shard is a table of its own,
+	with its own directory, Bloom filter and batch writer:
+		invKeyword_title/shard-<i>/	: posting lists of the wordHashes with fnv32a(wordHash) % shards == i
+	ShardedDB puts the shards behind the DB interface: reads and writes of a key go to its shard, scans
+	merge the shards in key order, Iterate walks one shard after the other. Units of work write to
+	every shard through the journal shared by all tables, refer to journal.go.
+	The number of shards is chosen when the index is created (DBOptions.Shards) and recorded in
+	schema.json. To change it, export the index and import it with another number of shards.
+*/
+
+const shardDirFormat = "shard-%02d"
+
+var (
+	shardedTables = []string{"invKeyword_title/", "invKeyword_body/"}
+
+	ErrShardCount = errors.New("Index was built with another number of shards, export and import it to change the number of shards")
+)
+
+type (
+	ShardedDB struct {
+		name     string
+		shards   []DB
+		keyCodec Codec
+		valCodec Codec
+	}
+
+	// one batch writer per shard, created on the first key of the shard
+	shardedBatchWriter struct {
+		table   *ShardedDB
+		writers []BatchWriter
+	}
+
+	// pair read from a shard by a merged scan, with its stored key to order the shards
+	shardPair struct {
+		key   []byte
+		k     interface{}
+		value interface{}
+	}
+)
+
+// isSharded tells whether the table directory is split into shards when the index has more than one
+func isSharded(table string) bool {
+	for _, v := range shardedTables {
+		if v == table {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+openShards opens the shards of a table
+\params: context, directory of the table, logger, table definition (refer to invertedTables), number of shards, options
+\return: sharded table, error
+*/
+func openShards(ctx context.Context, dir string, logger *logger.Logger, def []string, shards int, opts DBOptions) (*ShardedDB, error) {
+	s := &ShardedDB{
+		name:     strings.TrimSuffix(def[0], "/"),
+		keyCodec: lookupCodec(def[1], ErrKeyTypeNotFound),
+		valCodec: lookupCodec(def[2], ErrValTypeNotFound),
+	}
+	for i := 0; i < shards; i++ {
+		shardDir := dir + fmt.Sprintf(shardDirFormat, i) + "/"
+		if !opts.ReadOnly {
+			if err := os.MkdirAll(shardDir, 0755); err != nil {
+				return nil, err
+			}
+		}
+		temp, err := NewBadgerDB(ctx, shardDir, logger, opts.loadModeOf(def[0]), def[1], def[2], opts)
+		if err != nil {
+			for _, t := range s.shards {
+				t.Close(ctx, func() {})
+			}
+			return nil, err
+		}
+		// shards are named after their directory below the data directory, e.g. in backups
+		temp.(*BadgerDB).name = s.name + "/" + fmt.Sprintf(shardDirFormat, i)
+		s.shards = append(s.shards, temp)
+	}
+	return s, nil
+}
+
+// NewShardedDB puts the given tables behind a single one, keys are partitioned by hash in the order of shards
+func NewShardedDB(name string, shards []DB) *ShardedDB {
+	s := &ShardedDB{name: name, shards: shards}
+	if rt, ok := shards[0].(rawTable); ok {
+		s.keyCodec, s.valCodec = rt.schema()
+	}
+	return s
+}
+
+// Shards returns the table of every shard
+func (s *ShardedDB) Shards() []DB {
+	return s.shards
+}
+
+func (s *ShardedDB) shardOf(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+// shard returns the table holding the key
+func (s *ShardedDB) shard(key_ interface{}) (DB, error) {
+	key, _, err := marshalPair(s.keyCodec, key_, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.shards[s.shardOf(key)], nil
+}
+
+func (s *ShardedDB) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	shard, err := s.shard(key)
+	if err != nil {
+		return nil, err
+	}
+	return shard.Get(ctx, key)
+}
+
+func (s *ShardedDB) Set(ctx context.Context, key interface{}, value interface{}) error {
+	shard, err := s.shard(key)
+	if err != nil {
+		return err
+	}
+	return shard.Set(ctx, key, value)
+}
+
+func (s *ShardedDB) Has(ctx context.Context, key interface{}) (bool, error) {
+	shard, err := s.shard(key)
+	if err != nil {
+		return false, err
+	}
+	return shard.Has(ctx, key)
+}
+
+func (s *ShardedDB) Delete(ctx context.Context, key interface{}) error {
+	shard, err := s.shard(key)
+	if err != nil {
+		return err
+	}
+	return shard.Delete(ctx, key)
+}
+
+func (s *ShardedDB) Append(ctx context.Context, key interface{}, value interface{}) error {
+	shard, err := s.shard(key)
+	if err != nil {
+		return err
+	}
+	return shard.Append(ctx, key, value)
+}
+
+// every shard is closed even if some fail, the first error is returned
+func (s *ShardedDB) Close(ctx context.Context, cancel context.CancelFunc) error {
+	var ret error
+	for _, shard := range s.shards {
+		if err := shard.Close(ctx, cancel); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+func (s *ShardedDB) DropTable(ctx context.Context) error {
+	for _, shard := range s.shards {
+		if err := shard.DropTable(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedDB) Iterate(ctx context.Context, fn ScanFunc) error {
+	stopped := false
+	for _, shard := range s.shards {
+		err := shard.Iterate(ctx, func(k interface{}, v interface{}) error {
+			err := fn(k, v)
+			if err == ErrStopScan {
+				stopped = true
+			}
+			return err
+		})
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedDB) ScanPrefix(ctx context.Context, prefix interface{}, fn ScanFunc, opt ScanOptions) error {
+	return s.merge(ctx, func(shard DB, fn ScanFunc) error {
+		return shard.ScanPrefix(ctx, prefix, fn, opt)
+	}, fn, opt)
+}
+
+func (s *ShardedDB) ScanRange(ctx context.Context, start interface{}, end interface{}, fn ScanFunc, opt ScanOptions) error {
+	return s.merge(ctx, func(shard DB, fn ScanFunc) error {
+		return shard.ScanRange(ctx, start, end, fn, opt)
+	}, fn, opt)
+}
+
+/*
+merge runs the scan on every shard at once, and passes the pairs to fn in key order
+every shard is scanned with the same options, as the merged scan may take up to opt.Limit pairs from any of them
+\params: context, scan of a shard, callback, options of the scan
+\return: error
+*/
+func (s *ShardedDB) merge(ctx context.Context, scan func(shard DB, fn ScanFunc) error, fn ScanFunc, opt ScanOptions) error {
+	done := make(chan struct{})
+	pairs := make([]chan shardPair, len(s.shards))
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, shard := range s.shards {
+		pairs[i] = make(chan shardPair)
+		wg.Add(1)
+		go func(i int, shard DB) {
+			defer wg.Done()
+			defer close(pairs[i])
+			errs[i] = scan(shard, func(k interface{}, v interface{}) error {
+				key, err := s.keyCodec.Encode(k)
+				if err != nil {
+					return err
+				}
+				select {
+				case pairs[i] <- shardPair{key, k, v}:
+					return nil
+				case <-done:
+					return ErrStopScan
+				}
+			})
+		}(i, shard)
+	}
+	// shards still scanning are stopped before returning
+	defer wg.Wait()
+	defer close(done)
+
+	// a shard which failed has closed its channel, with its error set before
+	heads := make([]*shardPair, len(s.shards))
+	next := func(i int) error {
+		if p, ok := <-pairs[i]; ok {
+			heads[i] = &p
+			return nil
+		}
+		heads[i] = nil
+		return errs[i]
+	}
+	for i := range heads {
+		if err := next(i); err != nil {
+			return err
+		}
+	}
+
+	for n := 0; opt.Limit == 0 || n < opt.Limit; n++ {
+		first := -1
+		for i, p := range heads {
+			if p == nil {
+				continue
+			}
+			if first < 0 {
+				first = i
+			} else if c := bytes.Compare(p.key, heads[first].key); c != 0 && (c < 0) != opt.Reverse {
+				first = i
+			}
+		}
+		if first < 0 {
+			return nil
+		}
+
+		if err := fn(heads[first].k, heads[first].value); err == ErrStopScan {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := next(first); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedDB) BatchWrite_init(ctx context.Context) BatchWriter {
+	return &shardedBatchWriter{table: s, writers: make([]BatchWriter, len(s.shards))}
+}
+
+func (sbw *shardedBatchWriter) BatchSet(ctx context.Context, key_ interface{}, value interface{}) error {
+	key, _, err := marshalPair(sbw.table.keyCodec, key_, nil, nil)
+	if err != nil {
+		return err
+	}
+	i := sbw.table.shardOf(key)
+	if sbw.writers[i] == nil {
+		sbw.writers[i] = sbw.table.shards[i].BatchWrite_init(ctx)
+	}
+	return sbw.writers[i].BatchSet(ctx, key_, value)
+}
+
+func (sbw *shardedBatchWriter) Flush(ctx context.Context) error {
+	for _, w := range sbw.writers {
+		if w == nil {
+			continue
+		}
+		if err := w.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sbw *shardedBatchWriter) Cancel(ctx context.Context) {
+	for _, w := range sbw.writers {
+		if w != nil {
+			w.Cancel(ctx)
+		}
+	}
+}
+
+func (s *ShardedDB) Debug_Print(ctx context.Context) error {
+	for _, shard := range s.shards {
+		if err := shard.Debug_Print(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statistics of the shards added up
+func (s *ShardedDB) Stats(ctx context.Context) (TableStats, error) {
+	ret := TableStats{Name: s.name}
+	for _, shard := range s.shards {
+		stats, err := shard.Stats(ctx)
+		if err != nil {
+			return ret, err
+		}
+		ret.Keys += stats.Keys
+		ret.Fragments += stats.Fragments
+		ret.LSMSize += stats.LSMSize
+		ret.VlogSize += stats.VlogSize
+	}
+	return ret, nil
+}
+
+// words of the shards, every wordHash belongs to a single shard
+func (s *ShardedDB) IterateInv(ctx context.Context, pre string, frw0 DB) ([]string, error) {
+	var ret []string
+	for _, shard := range s.shards {
+		words, err := shard.IterateInv(ctx, pre, frw0)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, words...)
+	}
+	return ret, nil
+}
+
+func (s *ShardedDB) Iterate_QuickFix(ctx context.Context) (map[string]map[string]float64, error) {
+	ret := make(map[string]map[string]float64)
+	for _, shard := range s.shards {
+		m, err := shard.Iterate_QuickFix(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range m {
+			ret[k] = v
+		}
+	}
+	return ret, nil
+}
+
+// units of work write the ops of every shard in a batch of its own, refer to journal.go
+func (s *ShardedDB) tableName() string {
+	return s.name
+}
+
+func (s *ShardedDB) schema() (Codec, Codec) {
+	return s.keyCodec, s.valCodec
+}
+
+func (s *ShardedDB) tableJournal() *journal {
+	if rt, ok := s.shards[0].(rawTable); ok {
+		return rt.tableJournal()
+	}
+	return nil
+}
+
+func (s *ShardedDB) sync() error {
+	for _, shard := range s.shards {
+		rt, ok := shard.(rawTable)
+		if !ok {
+			return ErrTableNotSupported
+		}
+		if err := rt.sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedDB) writeRaw(ops []journalOp) error {
+	perShard := make([][]journalOp, len(s.shards))
+	for _, op := range ops {
+		i := s.shardOf(op.Key)
+		perShard[i] = append(perShard[i], op)
+	}
+	for i, shardOps := range perShard {
+		if len(shardOps) == 0 {
+			continue
+		}
+		rt, ok := s.shards[i].(rawTable)
+		if !ok {
+			return ErrTableNotSupported
+		}
+		if err := rt.writeRaw(shardOps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// badgerTables returns the Badger instances of the tables, i.e. the shards of the sharded ones
+func badgerTables(tables []DB) []*BadgerDB {
+	var ret []*BadgerDB
+	for _, t := range tables {
+		switch t := t.(type) {
+		case *BadgerDB:
+			ret = append(ret, t)
+		case *ShardedDB:
+			ret = append(ret, badgerTables(t.shards)...)
+		case *CachedDB:
+			ret = append(ret, badgerTables([]DB{t.Unwrap()})...)
+		}
+	}
+	return ret
+}
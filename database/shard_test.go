@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"github.com/apsdehal/go-logger"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestShardedDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, _ := logger.New("test", 1)
+	opts := DefaultDBOptions()
+	opts.Dir, opts.GCInterval, opts.Shards = dir, 0, 4
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tables, err := OpenTables(ctx, log, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharded, ok := tables.BodyPostings.Raw().(*ShardedDB)
+	if !ok || len(sharded.Shards()) != 4 {
+		t.Fatalf("got body postings %T, want 4 shards", tables.BodyPostings.Raw())
+	}
+
+	var words []string
+	for _, w := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		words = append(words, hashOf(w))
+		tables.BodyPostings.Append(ctx, hashOf(w), map[uint32][]float32{docA: {1, 2}})
+	}
+	uow := NewUnitOfWork()
+	tables.BodyPostings.AppendIn(ctx, uow, words[0], map[uint32][]float32{docB: {1, 3}})
+	if err = uow.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := tables.BodyPostings.Get(ctx, words[0]); len(list) != 2 {
+		t.Errorf("got postings %v, want the ones of both documents", list)
+	}
+
+	// scans merge the shards in key order
+	for _, opt := range []ScanOptions{{}, {Reverse: true}, {Limit: 3}} {
+		var got []string
+		err = tables.BodyPostings.Raw().ScanRange(ctx, "", "", func(k interface{}, _ interface{}) error {
+			got = append(got, k.(string))
+			return nil
+		}, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append([]string{}, words...)
+		sort.Strings(want)
+		if opt.Reverse {
+			sort.Sort(sort.Reverse(sort.StringSlice(want)))
+		}
+		if opt.Limit > 0 {
+			want = want[:opt.Limit]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got keys %v with %+v, want %v", got, opt, want)
+		}
+	}
+	if err = tables.Close(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	// number of shards is recorded, and cannot be changed once the index is built
+	opts.Shards = 2
+	ctx, cancel = context.WithCancel(context.Background())
+	if _, err = OpenTables(ctx, log, opts); err != ErrShardCount {
+		t.Errorf("got error %v opening with another number of shards, want %v", err, ErrShardCount)
+	}
+	opts.Shards = 0
+	if tables, err = OpenTables(ctx, log, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer tables.Close(ctx, cancel)
+	for _, w := range words {
+		if has, _ := tables.BodyPostings.Has(ctx, w); !has {
+			t.Errorf("%s missing after reopening the shards", w)
+		}
+	}
+	if stats, _ := tables.BodyPostings.Raw().Stats(ctx); stats.Fragments != len(words)+1 {
+		t.Errorf("got %d fragments in the shards, want %d", stats.Fragments, len(words)+1)
+	}
+}
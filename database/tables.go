@@ -0,0 +1,471 @@
+package database
+
+import (
+	"context"
+	"github.com/apsdehal/go-logger"
+	"strings"
+)
+
+/*
+=============================== TABLE HANDLES ==========================================
+	Tables gives every table opened by DB_init a name and a handle typed after its schema, so that
+	the type of keys and values is checked at compile time instead of asserted on every Get:
+		TitlePostings	: inv[0], PostingTable
+		BodyPostings	: inv[1], PostingTable
+		TopicKeywords	: inv[2], TopicTable
+		Words		: forw[0], WordTable
+		Docs		: forw[1], DocInfoTable
+		Children	: forw[2], ChildrenTable
+		Rank		: forw[3], DocRankTable
+		Magnitude	: forw[4], DocRankTable
+		TopicMetadata	: forw[5], RankTable
+		DocIDs		: forw[6] and forw[7], DocRegistry
+	Every handle wraps the DB, which stays reachable through Raw() for batch writers and scans
+	not covered by the handle. Methods ending with In go through a unit of work, refer to journal.go.
+	Tables of documents are keyed by docID, refer to docid.go.
+*/
+
+type (
+	// untyped part shared by every handle
+	table struct {
+		db DB
+	}
+
+	// untyped part shared by every handle keyed by docID
+	docTable struct{ table }
+
+	// wordHash -> docID -> weight followed by positions
+	PostingTable struct{ table }
+
+	// docID -> DocInfo
+	DocInfoTable struct{ docTable }
+
+	// wordHash -> word
+	WordTable struct{ table }
+
+	// docID -> docIDs of its children
+	ChildrenTable struct{ docTable }
+
+	// key -> name -> value, e.g. category -> numPages
+	RankTable struct{ table }
+
+	// docID -> name -> value, e.g. docID -> topic -> pageRank
+	DocRankTable struct{ docTable }
+
+	// keyword -> category -> frequency
+	TopicTable struct{ table }
+
+	Tables struct {
+		TitlePostings PostingTable
+		BodyPostings  PostingTable
+		TopicKeywords TopicTable
+		Words         WordTable
+		Docs          DocInfoTable
+		Children      ChildrenTable
+		Rank          DocRankTable
+		Magnitude     DocRankTable
+		TopicMetadata RankTable
+		DocIDs        *DocRegistry
+
+		// page cache of the index with trailing slash, set by OpenTables from DBOptions.DocsDir
+		// a copy published with its page cache has its own, refer to publish.go
+		DocsDir string
+
+		inv  []DB
+		forw []DB
+	}
+)
+
+/*
+	NewTables names the tables returned by DB_init or MemoryDB_init
+	\params: inverted tables, forward tables
+	\return: table handles, ErrSchemaTables if the tables do not match the schema of this build
+*/
+func NewTables(inv []DB, forw []DB) (*Tables, error) {
+	if len(inv) != len(invertedTables) || len(forw) != len(forwardTables) {
+		return nil, ErrSchemaTables
+	}
+	for i, t := range append(append([]DB{}, inv...), forw...) {
+		def := append(append([][]string{}, invertedTables...), forwardTables...)[i]
+		if rt, ok := t.(rawTable); ok {
+			if keyCodec, valCodec := rt.schema(); keyCodec.Name() != def[1] || valCodec.Name() != def[2] {
+				return nil, ErrSchemaTables
+			}
+		}
+	}
+
+	return &Tables{
+		TitlePostings: PostingTable{table{inv[0]}},
+		BodyPostings:  PostingTable{table{inv[1]}},
+		TopicKeywords: TopicTable{table{inv[2]}},
+		Words:         WordTable{table{forw[0]}},
+		Docs:          DocInfoTable{docTable{table{forw[1]}}},
+		Children:      ChildrenTable{docTable{table{forw[2]}}},
+		Rank:          DocRankTable{docTable{table{forw[3]}}},
+		Magnitude:     DocRankTable{docTable{table{forw[4]}}},
+		TopicMetadata: RankTable{table{forw[5]}},
+		DocIDs:        newDocRegistry(forw[6], forw[7]),
+		inv:           inv,
+		forw:          forw,
+	}, nil
+}
+
+// OpenTables calls DB_init and names the tables, refer to DB_init for the options
+func OpenTables(ctx context.Context, logger *logger.Logger, opts DBOptions) (*Tables, error) {
+	inv, forw, err := DB_init(ctx, logger, opts)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := NewTables(inv, forw)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DocsDir != "" {
+		tables.DocsDir = strings.TrimSuffix(opts.DocsDir, "/") + "/"
+	}
+	return tables, nil
+}
+
+// Inverted returns the inverted tables in the order of DB_init
+func (t *Tables) Inverted() []DB {
+	return t.inv
+}
+
+// Forward returns the forward tables in the order of DB_init
+func (t *Tables) Forward() []DB {
+	return t.forw
+}
+
+// All returns every table, inverted tables first
+func (t *Tables) All() []DB {
+	return append(append([]DB{}, t.inv...), t.forw...)
+}
+
+// CacheStats returns the statistics of every cached table, refer to cache.go
+func (t *Tables) CacheStats() []CacheStats {
+	var stats []CacheStats
+	for _, d := range t.All() {
+		if c, ok := d.(*CachedDB); ok {
+			stats = append(stats, c.CacheStats())
+		}
+	}
+	return stats
+}
+
+// Close closes every table, and calls cancel as DB.Close does
+// every table is closed even if some fail, the first error is returned
+func (t *Tables) Close(ctx context.Context, cancel context.CancelFunc) error {
+	var ret error
+	for _, d := range t.All() {
+		if err := d.Close(ctx, cancel); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// Raw returns the untyped table
+func (t table) Raw() DB {
+	return t.db
+}
+
+func (t table) Has(ctx context.Context, key string) (bool, error) {
+	return t.db.Has(ctx, key)
+}
+
+func (t table) Delete(ctx context.Context, key string) error {
+	return t.db.Delete(ctx, key)
+}
+
+func (t table) DeleteIn(ctx context.Context, uow *UnitOfWork, key string) error {
+	return uow.Delete(ctx, t.db, key)
+}
+
+// scan calls fn on every key-value pair of the table, refer to DB.Iterate
+func (t table) scan(ctx context.Context, fn func(key string, value interface{}) error) error {
+	return t.db.Iterate(ctx, func(k interface{}, v interface{}) error {
+		return fn(k.(string), v)
+	})
+}
+
+func (t docTable) Has(ctx context.Context, docID uint32) (bool, error) {
+	return t.db.Has(ctx, docID)
+}
+
+func (t docTable) Delete(ctx context.Context, docID uint32) error {
+	return t.db.Delete(ctx, docID)
+}
+
+func (t docTable) DeleteIn(ctx context.Context, uow *UnitOfWork, docID uint32) error {
+	return uow.Delete(ctx, t.db, docID)
+}
+
+// scan calls fn on every key-value pair of the table, refer to DB.Iterate
+func (t docTable) scan(ctx context.Context, fn func(docID uint32, value interface{}) error) error {
+	return t.db.Iterate(ctx, func(k interface{}, v interface{}) error {
+		return fn(k.(uint32), v)
+	})
+}
+
+func (t PostingTable) Get(ctx context.Context, wordHash string) (map[uint32][]float32, error) {
+	v, err := t.db.Get(ctx, wordHash)
+	if err != nil {
+		return nil, err
+	}
+	return asPostings(v)
+}
+
+func (t PostingTable) GetIn(ctx context.Context, uow *UnitOfWork, wordHash string) (map[uint32][]float32, error) {
+	v, err := uow.Get(ctx, t.db, wordHash)
+	if err != nil {
+		return nil, err
+	}
+	return asPostings(v)
+}
+
+func (t PostingTable) Put(ctx context.Context, wordHash string, postings map[uint32][]float32) error {
+	return t.db.Set(ctx, wordHash, postings)
+}
+
+// Append adds the postings to the posting list of the word, refer to append.go
+func (t PostingTable) Append(ctx context.Context, wordHash string, postings map[uint32][]float32) error {
+	return t.db.Append(ctx, wordHash, postings)
+}
+
+func (t PostingTable) AppendIn(ctx context.Context, uow *UnitOfWork, wordHash string, postings map[uint32][]float32) error {
+	return uow.Append(ctx, t.db, wordHash, postings)
+}
+
+func (t PostingTable) Scan(ctx context.Context, fn func(wordHash string, postings map[uint32][]float32) error) error {
+	return t.scan(ctx, func(k string, v interface{}) error {
+		postings, err := asPostings(v)
+		if err != nil {
+			return err
+		}
+		return fn(k, postings)
+	})
+}
+
+func asPostings(v interface{}) (map[uint32][]float32, error) {
+	ret, ok := v.(map[uint32][]float32)
+	if !ok {
+		return nil, ErrValTypeNotMatch
+	}
+	return ret, nil
+}
+
+func (t DocInfoTable) Get(ctx context.Context, docID uint32) (DocInfo, error) {
+	v, err := t.db.Get(ctx, docID)
+	if err != nil {
+		return DocInfo{}, err
+	}
+	return asDocInfo(v)
+}
+
+func (t DocInfoTable) GetIn(ctx context.Context, uow *UnitOfWork, docID uint32) (DocInfo, error) {
+	v, err := uow.Get(ctx, t.db, docID)
+	if err != nil {
+		return DocInfo{}, err
+	}
+	return asDocInfo(v)
+}
+
+func (t DocInfoTable) Put(ctx context.Context, docID uint32, info DocInfo) error {
+	return t.db.Set(ctx, docID, info)
+}
+
+func (t DocInfoTable) PutIn(ctx context.Context, uow *UnitOfWork, docID uint32, info DocInfo) error {
+	return uow.Set(ctx, t.db, docID, info)
+}
+
+func (t DocInfoTable) Scan(ctx context.Context, fn func(docID uint32, info DocInfo) error) error {
+	return t.scan(ctx, func(k uint32, v interface{}) error {
+		info, err := asDocInfo(v)
+		if err != nil {
+			return err
+		}
+		return fn(k, info)
+	})
+}
+
+func asDocInfo(v interface{}) (DocInfo, error) {
+	ret, ok := v.(DocInfo)
+	if !ok {
+		return DocInfo{}, ErrValTypeNotMatch
+	}
+	return ret, nil
+}
+
+func (t WordTable) Get(ctx context.Context, wordHash string) (string, error) {
+	v, err := t.db.Get(ctx, wordHash)
+	if err != nil {
+		return "", err
+	}
+	return asWord(v)
+}
+
+func (t WordTable) GetIn(ctx context.Context, uow *UnitOfWork, wordHash string) (string, error) {
+	v, err := uow.Get(ctx, t.db, wordHash)
+	if err != nil {
+		return "", err
+	}
+	return asWord(v)
+}
+
+func (t WordTable) Put(ctx context.Context, wordHash string, word string) error {
+	return t.db.Set(ctx, wordHash, word)
+}
+
+func (t WordTable) PutIn(ctx context.Context, uow *UnitOfWork, wordHash string, word string) error {
+	return uow.Set(ctx, t.db, wordHash, word)
+}
+
+func (t WordTable) Scan(ctx context.Context, fn func(wordHash string, word string) error) error {
+	return t.scan(ctx, func(k string, v interface{}) error {
+		word, err := asWord(v)
+		if err != nil {
+			return err
+		}
+		return fn(k, word)
+	})
+}
+
+func asWord(v interface{}) (string, error) {
+	ret, ok := v.(string)
+	if !ok {
+		return "", ErrValTypeNotMatch
+	}
+	return ret, nil
+}
+
+func (t ChildrenTable) Get(ctx context.Context, docID uint32) ([]uint32, error) {
+	v, err := t.db.Get(ctx, docID)
+	if err != nil {
+		return nil, err
+	}
+	return asChildren(v)
+}
+
+func (t ChildrenTable) GetIn(ctx context.Context, uow *UnitOfWork, docID uint32) ([]uint32, error) {
+	v, err := uow.Get(ctx, t.db, docID)
+	if err != nil {
+		return nil, err
+	}
+	return asChildren(v)
+}
+
+func (t ChildrenTable) Put(ctx context.Context, docID uint32, children []uint32) error {
+	return t.db.Set(ctx, docID, children)
+}
+
+func (t ChildrenTable) PutIn(ctx context.Context, uow *UnitOfWork, docID uint32, children []uint32) error {
+	return uow.Set(ctx, t.db, docID, children)
+}
+
+func (t ChildrenTable) Scan(ctx context.Context, fn func(docID uint32, children []uint32) error) error {
+	return t.scan(ctx, func(k uint32, v interface{}) error {
+		children, err := asChildren(v)
+		if err != nil {
+			return err
+		}
+		return fn(k, children)
+	})
+}
+
+func asChildren(v interface{}) ([]uint32, error) {
+	ret, ok := v.([]uint32)
+	if !ok {
+		return nil, ErrValTypeNotMatch
+	}
+	return ret, nil
+}
+
+func (t RankTable) Get(ctx context.Context, key string) (map[string]float64, error) {
+	v, err := t.db.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return asRank(v)
+}
+
+func (t RankTable) Put(ctx context.Context, key string, value map[string]float64) error {
+	return t.db.Set(ctx, key, value)
+}
+
+func (t RankTable) PutIn(ctx context.Context, uow *UnitOfWork, key string, value map[string]float64) error {
+	return uow.Set(ctx, t.db, key, value)
+}
+
+func (t RankTable) Scan(ctx context.Context, fn func(key string, value map[string]float64) error) error {
+	return t.scan(ctx, func(k string, v interface{}) error {
+		value, err := asRank(v)
+		if err != nil {
+			return err
+		}
+		return fn(k, value)
+	})
+}
+
+func asRank(v interface{}) (map[string]float64, error) {
+	ret, ok := v.(map[string]float64)
+	if !ok {
+		return nil, ErrValTypeNotMatch
+	}
+	return ret, nil
+}
+
+func (t DocRankTable) Get(ctx context.Context, docID uint32) (map[string]float64, error) {
+	v, err := t.db.Get(ctx, docID)
+	if err != nil {
+		return nil, err
+	}
+	return asRank(v)
+}
+
+func (t DocRankTable) Put(ctx context.Context, docID uint32, value map[string]float64) error {
+	return t.db.Set(ctx, docID, value)
+}
+
+func (t DocRankTable) PutIn(ctx context.Context, uow *UnitOfWork, docID uint32, value map[string]float64) error {
+	return uow.Set(ctx, t.db, docID, value)
+}
+
+func (t DocRankTable) Scan(ctx context.Context, fn func(docID uint32, value map[string]float64) error) error {
+	return t.scan(ctx, func(k uint32, v interface{}) error {
+		value, err := asRank(v)
+		if err != nil {
+			return err
+		}
+		return fn(k, value)
+	})
+}
+
+func (t TopicTable) Get(ctx context.Context, keyword string) (map[string]uint32, error) {
+	v, err := t.db.Get(ctx, keyword)
+	if err != nil {
+		return nil, err
+	}
+	return asTopic(v)
+}
+
+func (t TopicTable) Put(ctx context.Context, keyword string, freq map[string]uint32) error {
+	return t.db.Set(ctx, keyword, freq)
+}
+
+func (t TopicTable) Scan(ctx context.Context, fn func(keyword string, freq map[string]uint32) error) error {
+	return t.scan(ctx, func(k string, v interface{}) error {
+		freq, err := asTopic(v)
+		if err != nil {
+			return err
+		}
+		return fn(k, freq)
+	})
+}
+
+func asTopic(v interface{}) (map[string]uint32, error) {
+	ret, ok := v.(map[string]uint32)
+	if !ok {
+		return nil, ErrValTypeNotMatch
+	}
+	return ret, nil
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestTables(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	inv, forw, _ := MemoryDB_init(ctx)
+	tables, err := NewTables(inv, forw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tables.Close(ctx, cancel)
+
+	if _, err = NewTables(forw, inv); err != ErrSchemaTables {
+		t.Errorf("got error %v, want %v", err, ErrSchemaTables)
+	}
+
+	info := DocInfo{Page_title: []string{"title"}, Children: []uint32{docB}}
+	if err = tables.Docs.Put(ctx, docA, info); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := tables.Docs.Get(ctx, docA); err != nil || !reflect.DeepEqual(v.Page_title, info.Page_title) {
+		t.Errorf("got %v (%v), want %v", v, err, info)
+	}
+	if _, err = tables.Docs.Get(ctx, docB); err != ErrNotFound {
+		t.Errorf("got error %v, want %v", err, ErrNotFound)
+	}
+
+	uow := NewUnitOfWork()
+	tables.Words.PutIn(ctx, uow, "w", "word")
+	tables.TitlePostings.AppendIn(ctx, uow, "w", map[uint32][]float32{docA: {1, 0}})
+	if v, err := tables.Words.GetIn(ctx, uow, "w"); err != nil || v != "word" {
+		t.Errorf("got %q (%v) before commit, want word", v, err)
+	}
+	if err = uow.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var words []string
+	tables.TitlePostings.Scan(ctx, func(wordHash string, postings map[uint32][]float32) error {
+		words = append(words, wordHash)
+		return nil
+	})
+	if !reflect.DeepEqual(words, []string{"w"}) {
+		t.Errorf("got %v, want [w]", words)
+	}
+
+	// typed handle refuses a table of another schema instead of panicking
+	wrong := RankTable{table{forw[0]}}
+	if _, err = wrong.Get(ctx, "w"); err != ErrValTypeNotMatch {
+		t.Errorf("got error %v, want %v", err, ErrValTypeNotMatch)
+	}
+}
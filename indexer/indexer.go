@@ -5,13 +5,15 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
-	"github.com/dgraph-io/badger"
 	"github.com/nwihardjo/SpaghettiSearch/database"
 	"github.com/nwihardjo/SpaghettiSearch/parser"
+	"github.com/pkg/errors"
 	"golang.org/x/net/html"
+	"golang.org/x/sync/errgroup"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,31 +22,63 @@ import (
 
 var DocsDir = "docs/"
 
+// DocInfo of a document is read-modify-written by the document itself and by its parents,
+// documents are locked by stripe so that documents sharing no stripe are indexed concurrently
+const lockStripes = 256
+
+var docLocks [lockStripes]sync.Mutex
+
+// lockDocs locks the stripes of the docIDs in ascending order to avoid deadlocks, returns the function unlocking them
+func lockDocs(docIDs ...uint32) (unlock func()) {
+	seen := make(map[int]bool)
+	var stripes []int
+	for _, d := range docIDs {
+		if s := int(d % lockStripes); !seen[s] {
+			seen[s] = true
+			stripes = append(stripes, s)
+		}
+	}
+	sort.Ints(stripes)
+
+	for _, s := range stripes {
+		docLocks[s].Lock()
+	}
+	return func() {
+		for i := len(stripes) - 1; i >= 0; i-- {
+			docLocks[stripes[i]].Unlock()
+		}
+	}
+}
+
+// Index stores the document and its links to the children in every table
+// nothing is written if an error is returned, except the page cache which is written last
+// etag is the ETag header of the response, empty if none
 func Index(doc []byte, rootNode *html.Node, urlString string,
-	lastModified time.Time, ps string, mutex *sync.Mutex,
-	inverted []database.DB, forward []database.DB,
-	parentURL string, children []string) {
+	lastModified time.Time, ps string, etag string,
+	tables *database.Tables,
+	parentURL string, children []string) error {
 
-	ctx, _ := context.WithCancel(context.TODO())
+	ctx := context.TODO()
 
 	// Get the URL type of current URL string
 	URL, err := url.Parse(urlString)
 	if err != nil {
-		panic(err)
+		return errors.Wrapf(err, "failed to parse URL %s", urlString)
 	}
 	fmt.Println("Indexing", URL.String())
 
-	// Get the hash of current URL
-	docHash := md5.Sum([]byte(urlString))
-	docHashString := hex.EncodeToString(docHash[:])
+	// Get the docID of current URL, assigned the first time the URL is seen
+	docID, err := tables.DocIDs.Assign(ctx, urlString)
+	if err != nil {
+		return err
+	}
+	// page cache is named after the docHash of the URL
+	cacheName := database.DocHash(urlString)
 
 	// Get Last Modified from DB
-	var dI database.DocInfo
-	mutex.Lock()
-	dI_, err := forward[1].Get(ctx, docHashString)
+	dI, err := tables.Docs.Get(ctx, docID)
 	checkIndex := false
 	if err == nil {
-		dI = dI_.(database.DocInfo)
 		lm := dI.Mod_date
 		if lastModified.After(lm) {
 			// check dI different or not
@@ -57,22 +91,14 @@ func Index(doc []byte, rootNode *html.Node, urlString string,
 				checkIndex = true
 			}
 		} else {
-			// no need to update
-			mutex.Unlock()
-			return
+			// no need to update, besides recording the check
+			return Touch(urlString, etag, tables)
 		}
-	} else if err == badger.ErrKeyNotFound {
+	} else if err == database.ErrNotFound {
 		// do indexing as usual
 		checkIndex = false
 	} else {
-		panic(err)
-	}
-	mutex.Unlock()
-
-	// If the doc exists, check its title, body, children, and page size
-	// If any of them modified, update / delete accordingly
-	if checkIndex {
-		checkAndUpdate(mutex, docHashString, dI, &checkIndex, doc, inverted, forward)
+		return err
 	}
 
 	// title and body are structs
@@ -80,14 +106,10 @@ func Index(doc []byte, rootNode *html.Node, urlString string,
 
 	// Parse title & page size
 	pageTitle := strings.Fields(titleInfo.Content)
-	var pageSize int
-	if ps == "" {
+	// size of the content read if the Content-Length header is missing or malformed
+	pageSize, err := strconv.Atoi(ps)
+	if err != nil {
 		pageSize = len(doc)
-	} else {
-		pageSize, err = strconv.Atoi(ps)
-		if err != nil {
-			panic(err)
-		}
 	}
 
 	// Get the word mapping (wordHash -> frequency) of each document
@@ -97,221 +119,141 @@ func Index(doc []byte, rootNode *html.Node, urlString string,
 		wordMapping[hex.EncodeToString(h[:])] = val
 	}
 
-	// Initialize container for docHashes of children
-	var kids []string
+	// Initialize container for docIDs of children
+	var kids []uint32
 	var kidUrls []*url.URL
+	// anchor text of the children is keyed by docHash, refer to parser.Parse
+	var kidHashes []string
 
 	for _, child := range children {
-		// Get URL object of current child url
+		// Get URL object of current child url, children which are not valid URLs are left out
 		childURL, err := url.Parse(child)
 		if err != nil {
-			panic(err)
+			continue
 		}
 
-		// Get docHash of each child
-		childHash := md5.Sum([]byte(child))
-		childHashString := hex.EncodeToString(childHash[:])
+		// Get docID of each child
+		childID, err := tables.DocIDs.Assign(ctx, child)
+		if err != nil {
+			return err
+		}
 
-		kids = append(kids, childHashString)
+		kids = append(kids, childID)
 		kidUrls = append(kidUrls, childURL)
+		kidHashes = append(kidHashes, database.DocHash(child))
 	}
 
-	// initiate batch object
-	var batchWriter_forward []database.BatchWriter
-	var batchWriter_inverted []database.BatchWriter
+	// every table mutation for this document is committed at once, refer to database/journal.go
+	uow := database.NewUnitOfWork()
+	defer uow.Discard()
 
-	for _, i := range forward {
-		temp := i.BatchWrite_init(ctx)
-		defer temp.Cancel(ctx)
-		batchWriter_forward = append(batchWriter_forward, temp)
+	// DocInfo of this document, its new and its old children are read-modify-written, locked until commit
+	// children only change when this document is indexed, which the crawler never does twice at once
+	// posting lists are appended to without being read, they need no lock
+	unlock := lockDocs(append(append([]uint32{docID}, kids...), dI.Children...)...)
+	defer unlock()
+
+	// parents indexed meanwhile may have updated the DocInfo
+	if checkIndex {
+		if dI, err = tables.Docs.Get(ctx, docID); err != nil {
+			return err
+		}
 	}
-	for _, i := range inverted {
-		temp := i.BatchWrite_init(ctx)
-		defer temp.Cancel(ctx)
-		batchWriter_inverted = append(batchWriter_inverted, temp)
+
+	// If the doc exists, check its title, body, children, and page size
+	// If any of them modified, update / delete accordingly
+	if checkIndex {
+		if err = checkAndUpdate(ctx, uow, docID, cacheName, dI, &checkIndex, doc, tables); err != nil {
+			return err
+		}
 	}
 
-	// process and load data to batch writer for inverted tables
+	// process and load data to the unit of work for inverted tables
 	// map word to wordHash as well if not exist
 	maxFreq := getMaxFreq(titleInfo.Freq)
-	// save from title wordHash -> [{DocHash, Positions}]
-	mutex.Lock()
-	setInverted(ctx, titleInfo.Pos, maxFreq, docHashString, forward, inverted[0], batchWriter_forward, batchWriter_inverted[0])
+	// save from title wordHash -> [{DocID, Positions}]
+	if err = setInverted(ctx, uow, titleInfo.Pos, maxFreq, docID, tables.Words, tables.TitlePostings); err != nil {
+		return err
+	}
 
 	maxFreq = getMaxFreq(bodyInfo.Freq)
-	// save from body wordHash-> [{DocHash, Positions}]
-	setInverted(ctx, bodyInfo.Pos, maxFreq, docHashString, forward, inverted[1], batchWriter_forward, batchWriter_inverted[1])
-
-	// write the key-value pairs set on batch write. If no value is to be flushed, it'll return nil
-	for _, f := range batchWriter_forward {
-		if err = f.Flush(ctx); err != nil {
-			panic(err)
-		}
+	// save from body wordHash-> [{DocID, Positions}]
+	if err = setInverted(ctx, uow, bodyInfo.Pos, maxFreq, docID, tables.Words, tables.BodyPostings); err != nil {
+		return err
 	}
-	for _, i := range batchWriter_inverted {
-		if err = i.Flush(ctx); err != nil {
-			panic(err)
-		}
-	}
-	mutex.Unlock()
-
-	// initialise batch writer for child append
-	bw_child := forward[1].BatchWrite_init(ctx)
-	defer bw_child.Cancel(ctx)
 
-	mutex.Lock()
 	for idx, kid := range kids {
-		bw_anchor := inverted[0].BatchWrite_init(ctx)
-		defer bw_anchor.Cancel(ctx)
-		bw_anchor_frw := forward[0].BatchWrite_init(ctx)
-		defer bw_anchor_frw.Cancel(ctx)
-
+		anchor := cleanFancy[kidHashes[idx]]
 		// Get DocInfo corresponding to the child,
 		// make one if not present (for the sake of getting the url of not-yet-visited child)
-		docInfoC, err := forward[1].Get(ctx, kid)
-		if err == badger.ErrKeyNotFound {
-			tempP := make(map[string][]string)
-			if cleanFancy[kid] == nil {
-				tempP[docHashString] = []string{}
+		docInfoC_, err := tables.Docs.GetIn(ctx, uow, kid)
+		if err == database.ErrNotFound {
+			tempP := make(map[uint32][]string)
+			if anchor == nil {
+				tempP[docID] = []string{}
 			} else {
-				tempP[docHashString] = cleanFancy[kid]
+				tempP[docID] = anchor
 			}
-			docInfoC_ := database.DocInfo{*kidUrls[idx], nil, time.Time{}, 0, nil, tempP, nil}
+			docInfoC_ := database.DocInfo{Url: *kidUrls[idx], Parents: tempP, Discovered: time.Now().UTC()}
 
-			// Set docHash of child -> docInfo of child using batch writer
-			if err = bw_child.BatchSet(ctx, kid, docInfoC_); err != nil {
-				panic(err)
+			// Set docID of child -> docInfo of child
+			if err = tables.Docs.PutIn(ctx, uow, kid, docInfoC_); err != nil {
+				return err
 			}
 
 			tttt := make(map[string]uint32)
 			babi := make(map[string][]float32)
-			for _, w := range cleanFancy[kid] {
+			for _, w := range anchor {
 				tttt[w] += 1
 				babi[w] = append(babi[w], -100)
 			}
-			maxFreq := getMaxFreq(fancyInfo[kid].Freq)
-			var wg1 sync.WaitGroup
-			for wrd, _ := range tttt {
-				wg1.Add(1)
-				go func(w string) {
-					defer wg1.Done()
-					wHash := md5.Sum([]byte(w))
-					wHashString := hex.EncodeToString(wHash[:])
-					invKeyVals := make(map[string][]float32)
-					normTF := float32(float32(tttt[w]) / float32(maxFreq))
-					invKeyVals[kid] = append([]float32{normTF}, babi[w]...)
-					// append the added entry (docHash and pos) to inverted file
-					// value has type of map[DocHash][]uint32 (docHash -> list of position)
-					value, err := inverted[0].Get(ctx, wHashString)
-					if err == badger.ErrKeyNotFound {
-						// there's no entry on the inverted table for the corresponding wordHash
-						if err = bw_anchor.BatchSet(ctx, wHashString, invKeyVals); err != nil {
-							panic(err)
-						}
-						if err = bw_anchor_frw.BatchSet(ctx, wHashString, w); err != nil {
-							panic(err)
-						}
-					} else if err != nil {
-						panic(err)
-					} else {
-						// append new docHash entry to the existing one
-						value.(map[string][]float32)[kid] = invKeyVals[kid]
-
-						// load new appended value of inverted table according to the wordHash
-						if err = bw_anchor.BatchSet(ctx, wHashString, value); err != nil {
-							panic(err)
-						}
-					}
-				}(wrd)
+			maxFreq := getMaxFreq(fancyInfo[kidHashes[idx]].Freq)
+			if err = setAnchor(ctx, uow, tttt, babi, maxFreq, kid, tables.Words, tables.TitlePostings); err != nil {
+				return err
 			}
-			wg1.Wait()
 		} else if err != nil {
-			panic(err)
+			return err
 		} else {
-			docInfoC_ := docInfoC.(database.DocInfo)
 			if docInfoC_.Parents == nil {
-				docInfoC_.Parents = make(map[string][]string)
+				docInfoC_.Parents = make(map[uint32][]string)
 			}
-			docInfoC_.Parents[docHashString] = cleanFancy[kid]
-			// Set docHash of child -> docInfo of child using batch writer
-			if err = bw_child.BatchSet(ctx, kid, docInfoC_); err != nil {
-				panic(err)
+			docInfoC_.Parents[docID] = anchor
+			// Set docID of child -> docInfo of child
+			if err = tables.Docs.PutIn(ctx, uow, kid, docInfoC_); err != nil {
+				return err
 			}
 			tttt := make(map[string]uint32)
 			babi := make(map[string][]float32)
-			for _, w := range cleanFancy[kid] {
+			for _, w := range anchor {
 				tttt[w] += 1
 				babi[w] = append(babi[w], -100)
 			}
-			tempCleanFancyUnique := tttt
 			for i, w := range docInfoC_.Page_title {
 				tttt[w] += 1
 				babi[w] = append(babi[w], float32(i))
 			}
-			maxFreq := uint32(0)
-			for _, v := range tttt {
-				if v > maxFreq {
-					maxFreq = v
-				}
-			}
-			var wg1 sync.WaitGroup
-			for wrd, _ := range tempCleanFancyUnique {
-				wg1.Add(1)
-				go func(w string) {
-					defer wg1.Done()
-					wHash := md5.Sum([]byte(w))
-					wHashString := hex.EncodeToString(wHash[:])
-					invKeyVals := make(map[string][]float32)
-					normTF := float32(float32(tttt[w]) / float32(maxFreq))
-					invKeyVals[kid] = append([]float32{normTF}, babi[w]...)
-					// append the added entry (docHash and pos) to inverted file
-					// value has type of map[DocHash][]uint32 (docHash -> list of position)
-					value, err := inverted[0].Get(ctx, wHashString)
-					if err == badger.ErrKeyNotFound {
-						// there's no entry on the inverted table for the corresponding wordHash
-						if err = bw_anchor.BatchSet(ctx, wHashString, invKeyVals); err != nil {
-							panic(err)
-						}
-						if err = bw_anchor_frw.BatchSet(ctx, wHashString, w); err != nil {
-							panic(err)
-						}
-					} else if err != nil {
-						panic(err)
-					} else {
-						// append new docHash entry to the existing one
-						value.(map[string][]float32)[kid] = invKeyVals[kid]
-
-						// load new appended value of inverted table according to the wordHash
-						if err = bw_anchor.BatchSet(ctx, wHashString, value); err != nil {
-							panic(err)
-						}
-					}
-				}(wrd)
+			maxFreq := getMaxFreq(tttt)
+			if err = setAnchor(ctx, uow, tttt, babi, maxFreq, kid, tables.Words, tables.TitlePostings); err != nil {
+				return err
 			}
-			wg1.Wait()
-		}
-		if err := bw_anchor.Flush(ctx); err != nil {
-			panic(err)
-		}
-		if err := bw_anchor_frw.Flush(ctx); err != nil {
-			panic(err)
 		}
 	}
 
 	// Store the children of current doc to db for faster pagerank process
-	if err = forward[2].Set(ctx, docHashString, kids); err != nil {
-		panic(err)
+	if err = tables.Children.PutIn(ctx, uow, docID, kids); err != nil {
+		return err
 	}
 
-	// Save children data into the db
-	if err = bw_child.Flush(ctx); err != nil {
-		panic(err)
+	// a document keeps the time it was discovered as a child, if it was
+	discovered := dI.Discovered
+	if discovered.IsZero() {
+		discovered = time.Now().UTC()
 	}
-	mutex.Unlock()
 
 	// PageInfo
 	// Initialize document object
 	var pageInfo database.DocInfo
+	checked := time.Now().UTC()
 	if checkIndex {
 		pageInfo = dI
 		pageInfo.Page_title = pageTitle
@@ -319,92 +261,138 @@ func Index(doc []byte, rootNode *html.Node, urlString string,
 		pageInfo.Children = kids
 		pageInfo.Mod_date = lastModified
 		pageInfo.Page_size = uint32(pageSize)
+		pageInfo.ETag = etag
+		pageInfo.Checked = checked
 	} else {
 		if parentURL == "" {
-			pageInfo = database.DocInfo{*URL, pageTitle, lastModified, uint32(pageSize), kids, nil, wordMapping}
+			pageInfo = database.DocInfo{Url: *URL, Page_title: pageTitle, Mod_date: lastModified, Page_size: uint32(pageSize),
+				Children: kids, Words_mapping: wordMapping, Discovered: discovered, ETag: etag, Checked: checked}
 		} else {
-			pHash := md5.Sum([]byte(parentURL))
-			pHashString := hex.EncodeToString(pHash[:])
-			tempP := make(map[string][]string)
-			tempP[pHashString] = []string{}
-			pageInfo = database.DocInfo{*URL, pageTitle, lastModified, uint32(pageSize), kids, tempP, wordMapping}
+			parentID, err := tables.DocIDs.Assign(ctx, parentURL)
+			if err != nil {
+				return err
+			}
+			tempP := make(map[uint32][]string)
+			tempP[parentID] = []string{}
+			pageInfo = database.DocInfo{Url: *URL, Page_title: pageTitle, Mod_date: lastModified, Page_size: uint32(pageSize),
+				Children: kids, Parents: tempP, Words_mapping: wordMapping, Discovered: discovered, ETag: etag, Checked: checked}
 		}
 	}
 
-	mutex.Lock()
-	// Save docHash -> docInfo of current doc
-	if err = forward[1].Set(ctx, docHashString, pageInfo); err != nil {
-		panic(err)
+	// Save docID -> docInfo of current doc
+	if err = tables.Docs.PutIn(ctx, uow, docID, pageInfo); err != nil {
+		return err
+	}
+
+	// write every table at once, either all of the document is indexed or none of it
+	if err = uow.Commit(ctx); err != nil {
+		return errors.Wrapf(err, "failed to index %s", urlString)
 	}
-	mutex.Unlock()
 
 	// Cache
 	if _, err := os.Stat(DocsDir); os.IsNotExist(err) {
 		os.Mkdir(DocsDir, 0755)
 	}
-	if err = ioutil.WriteFile(DocsDir+docHashString, doc, 0644); err != nil {
-		panic(err)
+	// written aside and renamed over the previous page, which copies published may have hard-linked
+	if err = ioutil.WriteFile(DocsDir+cacheName+".tmp", doc, 0644); err != nil {
+		return errors.Wrapf(err, "failed to cache %s", urlString)
+	}
+	if err = os.Rename(DocsDir+cacheName+".tmp", DocsDir+cacheName); err != nil {
+		return errors.Wrapf(err, "failed to cache %s", urlString)
 	}
+	return nil
 }
 
-func setInverted(ctx context.Context, pos map[string][]float32, maxFreq uint32, docHash string,
-	forward []database.DB, inverted database.DB, bw_forward []database.BatchWriter, bw_inverted database.BatchWriter) {
+// Touch records that the document has been checked and is unchanged, e.g. answered 304 Not Modified
+// the ETag is replaced if the response has one, nothing else of the document changes
+func Touch(urlString string, etag string, tables *database.Tables) error {
+	ctx := context.TODO()
 
-	var wg1 sync.WaitGroup
+	docID, err := tables.DocIDs.ID(ctx, urlString)
+	if err != nil {
+		return errors.Wrapf(err, "failed to look up %s", urlString)
+	}
+	unlock := lockDocs(docID)
+	defer unlock()
+
+	dI, err := tables.Docs.Get(ctx, docID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to look up %s", urlString)
+	}
+	if etag != "" {
+		dI.ETag = etag
+	}
+	dI.Checked = time.Now().UTC()
+	return tables.Docs.Put(ctx, docID, dI)
+}
+
+func setInverted(ctx context.Context, uow *database.UnitOfWork, pos map[string][]float32, maxFreq uint32, docID uint32,
+	words database.WordTable, inverted database.PostingTable) error {
+
+	var g errgroup.Group
 	for w, _ := range pos {
 
-		wg1.Add(1)
-		go func(word string) {
-			defer wg1.Done()
+		word := w
+		g.Go(func() error {
 
 			// initialise inverted keywords values
-			invKeyVals := make(map[string][]float32)
+			invKeyVals := make(map[uint32][]float32)
 			normTF := float32(len(pos[word])) / float32(maxFreq)
-			invKeyVals[docHash] = append([]float32{normTF}, pos[word]...)
+			invKeyVals[docID] = append([]float32{normTF}, pos[word]...)
 
 			// Compute the wordHash of current word
 			wordHash := md5.Sum([]byte(word))
 			wordHashString := hex.EncodeToString(wordHash[:])
 
-			// Check if current wordHash exist
-			_, err := forward[0].Get(ctx, wordHashString)
-
-			// If not exist, create one
-			if err == badger.ErrKeyNotFound {
-				// batch writer accepts array of byte only, conversion to []byte is needed
-				// forw[0] save wordHash -> word
-				if err = bw_forward[0].BatchSet(ctx, wordHashString, word); err != nil {
-					panic(err)
-				}
-			} else if err != nil {
-				panic(err)
+			if err := setWord(ctx, uow, word, wordHashString, words); err != nil {
+				return err
 			}
 
-			// append the added entry (docHash and pos) to inverted file
-			// value has type of map[DocHash][]uint32 (docHash -> list of position)
-			value, err := inverted.Get(ctx, wordHashString)
-			if err == badger.ErrKeyNotFound {
-				// there's no entry on the inverted table for the corresponding wordHash
-				if err = bw_inverted.BatchSet(ctx, wordHashString, invKeyVals); err != nil {
-					panic(err)
-				}
-			} else if err != nil {
-				panic(err)
-			} else {
-				// append new docHash entry to the existing one
-				value.(map[string][]float32)[docHash] = invKeyVals[docHash]
+			// append the added entry (docID and pos) to inverted file, without reading the posting list
+			// value has type of map[DocID][]float32 (docID -> weight followed by list of position)
+			return inverted.AppendIn(ctx, uow, wordHashString, invKeyVals)
+		})
 
-				// load new appended value of inverted table according to the wordHash
-				if err = bw_inverted.BatchSet(ctx, wordHashString, value); err != nil {
-					panic(err)
-				}
+	}
+	return g.Wait()
+}
+
+// setAnchor appends the anchor text given by a parent to the title posting lists of the child
+func setAnchor(ctx context.Context, uow *database.UnitOfWork, freq map[string]uint32, pos map[string][]float32, maxFreq uint32,
+	kid uint32, words database.WordTable, inverted database.PostingTable) error {
+
+	var g errgroup.Group
+	for wrd, _ := range freq {
+		w := wrd
+		g.Go(func() error {
+			wHash := md5.Sum([]byte(w))
+			wHashString := hex.EncodeToString(wHash[:])
+			invKeyVals := make(map[uint32][]float32)
+			normTF := float32(float32(freq[w]) / float32(maxFreq))
+			invKeyVals[kid] = append([]float32{normTF}, pos[w]...)
+
+			if err := setWord(ctx, uow, w, wHashString, words); err != nil {
+				return err
 			}
-		}(w)
 
+			// append the added entry (docID and pos) to inverted file, without reading the posting list
+			return inverted.AppendIn(ctx, uow, wHashString, invKeyVals)
+		})
 	}
-	wg1.Wait()
+	return g.Wait()
+}
 
-	return
+// setWord maps the wordHash to the word if not mapped yet
+func setWord(ctx context.Context, uow *database.UnitOfWork, word string, wordHash string, words database.WordTable) error {
+	// Check if current wordHash exist
+	_, err := words.GetIn(ctx, uow, wordHash)
+
+	// If not exist, create one
+	if err == database.ErrNotFound {
+		// save wordHash -> word
+		return words.PutIn(ctx, uow, wordHash, word)
+	}
+	return err
 }
 
 func getMaxFreq(in map[string]uint32) (ret uint32) {
@@ -417,225 +405,59 @@ func getMaxFreq(in map[string]uint32) (ret uint32) {
 	return
 }
 
-func checkAndUpdate(mutex *sync.Mutex, docHashString string, dI database.DocInfo, checkIndex *bool,
-	doc []byte, inverted []database.DB, forward []database.DB) {
+func checkAndUpdate(ctx context.Context, uow *database.UnitOfWork, docID uint32, cacheName string, dI database.DocInfo,
+	checkIndex *bool, doc []byte, tables *database.Tables) error {
 
-	cacheFileD, e := ioutil.ReadFile(DocsDir + docHashString)
+	cacheFileD, e := ioutil.ReadFile(DocsDir + cacheName)
 	if e != nil {
 		fmt.Println(e)
 		*checkIndex = false
-	} else {
-		cacheFileDHash := md5.Sum(cacheFileD)
-		currentDocHash := md5.Sum(doc)
-		if currentDocHash != cacheFileDHash {
-			ctx, _ := context.WithCancel(context.Background())
-			// Init batch writer for modified handler
-			var bwFrw []database.BatchWriter
-			var bwInv []database.BatchWriter
-
-			for _, i := range forward {
-				temp := i.BatchWrite_init(ctx)
-				defer temp.Cancel(ctx)
-				bwFrw = append(bwFrw, temp)
-			}
-			for _, i := range inverted {
-				temp := i.BatchWrite_init(ctx)
-				defer temp.Cancel(ctx)
-				bwInv = append(bwInv, temp)
-			}
-
-			type DocPosHashStruct struct {
-				DocPos   map[string][]float32
-				WordHash string
-			}
-			tempPageTitle := parser.Laundry(strings.Join(dI.Page_title, " "))
-			wordChann := make(chan DocPosHashStruct, len(tempPageTitle))
-			var wgGet sync.WaitGroup
-			mutex.Lock()
-			for _, word := range tempPageTitle {
-				h := md5.Sum([]byte(word))
-				hStr := hex.EncodeToString(h[:])
-				wgGet.Add(1)
-				go func(hS string) {
-					defer wgGet.Done()
-					docP_, e := inverted[0].Get(ctx, hS)
-					if e != nil {
-						fmt.Println(e)
-						wordChann <- DocPosHashStruct{nil, ""}
-					} else {
-						docP, _ := docP_.(map[string][]float32)
-						wordChann <- DocPosHashStruct{docP, hS}
-					}
-				}(hStr)
-			}
-
-			wgGet.Wait()
-			close(wordChann)
-			for dphs := range wordChann {
-				docP := dphs.DocPos
-				hStr := dphs.WordHash
-				if hStr == "" {
-					continue
-				}
-				if len(docP) > 1 {
-					// remove this doc from this row
-					delete(docP, docHashString)
-					if e = bwInv[0].BatchSet(ctx, hStr, docP); e != nil {
-						panic(e)
-					}
-				} else if docP[docHashString] != nil {
-					// delete this row
-					if e = inverted[0].Delete(ctx, hStr); e != nil {
-						panic(e)
-					}
-				}
-			}
+		return nil
+	}
+	if md5.Sum(doc) == md5.Sum(cacheFileD) {
+		// If the doc exists and there is no changes, return
+		// no need to update
+		return nil
+	}
 
-			wordChann = make(chan DocPosHashStruct, len(dI.Words_mapping))
-			for wordHash, _ := range dI.Words_mapping {
-				wgGet.Add(1)
-				go func(whS string) {
-					defer wgGet.Done()
-					docP_, e := inverted[1].Get(ctx, whS)
-					if e != nil {
-						fmt.Println(e)
-						wordChann <- DocPosHashStruct{nil, ""}
-					} else {
-						docP, _ := docP_.(map[string][]float32)
-						wordChann <- DocPosHashStruct{docP, whS}
-					}
-				}(wordHash)
-			}
+	// modifications are staged in the unit of work, and committed together with the new content
+	// a docID appended with an empty list is removed from the posting list, refer to database/append.go
+	removed := map[uint32][]float32{docID: nil}
 
-			wgGet.Wait()
-			close(wordChann)
-			for dphs := range wordChann {
-				docP := dphs.DocPos
-				wordHash := dphs.WordHash
-				if wordHash == "" {
-					continue
-				}
-				if len(docP) > 1 {
-					// remove this doc from this row
-					delete(docP, docHashString)
-					if e = bwInv[1].BatchSet(ctx, wordHash, docP); e != nil {
-						panic(e)
-					}
-				} else if docP[docHashString] != nil {
-					// delete this row
-					if e = inverted[1].Delete(ctx, wordHash); e != nil {
-						panic(e)
-					}
-				}
-			}
-
-			type DocInfoChildStruct struct {
-				DocInfo   database.DocInfo
-				ChildHash string
-			}
-			newChann := make(chan DocInfoChildStruct, len(dI.Children))
-			for _, c := range dI.Children {
-				wgGet.Add(1)
-				go func(cHash string) {
-					defer wgGet.Done()
-					dIc_, e := forward[1].Get(ctx, cHash)
-					if e != nil {
-						panic(e)
-					}
-					dIc, _ := dIc_.(database.DocInfo)
-					newChann <- DocInfoChildStruct{dIc, c}
-				}(c)
-			}
+	// remove this doc from the posting lists of its old title and body
+	for _, word := range parser.Laundry(strings.Join(dI.Page_title, " ")) {
+		h := md5.Sum([]byte(word))
+		if e = tables.TitlePostings.AppendIn(ctx, uow, hex.EncodeToString(h[:]), removed); e != nil {
+			return e
+		}
+	}
+	for wordHash, _ := range dI.Words_mapping {
+		if e = tables.BodyPostings.AppendIn(ctx, uow, wordHash, removed); e != nil {
+			return e
+		}
+	}
 
-			wgGet.Wait()
-			close(newChann)
-			type DocPosHashChildStruct struct {
-				DocPos    map[string][]float32
-				WordHash  string
-				ChildHash string
-			}
-			arrOfChann := make([]chan DocPosHashChildStruct, len(dI.Children))
-			arrOfWGs := make([]sync.WaitGroup, len(dI.Children))
-			arrIdx := -1
-			for dIcs := range newChann {
-				dIc := dIcs.DocInfo
-				c := dIcs.ChildHash
-				arrIdx += 1
-				tempParents := dIc.Parents
-				dIc.Parents = make(map[string][]string)
-				var innerWordHashes []string
-
-				for k, t := range tempParents {
-					if k != docHashString {
-						dIc.Parents[k] = t
-					} else {
-						innerWordHashes = t
-					}
-				}
-				if e = bwFrw[1].BatchSet(ctx, c, dIc); e != nil {
-					panic(e)
-				}
-
-				arrOfChann[arrIdx] = make(chan DocPosHashChildStruct, len(innerWordHashes))
-				// arrOfWGs[arrIdx] = sync.WaitGroup
-
-				for _, w := range innerWordHashes {
-					arrOfWGs[arrIdx].Add(1)
-
-					wHash := md5.Sum([]byte(w))
-					wHashString := hex.EncodeToString(wHash[:])
-					go func(wHStr string, childHash string, idx int) {
-						defer arrOfWGs[idx].Done()
-						dpw_, e := inverted[0].Get(ctx, wHStr)
-						if e != nil {
-							panic(e)
-						}
-						dpw, _ := dpw_.(map[string][]float32)
-						arrOfChann[idx] <- DocPosHashChildStruct{dpw, wHStr, childHash}
-					}(wHashString, c, arrIdx)
-				}
-			}
-			for i, _ := range arrOfWGs {
-				arrOfWGs[i].Wait()
-			}
-			for _, channC := range arrOfChann {
-				close(channC)
-
-				for dphs := range channC {
-					dpw := dphs.DocPos
-					wHashString := dphs.WordHash
-					childHash := dphs.ChildHash
-					if len(dpw) > 1 {
-						// remove this doc from this row
-						delete(dpw, childHash)
-						if e = bwInv[0].BatchSet(ctx, wHashString, dpw); e != nil {
-							panic(e)
-						}
-					} else if dpw[childHash] != nil {
-						// delete this row
-						if e = inverted[0].Delete(ctx, wHashString); e != nil {
-							panic(e)
-						}
-					}
-				}
-			}
+	// remove this doc from the parents of its old children, together with the anchor text it gave them
+	for _, c := range dI.Children {
+		dIc, e := tables.Docs.GetIn(ctx, uow, c)
+		if e == database.ErrNotFound {
+			// nothing to remove from a child which was never stored
+			continue
+		} else if e != nil {
+			return e
+		}
+		innerWords := dIc.Parents[docID]
+		delete(dIc.Parents, docID)
+		if e = tables.Docs.PutIn(ctx, uow, c, dIc); e != nil {
+			return e
+		}
 
-			// Flush the writes
-			for _, f := range bwFrw {
-				if err := f.Flush(ctx); err != nil {
-					panic(err)
-				}
+		for _, w := range innerWords {
+			wHash := md5.Sum([]byte(w))
+			if e = tables.TitlePostings.AppendIn(ctx, uow, hex.EncodeToString(wHash[:]), map[uint32][]float32{c: nil}); e != nil {
+				return e
 			}
-			for _, i := range bwInv {
-				if err := i.Flush(ctx); err != nil {
-					panic(err)
-				}
-			}
-			mutex.Unlock()
-		} else {
-			// If the doc exists and there is no changes, return
-			// no need to update
-			return
 		}
 	}
+	return nil
 }
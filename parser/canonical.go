@@ -0,0 +1,243 @@
+package parser
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+/*
+=============================== URL CANONICALISATION ==========================================
+	Links are resolved against the base of their page (<base href> if any, the page URL otherwise)
+	with url.ResolveReference, which removes the dot segments, then canonicalised so that every
+	spelling of a URL is registered, crawled and indexed once:
+		- scheme and host are lowercased, the port is dropped if it is the default one of the scheme
+		- empty path is "/", percent-encoded unreserved characters are decoded, other escapes uppercased
+		- query parameters are sorted by name, tracking parameters (TrackingParams) are removed
+		- fragment is dropped
+	Only http and https URLs are canonicalised. The crawler and the anchor text mapping of Parse both
+	go through LinkURL, so that the children of a page and their anchor text agree.
+*/
+
+var (
+	ErrUnsupportedScheme = errors.New("Unsupported URL scheme, only http and https URLs are canonicalised")
+
+	// query parameters removed from every URL, matched case-insensitively. A trailing '*' matches a prefix
+	// set before crawling, e.g. by cmd/crawl -trackingParams
+	TrackingParams = []string{"utm_*", "gclid", "fbclid", "msclkid", "dclid", "yclid", "mc_cid", "mc_eid", "_ga", "_hsenc", "_hsmi"}
+
+	defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+	// links to these files are not crawled
+	mediaExts = []string{
+		".mp3", ".pdf", ".png", ".jpg", ".mp4", ".avi",
+		".zip", ".pptx", ".ppt", ".rar", ".doc", ".docx",
+		".tar", ".gz", ".xz", ".bz", ".7z",
+	}
+)
+
+// CanonicalURL returns the canonical form of an absolute URL, e.g. the start URL of a crawl
+func CanonicalURL(rawURL string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", err
+	}
+	// resolving an absolute reference only removes its dot segments
+	return canonical(new(url.URL).ResolveReference(u))
+}
+
+// ResolveURL returns the canonical form of the href resolved against the base
+func ResolveURL(base *url.URL, href string) (string, error) {
+	ref, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return "", err
+	}
+	return canonical(base.ResolveReference(ref))
+}
+
+/*
+BaseURL returns the URL the links of the page are relative to, i.e. its <base href> resolved against the page URL if
+it has one, the page URL otherwise
+\params: root node of the page, URL of the page
+\return: base URL, error if the page URL is invalid
+*/
+func BaseURL(doc *html.Node, pageURL string) (*url.URL, error) {
+	page, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the first <base> counts, as in browsers
+	var href string
+	var find func(*html.Node) bool
+	find = func(n *html.Node) bool {
+		if n.Type == html.ElementNode && n.Data == "base" {
+			for _, attr := range n.Attr {
+				if attr.Key == "href" {
+					href = attr.Val
+					return true
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if find(c) {
+				return true
+			}
+		}
+		return false
+	}
+	find(doc)
+
+	if href == "" {
+		return page, nil
+	}
+	ref, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return page, nil
+	}
+	return page.ResolveReference(ref), nil
+}
+
+/*
+LinkURL returns the canonical URL an href of the page links to, if it is to be crawled
+links to other schemes (mailto, javascript...), to media files and to the page itself are not
+\params: base URL of the page (refer to BaseURL), canonical URL of the page, href
+\return: canonical URL, whether the link is to be crawled
+*/
+func LinkURL(base *url.URL, pageURL string, href string) (string, bool) {
+	if strings.TrimSpace(href) == "" {
+		return "", false
+	}
+	link, err := ResolveURL(base, href)
+	if err != nil || link == pageURL {
+		return "", false
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", false
+	}
+	path := strings.ToLower(u.Path)
+	for _, ext := range mediaExts {
+		if strings.HasSuffix(path, ext) {
+			return "", false
+		}
+	}
+	return link, true
+}
+
+func canonical(u *url.URL) (string, error) {
+	scheme := strings.ToLower(u.Scheme)
+	if _, ok := defaultPorts[scheme]; !ok || u.Host == "" {
+		return "", ErrUnsupportedScheme
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if strings.Contains(host, ":") {
+		// IPv6 literal
+		host = "[" + host + "]"
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[scheme] {
+		host += ":" + port
+	}
+
+	var b strings.Builder
+	b.WriteString(scheme + "://")
+	if u.User != nil {
+		b.WriteString(u.User.String() + "@")
+	}
+	b.WriteString(host)
+
+	path := normaliseEscapes(u.EscapedPath())
+	if path == "" {
+		path = "/"
+	}
+	b.WriteString(path)
+
+	if query := canonicalQuery(u.RawQuery); query != "" {
+		b.WriteString("?" + query)
+	}
+	return b.String(), nil
+}
+
+// canonicalQuery sorts the parameters by name, keeping the order of the values of a name, and removes tracking parameters
+func canonicalQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// kept as it is rather than losing parameters
+		return normaliseEscapes(rawQuery)
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		if !isTrackingParam(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var params []string
+	for _, name := range names {
+		for _, v := range values[name] {
+			params = append(params, url.QueryEscape(name)+"="+url.QueryEscape(v))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func isTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range TrackingParams {
+		p = strings.ToLower(p)
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// normaliseEscapes decodes the percent-encoded unreserved characters (RFC 3986), and uppercases the other escapes
+func normaliseEscapes(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(s[i+1:i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
@@ -0,0 +1,50 @@
+package parser
+
+import (
+	"golang.org/x/net/html"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestResolveURL(t *testing.T) {
+	base, _ := url.Parse("https://a.com/dir/page.html?x=1")
+	for href, want := range map[string]string{
+		"other.html":                          "https://a.com/dir/other.html",
+		"../up/":                              "https://a.com/up/",
+		"./sub/../same":                       "https://a.com/dir/same",
+		"?y=2":                                "https://a.com/dir/page.html?y=2",
+		"/root#section":                       "https://a.com/root",
+		"//b.com":                             "https://b.com/",
+		"HTTP://B.COM:80/P%7eath/%2f?b=2&a=1": "http://b.com/P~ath/%2F?a=1&b=2",
+		"https://a.com:443/x?utm_source=s&id=3&gclid=g&UTM_Medium=m": "https://a.com/x?id=3",
+		"https://a.com:8443/x?a=2&a=1":                               "https://a.com:8443/x?a=2&a=1",
+	} {
+		if got, err := ResolveURL(base, href); err != nil || got != want {
+			t.Errorf("%s resolved to %s (%v), want %s", href, got, err, want)
+		}
+	}
+	for _, href := range []string{"mailto:a@a.com", "javascript:void(0)", "ftp://a.com/"} {
+		if got, err := ResolveURL(base, href); err != ErrUnsupportedScheme {
+			t.Errorf("%s resolved to %s (%v), want %v", href, got, err, ErrUnsupportedScheme)
+		}
+	}
+}
+
+func TestLinkURL(t *testing.T) {
+	page := "https://a.com/dir/page.html"
+	doc, _ := html.Parse(strings.NewReader(`<html><head><base href="/base/"></head><body></body></html>`))
+	base, err := BaseURL(doc, page)
+	if err != nil || base.String() != "https://a.com/base/" {
+		t.Fatalf("got base %v (%v), want https://a.com/base/", base, err)
+	}
+
+	if got, ok := LinkURL(base, page, "child"); !ok || got != "https://a.com/base/child" {
+		t.Errorf("got %s (%v), want https://a.com/base/child", got, ok)
+	}
+	for _, href := range []string{"", "/dir/page.html#top", "doc.PDF", "mailto:a@a.com"} {
+		if got, ok := LinkURL(base, page, href); ok {
+			t.Errorf("link %q to %s is crawled", href, got)
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/surgebase/porter2"
 	"golang.org/x/net/html"
 	"io/ioutil"
-	"net/url"
 	"regexp"
 	"strings"
 )
@@ -49,8 +48,11 @@ func Parse(doc *html.Node, baseURL string) (titleInfo Term, bodyInfo Term, fancy
 func tokenize(doc *html.Node, baseURL string) (title string,
 	words, meta, fancy, fancyURLs []string) {
 
-	var f func(*html.Node, string)
-	f = func(n *html.Node, baseURL string) {
+	// links are relative to <base href> if the page has one, links of a page whose URL is invalid are left out
+	base, _ := BaseURL(doc, baseURL)
+
+	var f func(*html.Node)
+	f = func(n *html.Node) {
 		if n.Type == html.ElementNode {
 			if n.Data == "title" {
 				if n.FirstChild != nil {
@@ -75,84 +77,26 @@ func tokenize(doc *html.Node, baseURL string) (title string,
 			tempD := n.Parent.Data
 			cleaned := strings.TrimSpace(n.Data)
 			if tempD != "title" && tempD != "script" && tempD != "style" && tempD != "noscript" && tempD != "iframe" && cleaned != "" {
-				if tempD == "a" {
+				if tempD == "a" && base != nil {
 					for _, attr := range n.Parent.Attr {
 						if attr.Key == "href" {
-							urlRe := regexp.MustCompile("[^A-Za-z0-9-._~:/?#[]@!$&'()\\*\\+,;=]|\r?\n| ")
-							/* Skip if no href or
-							if href is anchor or
-							if href is mail or script */
-							if attr.Val == "" ||
-								attr.Val[0] == '#' ||
-								strings.HasPrefix(attr.Val, "javascript") ||
-								strings.HasPrefix(attr.Val, "mailto") {
-								break
-							}
-
-							thisURL := ""
-							/* Make sure the URL ends without '/' */
-							if strings.HasSuffix(attr.Val, "/") {
-								thisURL = attr.Val[:len(attr.Val)-1]
-							} else {
-								thisURL = attr.Val
-							}
-
-							/* Ignore media files */
-							isMedia := false
-							mediaExs := []string{
-								".mp3", ".pdf", ".png", ".jpg", ".mp4", ".avi",
-								".zip", ".pptx", ".ppt", ".rar", ".doc", ".docx",
-								".tar", ".gz", ".xz", ".bz", ".7z",
-							}
-							for _, ex := range mediaExs {
-								if strings.HasSuffix(strings.ToLower(thisURL), ex) {
-									isMedia = true
-									break
-								}
-							}
-							if isMedia {
-								break
-							}
-
-							if len(thisURL) == 0 {
-								break
-							}
-
-							var tail string
-							if len(thisURL) < 4 ||
-								(thisURL[:4] != "http" && thisURL[:4] != "www.") {
-								baseURLtype, e := url.Parse(baseURL)
-								if e != nil {
-									panic(e)
-								}
-								hn := baseURLtype.Hostname()
-								sc := baseURLtype.Scheme
-
-								if thisURL[0] != '/' {
-									tail = urlRe.ReplaceAllString(baseURL+"/"+thisURL, "")
-								} else {
-									tail = urlRe.ReplaceAllString(sc+"://"+hn+thisURL, "")
-								}
-							} else {
-								if thisURL == baseURL {
-									break
-								}
-								tail = urlRe.ReplaceAllString(thisURL, "")
+							/* Anchor text is mapped to the canonical URL of the link, refer to canonical.go */
+							if link, ok := LinkURL(base, baseURL, attr.Val); ok {
+								fancyURLs = append(fancyURLs, link)
+								fancy = append(fancy, cleaned)
 							}
-							fancyURLs = append(fancyURLs, tail)
-							fancy = append(fancy, cleaned)
+							break
 						}
-						break
 					}
 				}
 				words = append(words, cleaned)
 			}
 		}
 		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			f(c, baseURL)
+			f(c)
 		}
 	}
-	f(doc, baseURL)
+	f(doc)
 
 	return
 }
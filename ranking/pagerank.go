@@ -2,90 +2,90 @@ package ranking
 
 import (
 	"context"
-	"encoding/json"
 	db "github.com/nwihardjo/SpaghettiSearch/database"
 	"log"
 	"math"
 )
 
-// table 1 key: docHash (type: string) value: list of child (type: []string)
-// table 2 key: docHash (type: string) value: ranking (type: float64)
+// table 1 key: docID (type: uint32) value: list of child (type: []uint32)
+// table 2 key: docID (type: uint32) value: ranking (type: float64)
 
-func UpdateTopicSensitivePagerank(ctx context.Context, dampingFactor float64, convergenceCriterion float64, forward []db.DB) {
+func UpdateTopicSensitivePagerank(ctx context.Context, dampingFactor float64, convergenceCriterion float64, tables *db.Tables) error {
 	log.Printf("Ranking with damping factor='%f', convergence_criteria='%f'", dampingFactor, convergenceCriterion)
 
 	// web nodes with their corresponding children
-	nodesCompressed, err := forward[2].Iterate(ctx)
-	if err != nil {
-		panic(err)
-	}
-
-	// extract the data from stream
-	webNodesAll := make(map[string]struct{})
-	webNodes := make(map[string][]string, len(nodesCompressed.KV))
-	for _, kv := range nodesCompressed.KV {
-		var tempVal []string
-		if err = json.Unmarshal(kv.Value, &tempVal); err != nil {
-			panic(err)
+	// only the adjacency list is kept in memory, the table itself is streamed
+	var maxID uint32
+	parents := make(map[uint32][]uint32)
+	err := tables.Children.Scan(ctx, func(docID uint32, children []uint32) error {
+		for _, childID := range children {
+			if childID > maxID {
+				maxID = childID
+			}
 		}
-
-		// add childhash to list of webnodes
-		for _, childHash := range tempVal {
-			webNodesAll[childHash] = struct{}{}
+		if docID > maxID {
+			maxID = docID
 		}
 
-		webNodes[string(kv.Key)] = tempVal
-		webNodesAll[string(kv.Key)] = struct{}{}
+		parents[docID] = children
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	setWebNodes := make([]string, 0, len(webNodesAll))
-	for k, _ := range webNodesAll {
-		setWebNodes = append(setWebNodes, k)
+	// docIDs are dense, the web nodes and their ranks are indexed by docID
+	webNodes := make([][]uint32, maxID+1)
+	inGraph := make([]bool, maxID+1)
+	for docID, children := range parents {
+		webNodes[docID] = children
+		inGraph[docID] = true
+		for _, childID := range children {
+			inGraph[childID] = true
+		}
 	}
 
-	// retrieve the categories, to be updated each
-	categoryCompressed, err := forward[5].Iterate(ctx)
-	if err != nil {
-		panic(err)
+	setWebNodes := make([]uint32, 0, len(parents))
+	for docID, ok := range inGraph {
+		if ok {
+			setWebNodes = append(setWebNodes, uint32(docID))
+		}
 	}
 
+	// retrieve the categories, to be updated each
 	// TODO: to be optimised with goroutines
-	biasedRank := make(map[string]map[string]float64, len(categoryCompressed.KV))
-	for _, kv := range categoryCompressed.KV {
-		val := make(map[string]float64, 2)
-		if err = json.Unmarshal(kv.Value, &val); err != nil {
-			panic(err)
-		}
-
-		log.Printf("number of webnodes in %s is %d", string(kv.Key), int(val["numPages"]))
-		biasedRank[string(kv.Key)] = updatePagerank(ctx, dampingFactor, convergenceCriterion, forward, setWebNodes, webNodes, int(val["numPages"]))
-
+	biasedRank := make(map[string][]float64)
+	err = tables.TopicMetadata.Scan(ctx, func(category string, val map[string]float64) error {
+		log.Printf("number of webnodes in %s is %d", category, int(val["numPages"]))
+		biasedRank[category] = updatePagerank(ctx, dampingFactor, convergenceCriterion, setWebNodes, webNodes, int(val["numPages"]))
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	// aggregate final ranking to a single map for populating DB
-	bw := forward[3].BatchWrite_init(ctx)
+	bw := tables.Rank.Raw().BatchWrite_init(ctx)
 	defer bw.Cancel(ctx)
 
 	for _, webNode := range setWebNodes {
-		PR := make(map[string]float64, len(categoryCompressed.KV))
+		PR := make(map[string]float64, len(biasedRank))
 		for category, ranks := range biasedRank {
 			PR[category] = ranks[webNode]
 		}
 
 		if err := bw.BatchSet(ctx, webNode, PR); err != nil {
-			panic(err)
+			return err
 		}
 	}
 
-	if err = bw.Flush(ctx); err != nil {
-		panic(err)
-	}
+	return bw.Flush(ctx)
 }
 
-func updatePagerank(ctx context.Context, dampingFactor float64, convergenceCriterion float64, forward []db.DB, setWebNodes []string, webNodes map[string][]string, n int) map[string]float64 {
-	// use number of web nodes for more efficient memory allocation
-	currentRank := make(map[string]float64, n)
-	lastRank := make(map[string]float64, n)
+func updatePagerank(ctx context.Context, dampingFactor float64, convergenceCriterion float64, setWebNodes []uint32, webNodes [][]uint32, n int) []float64 {
+	// ranks are indexed by docID, docIDs which are not web nodes keep a zero rank
+	currentRank := make([]float64, len(webNodes))
+	lastRank := make([]float64, len(webNodes))
 
 	teleportProbs := 1.0 - dampingFactor
 
@@ -95,27 +95,27 @@ func updatePagerank(ctx context.Context, dampingFactor float64, convergenceCrite
 
 		// clear out old values
 		if iteration > 1 {
-			for _, docHash := range setWebNodes {
-				currentRank[docHash] = 0.0
+			for _, docID := range setWebNodes {
+				currentRank[docID] = 0.0
 			}
 		} else {
 			// base case: everything is uniform
-			for _, docHash := range setWebNodes {
-				currentRank[docHash] = 1.0 / float64(n)
-				lastRank[docHash] = 1.0 / float64(n)
+			for _, docID := range setWebNodes {
+				currentRank[docID] = 1.0 / float64(n)
+				lastRank[docID] = 1.0 / float64(n)
 			}
 		}
 
 		// perform single power iteration, pass by reference
 		// get totalValue for normalisation
-		totalValue := computeRankInherited(currentRank, lastRank, dampingFactor, webNodes)
-		totalValue += (teleportProbs * float64(len(currentRank)))
+		totalValue := computeRankInherited(currentRank, lastRank, dampingFactor, setWebNodes, webNodes)
+		totalValue += (teleportProbs * float64(len(setWebNodes)))
 
 		// calculate last change for to convergence assesment based on L1 norm
 		lastChange = 0.0
-		for docHash, rank := range currentRank {
-			currentRank[docHash] = (rank + teleportProbs) / totalValue
-			lastChange += math.Abs(currentRank[docHash] - lastRank[docHash])
+		for _, docID := range setWebNodes {
+			currentRank[docID] = (currentRank[docID] + teleportProbs) / totalValue
+			lastChange += math.Abs(currentRank[docID] - lastRank[docID])
 		}
 
 		// log.Printf("Pagerank iteration #%d delta=%f", iteration, lastChange)
@@ -123,39 +123,36 @@ func updatePagerank(ctx context.Context, dampingFactor float64, convergenceCrite
 	return currentRank
 }
 
-func computeRankInherited(currentRank map[string]float64, lastRank map[string]float64, dampingFactor float64, webNodes map[string][]string) float64 {
+func computeRankInherited(currentRank []float64, lastRank []float64, dampingFactor float64, setWebNodes []uint32, webNodes [][]uint32) float64 {
 	totalValue := 0.0
 
 	// perform single power iteration --> d*(PR(parent)/CR(parent))
-	for parentHash, _ := range currentRank {
+	for _, parentID := range setWebNodes {
 		// web with no child
-		if len(webNodes[parentHash]) == 0 {
+		if len(webNodes[parentID]) == 0 {
 			continue
 		}
 
-		weightPassedDown := dampingFactor * lastRank[parentHash] / float64(len(webNodes[parentHash]))
+		weightPassedDown := dampingFactor * lastRank[parentID] / float64(len(webNodes[parentID]))
 		totalValue += weightPassedDown
 
 		// add child's rank with the weights passed down
-		for _, childHash := range webNodes[parentHash] {
-			currentRank[childHash] += weightPassedDown
+		for _, childID := range webNodes[parentID] {
+			currentRank[childID] += weightPassedDown
 		}
 	}
 	return totalValue
 }
 
-func saveRanking(ctx context.Context, table db.DB, currentRank map[string]float64, category string) (err error) {
-	// rank, err := forward[5].Iterate(ctx)
-	if err != nil {
-		panic(err)
-	}
+func saveRanking(ctx context.Context, table db.DB, currentRank map[uint32]float64, category string) (err error) {
+	// rank, err := tables.TopicMetadata.Scan(ctx)
 
 	bw := table.BatchWrite_init(ctx)
 	defer bw.Cancel(ctx)
 
 	// feed batch writer with the rank of each page
-	for docHash, rank := range currentRank {
-		if err = bw.BatchSet(ctx, docHash, rank); err != nil {
+	for docID, rank := range currentRank {
+		if err = bw.BatchSet(ctx, docID, rank); err != nil {
 			return err
 		}
 	}
@@ -7,13 +7,14 @@ import (
 	"github.com/nwihardjo/SpaghettiSearch/indexer"
 	"golang.org/x/net/html"
 	"io/ioutil"
+	"log"
 	"math"
 	"regexp"
 	"strings"
 	"sync"
 )
 
-func computeFinalRank(ctx context.Context, docs <-chan Rank_result, forw []db.DB, queryLength int, query string, phrases []string, topicProbs map[string]float64) <-chan Rank_combined {
+func computeFinalRank(ctx context.Context, docs <-chan Rank_result, tables *db.Tables, queryLength int, query string, phrases []string, topicProbs map[string]float64, errs *queryError) <-chan Rank_combined {
 	out := make(chan Rank_combined, len(docs))
 	defer close(out)
 	var wg sync.WaitGroup
@@ -24,15 +25,13 @@ func computeFinalRank(ctx context.Context, docs <-chan Rank_result, forw []db.DB
 			defer wg.Done()
 
 			// get doc metadata using future pattern for faster performance
-			metadata := getDocInfo(ctx, doc.DocHash, forw)
-			summary := getSummary(doc.DocHash, query, phrases)
+			metadata := getDocInfo(ctx, doc.DocID, tables, errs)
+			summary := getSummary(ctx, doc.DocID, tables, query, phrases)
 
-			// get pagerank value
-			var PR map[string]float64
-			if tempVal, err := forw[3].Get(ctx, doc.DocHash); err != nil {
-				panic(err)
-			} else {
-				PR = tempVal.(map[string]float64)
+			// get pagerank value, documents not ranked yet have none
+			PR, err := tables.Rank.Get(ctx, doc.DocID)
+			if err != nil && err != db.ErrNotFound {
+				errs.set(err)
 			}
 
 			// compute query-sensitive importance score
@@ -42,17 +41,19 @@ func computeFinalRank(ctx context.Context, docs <-chan Rank_result, forw []db.DB
 			}
 
 			// get page magnitude for cossim normalisation
-			var pageMagnitude map[string]float64
-			if tempVal, err := forw[4].Get(ctx, doc.DocHash); err != nil {
-				panic(err)
-			} else {
-				pageMagnitude = tempVal.(map[string]float64)
+			pageMagnitude, err := tables.Magnitude.Get(ctx, doc.DocID)
+			if err != nil && err != db.ErrNotFound {
+				errs.set(err)
 			}
 
 			// compute final rank
 			queryMagnitude := math.Sqrt(float64(queryLength))
 
-			docMetaData := <-metadata
+			// the document is left out if its DocInfo cannot be read
+			docMetaData, ok := <-metadata
+			if !ok {
+				return
+			}
 
 			doc.BodyRank /= (pageMagnitude["body"] * queryMagnitude)
 			doc.TitleRank /= (pageMagnitude["title"] * queryMagnitude)
@@ -76,19 +77,32 @@ func computeFinalRank(ctx context.Context, docs <-chan Rank_result, forw []db.DB
 	return out
 }
 
-func getSummary(docHash, query string, phrases []string) <-chan string {
+func getSummary(ctx context.Context, docID uint32, tables *db.Tables, query string, phrases []string) <-chan string {
 	out := make(chan string, 1)
 	go func() {
 		queryTokenised := strings.Fields(strings.Replace(strings.ToLower(query), "\"", "", -1))
 
+		// cached files are named after the docHash of the URL
+		url, err := tables.DocIDs.URL(ctx, docID)
+		if err != nil {
+			out <- ""
+			return
+		}
+
 		// read cached files
-		htmResp, err := ioutil.ReadFile(indexer.DocsDir + docHash)
+		// a published copy is served with its own page cache, refer to database/publish.go
+		docsDir := tables.DocsDir
+		if docsDir == "" {
+			docsDir = indexer.DocsDir
+		}
+		htmResp, err := ioutil.ReadFile(docsDir + db.DocHash(url))
 		if err != nil {
 			out <- ""
 		} else {
 			doc, err := html.Parse(bytes.NewReader(htmResp))
 			if err != nil {
-				panic(err)
+				out <- ""
+				return
 			}
 
 			// extract text from html body
@@ -208,22 +222,29 @@ func getSummary(docHash, query string, phrases []string) <-chan string {
 	return out
 }
 
-func getDocInfo(ctx context.Context, docHash string, forw []db.DB) <-chan Rank_combined {
+// getDocInfo closes the channel without sending anything if the DocInfo cannot be read
+func getDocInfo(ctx context.Context, docID uint32, tables *db.Tables, errs *queryError) <-chan Rank_combined {
 	out := make(chan Rank_combined, 1)
 
 	go func() {
-		var val db.DocInfo
-		if tempVal, err := forw[1].Get(ctx, docHash); err != nil {
-			panic(err)
-		} else {
-			val = tempVal.(db.DocInfo)
+		val, err := tables.Docs.Get(ctx, docID)
+		if err == db.ErrNotFound {
+			// posting of a document without DocInfo, refer to cmd/fsck
+			log.Printf("Skipping document %d: %v", docID, err)
+			close(out)
+			return
+		} else if err != nil {
+			errs.set(err)
+			close(out)
+			return
 		}
 
 		ret := resultFormat(val, 0, 0, "")
+		parentIDs, childIDs := firstLinks(val)
 
-		parentChan := convertHashDocinfo(ctx, ret.Parents, forw)
-		childrenChan := convertHashDocinfo(ctx, ret.Children, forw)
-		wordmapChan := convertHashWords(ctx, ret.Words_mapping, forw)
+		parentChan := convertDocIDs(ctx, parentIDs, tables.DocIDs, errs)
+		childrenChan := convertDocIDs(ctx, childIDs, tables.DocIDs, errs)
+		wordmapChan := convertHashWords(ctx, ret.Words_mapping, tables.Words, errs)
 
 		ret.Parents = <-parentChan
 		ret.Children = <-childrenChan
@@ -234,24 +255,24 @@ func getDocInfo(ctx context.Context, docHash string, forw []db.DB) <-chan Rank_c
 	return out
 }
 
-func convertHashDocinfo(ctx context.Context, docHashes []string, forw []db.DB) <-chan []string {
+func convertDocIDs(ctx context.Context, docIDs []uint32, registry *db.DocRegistry, errs *queryError) <-chan []string {
 	out := make(chan []string, 1)
 
 	// early stopping
-	if docHashes == nil || len(docHashes) == 0 {
+	if docIDs == nil || len(docIDs) == 0 {
 		out <- nil
 		return out
 	}
 
 	go func() {
 		// generate common input
-		docHashInChan := genTermPipeline(docHashes)
+		docIDInChan := genDocIDPipeline(docIDs)
 
 		// fan-out to several getter
-		numFanOut := len(docHashes)
+		numFanOut := len(docIDs)
 		docOutChan := [](<-chan string){}
 		for i := 0; i < numFanOut; i++ {
-			docOutChan = append(docOutChan, retrieveUrl(ctx, docHashInChan, forw))
+			docOutChan = append(docOutChan, retrieveUrl(ctx, docIDInChan, registry, errs))
 		}
 
 		// fan-in result
@@ -265,26 +286,27 @@ func convertHashDocinfo(ctx context.Context, docHashes []string, forw []db.DB) <
 	return out
 }
 
-func retrieveUrl(ctx context.Context, docHashIn <-chan string, forw []db.DB) <-chan string {
-	out := make(chan string, len(docHashIn))
+// retrieveUrl leaves out the docIDs without URL in the registry
+func retrieveUrl(ctx context.Context, docIDIn <-chan uint32, registry *db.DocRegistry, errs *queryError) <-chan string {
+	out := make(chan string, len(docIDIn))
 	defer close(out)
 	var wg sync.WaitGroup
 
-	for docHash := range docHashIn {
+	for docID := range docIDIn {
 		wg.Add(1)
-		go func(docHash string) {
+		go func(docID uint32) {
 			defer wg.Done()
 
-			var url string
-			if val, err := forw[1].Get(ctx, docHash); err != nil {
-				panic(err)
-			} else {
-				doc := val.(db.DocInfo)
-				url = doc.Url.String()
+			url, err := registry.URL(ctx, docID)
+			if err != nil {
+				if err != db.ErrNotFound {
+					errs.set(err)
+				}
+				return
 			}
 
 			out <- url
-		}(docHash)
+		}(docID)
 	}
 
 	wg.Wait()
@@ -350,7 +372,8 @@ func fanInWords(wordIn []<-chan map[string]string) <-chan map[string]string {
 	return c
 }
 
-func retrieveWord(ctx context.Context, wordInChan <-chan string, forw []db.DB) <-chan map[string]string {
+// retrieveWord leaves out the wordHashes without word
+func retrieveWord(ctx context.Context, wordInChan <-chan string, words db.WordTable, errs *queryError) <-chan map[string]string {
 	out := make(chan map[string]string, len(wordInChan))
 	defer close(out)
 	var wg sync.WaitGroup
@@ -360,11 +383,12 @@ func retrieveWord(ctx context.Context, wordInChan <-chan string, forw []db.DB) <
 		go func(word string) {
 			defer wg.Done()
 
-			var wordStr string
-			if val, err := forw[0].Get(ctx, word); err != nil {
-				panic(err)
-			} else {
-				wordStr = val.(string)
+			wordStr, err := words.Get(ctx, word)
+			if err != nil {
+				if err != db.ErrNotFound {
+					errs.set(err)
+				}
+				return
 			}
 
 			out <- map[string]string{word: wordStr}
@@ -375,7 +399,7 @@ func retrieveWord(ctx context.Context, wordInChan <-chan string, forw []db.DB) <
 	return out
 }
 
-func convertHashWords(ctx context.Context, wordMap map[string]uint32, forw []db.DB) <-chan map[string]uint32 {
+func convertHashWords(ctx context.Context, wordMap map[string]uint32, words db.WordTable, errs *queryError) <-chan map[string]uint32 {
 	out := make(chan map[string]uint32, 1)
 
 	// early stopping
@@ -393,7 +417,7 @@ func convertHashWords(ctx context.Context, wordMap map[string]uint32, forw []db.
 		numFanOut := len(wordMap)
 		wordOutChan := [](<-chan map[string]string){}
 		for i := 0; i < numFanOut; i++ {
-			wordOutChan = append(wordOutChan, retrieveWord(ctx, wordInChan, forw))
+			wordOutChan = append(wordOutChan, retrieveWord(ctx, wordInChan, words, errs))
 		}
 
 		// fan-in word hash mapping
@@ -4,15 +4,18 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/hex"
-	"github.com/dgraph-io/badger"
 	db "github.com/nwihardjo/SpaghettiSearch/database"
 	"github.com/nwihardjo/SpaghettiSearch/parser"
+	"github.com/pkg/errors"
 	"math"
 	"strings"
 	"sync"
 )
 
-func Retrieve(query string, ctx context.Context, forw []db.DB, inv []db.DB) []Rank_combined {
+// Retrieve returns the 50 documents ranked the highest for the query
+// documents whose DocInfo is missing are left out, any other failure of the tables fails the query
+func Retrieve(query string, ctx context.Context, tables *db.Tables) ([]Rank_combined, error) {
+	errs := &queryError{}
 
 	//---------------- QUERY PARSING ----------------//
 
@@ -37,12 +40,12 @@ func Retrieve(query string, ctx context.Context, forw []db.DB, inv []db.DB) []Ra
 
 	// compute class probabilities conditioned on the query as sole context
 	// for topic-sensitive pagerank
-	// topicProbsChan := computeTopicProbs(ctx, inv, forw, queryTokenised)
+	// topicProbsChan := computeTopicProbs(ctx, tables, queryTokenised, errs)
 
 	//---------------- PHRASE RETRIEVAL ----------------//
 
 	// use future pattern
-	docPhrase := getPhraseFromInverted(ctx, phraseTokenised, inv)
+	docPhrase := getPhraseFromInverted(ctx, phraseTokenised, tables, errs)
 
 	//---------------- NON-PHRASE TERM RETRIEVAL ----------------//
 
@@ -51,30 +54,30 @@ func Retrieve(query string, ctx context.Context, forw []db.DB, inv []db.DB) []Ra
 
 	// fan-out to get term occurence from inverted tables
 	numFanOut := int(math.Ceil(float64(len(queryTokenised)) * 1.0))
-	termOutChan := [](<-chan map[string]Rank_term){}
+	termOutChan := [](<-chan map[uint32]Rank_term){}
 	for i := 0; i < numFanOut; i++ {
-		termOutChan = append(termOutChan, getFromInverted(ctx, termInChan, inv))
+		termOutChan = append(termOutChan, getFromInverted(ctx, termInChan, tables, errs))
 	}
 
 	// fan-in the result and aggregate the result based on generator model
-	// docsMatched has type map[string]Rank_term
-	aggregatedDocs := make(map[string]Rank_term)
+	// docsMatched has type map[uint32]Rank_term
+	aggregatedDocs := make(map[uint32]Rank_term)
 	for docsMatched := range fanInDocs(termOutChan) {
-		for docHash, ranks := range docsMatched {
-			val := aggregatedDocs[docHash]
+		for docID, ranks := range docsMatched {
+			val := aggregatedDocs[docID]
 			val.TitleWeights = append(val.TitleWeights, ranks.TitleWeights...)
 			val.BodyWeights = append(val.BodyWeights, ranks.BodyWeights...)
-			aggregatedDocs[docHash] = val
+			aggregatedDocs[docID] = val
 		}
 	}
 
 	//---------------- COMBINED RETRIEVAL, FINAL RANK CALCULATION ----------------//
 
-	for docHash, ranks := range <-docPhrase {
-		val := aggregatedDocs[docHash]
+	for docID, ranks := range <-docPhrase {
+		val := aggregatedDocs[docID]
 		val.TitleWeights = append(val.TitleWeights, ranks.TitleWeights...)
 		val.BodyWeights = append(val.BodyWeights, ranks.BodyWeights...)
-		aggregatedDocs[docHash] = val
+		aggregatedDocs[docID] = val
 	}
 
 	// common channel for inputs of final ranking calculation
@@ -87,7 +90,7 @@ func Retrieve(query string, ctx context.Context, forw []db.DB, inv []db.DB) []Ra
 	// topicProbs := <-topicProbsChan
 	var topicProbs map[string]float64
 	for i := 0; i < numFanOut; i++ {
-		docsOutChan = append(docsOutChan, computeFinalRank(ctx, docsInChan, forw, len(queryTokenised)+len(phraseTokenised), query, phrases, topicProbs))
+		docsOutChan = append(docsOutChan, computeFinalRank(ctx, docsInChan, tables, len(queryTokenised)+len(phraseTokenised), query, phrases, topicProbs, errs))
 	}
 
 	// fan-in final rank (generator pattern) and sort the result
@@ -96,40 +99,44 @@ func Retrieve(query string, ctx context.Context, forw []db.DB, inv []db.DB) []Ra
 		finalResult = appendSort(finalResult, docRank)
 	}
 
+	if err := errs.get(); err != nil {
+		return nil, errors.Wrapf(err, "failed to retrieve %q", query)
+	}
+
 	if len(finalResult) > 50 {
-		return finalResult[:50]
+		return finalResult[:50], nil
 	} else {
-		return finalResult
+		return finalResult, nil
 	}
 }
 
-func computeTopicProbs(ctx context.Context, inv []db.DB, forw []db.DB, queryTokenised []string) <-chan map[string]float64 {
+func computeTopicProbs(ctx context.Context, tables *db.Tables, queryTokenised []string, errs *queryError) <-chan map[string]float64 {
 	out := make(chan map[string]float64, 1)
 
-	go func(inv []db.DB, forw []db.DB) {
-		metadata, err := forw[5].Iterate_QuickFix(ctx)
+	go func() {
+		metadata, err := tables.TopicMetadata.Raw().Iterate_QuickFix(ctx)
 		if err != nil {
-			panic(err)
+			errs.set(err)
+			out <- nil
+			return
 		}
 
 		// aggregate each query occurrence for each topic
 		// TODO: expand the topic selection by including words contained / in the surrounding of the query terms in a particular webpage
 		topicTF := make(map[string][]float64, len(metadata))
 		for i := 0; i < len(queryTokenised); i++ {
-			var topicFreq map[string]float64
-			if val_, err := inv[2].Get(ctx, queryTokenised[i]); err != nil {
-				panic(err)
-			} else {
-				topicFreq = val_.(map[string]float64)
+			topicFreq, err := tables.TopicKeywords.Get(ctx, queryTokenised[i])
+			if err != nil && err != db.ErrNotFound {
+				errs.set(err)
 			}
 
 			for topic, freq := range topicFreq {
 				if val, ok := topicTF[topic]; ok {
-					val = append(val, freq)
+					val = append(val, float64(freq))
 					topicTF[topic] = val
 				} else {
 					temp := make([]float64, 0, len(queryTokenised))
-					temp = append(temp, freq)
+					temp = append(temp, float64(freq))
 					topicTF[topic] = temp
 				}
 			}
@@ -153,7 +160,7 @@ func computeTopicProbs(ctx context.Context, inv []db.DB, forw []db.DB, queryToke
 		}
 
 		out <- topicProbs
-	}(inv, forw)
+	}()
 
 	return out
 }
@@ -167,11 +174,20 @@ func genTermPipeline(listStr []string) <-chan string {
 	return out
 }
 
-func genAggrDocsPipeline(docRank map[string]Rank_term) <-chan Rank_result {
+func genDocIDPipeline(docIDs []uint32) <-chan uint32 {
+	out := make(chan uint32, len(docIDs))
+	defer close(out)
+	for i := 0; i < len(docIDs); i++ {
+		out <- docIDs[i]
+	}
+	return out
+}
+
+func genAggrDocsPipeline(docRank map[uint32]Rank_term) <-chan Rank_result {
 	out := make(chan Rank_result, len(docRank))
 	defer close(out)
-	for docHash, rank := range docRank {
-		ret := Rank_result{DocHash: docHash, TitleRank: 0.0, BodyRank: 0.0}
+	for docID, rank := range docRank {
+		ret := Rank_result{DocID: docID, TitleRank: 0.0, BodyRank: 0.0}
 
 		for i := 0; i < len(rank.TitleWeights); i++ {
 			ret.TitleRank += float64(rank.TitleWeights[i])
@@ -186,14 +202,12 @@ func genAggrDocsPipeline(docRank map[string]Rank_term) <-chan Rank_result {
 	return out
 }
 
-func getInvTitle(ctx context.Context, inv db.DB, wordHash string) <-chan map[string][]float32 {
-	out := make(chan map[string][]float32, 1)
+func getInvTitle(ctx context.Context, inv db.PostingTable, wordHash string, errs *queryError) <-chan map[uint32][]float32 {
+	out := make(chan map[uint32][]float32, 1)
 	go func() {
-		var ret map[string][]float32
-		if v, err := inv.Get(ctx, wordHash); err != nil && err != badger.ErrKeyNotFound {
-			panic(err)
-		} else if v != nil {
-			ret = v.(map[string][]float32)
+		ret, err := inv.Get(ctx, wordHash)
+		if err != nil && err != db.ErrNotFound {
+			errs.set(err)
 		}
 
 		out <- ret
@@ -201,8 +215,8 @@ func getInvTitle(ctx context.Context, inv db.DB, wordHash string) <-chan map[str
 	return out
 }
 
-func getFromInverted(ctx context.Context, termChan <-chan string, inv []db.DB) <-chan map[string]Rank_term {
-	out := make(chan map[string]Rank_term, len(termChan))
+func getFromInverted(ctx context.Context, termChan <-chan string, tables *db.Tables, errs *queryError) <-chan map[uint32]Rank_term {
+	out := make(chan map[uint32]Rank_term, len(termChan))
 	defer close(out)
 	var wg sync.WaitGroup
 
@@ -212,30 +226,28 @@ func getFromInverted(ctx context.Context, termChan <-chan string, inv []db.DB) <
 			defer wg.Done()
 
 			// get list of documents from both inverted tables
-			var bodyResult map[string][]float32
-			titleRes := getInvTitle(ctx, inv[0], term)
+			titleRes := getInvTitle(ctx, tables.TitlePostings, term, errs)
 
-			if v, err := inv[1].Get(ctx, term); err != nil && err != badger.ErrKeyNotFound {
-				panic(err)
-			} else if v != nil {
-				bodyResult = v.(map[string][]float32)
+			bodyResult, err := tables.BodyPostings.Get(ctx, term)
+			if err != nil && err != db.ErrNotFound {
+				errs.set(err)
 			}
 
 			// merge document retrieved from inverted tables
-			ret := make(map[string]Rank_term)
-			for docHash, listPos := range bodyResult {
+			ret := make(map[uint32]Rank_term)
+			for docID, listPos := range bodyResult {
 				// first entry of the listPos is norm_tf*idf
-				ret[docHash] = Rank_term{
+				ret[docID] = Rank_term{
 					TitleWeights: nil,
 					BodyWeights:  []float32{listPos[0]},
 				}
 			}
 
-			for docHash, listPos := range <-titleRes {
-				tempVal := ret[docHash]
+			for docID, listPos := range <-titleRes {
+				tempVal := ret[docID]
 				// first entry of the listPos is norm_tf*idf
 				tempVal.TitleWeights = []float32{listPos[0]}
-				ret[docHash] = tempVal
+				ret[docID] = tempVal
 			}
 
 			out <- ret
@@ -246,10 +258,10 @@ func getFromInverted(ctx context.Context, termChan <-chan string, inv []db.DB) <
 	return out
 }
 
-func fanInDocs(docsIn []<-chan map[string]Rank_term) <-chan map[string]Rank_term {
+func fanInDocs(docsIn []<-chan map[uint32]Rank_term) <-chan map[uint32]Rank_term {
 	var wg sync.WaitGroup
-	c := make(chan map[string]Rank_term)
-	out := func(docs <-chan map[string]Rank_term) {
+	c := make(chan map[uint32]Rank_term)
+	out := func(docs <-chan map[uint32]Rank_term) {
 		defer wg.Done()
 		for doc := range docs {
 			c <- doc
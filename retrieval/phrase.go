@@ -2,14 +2,13 @@ package retrieval
 
 import (
 	"context"
-	"github.com/dgraph-io/badger"
 	db "github.com/nwihardjo/SpaghettiSearch/database"
 	"math"
 	"sync"
 )
 
-func getPhraseFromInverted(ctx context.Context, phraseTokenised []string, inv []db.DB) <-chan map[string]Rank_term {
-	out := make(chan map[string]Rank_term, 1)
+func getPhraseFromInverted(ctx context.Context, phraseTokenised []string, tables *db.Tables, errs *queryError) <-chan map[uint32]Rank_term {
+	out := make(chan map[uint32]Rank_term, 1)
 
 	go func() {
 		// generate common channel with inputs
@@ -17,17 +16,17 @@ func getPhraseFromInverted(ctx context.Context, phraseTokenised []string, inv []
 
 		// fan-out to get term occurence from inverted tables
 		numFanOut := int(math.Ceil(float64(len(phraseTokenised)) * 1.0))
-		termOutChan := [](<-chan map[string]Rank_term){}
+		termOutChan := [](<-chan map[uint32]Rank_term){}
 		for i := 0; i < numFanOut; i++ {
-			termOutChan = append(termOutChan, getPosTerm(ctx, phraseInChan, inv))
+			termOutChan = append(termOutChan, getPosTerm(ctx, phraseInChan, tables, errs))
 		}
 
 		// fan-in the docs, and group the weights based on the phrase's term position
-		aggregatedResult := make(map[string](map[uint8]Rank_term))
+		aggregatedResult := make(map[uint32](map[uint8]Rank_term))
 		for docsMatched := range fanInDocs(termOutChan) {
-			// below iterate through a map[string]Rank_term
-			for docHash, ranks := range docsMatched {
-				val_ := aggregatedResult[docHash]
+			// below iterate through a map[uint32]Rank_term
+			for docID, ranks := range docsMatched {
+				val_ := aggregatedResult[docID]
 				if val_ == nil {
 					val_ = make(map[uint8]Rank_term)
 				}
@@ -39,7 +38,7 @@ func getPhraseFromInverted(ctx context.Context, phraseTokenised []string, inv []
 				val.BodyWeights = ranks.BodyWeights
 
 				val_[ranks.TermPos] = val
-				aggregatedResult[docHash] = val_
+				aggregatedResult[docID] = val_
 			}
 		}
 
@@ -50,12 +49,12 @@ func getPhraseFromInverted(ctx context.Context, phraseTokenised []string, inv []
 	return out
 }
 
-func evalPhraseOccurrence(aggregatedResult map[string](map[uint8]Rank_term), lengthPhrase int) map[string]Rank_term {
-	ret := make(map[string]Rank_term)
+func evalPhraseOccurrence(aggregatedResult map[uint32](map[uint8]Rank_term), lengthPhrase int) map[uint32]Rank_term {
+	ret := make(map[uint32]Rank_term)
 
 	// evaluate and return only documents containing the phrase
 	// termWeights below is map[uint8]Rank_term
-	for docHash, termWeights := range aggregatedResult {
+	for docID, termWeights := range aggregatedResult {
 		var sumBodyWeight, sumTitleWeight float32
 		var bodyIntersect, titleIntersect []float32
 
@@ -95,14 +94,14 @@ func evalPhraseOccurrence(aggregatedResult map[string](map[uint8]Rank_term), len
 
 		// append doc having phrase to final result
 		if len(bodyIntersect) != 0 || len(titleIntersect) != 0 {
-			val := ret[docHash]
+			val := ret[docID]
 			if len(bodyIntersect) != 0 {
 				val.BodyWeights = append(val.BodyWeights, sumBodyWeight)
 			}
 			if len(titleIntersect) != 0 {
 				val.TitleWeights = append(val.TitleWeights, sumTitleWeight)
 			}
-			ret[docHash] = val
+			ret[docID] = val
 		}
 	}
 	return ret
@@ -117,8 +116,8 @@ func genPhrasePipeline(listStr []string) <-chan termPhrase {
 	return out
 }
 
-func getPosTerm(ctx context.Context, termChan <-chan termPhrase, inv []db.DB) <-chan map[string]Rank_term {
-	out := make(chan map[string]Rank_term, len(termChan))
+func getPosTerm(ctx context.Context, termChan <-chan termPhrase, tables *db.Tables, errs *queryError) <-chan map[uint32]Rank_term {
+	out := make(chan map[uint32]Rank_term, len(termChan))
 	defer close(out)
 	var wg sync.WaitGroup
 
@@ -128,38 +127,36 @@ func getPosTerm(ctx context.Context, termChan <-chan termPhrase, inv []db.DB) <-
 			defer wg.Done()
 
 			// get list of documents from both inverted tables
-			var bodyResult map[string][]float32
-			titleRes := getInvTitle(ctx, inv[0], term.Term)
+			titleRes := getInvTitle(ctx, tables.TitlePostings, term.Term, errs)
 
-			if v, err := inv[1].Get(ctx, term.Term); err != nil && err != badger.ErrKeyNotFound {
-				panic(err)
-			} else if v != nil {
-				bodyResult = v.(map[string][]float32)
+			bodyResult, err := tables.BodyPostings.Get(ctx, term.Term)
+			if err != nil && err != db.ErrNotFound {
+				errs.set(err)
 			}
 
 			// merge document retrieved from inverted tables
-			ret := make(map[string]Rank_term)
-			for docHash, listPos := range bodyResult {
+			ret := make(map[uint32]Rank_term)
+			for docID, listPos := range bodyResult {
 				// first entry is norm_tf*idf, no need to be subtracted
 				for i := 1; i < len(listPos); i++ {
 					listPos[i] -= float32(term.Pos)
 				}
-				ret[docHash] = Rank_term{
+				ret[docID] = Rank_term{
 					TitleWeights: nil,
 					BodyWeights:  listPos,
 					TermPos:      term.Pos,
 				}
 			}
 
-			for docHash, listPos := range <-titleRes {
+			for docID, listPos := range <-titleRes {
 				// first entry is norm_tf*idf, no need to be subtracted
 				for i := 1; i < len(listPos); i++ {
 					listPos[i] -= float32(term.Pos)
 				}
-				tempVal := ret[docHash]
+				tempVal := ret[docID]
 				tempVal.TitleWeights = listPos
 				tempVal.TermPos = term.Pos
-				ret[docHash] = tempVal
+				ret[docID] = tempVal
 			}
 
 			out <- ret
@@ -5,6 +5,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,7 +18,7 @@ type Rank_term struct {
 }
 
 type Rank_result struct {
-	DocHash   string
+	DocID     uint32
 	TitleRank float64
 	BodyRank  float64
 }
@@ -40,6 +41,27 @@ type termPhrase struct {
 	Pos  uint8
 }
 
+// queryError keeps the first error met by the goroutines serving a query
+// keys missing from the tables are not errors, the documents or words concerned are left out
+type queryError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (q *queryError) set(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+func (q *queryError) get() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
 type kv_sort struct {
 	Key   string
 	Value uint32
@@ -53,44 +75,43 @@ func appendSort(data []Rank_combined, el Rank_combined) []Rank_combined {
 	return data
 }
 
-func resultFormat(metadata db.DocInfo, PR float64, finalRank float64, summary string) Rank_combined {
-	// only get first 5 children and parents
-	var parentList, childList []string
-	if len(metadata.Parents) == 0 {
-		parentList = nil
-	} else {
+// firstLinks returns the docIDs of the first 5 parents and children, to be resolved to their URLs
+func firstLinks(metadata db.DocInfo) (parentList []uint32, childList []uint32) {
+	if len(metadata.Parents) > 0 {
 		if len(metadata.Parents) > 5 {
-			parentList = make([]string, 0, 5)
+			parentList = make([]uint32, 0, 5)
 		} else {
-			parentList = make([]string, 0, len(metadata.Parents))
+			parentList = make([]uint32, 0, len(metadata.Parents))
 		}
 
-		for parentHash, _ := range metadata.Parents {
-			parentList = append(parentList, parentHash)
+		for parentID, _ := range metadata.Parents {
+			parentList = append(parentList, parentID)
 			if len(parentList) == 5 {
 				break
 			}
 		}
 	}
 
-	if len(metadata.Children) == 0 {
-		childList = nil
-	} else {
+	if len(metadata.Children) > 0 {
 		if len(metadata.Children) > 5 {
-			childList = make([]string, 0, 5)
+			childList = make([]uint32, 0, 5)
 		} else {
-			childList = make([]string, 0, len(metadata.Children))
+			childList = make([]uint32, 0, len(metadata.Children))
 		}
 
-		// metadata.Children is []string
-		for _, childHash := range metadata.Children {
-			childList = append(childList, childHash)
+		// metadata.Children is []uint32
+		for _, childID := range metadata.Children {
+			childList = append(childList, childID)
 			if len(childList) == 5 {
 				break
 			}
 		}
 	}
+	return parentList, childList
+}
 
+// resultFormat leaves the children and parents empty, their URLs are resolved from firstLinks
+func resultFormat(metadata db.DocInfo, PR float64, finalRank float64, summary string) Rank_combined {
 	// check if page title is empty because not indexed yet
 	var title string
 	if len(metadata.Page_title) == 0 {
@@ -104,8 +125,6 @@ func resultFormat(metadata db.DocInfo, PR float64, finalRank float64, summary st
 		Page_title:    title,
 		Mod_date:      metadata.Mod_date,
 		Page_size:     metadata.Page_size,
-		Children:      childList,
-		Parents:       parentList,
 		Words_mapping: sortMap(metadata.Words_mapping),
 		Summary:       summary,
 		PageRank:      PR,